@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/valyala/fasthttp"
+)
+
+// CancelOrder cancels an order that hasn't been shipped yet and lets the
+// Payment service know, so the payment can be refunded
+func CancelOrder(ctx *fasthttp.RequestCtx) {
+	rctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	// Create the key attributes
+	orderID := ctx.UserValue("orderid").(string)
+
+	ord, err := svc.CancelOrder(rctx, orderID)
+	if err != nil {
+		ErrorHandler(ctx, "CancelOrder", "CancelOrder", err)
+		return
+	}
+
+	payload, err := ord.Marshal()
+	if err != nil {
+		ErrorHandler(ctx, "CancelOrder", "Marshal", err)
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.Write(payload)
+}
@@ -3,12 +3,23 @@ package main
 import (
 	"net/http"
 
+	"github.com/retgits/acme-serverless-order/internal/datastore"
 	"github.com/valyala/fasthttp"
 )
 
 // GetAllOrders adds an item to the cart of a user
 func GetAllOrders(ctx *fasthttp.RequestCtx) {
-	orders, err := db.AllOrders()
+	rctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	// Get the page of orders the user asked for
+	page, err := datastore.ParsePage(string(ctx.QueryArgs().Peek("size")), string(ctx.QueryArgs().Peek("token")))
+	if err != nil {
+		ErrorHandler(ctx, "GetAllOrders", "ParsePage", err)
+		return
+	}
+
+	orders, token, err := db.AllOrders(rctx, page)
 	if err != nil {
 		ErrorHandler(ctx, "GetAllOrders", "AllOrders", err)
 		return
@@ -20,6 +31,11 @@ func GetAllOrders(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	// Return the continuation token for the next page, if there is one
+	if len(token) > 0 {
+		ctx.Response.Header.Set("X-Continuation-Token", token)
+	}
+
 	ctx.SetStatusCode(http.StatusOK)
 	ctx.Write(payload)
 }
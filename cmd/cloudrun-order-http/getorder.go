@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/valyala/fasthttp"
+)
+
+// GetOrder gets a single order based on the orderID
+func GetOrder(ctx *fasthttp.RequestCtx) {
+	rctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	// Create the key attributes
+	orderID := ctx.UserValue("orderid").(string)
+
+	ord, err := db.GetOrder(rctx, orderID)
+	if err != nil {
+		ErrorHandler(ctx, "GetOrder", "GetOrder", err)
+		return
+	}
+
+	payload, err := ord.Marshal()
+	if err != nil {
+		ErrorHandler(ctx, "GetOrder", "Marshal", err)
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.Write(payload)
+}
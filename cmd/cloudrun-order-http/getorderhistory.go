@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/valyala/fasthttp"
+)
+
+// GetOrderHistory gets the status changes of a single order based on the orderID
+func GetOrderHistory(ctx *fasthttp.RequestCtx) {
+	rctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	// Create the key attributes
+	orderID := ctx.UserValue("orderid").(string)
+
+	history, err := db.History(rctx, orderID)
+	if err != nil {
+		ErrorHandler(ctx, "GetOrderHistory", "History", err)
+		return
+	}
+
+	payload, err := history.Marshal()
+	if err != nil {
+		ErrorHandler(ctx, "GetOrderHistory", "Marshal", err)
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.Write(payload)
+}
@@ -3,15 +3,26 @@ package main
 import (
 	"net/http"
 
+	"github.com/retgits/acme-serverless-order/internal/datastore"
 	"github.com/valyala/fasthttp"
 )
 
 // GetUserOrders adds an item to the cart of a user
 func GetUserOrders(ctx *fasthttp.RequestCtx) {
+	rctx, cancel := requestContext(ctx)
+	defer cancel()
+
 	// Create the key attributes
 	userID := ctx.UserValue("userid").(string)
 
-	orders, err := db.UserOrders(userID)
+	// Get the page of orders the user asked for
+	page, err := datastore.ParsePage(string(ctx.QueryArgs().Peek("size")), string(ctx.QueryArgs().Peek("token")))
+	if err != nil {
+		ErrorHandler(ctx, "GetUserOrders", "ParsePage", err)
+		return
+	}
+
+	orders, token, err := db.UserOrders(rctx, userID, page)
 	if err != nil {
 		ErrorHandler(ctx, "GetUserOrders", "UserOrders", err)
 		return
@@ -23,6 +34,11 @@ func GetUserOrders(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	// Return the continuation token for the next page, if there is one
+	if len(token) > 0 {
+		ctx.Response.Header.Set("X-Continuation-Token", token)
+	}
+
 	ctx.SetStatusCode(http.StatusOK)
 	ctx.Write(payload)
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,18 +12,31 @@ import (
 	"github.com/fasthttp/router"
 	"github.com/getsentry/sentry-go"
 	sentryfasthttp "github.com/getsentry/sentry-go/fasthttp"
+	_ "github.com/retgits/acme-serverless-order/internal/backends"
+	"github.com/retgits/acme-serverless-order/internal/card"
+	"github.com/retgits/acme-serverless-order/internal/cloudevents"
 	"github.com/retgits/acme-serverless-order/internal/datastore"
-	"github.com/retgits/acme-serverless-order/internal/datastore/mongodb"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+	"github.com/retgits/acme-serverless-order/internal/emitter/fanout"
+	"github.com/retgits/acme-serverless-order/internal/emitter/resilient"
+	"github.com/retgits/acme-serverless-order/internal/outbox"
+	"github.com/retgits/acme-serverless-order/internal/service"
+	"github.com/retgits/acme-serverless-order/internal/validation"
 	gcrwavefront "github.com/retgits/gcr-wavefront"
 	"github.com/valyala/fasthttp"
 )
 
 const (
 	servicename = "order"
+
+	// requestTimeout is how long the datastore and the emitter get to handle a request
+	requestTimeout = 30 * time.Second
 )
 
 var (
-	db datastore.Manager
+	db  datastore.Manager
+	em  emitter.EventEmitter
+	svc *service.Service
 )
 
 // CORSHandler sets CORS headers for the preflight request
@@ -35,12 +50,56 @@ func CORSHandler(ctx *fasthttp.RequestCtx) {
 }
 
 // ErrorHandler takes the activity where the error occured and the error object and sends a message to sentry.
+// The status code depends on the error, like 404 when the order doesn't exist, 409 when the order can't move
+// to the requested status, or 503 when the datastore is unavailable (see service.StatusCode). When the order
+// isn't valid, the body lists the fields that aren't valid.
 func ErrorHandler(ctx *fasthttp.RequestCtx, function string, method string, err error) {
 	sentry.CaptureException(fmt.Errorf("error in %s::%s %s", function, method, err.Error()))
-	ctx.SetStatusCode(http.StatusBadRequest)
+	ctx.SetStatusCode(service.StatusCode(err))
+
+	var verr *validation.Error
+	if errors.As(err, &verr) {
+		if payload, merr := verr.Marshal(); merr == nil {
+			ctx.SetContentType("application/json")
+			ctx.SetBody(payload)
+			return
+		}
+	}
+
 	ctx.SetBodyString(err.Error())
 }
 
+// requestContext returns the context that is passed to the datastore and the emitter.
+// It is cancelled when the request takes longer than requestTimeout. fasthttp doesn't
+// report a client that disconnects to the RequestCtx, so the request isn't cancelled
+// then, and keeps running until it is done or times out. It carries the Sentry hub of
+// the request so breadcrumbs and errors end up in its trace.
+func requestContext(ctx *fasthttp.RequestCtx) (context.Context, context.CancelFunc) {
+	rctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	if hub := sentryfasthttp.GetHubFromContext(ctx); hub != nil {
+		rctx = sentry.SetHubOnContext(rctx, hub)
+	}
+	return rctx, cancel
+}
+
+// header returns a function that looks up the value of a request header.
+func header(ctx *fasthttp.RequestCtx) func(key string) string {
+	return func(key string) string {
+		return string(ctx.Request.Header.Peek(key))
+	}
+}
+
+// eventID returns the identifier under which the consumer records the event in the
+// request, so it is processed once. Events are identified by the id of their
+// CloudEvent, other events by a hash of the body.
+func eventID(ctx *fasthttp.RequestCtx, consumer string) string {
+	if id := cloudevents.IDFromHTTP(header(ctx), ctx.Request.Body()); len(id) > 0 {
+		return datastore.EventID(consumer, id)
+	}
+
+	return datastore.HashEventID(consumer, ctx.Request.Body())
+}
+
 func main() {
 	// Get the version or set a default to "dev"
 	version := os.Getenv("VERSION")
@@ -61,9 +120,9 @@ func main() {
 	}
 
 	// Get the service name
-	service := os.Getenv("K_SERVICE")
-	if service == "" {
-		service = servicename
+	serviceName := os.Getenv("K_SERVICE")
+	if serviceName == "" {
+		serviceName = servicename
 	}
 
 	// Initialize a connection to Sentry to capture errors and traces
@@ -72,9 +131,11 @@ func main() {
 		Transport: &sentry.HTTPSyncTransport{
 			Timeout: time.Second * 3,
 		},
-		ServerName:  service,
-		Release:     version,
-		Environment: os.Getenv("STAGE"),
+		ServerName:       serviceName,
+		Release:          version,
+		Environment:      os.Getenv("STAGE"),
+		BeforeSend:       card.ScrubEvent,
+		BeforeBreadcrumb: card.ScrubBreadcrumb,
 	}); err != nil {
 		log.Fatalf("error configuring sentry: %s", err.Error())
 	}
@@ -104,13 +165,38 @@ func main() {
 	router.GlobalOPTIONS = CORSHandler
 
 	// Add routes to the router
+	router.POST("/order/ship", cfg.WrapFastHTTPRequest(sentryHandler.Handle(ShipOrder)))
 	router.POST("/order/update", cfg.WrapFastHTTPRequest(sentryHandler.Handle(UpdateShipmentStatus)))
 	router.POST("/order/add/{userid}", cfg.WrapFastHTTPRequest(sentryHandler.Handle(AddOrder)))
+	router.POST("/order/cancel/{orderid}", cfg.WrapFastHTTPRequest(sentryHandler.Handle(CancelOrder)))
 	router.GET("/order/{userid}", cfg.WrapFastHTTPRequest(sentryHandler.Handle(GetUserOrders)))
 	router.GET("/order/all", cfg.WrapFastHTTPRequest(sentryHandler.Handle(GetAllOrders)))
+	router.GET("/order/id/{orderid}", cfg.WrapFastHTTPRequest(sentryHandler.Handle(GetOrder)))
+	router.GET("/order/id/{orderid}/history", cfg.WrapFastHTTPRequest(sentryHandler.Handle(GetOrderHistory)))
+	router.POST("/order/relay", cfg.WrapFastHTTPRequest(sentryHandler.Handle(RelayOutbox)))
+
+	// Create an instance of the datastore manager and the order service. The
+	// backends are selected with ORDER_DATASTORE and ORDER_EMITTER, and
+	// EMITTER_BACKENDS sends the events to more than one backend
+	var err error
+	db, err = datastore.FromEnv("mongodb")
+	if err != nil {
+		log.Fatalf("error opening datastore: %s", err.Error())
+	}
+
+	em, err = fanout.FromEnv("http")
+	if err != nil {
+		log.Fatalf("error creating emitter: %s", err.Error())
+	}
+
+	// Retry events, and store the ones that can't be sent as dead letters
+	em = resilient.New(em, resilient.ConfigFromEnv())
+
+	svc = service.New(db, em)
 
-	// Create an instance of the datastore manager
-	db = mongodb.New()
+	// Send the events that are left in the outbox, like events that couldn't be
+	// sent when the order was placed or cancelled
+	go outbox.Poll(context.Background(), db, em, outbox.IntervalFromEnv())
 
 	// Start the server
 	log.Printf("successfully started %s server", servicename)
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/retgits/acme-serverless-order/internal/outbox"
+	"github.com/valyala/fasthttp"
+)
+
+// relayTokenHeader is the header that carries the shared secret of the relay.
+const relayTokenHeader = "X-Relay-Token"
+
+// RelayOutbox sends the events that are left in the outbox, like events that
+// couldn't be sent when the order was placed or cancelled. It is meant to be
+// called by a scheduler, like Cloud Scheduler, when the service doesn't have
+// CPU between requests to run the relay itself. The scheduler needs to send the
+// shared secret set in RELAY_TOKEN in the X-Relay-Token header. When RELAY_TOKEN
+// isn't set, every request is refused.
+func RelayOutbox(ctx *fasthttp.RequestCtx) {
+	if !relayAllowed(ctx) {
+		ctx.SetStatusCode(http.StatusUnauthorized)
+		ctx.SetBodyString("a valid X-Relay-Token header is required")
+		return
+	}
+
+	rctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	sent, err := outbox.Relay(rctx, db, em)
+	if err != nil {
+		ErrorHandler(ctx, "RelayOutbox", "Relay", err)
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.Write([]byte(fmt.Sprintf("%d outbox events successfully sent", sent)))
+}
+
+// relayAllowed returns true when the request carries the shared secret set in
+// RELAY_TOKEN. The tokens are compared in constant time.
+func relayAllowed(ctx *fasthttp.RequestCtx) bool {
+	token := os.Getenv("RELAY_TOKEN")
+	if len(token) == 0 {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(ctx.Request.Header.Peek(relayTokenHeader), []byte(token)) == 1
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/cloudevents"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/service"
+	"github.com/valyala/fasthttp"
+)
+
+// ShipOrder updates the order with the result of the payment and, when the
+// payment was successful, requests the shipment of the order
+func ShipOrder(ctx *fasthttp.RequestCtx) {
+	rctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	// Events can also arrive as a CloudEvent, in structured or binary mode
+	payload, err := cloudevents.UnwrapHTTP(header(ctx), ctx.Request.Body())
+	if err != nil {
+		ErrorHandler(ctx, "ShipOrder", "UnwrapHTTP", service.Malformed(err))
+		return
+	}
+
+	req, err := acmeserverless.UnmarshalCreditCardValidatedEvent(payload)
+	if err != nil {
+		ErrorHandler(ctx, "ShipOrder", "UnmarshalCreditCardValidatedEvent", service.Malformed(err))
+		return
+	}
+
+	// Deliveries that are retried, like Pub/Sub push requests, are only handled once
+	err = datastore.Once(rctx, db, eventID(ctx, "ShipOrder"), func() error {
+		return svc.HandlePaymentResult(rctx, req)
+	})
+	if err != nil {
+		ErrorHandler(ctx, "ShipOrder", "HandlePaymentResult", err)
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.Write([]byte(fmt.Sprintf("payment result successfully processed for order [%s]", req.Data.OrderID)))
+}
@@ -4,29 +4,40 @@ import (
 	"fmt"
 	"net/http"
 
-	"github.com/getsentry/sentry-go"
 	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/cloudevents"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/service"
 	"github.com/valyala/fasthttp"
 )
 
-// UpdateShipmentStatus adds an item to the cart of a user
+// UpdateShipmentStatus updates the order with the status of the shipment
 func UpdateShipmentStatus(ctx *fasthttp.RequestCtx) {
-	req, err := acmeserverless.UnmarshalShipmentSent(ctx.Request.Body())
+	rctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	// Events can also arrive as a CloudEvent, in structured or binary mode
+	payload, err := cloudevents.UnwrapHTTP(header(ctx), ctx.Request.Body())
 	if err != nil {
-		ErrorHandler(ctx, "UpdateOrderStatus", "UnmarshalShipmentSent", err)
+		ErrorHandler(ctx, "UpdateOrderStatus", "UnwrapHTTP", service.Malformed(err))
 		return
 	}
 
-	_, err = db.UpdateStatus(req.Data)
+	req, err := acmeserverless.UnmarshalShipmentSent(payload)
 	if err != nil {
-		ErrorHandler(ctx, "UpdateOrderStatus", "UpdateStatus", err)
+		ErrorHandler(ctx, "UpdateOrderStatus", "UnmarshalShipmentSent", service.Malformed(err))
 		return
 	}
 
-	msg := fmt.Sprintf("shipment status successfully updated for order [%s]", req.Data.OrderNumber)
-
-	sentry.CaptureMessage(msg)
+	// Deliveries that are retried, like Pub/Sub push requests, are only handled once
+	err = datastore.Once(rctx, db, eventID(ctx, "UpdateOrder"), func() error {
+		return svc.HandleShipmentUpdate(rctx, req)
+	})
+	if err != nil {
+		ErrorHandler(ctx, "UpdateOrderStatus", "HandleShipmentUpdate", err)
+		return
+	}
 
 	ctx.SetStatusCode(http.StatusOK)
-	ctx.Write([]byte(msg))
+	ctx.Write([]byte(fmt.Sprintf("shipment status successfully updated for order [%s]", req.Data.OrderNumber)))
 }
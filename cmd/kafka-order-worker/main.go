@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	_ "github.com/retgits/acme-serverless-order/internal/backends"
+	"github.com/retgits/acme-serverless-order/internal/card"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/emitter/fanout"
+	"github.com/retgits/acme-serverless-order/internal/emitter/kafka"
+	"github.com/retgits/acme-serverless-order/internal/emitter/resilient"
+	"github.com/retgits/acme-serverless-order/internal/kafkaworker"
+	"github.com/retgits/acme-serverless-order/internal/outbox"
+	"github.com/retgits/acme-serverless-order/internal/service"
+)
+
+const (
+	servicename = "order"
+)
+
+func main() {
+	// Get the version or set a default to "dev"
+	version := os.Getenv("VERSION")
+	if version == "" {
+		version = "dev"
+	}
+
+	// Initialize a connection to Sentry to capture errors and traces
+	if err := sentry.Init(sentry.ClientOptions{
+		Dsn: os.Getenv("SENTRY_DSN"),
+		Transport: &sentry.HTTPSyncTransport{
+			Timeout: time.Second * 3,
+		},
+		ServerName:       servicename,
+		Release:          version,
+		Environment:      os.Getenv("STAGE"),
+		BeforeSend:       card.ScrubEvent,
+		BeforeBreadcrumb: card.ScrubBreadcrumb,
+	}); err != nil {
+		log.Fatalf("error configuring sentry: %s", err.Error())
+	}
+
+	// Create an instance of the datastore manager and the order service
+	db, err := datastore.FromEnv("mongodb")
+	if err != nil {
+		log.Fatalf("error opening datastore: %s", err.Error())
+	}
+
+	// ORDER_EMITTER selects the emitter, EMITTER_BACKENDS sends the events to more than one backend
+	em, err := fanout.FromEnv("kafka")
+	if err != nil {
+		log.Fatalf("error creating emitter: %s", err.Error())
+	}
+
+	// Retry events, and store the ones that can't be sent as dead letters
+	em = resilient.New(em, resilient.ConfigFromEnv())
+
+	svc := service.New(db, em)
+
+	brokers := kafka.Brokers()
+	worker := kafkaworker.New(db, svc,
+		kafkaworker.NewReader(brokers, kafkaworker.PaymentTopic()),
+		kafkaworker.NewReader(brokers, kafkaworker.ShipmentTopic()),
+	)
+
+	// Stop reading messages when the process is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	// Send the events that are left in the outbox, like ShipmentRequested events that
+	// couldn't be sent right away
+	go outbox.Poll(ctx, db, em, outbox.IntervalFromEnv())
+
+	log.Printf("successfully started %s worker", servicename)
+
+	if err := worker.Run(ctx); err != nil {
+		log.Fatalf("error running worker: %s", err.Error())
+	}
+}
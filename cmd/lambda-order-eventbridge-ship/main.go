@@ -1,84 +1,62 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"os"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/getsentry/sentry-go"
-	acmeserverless "github.com/retgits/acme-serverless"
-	"github.com/retgits/acme-serverless-order/internal/datastore/dynamodb"
-	"github.com/retgits/acme-serverless-order/internal/emitter/eventbridge"
+	_ "github.com/retgits/acme-serverless-order/internal/backends"
+	"github.com/retgits/acme-serverless-order/internal/card"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/emitter/fanout"
+	"github.com/retgits/acme-serverless-order/internal/emitter/resilient"
+	"github.com/retgits/acme-serverless-order/internal/service"
 	wflambda "github.com/wavefronthq/wavefront-lambda-go"
 )
 
 // handler handles the EventBridge events and returns an error if anything goes wrong.
 // The resulting event, if no error is thrown, is sent to an EventBridge bus.
-func handler(request json.RawMessage) error {
+func handler(ctx context.Context, request json.RawMessage) error {
 	// Initiialize a connection to Sentry to capture errors and traces
 	sentry.Init(sentry.ClientOptions{
 		Dsn: os.Getenv("SENTRY_DSN"),
 		Transport: &sentry.HTTPSyncTransport{
 			Timeout: time.Second * 3,
 		},
-		ServerName:  os.Getenv("FUNCTION_NAME"),
-		Release:     os.Getenv("VERSION"),
-		Environment: os.Getenv("STAGE"),
+		ServerName:       os.Getenv("FUNCTION_NAME"),
+		Release:          os.Getenv("VERSION"),
+		Environment:      os.Getenv("STAGE"),
+		BeforeSend:       card.ScrubEvent,
+		BeforeBreadcrumb: card.ScrubBreadcrumb,
 	})
 
-	req, err := acmeserverless.UnmarshalCreditCardValidatedEvent(request)
+	db, err := datastore.FromEnv("dynamodb")
 	if err != nil {
-		sentry.CaptureException(fmt.Errorf("error unmarshalling creditcard validated event: %s", err.Error()))
+		sentry.CaptureException(err)
 		return err
 	}
 
-	shipmentStatus := acmeserverless.ShipmentData{
-		OrderNumber: req.Data.OrderID,
-		Status:      req.Data.Message,
-	}
-
-	dynamoStore := dynamodb.New()
-	ord, err := dynamoStore.UpdateStatus(shipmentStatus)
+	// ORDER_EMITTER selects the emitter, EMITTER_BACKENDS sends the events to more than one backend
+	em, err := fanout.FromEnv("eventbridge")
 	if err != nil {
-		sentry.CaptureException(fmt.Errorf("error updating shipment status: %s", err.Error()))
+		sentry.CaptureException(err)
 		return err
 	}
 
-	if req.Data.Success {
-		em := eventbridge.New()
-		evt := acmeserverless.ShipmentRequested{
-			Metadata: acmeserverless.Metadata{
-				Domain: acmeserverless.OrderDomain,
-				Source: "ShipOrder",
-				Type:   acmeserverless.ShipmentRequestedEventName,
-				Status: "success",
-			},
-			Data: acmeserverless.ShipmentRequest{
-				OrderID:  req.Data.OrderID,
-				Delivery: ord.Delivery,
-			},
-		}
-
-		sentry.AddBreadcrumb(&sentry.Breadcrumb{
-			Category:  acmeserverless.ShipmentRequestedEventName,
-			Timestamp: time.Now(),
-			Level:     sentry.LevelInfo,
-			Data:      acmeserverless.ToSentryMap(evt.Data),
-		})
-
-		err = em.SendShipmentRequestedEvent(evt)
-		if err != nil {
-			sentry.CaptureException(fmt.Errorf("error sending ShipmentRequested event: %s", err.Error()))
-			return err
-		}
+	// Retry events, and store the ones that can't be sent as dead letters
+	em = resilient.New(em, resilient.ConfigFromEnv())
 
-		sentry.CaptureMessage(fmt.Sprintf("shipment successfully requested for order [%s]", req.Data.OrderID))
+	svc := service.New(db, em)
 
-	}
-
-	return nil
+	// EventBridge delivers events at least once, so events that were already processed
+	// are skipped. The function only receives the detail of the event, which doesn't
+	// contain an ID, so the event is identified by its payload.
+	return datastore.Once(ctx, db, datastore.HashEventID("ShipOrder", request), func() error {
+		return service.Report(svc.HandlePaymentPayload(ctx, request))
+	})
 }
 
 // The main method is executed by AWS Lambda and points to the handler
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/datastore/memory"
+	"github.com/retgits/acme-serverless-order/internal/emitter/mock"
+	"github.com/retgits/acme-serverless-order/internal/service"
+)
+
+func TestShipOrder(t *testing.T) {
+	event := `{"metadata":{"domain":"Payment","source":"ValidateCreditCard","type":"CreditCardValidatedEvent","status":"success"},"data":{"success":%t,"status":200,"message":"transaction successful","amount":"8.00","transactionID":"1","orderID":"%s"}}`
+	cloudEvent := `{"specversion":"1.0","id":"1","source":"ValidateCreditCard","type":"CreditCardValidatedEvent","domain":"Payment","status":"success","datacontenttype":"application/json","data":{"success":true,"status":200,"message":"transaction successful","amount":"8.00","transactionID":"1","orderID":"%s"}}`
+
+	tests := []struct {
+		name     string
+		payload  func(orderID string) string
+		failNext int
+		wantErr  bool
+		sent     int
+		outbox   int
+		status   string
+	}{
+		{
+			name:    "payment successful",
+			payload: func(orderID string) string { return fmt.Sprintf(event, true, orderID) },
+			sent:    1,
+			status:  datastore.StatusShipmentRequested,
+		},
+		{
+			name:    "payment failed",
+			payload: func(orderID string) string { return fmt.Sprintf(event, false, orderID) },
+			status:  datastore.StatusPaymentFailed,
+		},
+		{
+			name:    "CloudEvent",
+			payload: func(orderID string) string { return fmt.Sprintf(cloudEvent, orderID) },
+			sent:    1,
+			status:  datastore.StatusShipmentRequested,
+		},
+		{
+			name:     "broker outage stays in the outbox",
+			payload:  func(orderID string) string { return fmt.Sprintf(event, true, orderID) },
+			failNext: 1,
+			outbox:   1,
+			status:   datastore.StatusShipmentRequested,
+		},
+		{
+			name:    "malformed event is dropped",
+			payload: func(orderID string) string { return "{" },
+			status:  datastore.StatusPendingPayment,
+		},
+		{
+			name:    "unknown order is dropped",
+			payload: func(orderID string) string { return fmt.Sprintf(event, true, "unknown") },
+			status:  datastore.StatusPendingPayment,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := memory.New()
+			rec := mock.NewRecorder()
+
+			ord, err := db.AddOrder(context.Background(), acmeserverless.Order{Delivery: "UPS/FEDEX"})
+			if err != nil {
+				t.Fatalf("AddOrder returned an error: %s", err.Error())
+			}
+
+			rec.FailNext(tt.failNext, nil)
+
+			err = service.Report(service.New(db, rec).HandlePaymentPayload(context.Background(), []byte(tt.payload(ord.OrderID))))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if n := len(rec.EventsForOrder(ord.OrderID)); n != tt.sent {
+				t.Errorf("expected %d events for the order, got %d", tt.sent, n)
+			}
+
+			events, err := db.OutboxEvents(context.Background(), 0)
+			if err != nil {
+				t.Fatalf("OutboxEvents returned an error: %s", err.Error())
+			}
+			if len(events) != tt.outbox {
+				t.Errorf("expected %d events in the outbox, got %d", tt.outbox, len(events))
+			}
+
+			stored, err := db.GetOrder(context.Background(), ord.OrderID)
+			if err != nil {
+				t.Fatalf("GetOrder returned an error: %s", err.Error())
+			}
+			if stored.Status == nil || *stored.Status != tt.status {
+				t.Errorf("expected status %q, got %v", tt.status, stored.Status)
+			}
+		})
+	}
+}
@@ -1,48 +1,57 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"os"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/getsentry/sentry-go"
-	acmeserverless "github.com/retgits/acme-serverless"
-	"github.com/retgits/acme-serverless-order/internal/datastore/dynamodb"
+	_ "github.com/retgits/acme-serverless-order/internal/backends"
+	"github.com/retgits/acme-serverless-order/internal/card"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+	"github.com/retgits/acme-serverless-order/internal/service"
 	wflambda "github.com/wavefronthq/wavefront-lambda-go"
 )
 
 // handler handles the EventBridge events and returns an error if anything goes wrong.
 // The resulting event, if no error is thrown, is sent to an EventBridge bus.
-func handler(request json.RawMessage) error {
+func handler(ctx context.Context, request json.RawMessage) error {
 	// Initiialize a connection to Sentry to capture errors and traces
 	sentry.Init(sentry.ClientOptions{
 		Dsn: os.Getenv("SENTRY_DSN"),
 		Transport: &sentry.HTTPSyncTransport{
 			Timeout: time.Second * 3,
 		},
-		ServerName:  os.Getenv("FUNCTION_NAME"),
-		Release:     os.Getenv("VERSION"),
-		Environment: os.Getenv("STAGE"),
+		ServerName:       os.Getenv("FUNCTION_NAME"),
+		Release:          os.Getenv("VERSION"),
+		Environment:      os.Getenv("STAGE"),
+		BeforeSend:       card.ScrubEvent,
+		BeforeBreadcrumb: card.ScrubBreadcrumb,
 	})
 
-	req, err := acmeserverless.UnmarshalShipmentSent(request)
+	db, err := datastore.FromEnv("dynamodb")
 	if err != nil {
-		sentry.CaptureException(fmt.Errorf("error unmarshalling shipment update event: %s", err.Error()))
+		sentry.CaptureException(err)
 		return err
 	}
 
-	dynamoStore := dynamodb.New()
-	_, err = dynamoStore.UpdateStatus(req.Data)
+	em, err := emitter.FromEnv("eventbridge")
 	if err != nil {
-		sentry.CaptureException(fmt.Errorf("error updating shipment status for order [%s]: %s", req.Data.OrderNumber, err.Error()))
+		sentry.CaptureException(err)
 		return err
 	}
 
-	sentry.CaptureMessage(fmt.Sprintf("shipment status successfully updated for order [%s]", req.Data.OrderNumber))
+	svc := service.New(db, em)
 
-	return nil
+	// EventBridge delivers events at least once, so events that were already processed
+	// are skipped. The function only receives the detail of the event, which doesn't
+	// contain an ID, so the event is identified by its payload.
+	return datastore.Once(ctx, db, datastore.HashEventID("UpdateOrder", request), func() error {
+		return service.Report(svc.HandleShipmentPayload(ctx, request))
+	})
 }
 
 // The main method is executed by AWS Lambda and points to the handler
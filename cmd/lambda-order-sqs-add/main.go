@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,24 +12,30 @@ import (
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/getsentry/sentry-go"
-	"github.com/gofrs/uuid"
 	acmeserverless "github.com/retgits/acme-serverless"
-	"github.com/retgits/acme-serverless-order/internal/datastore/dynamodb"
-	"github.com/retgits/acme-serverless-order/internal/emitter/sqs"
+	_ "github.com/retgits/acme-serverless-order/internal/backends"
+	"github.com/retgits/acme-serverless-order/internal/card"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/emitter/fanout"
+	"github.com/retgits/acme-serverless-order/internal/emitter/resilient"
+	"github.com/retgits/acme-serverless-order/internal/service"
+	"github.com/retgits/acme-serverless-order/internal/validation"
 	wflambda "github.com/wavefronthq/wavefront-lambda-go"
 )
 
 // handler handles the API Gateway events and returns an error if anything goes wrong.
-func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	// Initiialize a connection to Sentry to capture errors and traces
 	sentry.Init(sentry.ClientOptions{
 		Dsn: os.Getenv("SENTRY_DSN"),
 		Transport: &sentry.HTTPSyncTransport{
 			Timeout: time.Second * 3,
 		},
-		ServerName:  os.Getenv("FUNCTION_NAME"),
-		Release:     os.Getenv("VERSION"),
-		Environment: os.Getenv("STAGE"),
+		ServerName:       os.Getenv("FUNCTION_NAME"),
+		Release:          os.Getenv("VERSION"),
+		Environment:      os.Getenv("STAGE"),
+		BeforeSend:       card.ScrubEvent,
+		BeforeBreadcrumb: card.ScrubBreadcrumb,
 	})
 
 	// Create headers if they don't exist and add
@@ -39,64 +47,34 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 	}
 	headers["Access-Control-Allow-Origin"] = "*"
 
-	// Update the order with an OrderID
+	// Unmarshal the order from the request
 	ord, err := acmeserverless.UnmarshalOrder(request.Body)
 	if err != nil {
-		return handleError("unmarshal", headers, err)
+		return handleError("unmarshal", headers, service.Malformed(err))
 	}
-	ord.OrderID = uuid.Must(uuid.NewV4()).String()
 
-	dynamoStore := dynamodb.New()
-	ord, err = dynamoStore.AddOrder(ord)
+	// The order and the PaymentRequested event are stored in a single transaction,
+	// so the Payment service always hears about the order
+	db, err := datastore.FromEnv("dynamodb")
 	if err != nil {
-		return handleError("store", headers, err)
+		return handleError("open datastore", headers, err)
 	}
 
-	prEvent := acmeserverless.PaymentRequestedEvent{
-		Metadata: acmeserverless.Metadata{
-			Domain: acmeserverless.OrderDomain,
-			Source: "AddOrder",
-			Type:   acmeserverless.PaymentRequestedEventName,
-			Status: acmeserverless.DefaultSuccessStatus,
-		},
-		Data: acmeserverless.PaymentRequestDetails{
-			OrderID: ord.OrderID,
-			Card:    ord.Card,
-			Total:   ord.Total,
-		},
+	// ORDER_EMITTER selects the emitter, EMITTER_BACKENDS sends the events to more than one backend
+	em, err := fanout.FromEnv("sqs")
+	if err != nil {
+		return handleError("create emitter", headers, err)
 	}
 
-	// Send a breadcrumb to Sentry with the payment request
-	sentry.AddBreadcrumb(&sentry.Breadcrumb{
-		Category:  acmeserverless.PaymentRequestedEventName,
-		Timestamp: time.Now(),
-		Level:     sentry.LevelInfo,
-		Data:      acmeserverless.ToSentryMap(prEvent.Data),
-	})
+	// Retry events, and store the ones that can't be sent as dead letters
+	em = resilient.New(em, resilient.ConfigFromEnv())
 
-	em := sqs.New()
-	err = em.SendPaymentRequestedEvent(prEvent)
+	svc := service.New(db, em)
+	status, err := svc.PlaceOrder(ctx, ord)
 	if err != nil {
-		return handleError("request payment", headers, err)
-	}
-
-	status := acmeserverless.OrderStatus{
-		OrderID: ord.OrderID,
-		UserID:  ord.UserID,
-		Payment: acmeserverless.CreditCardValidationDetails{
-			Message: "pending payment",
-			Success: false,
-		},
+		return handleError("store", headers, err)
 	}
 
-	// Send a breadcrumb to Sentry with the shipment request
-	sentry.AddBreadcrumb(&sentry.Breadcrumb{
-		Category:  acmeserverless.PaymentRequestedEventName,
-		Timestamp: time.Now(),
-		Level:     sentry.LevelInfo,
-		Data:      acmeserverless.ToSentryMap(status.Payment),
-	})
-
 	payload, err := status.Marshal()
 	if err != nil {
 		return handleError("response", headers, err)
@@ -113,13 +91,27 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 
 // handleError takes the activity where the error occured and the error object and sends a message to sentry.
 // The original error, together with the appropriate API Gateway Proxy Response, is returned so it can be thrown.
+// The status code of the response depends on the error, like 404 when the order doesn't exist or 503 when the
+// datastore is unavailable (see service.StatusCode). When the order isn't valid, the body of the response lists
+// the fields that aren't valid.
 func handleError(area string, headers map[string]string, err error) (events.APIGatewayProxyResponse, error) {
 	sentry.CaptureException(fmt.Errorf("error %s: %s", area, err.Error()))
 	msg := fmt.Sprintf("error %s: %s", area, err.Error())
 	log.Println(msg)
+
+	body := msg
+
+	var verr *validation.Error
+	if errors.As(err, &verr) {
+		if payload, merr := verr.Marshal(); merr == nil {
+			body = string(payload)
+			headers["Content-Type"] = "application/json"
+		}
+	}
+
 	return events.APIGatewayProxyResponse{
-		StatusCode: http.StatusBadRequest,
-		Body:       msg,
+		StatusCode: service.StatusCode(err),
+		Body:       body,
 		Headers:    headers,
 	}, nil
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/getsentry/sentry-go"
+	_ "github.com/retgits/acme-serverless-order/internal/backends"
+	"github.com/retgits/acme-serverless-order/internal/card"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/emitter/fanout"
+	"github.com/retgits/acme-serverless-order/internal/emitter/resilient"
+	"github.com/retgits/acme-serverless-order/internal/service"
+	wflambda "github.com/wavefronthq/wavefront-lambda-go"
+)
+
+// handler handles the API Gateway events and returns an error if anything goes wrong.
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Initiialize a connection to Sentry to capture errors and traces
+	sentry.Init(sentry.ClientOptions{
+		Dsn: os.Getenv("SENTRY_DSN"),
+		Transport: &sentry.HTTPSyncTransport{
+			Timeout: time.Second * 3,
+		},
+		ServerName:       os.Getenv("FUNCTION_NAME"),
+		Release:          os.Getenv("VERSION"),
+		Environment:      os.Getenv("STAGE"),
+		BeforeSend:       card.ScrubEvent,
+		BeforeBreadcrumb: card.ScrubBreadcrumb,
+	})
+
+	// Create headers if they don't exist and add
+	// the CORS required headers, otherwise the response
+	// will not be accepted by browsers.
+	headers := request.Headers
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	headers["Access-Control-Allow-Origin"] = "*"
+
+	// Create the key attributes
+	orderID := request.PathParameters["orderid"]
+
+	db, err := datastore.FromEnv("dynamodb")
+	if err != nil {
+		return handleError("open datastore", headers, err)
+	}
+
+	// ORDER_EMITTER selects the emitter, EMITTER_BACKENDS sends the events to more than one backend
+	em, err := fanout.FromEnv("sqs")
+	if err != nil {
+		return handleError("create emitter", headers, err)
+	}
+
+	// Retry events, and store the ones that can't be sent as dead letters
+	em = resilient.New(em, resilient.ConfigFromEnv())
+
+	svc := service.New(db, em)
+	ord, err := svc.CancelOrder(ctx, orderID)
+	if err != nil {
+		return handleError("cancel order", headers, err)
+	}
+
+	payload, err := ord.Marshal()
+	if err != nil {
+		return handleError("marshal order", headers, err)
+	}
+
+	response := events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(payload),
+		Headers:    headers,
+	}
+
+	return response, nil
+}
+
+// handleError takes the activity where the error occured and the error object and sends a message to sentry.
+// The original error, together with the appropriate API Gateway Proxy Response, is returned so it can be thrown.
+// The status code of the response depends on the error, like 404 when the order doesn't exist or 503 when the
+// datastore is unavailable (see service.StatusCode).
+func handleError(area string, headers map[string]string, err error) (events.APIGatewayProxyResponse, error) {
+	sentry.CaptureException(fmt.Errorf("error %s: %s", area, err.Error()))
+	msg := fmt.Sprintf("error %s: %s", area, err.Error())
+	log.Println(msg)
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: service.StatusCode(err),
+		Body:       msg,
+		Headers:    headers,
+	}, nil
+}
+
+// The main method is executed by AWS Lambda and points to the handler
+func main() {
+	lambda.Start(wflambda.Wrapper(handler))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/getsentry/sentry-go"
+	_ "github.com/retgits/acme-serverless-order/internal/backends"
+	"github.com/retgits/acme-serverless-order/internal/card"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/emitter/fanout"
+	"github.com/retgits/acme-serverless-order/internal/emitter/resilient"
+	"github.com/retgits/acme-serverless-order/internal/outbox"
+	wflambda "github.com/wavefronthq/wavefront-lambda-go"
+)
+
+// handler handles the scheduled events and sends the events that are still in the
+// outbox. It returns an error if anything goes wrong.
+func handler(ctx context.Context, request events.CloudWatchEvent) error {
+	// Initiialize a connection to Sentry to capture errors and traces
+	sentry.Init(sentry.ClientOptions{
+		Dsn: os.Getenv("SENTRY_DSN"),
+		Transport: &sentry.HTTPSyncTransport{
+			Timeout: time.Second * 3,
+		},
+		ServerName:       os.Getenv("FUNCTION_NAME"),
+		Release:          os.Getenv("VERSION"),
+		Environment:      os.Getenv("STAGE"),
+		BeforeSend:       card.ScrubEvent,
+		BeforeBreadcrumb: card.ScrubBreadcrumb,
+	})
+
+	db, err := datastore.FromEnv("dynamodb")
+	if err != nil {
+		sentry.CaptureException(err)
+		return err
+	}
+
+	// ORDER_EMITTER selects the emitter, EMITTER_BACKENDS sends the events to more than one backend
+	em, err := fanout.FromEnv("sqs")
+	if err != nil {
+		sentry.CaptureException(err)
+		return err
+	}
+
+	// Retry events, and store the ones that can't be sent as dead letters
+	em = resilient.New(em, resilient.ConfigFromEnv())
+
+	sent, err := outbox.Relay(ctx, db, em)
+	if err != nil {
+		sentry.CaptureException(fmt.Errorf("error relaying outbox events: %s", err.Error()))
+		return err
+	}
+
+	if sent > 0 {
+		sentry.CaptureMessage(fmt.Sprintf("%d outbox events successfully sent", sent))
+	}
+
+	return nil
+}
+
+// The main method is executed by AWS Lambda and points to the handler
+func main() {
+	lambda.Start(wflambda.Wrapper(handler))
+}
@@ -1,82 +1,68 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"os"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/getsentry/sentry-go"
-	acmeserverless "github.com/retgits/acme-serverless"
-	"github.com/retgits/acme-serverless-order/internal/datastore/dynamodb"
-	"github.com/retgits/acme-serverless-order/internal/emitter/sqs"
+	_ "github.com/retgits/acme-serverless-order/internal/backends"
+	"github.com/retgits/acme-serverless-order/internal/card"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/emitter/fanout"
+	"github.com/retgits/acme-serverless-order/internal/emitter/resilient"
+	"github.com/retgits/acme-serverless-order/internal/service"
+	"github.com/retgits/acme-serverless-order/internal/sqsbatch"
 	wflambda "github.com/wavefronthq/wavefront-lambda-go"
 )
 
-func handler(request events.SQSEvent) error {
+// handler handles the SQS events. Every record in the batch is processed on its own,
+// and only the records that failed are reported back so they are delivered again. When
+// the event source mapping doesn't use that report, an error is returned instead.
+func handler(ctx context.Context, request events.SQSEvent) (sqsbatch.Response, error) {
 	// Initiialize a connection to Sentry to capture errors and traces
 	sentry.Init(sentry.ClientOptions{
 		Dsn: os.Getenv("SENTRY_DSN"),
 		Transport: &sentry.HTTPSyncTransport{
 			Timeout: time.Second * 3,
 		},
-		ServerName:  os.Getenv("FUNCTION_NAME"),
-		Release:     os.Getenv("VERSION"),
-		Environment: os.Getenv("STAGE"),
+		ServerName:       os.Getenv("FUNCTION_NAME"),
+		Release:          os.Getenv("VERSION"),
+		Environment:      os.Getenv("STAGE"),
+		BeforeSend:       card.ScrubEvent,
+		BeforeBreadcrumb: card.ScrubBreadcrumb,
 	})
 
-	req, err := acmeserverless.UnmarshalCreditCardValidatedEvent([]byte(request.Records[0].Body))
+	return sqsbatch.Process(ctx, request, handleRecord)
+}
+
+// handleRecord handles a single SQS record and returns an error if the record
+// needs to be delivered again. SQS delivers messages at least once, so messages
+// that were already processed are skipped.
+func handleRecord(ctx context.Context, record events.SQSMessage) error {
+	db, err := datastore.FromEnv("dynamodb")
 	if err != nil {
-		sentry.CaptureException(fmt.Errorf("error unmarshalling creditcard validated event: %s", err.Error()))
+		sentry.CaptureException(err)
 		return err
 	}
 
-	shipmentStatus := acmeserverless.ShipmentData{
-		OrderNumber: req.Data.OrderID,
-		Status:      req.Data.Message,
-	}
-
-	dynamoStore := dynamodb.New()
-	ord, err := dynamoStore.UpdateStatus(shipmentStatus)
+	// ORDER_EMITTER selects the emitter, EMITTER_BACKENDS sends the events to more than one backend
+	em, err := fanout.FromEnv("sqs")
 	if err != nil {
-		sentry.CaptureException(fmt.Errorf("error updating shipment status: %s", err.Error()))
-
+		sentry.CaptureException(err)
 		return err
 	}
 
-	if req.Data.Success {
-		em := sqs.New()
-		evt := acmeserverless.ShipmentRequested{
-			Metadata: acmeserverless.Metadata{
-				Domain: acmeserverless.OrderDomain,
-				Source: "ShipOrder",
-				Type:   acmeserverless.ShipmentRequestedEventName,
-				Status: "success",
-			},
-			Data: acmeserverless.ShipmentRequest{
-				OrderID:  req.Data.OrderID,
-				Delivery: ord.Delivery,
-			},
-		}
+	// Retry events, and store the ones that can't be sent as dead letters
+	em = resilient.New(em, resilient.ConfigFromEnv())
 
-		sentry.AddBreadcrumb(&sentry.Breadcrumb{
-			Category:  acmeserverless.ShipmentRequestedEventName,
-			Timestamp: time.Now(),
-			Level:     sentry.LevelInfo,
-			Data:      acmeserverless.ToSentryMap(evt.Data),
-		})
+	svc := service.New(db, em)
 
-		err = em.SendShipmentRequestedEvent(evt)
-		if err != nil {
-			sentry.CaptureException(fmt.Errorf("error sending ShipmentRequested event: %s", err.Error()))
-			return err
-		}
-
-		sentry.CaptureMessage(fmt.Sprintf("shipment successfully requested for order [%s]", req.Data.OrderID))
-	}
-
-	return nil
+	return datastore.Once(ctx, db, datastore.EventID("ShipOrder", record.MessageId), func() error {
+		return service.Report(svc.HandlePaymentPayload(ctx, []byte(record.Body)))
+	})
 }
 
 // The main method is executed by AWS Lambda and points to the handler
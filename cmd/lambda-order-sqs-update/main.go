@@ -1,46 +1,63 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"os"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/getsentry/sentry-go"
-	acmeserverless "github.com/retgits/acme-serverless"
-	"github.com/retgits/acme-serverless-order/internal/datastore/dynamodb"
+	_ "github.com/retgits/acme-serverless-order/internal/backends"
+	"github.com/retgits/acme-serverless-order/internal/card"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+	"github.com/retgits/acme-serverless-order/internal/service"
+	"github.com/retgits/acme-serverless-order/internal/sqsbatch"
 	wflambda "github.com/wavefronthq/wavefront-lambda-go"
 )
 
-func handler(request events.SQSEvent) error {
+// handler handles the SQS events. Every record in the batch is processed on its own,
+// and only the records that failed are reported back so they are delivered again. When
+// the event source mapping doesn't use that report, an error is returned instead.
+func handler(ctx context.Context, request events.SQSEvent) (sqsbatch.Response, error) {
 	// Initiialize a connection to Sentry to capture errors and traces
 	sentry.Init(sentry.ClientOptions{
 		Dsn: os.Getenv("SENTRY_DSN"),
 		Transport: &sentry.HTTPSyncTransport{
 			Timeout: time.Second * 3,
 		},
-		ServerName:  os.Getenv("FUNCTION_NAME"),
-		Release:     os.Getenv("VERSION"),
-		Environment: os.Getenv("STAGE"),
+		ServerName:       os.Getenv("FUNCTION_NAME"),
+		Release:          os.Getenv("VERSION"),
+		Environment:      os.Getenv("STAGE"),
+		BeforeSend:       card.ScrubEvent,
+		BeforeBreadcrumb: card.ScrubBreadcrumb,
 	})
 
-	req, err := acmeserverless.UnmarshalShipmentSent([]byte(request.Records[0].Body))
+	return sqsbatch.Process(ctx, request, handleRecord)
+}
+
+// handleRecord handles a single SQS record and returns an error if the record
+// needs to be delivered again. SQS delivers messages at least once, so messages
+// that were already processed are skipped.
+func handleRecord(ctx context.Context, record events.SQSMessage) error {
+	db, err := datastore.FromEnv("dynamodb")
 	if err != nil {
-		sentry.CaptureException(fmt.Errorf("error unmarshalling shipment update event: %s", err.Error()))
+		sentry.CaptureException(err)
 		return err
 	}
 
-	dynamoStore := dynamodb.New()
-	_, err = dynamoStore.UpdateStatus(req.Data)
+	em, err := emitter.FromEnv("sqs")
 	if err != nil {
-		sentry.CaptureException(fmt.Errorf("error updating shipment status for order [%s]: %s", req.Data.OrderNumber, err.Error()))
+		sentry.CaptureException(err)
 		return err
 	}
 
-	sentry.CaptureMessage(fmt.Sprintf("shipment status successfully updated for order [%s]", req.Data.OrderNumber))
+	svc := service.New(db, em)
 
-	return nil
+	return datastore.Once(ctx, db, datastore.EventID("UpdateOrder", record.MessageId), func() error {
+		return service.Report(svc.HandleShipmentPayload(ctx, []byte(record.Body)))
+	})
 }
 
 // The main method is executed by AWS Lambda and points to the handler
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,21 +11,26 @@ import (
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/getsentry/sentry-go"
-	"github.com/retgits/acme-serverless-order/internal/datastore/dynamodb"
+	_ "github.com/retgits/acme-serverless-order/internal/backends"
+	"github.com/retgits/acme-serverless-order/internal/card"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/service"
 	wflambda "github.com/wavefronthq/wavefront-lambda-go"
 )
 
 // handler handles the API Gateway events and returns an error if anything goes wrong.
-func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	// Initiialize a connection to Sentry to capture errors and traces
 	sentry.Init(sentry.ClientOptions{
 		Dsn: os.Getenv("SENTRY_DSN"),
 		Transport: &sentry.HTTPSyncTransport{
 			Timeout: time.Second * 3,
 		},
-		ServerName:  os.Getenv("FUNCTION_NAME"),
-		Release:     os.Getenv("VERSION"),
-		Environment: os.Getenv("STAGE"),
+		ServerName:       os.Getenv("FUNCTION_NAME"),
+		Release:          os.Getenv("VERSION"),
+		Environment:      os.Getenv("STAGE"),
+		BeforeSend:       card.ScrubEvent,
+		BeforeBreadcrumb: card.ScrubBreadcrumb,
 	})
 
 	// Create headers if they don't exist and add
@@ -39,12 +45,29 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 	// Create the key attributes
 	userID := request.PathParameters["userid"]
 
-	dynamoStore := dynamodb.New()
-	orders, err := dynamoStore.UserOrders(userID)
+	// Get the page of orders the user asked for
+	page, err := datastore.ParsePage(request.QueryStringParameters["size"], request.QueryStringParameters["token"])
+	if err != nil {
+		return handleError("parsing page", headers, err)
+	}
+
+	db, err := datastore.FromEnv("dynamodb")
+	if err != nil {
+		return handleError("open datastore", headers, err)
+	}
+
+	orders, token, err := db.UserOrders(ctx, userID, page)
 	if err != nil {
 		return handleError("retrieving orders", headers, err)
 	}
 
+	// Return the continuation token for the next page, if there is one,
+	// and allow browsers to read it
+	headers["Access-Control-Expose-Headers"] = "X-Continuation-Token"
+	if len(token) > 0 {
+		headers["X-Continuation-Token"] = token
+	}
+
 	payload, err := orders.Marshal()
 	if err != nil {
 		return handleError("marshal orders", headers, err)
@@ -61,12 +84,15 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 
 // handleError takes the activity where the error occured and the error object and sends a message to sentry.
 // The original error, together with the appropriate API Gateway Proxy Response, is returned so it can be thrown.
+// The status code of the response depends on the error, like 404 when the order doesn't exist or 503 when the
+// datastore is unavailable (see service.StatusCode).
 func handleError(area string, headers map[string]string, err error) (events.APIGatewayProxyResponse, error) {
 	sentry.CaptureException(fmt.Errorf("error %s: %s", area, err.Error()))
 	msg := fmt.Sprintf("error %s: %s", area, err.Error())
 	log.Println(msg)
+
 	return events.APIGatewayProxyResponse{
-		StatusCode: http.StatusBadRequest,
+		StatusCode: service.StatusCode(err),
 		Body:       msg,
 		Headers:    headers,
 	}, nil
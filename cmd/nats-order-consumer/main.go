@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	_ "github.com/retgits/acme-serverless-order/internal/backends"
+	"github.com/retgits/acme-serverless-order/internal/card"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/emitter/fanout"
+	natsemitter "github.com/retgits/acme-serverless-order/internal/emitter/nats"
+	"github.com/retgits/acme-serverless-order/internal/emitter/resilient"
+	"github.com/retgits/acme-serverless-order/internal/natsconsumer"
+	"github.com/retgits/acme-serverless-order/internal/outbox"
+	"github.com/retgits/acme-serverless-order/internal/service"
+)
+
+const (
+	servicename = "order"
+)
+
+func main() {
+	// Get the version or set a default to "dev"
+	version := os.Getenv("VERSION")
+	if version == "" {
+		version = "dev"
+	}
+
+	// Initialize a connection to Sentry to capture errors and traces
+	if err := sentry.Init(sentry.ClientOptions{
+		Dsn: os.Getenv("SENTRY_DSN"),
+		Transport: &sentry.HTTPSyncTransport{
+			Timeout: time.Second * 3,
+		},
+		ServerName:       servicename,
+		Release:          version,
+		Environment:      os.Getenv("STAGE"),
+		BeforeSend:       card.ScrubEvent,
+		BeforeBreadcrumb: card.ScrubBreadcrumb,
+	}); err != nil {
+		log.Fatalf("error configuring sentry: %s", err.Error())
+	}
+
+	// Connect to NATS, the nats emitter uses the same connection
+	nc, err := natsemitter.Conn()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	defer nc.Drain()
+
+	// ORDER_EMITTER selects the emitter, EMITTER_BACKENDS sends the events to more than one backend
+	em, err := fanout.FromEnv("nats")
+	if err != nil {
+		log.Fatalf("error creating emitter: %s", err.Error())
+	}
+
+	// Retry events, and store the ones that can't be sent as dead letters
+	em = resilient.New(em, resilient.ConfigFromEnv())
+
+	// Create an instance of the datastore manager and the order service
+	db, err := datastore.FromEnv("mongodb")
+	if err != nil {
+		log.Fatalf("error opening datastore: %s", err.Error())
+	}
+
+	svc := service.New(db, em)
+
+	consumer := natsconsumer.New(nc, db, svc, natsconsumer.ConfigFromEnv())
+	if err := consumer.Start(); err != nil {
+		log.Fatalf("error starting consumer: %s", err.Error())
+	}
+
+	// Send the events that are left in the outbox, like ShipmentRequested events that
+	// couldn't be sent right away
+	ctx, cancel := context.WithCancel(context.Background())
+	go outbox.Poll(ctx, db, em, outbox.IntervalFromEnv())
+
+	log.Printf("successfully started %s consumer", servicename)
+
+	// Wait until the process is stopped and finish the events that are being handled
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	cancel()
+
+	if err := consumer.Close(); err != nil {
+		log.Printf("error stopping consumer: %s", err.Error())
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+
+	_ "github.com/retgits/acme-serverless-order/internal/backends"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/emitter/fanout"
+	"github.com/retgits/acme-serverless-order/internal/emitter/resilient"
+)
+
+// main sends the events that were stored as dead letters again, and removes the ones
+// that were sent. When DEADLETTER_FILE is set, the dead letters in that file are
+// replayed, otherwise the ones in the datastore named by DEADLETTER_DATASTORE (or the
+// datastore of the Order service). The datastore, the emitter and the keys are
+// configured with the same environment variables as the functions of the Order service.
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stop when the process is interrupted, the dead letters that weren't sent are kept
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	// ORDER_EMITTER selects the emitter, EMITTER_BACKENDS sends the events to more than one backend
+	em, err := fanout.FromEnv("sqs")
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	// Retry events, events that fail again aren't stored a second time
+	em = resilient.New(em, resilient.ConfigFromEnv())
+
+	if path := os.Getenv("DEADLETTER_FILE"); len(path) > 0 {
+		sent, err := resilient.ReplayFile(ctx, path, em)
+		if err != nil {
+			log.Fatalf("error replaying dead letters after %d events: %s", sent, err.Error())
+		}
+		log.Printf("sent %d dead letters", sent)
+		return
+	}
+
+	var db datastore.Manager
+	if name := os.Getenv("DEADLETTER_DATASTORE"); len(name) > 0 {
+		db, err = datastore.Open(name)
+	} else {
+		db, err = datastore.FromEnv("dynamodb")
+	}
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	sent, err := resilient.ReplayDatastore(ctx, db, em)
+	if err != nil {
+		log.Fatalf("error replaying dead letters after %d events: %s", sent, err.Error())
+	}
+	log.Printf("sent %d dead letters", sent)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+
+	_ "github.com/retgits/acme-serverless-order/internal/backends"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+)
+
+// defaultPageSize is the number of orders that are encrypted again at once when the
+// environment variable PAGE_SIZE isn't set.
+const defaultPageSize = 100
+
+// main encrypts every order in the datastore again that isn't encrypted with the
+// current key, one page at a time. The datastore and the keys are configured with
+// the same environment variables as the functions of the Order service. When the
+// command is stopped, it can be started again with the token it logged last.
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stop when the process is interrupted, the last token is logged to continue later
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	db, err := datastore.FromEnv("dynamodb")
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	p := datastore.Page{
+		Size:  defaultPageSize,
+		Token: os.Getenv("PAGE_TOKEN"),
+	}
+	if size, err := strconv.ParseInt(os.Getenv("PAGE_SIZE"), 10, 64); err == nil && size > 0 {
+		p.Size = size
+	}
+
+	total := 0
+
+	for {
+		rotated, next, err := db.RotateKeys(ctx, p)
+		total += rotated
+		if err != nil {
+			log.Fatalf("error rotating keys after %d orders (PAGE_TOKEN=%s): %s", total, p.Token, err.Error())
+		}
+
+		log.Printf("encrypted %d orders again (PAGE_TOKEN=%s)", total, next)
+
+		if len(next) == 0 {
+			return
+		}
+		p.Token = next
+	}
+}
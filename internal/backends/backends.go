@@ -0,0 +1,20 @@
+// Package backends registers every datastore and emitter of the Order service. A binary
+// that imports it can be deployed against any of them, by setting the environment
+// variables ORDER_DATASTORE and ORDER_EMITTER. The backends only connect to their
+// database or broker when they are selected.
+package backends
+
+import (
+	// Datastores
+	_ "github.com/retgits/acme-serverless-order/internal/datastore/dynamodb"
+	_ "github.com/retgits/acme-serverless-order/internal/datastore/memory"
+	_ "github.com/retgits/acme-serverless-order/internal/datastore/mongodb"
+
+	// Emitters
+	_ "github.com/retgits/acme-serverless-order/internal/emitter/eventbridge"
+	_ "github.com/retgits/acme-serverless-order/internal/emitter/http"
+	_ "github.com/retgits/acme-serverless-order/internal/emitter/kafka"
+	_ "github.com/retgits/acme-serverless-order/internal/emitter/mock"
+	_ "github.com/retgits/acme-serverless-order/internal/emitter/nats"
+	_ "github.com/retgits/acme-serverless-order/internal/emitter/sqs"
+)
@@ -0,0 +1,160 @@
+// Package card keeps the creditcard data of customers out of the places it doesn't belong.
+// The Order service only needs the full card to request the payment, so orders are stored
+// with a token and the last four digits of the card instead of the card number, and never
+// with the CVV. Until the payment is requested, the full card is only stored encrypted, in
+// the outbox (see outbox.PaymentRequested). Card numbers and CVVs are also scrubbed from
+// everything that is sent to Sentry.
+package card
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/creditcard"
+)
+
+// TokenPrefix is the prefix of the tokens that replace card numbers.
+const TokenPrefix = "tok_"
+
+// ErrNoKey is returned by CheckKey when the environment variable CARD_TOKEN_KEY isn't set.
+var ErrNoKey = errors.New("CARD_TOKEN_KEY isn't set")
+
+var (
+	keyOnce sync.Once
+	key     []byte
+)
+
+// CheckKey returns ErrNoKey when the key used to compute tokens isn't set. Every function
+// and service needs the same key, so the same card gets the same token everywhere, and
+// datastore.Open refuses to open a datastore without it.
+func CheckKey() error {
+	if len(tokenKey()) == 0 {
+		return ErrNoKey
+	}
+	return nil
+}
+
+// tokenKey returns the key used to compute tokens, which is read from the environment
+// variable CARD_TOKEN_KEY.
+func tokenKey() []byte {
+	keyOnce.Do(func() {
+		key = []byte(os.Getenv("CARD_TOKEN_KEY"))
+	})
+	return key
+}
+
+// IsToken returns true when number is a token rather than a card number.
+func IsToken(number string) bool {
+	return strings.HasPrefix(number, TokenPrefix)
+}
+
+// Token returns the token for the card number, like tok_3f1d9c2a7b4e5f60_1111. The token
+// is an HMAC of the card number, so the same card always gets the same token, followed by
+// the last four digits of the card. When number is already a token, it is returned as is.
+func Token(number string) string {
+	if IsToken(number) {
+		return number
+	}
+
+	k := tokenKey()
+	if len(k) == 0 {
+		// A random key would give every process other tokens, see CheckKey
+		panic("card: " + ErrNoKey.Error())
+	}
+
+	mac := hmac.New(sha256.New, k)
+	mac.Write([]byte(number))
+	sum := mac.Sum(nil)
+
+	return TokenPrefix + hex.EncodeToString(sum[:8]) + "_" + Last4(number)
+}
+
+// Last4 returns the last four digits of a card number or a token.
+func Last4(number string) string {
+	if IsToken(number) {
+		return number[strings.LastIndex(number, "_")+1:]
+	}
+	if len(number) <= 4 {
+		return number
+	}
+	return number[len(number)-4:]
+}
+
+// Mask returns the card with the number replaced by its token and without the CVV. The
+// type and expiry date are kept, so the card can still be shown to the customer.
+func Mask(c creditcard.Card) creditcard.Card {
+	if len(c.Number) > 0 {
+		c.Number = Token(c.Number)
+	}
+	c.CVV = ""
+	return c
+}
+
+// MaskOrder returns the order with its card masked.
+func MaskOrder(o acmeserverless.Order) acmeserverless.Order {
+	o.Card = Mask(o.Card)
+	return o
+}
+
+// MaskOrders returns the orders with their cards masked.
+func MaskOrders(orders acmeserverless.Orders) acmeserverless.Orders {
+	for i := range orders {
+		orders[i] = MaskOrder(orders[i])
+	}
+	return orders
+}
+
+// numberPattern matches runs of digits that could be card numbers.
+var numberPattern = regexp.MustCompile(`\b[0-9]{12,19}\b`)
+
+// cvvPattern matches CVVs in JSON documents and key=value pairs, like "cvv":"123".
+var cvvPattern = regexp.MustCompile(`(?i)("?(?:cvv|cvc|ccv)"?\s*[:=]\s*)"?[0-9]{3,4}"?`)
+
+// Scrub replaces the card numbers and CVVs in s. Card numbers are replaced by asterisks
+// followed by the last four digits, and CVVs by asterisks. Only numbers that pass the
+// Luhn check are replaced, so order IDs and timestamps stay readable.
+func Scrub(s string) string {
+	s = numberPattern.ReplaceAllStringFunc(s, func(number string) string {
+		if !luhn(number) {
+			return number
+		}
+		return redact(number)
+	})
+
+	return cvvPattern.ReplaceAllString(s, `${1}"***"`)
+}
+
+// redact returns the card number with all but the last four digits replaced by asterisks.
+func redact(number string) string {
+	if len(number) <= 4 {
+		return strings.Repeat("*", len(number))
+	}
+	return strings.Repeat("*", len(number)-4) + number[len(number)-4:]
+}
+
+// luhn returns true when the digits pass the Luhn check.
+func luhn(digits string) bool {
+	sum := 0
+	double := false
+
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+
+	return sum%10 == 0
+}
@@ -0,0 +1,177 @@
+package card
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/retgits/creditcard"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("CARD_TOKEN_KEY", "test")
+	os.Exit(m.Run())
+}
+
+// withKey makes Token use k as key until the end of the test.
+func withKey(t *testing.T, k string) {
+	previous := os.Getenv("CARD_TOKEN_KEY")
+	reset := func() {
+		keyOnce = sync.Once{}
+		key = nil
+	}
+
+	os.Setenv("CARD_TOKEN_KEY", k)
+	reset()
+	t.Cleanup(func() {
+		os.Setenv("CARD_TOKEN_KEY", previous)
+		reset()
+	})
+}
+
+func TestToken(t *testing.T) {
+	const number = "4111111111111111"
+
+	withKey(t, "first")
+	first := Token(number)
+	if again := Token(number); again != first {
+		t.Errorf("expected the same token for the same key, got %s and %s", first, again)
+	}
+	if other := Token("5555555555554444"); other == first {
+		t.Errorf("expected different cards to get different tokens, got %s", other)
+	}
+	if !IsToken(first) || !strings.HasSuffix(first, "_1111") || strings.Contains(first, number[:12]) {
+		t.Errorf("expected a token that only keeps the last 4 digits, got %s", first)
+	}
+	if Token(first) != first {
+		t.Errorf("expected a token to be returned as is, got %s", Token(first))
+	}
+
+	withKey(t, "second")
+	if second := Token(number); second == first {
+		t.Errorf("expected different keys to give different tokens, got %s for both", second)
+	}
+}
+
+func TestMask(t *testing.T) {
+	tests := []struct {
+		name   string
+		number string
+		last4  string
+	}{
+		{name: "visa", number: "4111111111111111", last4: "1111"},
+		{name: "mastercard", number: "5555555555554444", last4: "4444"},
+		{name: "amex", number: "378282246310005", last4: "0005"},
+		{name: "19 digits", number: "4000000000000000006", last4: "0006"},
+		{name: "short number", number: "123", last4: "123"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := creditcard.Card{Type: "Visa", Number: tt.number, ExpiryMonth: 12, ExpiryYear: 2030, CVV: "987"}
+
+			masked := Mask(c)
+			if !IsToken(masked.Number) || Last4(masked.Number) != tt.last4 {
+				t.Errorf("expected a token ending in %s, got %s", tt.last4, masked.Number)
+			}
+			if len(tt.number) > 4 && strings.Contains(masked.Number, tt.number[:len(tt.number)-4]) {
+				t.Errorf("expected only the last 4 digits to survive, got %s", masked.Number)
+			}
+			if len(masked.CVV) > 0 {
+				t.Errorf("expected the CVV to be removed, got %s", masked.CVV)
+			}
+			if masked.Type != c.Type || masked.ExpiryMonth != c.ExpiryMonth || masked.ExpiryYear != c.ExpiryYear {
+				t.Errorf("expected the type and expiry date to be kept, got %+v", masked)
+			}
+			if again := Mask(masked); again != masked {
+				t.Errorf("expected masking a masked card to change nothing, got %+v", again)
+			}
+		})
+	}
+}
+
+func TestScrub(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "card number", in: "card 4111111111111111 declined", want: "card ************1111 declined"},
+		{name: "json", in: `{"number":"4111111111111111","cvv":"987"}`, want: `{"number":"************1111","cvv":"***"}`},
+		{name: "key value", in: "cvv=987 cvc: 1234", want: `cvv="***" cvc: "***"`},
+		{name: "not a card number", in: "order 1234567890123 placed", want: "order 1234567890123 placed"},
+		{name: "nothing to scrub", in: "order placed", want: "order placed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Scrub(tt.in); got != tt.want {
+				t.Errorf("Scrub(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrubEvent(t *testing.T) {
+	const number = "4111111111111111"
+	card := map[string]interface{}{"type": "Visa", "number": number, "cvv": "987"}
+
+	event := &sentry.Event{
+		Message: "error requesting payment with card " + number,
+		Request: &sentry.Request{
+			Data:        `{"card":{"number":"` + number + `","cvv":"987"}}`,
+			QueryString: "pan=" + number,
+		},
+		Exception: []sentry.Exception{
+			{Value: `error marshalling {"cvv":"987","number":"` + number + `"}`},
+		},
+		Extra: map[string]interface{}{
+			"order": map[string]interface{}{"card": card},
+			"cards": []interface{}{map[string]interface{}{"cardNumber": number, "CVC": "987"}},
+		},
+		Breadcrumbs: []*sentry.Breadcrumb{
+			{Message: "payment requested", Data: map[string]interface{}{"data": map[string]interface{}{"card": map[string]interface{}{"number": number, "cvv": "987"}}}},
+		},
+	}
+
+	scrubbed := ScrubEvent(event, nil)
+
+	payload, err := json.Marshal(scrubbed)
+	if err != nil {
+		t.Fatalf("error marshalling event: %s", err.Error())
+	}
+	if strings.Contains(string(payload), number[:12]) {
+		t.Errorf("expected the card number to be scrubbed, got %s", payload)
+	}
+	if strings.Contains(string(payload), "987") {
+		t.Errorf("expected the CVV to be scrubbed, got %s", payload)
+	}
+	if !strings.Contains(string(payload), "1111") {
+		t.Errorf("expected the last 4 digits to be kept, got %s", payload)
+	}
+
+	if ScrubEvent(nil, nil) != nil || ScrubBreadcrumb(nil, nil) != nil {
+		t.Error("expected nil events and breadcrumbs to stay nil")
+	}
+}
+
+func TestCheckKey(t *testing.T) {
+	if err := CheckKey(); err != nil {
+		t.Fatalf("CheckKey returned an error: %s", err.Error())
+	}
+
+	withKey(t, "")
+	if err := CheckKey(); err != ErrNoKey {
+		t.Errorf("expected error %v, got %v", ErrNoKey, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected Token to panic without a key")
+		}
+	}()
+	Token("4111111111111111")
+}
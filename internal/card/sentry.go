@@ -0,0 +1,86 @@
+package card
+
+import (
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// ScrubEvent removes card numbers and CVVs from the event before it is sent to Sentry.
+// Use it as the BeforeSend option of the Sentry client. The request body, the message,
+// the exceptions, the extra data and the breadcrumbs of the event are scrubbed.
+func ScrubEvent(event *sentry.Event, hint *sentry.EventHint) *sentry.Event {
+	if event == nil {
+		return nil
+	}
+
+	event.Message = Scrub(event.Message)
+
+	if event.Request != nil {
+		event.Request.Data = Scrub(event.Request.Data)
+		event.Request.QueryString = Scrub(event.Request.QueryString)
+	}
+
+	for i := range event.Exception {
+		event.Exception[i].Value = Scrub(event.Exception[i].Value)
+	}
+
+	event.Extra = scrubMap(event.Extra)
+
+	for _, b := range event.Breadcrumbs {
+		ScrubBreadcrumb(b, nil)
+	}
+
+	return event
+}
+
+// ScrubBreadcrumb removes card numbers and CVVs from the breadcrumb before it is added
+// to the scope. Use it as the BeforeBreadcrumb option of the Sentry client. The data of
+// breadcrumbs is often a map of an event, made with acmeserverless.ToSentryMap, so the
+// number of a card is replaced by its token and the CVV is removed.
+func ScrubBreadcrumb(breadcrumb *sentry.Breadcrumb, hint *sentry.BreadcrumbHint) *sentry.Breadcrumb {
+	if breadcrumb == nil {
+		return nil
+	}
+
+	breadcrumb.Message = Scrub(breadcrumb.Message)
+	breadcrumb.Data = scrubMap(breadcrumb.Data)
+
+	return breadcrumb
+}
+
+// scrubMap scrubs the values of m, and the maps and slices in it.
+func scrubMap(m map[string]interface{}) map[string]interface{} {
+	for k, v := range m {
+		switch strings.ToLower(k) {
+		case "cvv", "cvc", "ccv":
+			m[k] = "***"
+		case "number", "cardnumber", "pan":
+			if s, ok := v.(string); ok && !IsToken(s) && len(s) > 0 {
+				m[k] = Token(s)
+				continue
+			}
+			m[k] = scrubValue(v)
+		default:
+			m[k] = scrubValue(v)
+		}
+	}
+	return m
+}
+
+// scrubValue scrubs a single value of a map.
+func scrubValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case string:
+		return Scrub(val)
+	case map[string]interface{}:
+		return scrubMap(val)
+	case []interface{}:
+		for i := range val {
+			val[i] = scrubValue(val[i])
+		}
+		return val
+	default:
+		return v
+	}
+}
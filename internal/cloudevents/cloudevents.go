@@ -0,0 +1,280 @@
+// Package cloudevents maps the events of the ACME Serverless Fitness Shop to and from
+// CloudEvents 1.0 (https://cloudevents.io), so they can be exchanged with consumers that
+// only understand CloudEvents.
+//
+// The Type and Source of the Metadata map to the type and source attributes, the order the
+// event is about maps to the subject attribute, and the Domain and Status of the Metadata
+// are sent as the extension attributes domain and status. The Data of the event is the data
+// of the CloudEvent.
+package cloudevents
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	acmeserverless "github.com/retgits/acme-serverless"
+)
+
+// SpecVersion is the version of the CloudEvents specification this package implements.
+const SpecVersion = "1.0"
+
+// ContentType is the content type of a CloudEvent in structured mode.
+const ContentType = "application/cloudevents+json"
+
+// Mode is the way events are sent.
+type Mode string
+
+const (
+	// ModeNone sends the events as they are, without a CloudEvents envelope
+	ModeNone Mode = ""
+
+	// ModeStructured sends the events, including all attributes, as a CloudEvent
+	// in JSON format
+	ModeStructured Mode = "structured"
+
+	// ModeBinary sends the data of the events as the body and the attributes as
+	// headers. Transports without headers use ModeStructured instead.
+	ModeBinary Mode = "binary"
+)
+
+// ModeFromEnv returns the Mode set in the environment variable CLOUDEVENTS_MODE.
+// Unknown values fall back to ModeNone.
+func ModeFromEnv() Mode {
+	switch Mode(strings.ToLower(os.Getenv("CLOUDEVENTS_MODE"))) {
+	case ModeStructured:
+		return ModeStructured
+	case ModeBinary:
+		return ModeBinary
+	default:
+		return ModeNone
+	}
+}
+
+// Event is a CloudEvent in structured mode.
+type Event struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Domain          string          `json:"domain,omitempty"`
+	Status          string          `json:"status,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+}
+
+// namespace is the namespace of the IDs that are derived from the order and the
+// type of an event.
+var namespace = uuid.NewV5(uuid.NamespaceURL, "https://github.com/retgits/acme-serverless-order")
+
+// idKey is the key of the ID of the event in a context.
+type idKey struct{}
+
+// WithID returns a copy of ctx that carries the ID of the event that is sent
+// with it, like the ID of the event in the outbox.
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, idKey{}, id)
+}
+
+// ID returns the id attribute of the CloudEvent for an event with the given
+// metadata and subject. It is the ID carried by ctx (see WithID), or else a
+// UUID derived from the subject and the type of the event. Sending the same
+// event again, for example after a retry or by the relay, uses the same ID,
+// so consumers can recognize duplicates.
+func ID(ctx context.Context, m acmeserverless.Metadata, subject string) string {
+	if id, ok := ctx.Value(idKey{}).(string); ok && len(id) > 0 {
+		return id
+	}
+	return uuid.NewV5(namespace, fmt.Sprintf("%s/%s", subject, m.Type)).String()
+}
+
+// New creates the CloudEvent with the given ID for an event with the given metadata
+// and data. The subject is the ID of the order the event is about.
+func New(id string, m acmeserverless.Metadata, subject string, data interface{}) (Event, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+
+	return Event{
+		SpecVersion:     SpecVersion,
+		ID:              id,
+		Source:          m.Source,
+		Type:            m.Type,
+		Subject:         subject,
+		Time:            time.Now().UTC().Format(time.RFC3339),
+		DataContentType: "application/json",
+		Domain:          m.Domain,
+		Status:          m.Status,
+		Data:            payload,
+	}, nil
+}
+
+// Marshal returns the JSON encoding of Event.
+func (e *Event) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Marshaler is an event of the ACME Serverless Fitness Shop, which is sent as
+// it is when CloudEvents aren't used.
+type Marshaler interface {
+	Marshal() ([]byte, error)
+}
+
+// Encode returns the payload of a message for an event with the given ID, metadata, subject
+// and data. In ModeNone the event is marshalled as it is, in all other modes it is wrapped
+// in a CloudEvent in structured mode.
+func Encode(mode Mode, event Marshaler, id string, m acmeserverless.Metadata, subject string, data interface{}) ([]byte, error) {
+	if mode == ModeNone {
+		return event.Marshal()
+	}
+
+	e, err := New(id, m, subject, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Marshal()
+}
+
+// Headers returns the attributes of the event as HTTP headers for binary mode.
+func (e *Event) Headers() map[string]string {
+	headers := map[string]string{
+		"ce-specversion": e.SpecVersion,
+		"ce-id":          e.ID,
+		"ce-source":      e.Source,
+		"ce-type":        e.Type,
+	}
+
+	optional := map[string]string{
+		"ce-subject": e.Subject,
+		"ce-time":    e.Time,
+		"ce-domain":  e.Domain,
+		"ce-status":  e.Status,
+	}
+	for key, value := range optional {
+		if len(value) > 0 {
+			headers[key] = value
+		}
+	}
+
+	return headers
+}
+
+// Metadata returns the Metadata of the event.
+func (e *Event) Metadata() acmeserverless.Metadata {
+	return acmeserverless.Metadata{
+		Domain: e.Domain,
+		Source: e.Source,
+		Type:   e.Type,
+		Status: e.Status,
+	}
+}
+
+// payload returns the data of the event.
+func (e *Event) payload() (json.RawMessage, error) {
+	if len(e.DataBase64) > 0 {
+		data, err := base64.StdEncoding.DecodeString(e.DataBase64)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding data_base64: %s", err.Error())
+		}
+		return data, nil
+	}
+	return e.Data, nil
+}
+
+// envelope is the format of the events of the ACME Serverless Fitness Shop.
+type envelope struct {
+	Metadata acmeserverless.Metadata `json:"metadata"`
+	Data     json.RawMessage         `json:"data"`
+}
+
+// IsCloudEvent returns true when the payload is a CloudEvent in structured mode.
+func IsCloudEvent(payload []byte) bool {
+	var probe struct {
+		SpecVersion string `json:"specversion"`
+	}
+	return json.Unmarshal(payload, &probe) == nil && len(probe.SpecVersion) > 0
+}
+
+// Unwrap returns the payload in the format of the ACME Serverless Fitness Shop. When the
+// payload is a CloudEvent in structured mode, the event is rebuilt from the attributes and
+// the data of the CloudEvent. Other payloads are returned as they are.
+func Unwrap(payload []byte) ([]byte, error) {
+	if !IsCloudEvent(payload) {
+		return payload, nil
+	}
+
+	var e Event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return nil, fmt.Errorf("error unmarshalling CloudEvent: %s", err.Error())
+	}
+
+	return e.unwrap()
+}
+
+// UnwrapHTTP returns the body of an HTTP request in the format of the ACME Serverless
+// Fitness Shop. The header function returns the value of a request header. CloudEvents
+// in binary mode are recognized by the ce-specversion header, all other requests are
+// handled by Unwrap.
+func UnwrapHTTP(header func(key string) string, body []byte) ([]byte, error) {
+	if len(header("ce-specversion")) == 0 {
+		return Unwrap(body)
+	}
+
+	e := Event{
+		SpecVersion: header("ce-specversion"),
+		ID:          header("ce-id"),
+		Source:      header("ce-source"),
+		Type:        header("ce-type"),
+		Subject:     header("ce-subject"),
+		Time:        header("ce-time"),
+		Domain:      header("ce-domain"),
+		Status:      header("ce-status"),
+		Data:        body,
+	}
+
+	return e.unwrap()
+}
+
+// IDFromHTTP returns the id attribute of the CloudEvent in an HTTP request, from the
+// ce-id header in binary mode or from the body in structured mode. It returns an empty
+// string when the request isn't a CloudEvent.
+func IDFromHTTP(header func(key string) string, body []byte) string {
+	if len(header("ce-specversion")) > 0 {
+		return header("ce-id")
+	}
+
+	var probe struct {
+		SpecVersion string `json:"specversion"`
+		ID          string `json:"id"`
+	}
+	if json.Unmarshal(body, &probe) != nil || len(probe.SpecVersion) == 0 {
+		return ""
+	}
+	return probe.ID
+}
+
+func (e *Event) unwrap() ([]byte, error) {
+	if e.SpecVersion != SpecVersion {
+		return nil, fmt.Errorf("error unwrapping CloudEvent: unsupported specversion %q", e.SpecVersion)
+	}
+
+	data, err := e.payload()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(envelope{
+		Metadata: e.Metadata(),
+		Data:     data,
+	})
+}
@@ -0,0 +1,77 @@
+package cloudevents
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+)
+
+func TestID(t *testing.T) {
+	shipment := acmeserverless.Metadata{Type: acmeserverless.ShipmentRequestedEventName}
+	payment := acmeserverless.Metadata{Type: acmeserverless.PaymentRequestedEventName}
+
+	id := ID(context.Background(), shipment, "1")
+	if id != ID(context.Background(), shipment, "1") {
+		t.Errorf("the ID of the same event should be the same every time it is sent")
+	}
+	if id == ID(context.Background(), payment, "1") || id == ID(context.Background(), shipment, "2") {
+		t.Errorf("events of another type or order should have another ID")
+	}
+
+	if got := ID(WithID(context.Background(), "outbox-1"), shipment, "1"); got != "outbox-1" {
+		t.Errorf("expected the ID of the context, got %s", got)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	m := acmeserverless.Metadata{
+		Domain: acmeserverless.OrderDomain,
+		Source: "ShipOrder",
+		Type:   acmeserverless.ShipmentRequestedEventName,
+		Status: acmeserverless.DefaultSuccessStatus,
+	}
+	e := acmeserverless.ShipmentRequested{
+		Metadata: m,
+		Data:     acmeserverless.ShipmentRequest{OrderID: "1", Delivery: "UPS/FEDEX"},
+	}
+
+	for i := 0; i < 2; i++ {
+		payload, err := Encode(ModeStructured, &e, "outbox-1", m, e.Data.OrderID, e.Data)
+		if err != nil {
+			t.Fatalf("Encode returned an error: %s", err.Error())
+		}
+
+		var ce Event
+		if err := json.Unmarshal(payload, &ce); err != nil {
+			t.Fatalf("Unmarshal returned an error: %s", err.Error())
+		}
+		if ce.ID != "outbox-1" {
+			t.Errorf("expected id outbox-1, got %s", ce.ID)
+		}
+	}
+}
+
+func TestIDFromHTTP(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		body    string
+		want    string
+	}{
+		{name: "binary mode", headers: map[string]string{"ce-specversion": SpecVersion, "ce-id": "evt-1"}, body: `{"request":"1"}`, want: "evt-1"},
+		{name: "structured mode", body: `{"specversion":"1.0","id":"evt-1","data":{}}`, want: "evt-1"},
+		{name: "no CloudEvent", body: `{"metadata":{},"data":{}}`},
+		{name: "invalid body", body: `{`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := func(key string) string { return tt.headers[key] }
+			if got := IDFromHTTP(header, []byte(tt.body)); got != tt.want {
+				t.Errorf("expected id %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
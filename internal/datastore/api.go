@@ -5,15 +5,95 @@
 package datastore
 
 import (
+	"context"
+	"errors"
+	"time"
+
 	acmeserverless "github.com/retgits/acme-serverless"
 )
 
+// ErrNotFound is returned when the requested order doesn't exist in the data store.
+var ErrNotFound = errors.New("order not found")
+
+// ErrUnavailable is returned when the data store can't handle the request right
+// now, like when it can't be reached or throttles the request. Trying again
+// later can succeed.
+var ErrUnavailable = errors.New("datastore unavailable")
+
+// ErrValidation is returned when a request can't be handled because of the data
+// that was sent, like an invalid page. Trying again won't succeed.
+var ErrValidation = errors.New("validation failed")
+
 // Manager is the interface that describes the methods the
 // data store needs to implement to be able to work with
 // the ACME Serverless Fitness Shop.
+//
+// AddOrder stores the order, together with the events that need to be
+// sent for it, in a single transaction. When the order doesn't have an
+// OrderID yet, a new one is assigned. OutboxEvents returns the events that
+// haven't been sent yet, oldest first, and RemoveOutboxEvent removes an event
+// from the outbox after it has been sent.
+//
+// AllOrders and UserOrders return the orders sorted by OrderID, one
+// page at a time. Next to the orders, they return the continuation
+// token for the next page, or an empty string when there are no more
+// orders.
+//
+// UpdateStatus never overwrites changes made by someone else. When the
+// order keeps changing while the update is tried, ErrConflict is returned.
+// Like AddOrder, it stores the events that need to be sent for the new
+// status in the same transaction.
+// Every status change is added to the history of the order, together with
+// the metadata of the event that triggered it. History returns the status
+// changes of an order, oldest first. CancelOrder cancels an order that
+// hasn't been shipped yet, and returns ErrInvalidTransition otherwise. Like
+// AddOrder, it stores the events that need to be sent for the cancellation
+// in the same transaction.
+//
+// Datastores that encrypt the personal data of orders, like the names and
+// the address, do so transparently: orders are passed to and returned by
+// the methods in plaintext. AllOrders and UserOrders leave out, and log,
+// the orders that can't be decrypted, so one order doesn't fail the whole
+// page. RotateKeys encrypts a page of orders again when
+// they aren't encrypted with the current key, and returns the number of
+// orders it encrypted again and the continuation token for the next page.
+//
+// RecordEvent records that an event is in progress, for the duration of
+// the ttl. It returns false when the event was already completed, so
+// duplicate deliveries can be skipped, and ErrInProgress when the event is
+// still in progress. CompleteEvent records that the event was processed,
+// and remembers it for the duration of its ttl. ForgetEvent removes the
+// record of an event, so it is processed when it is delivered again.
+// Records that expired, in progress or completed, are taken over by
+// RecordEvent.
+//
+// AddDeadLetter stores an event that couldn't be sent, keyed by the ID of
+// the event. DeadLetters returns the dead letters, oldest first, and
+// RemoveDeadLetter removes a dead letter after it has been replayed.
+//
+// Every method takes the context of the request as first argument. When the
+// context is cancelled or its deadline passes, like when a function or the
+// timeout of a request runs out or a server shuts down, the call to the
+// database is cancelled as well.
+//
+// Errors wrap one of the errors of this package when the cause is known, so
+// callers can use errors.Is to decide how to respond: ErrNotFound, ErrConflict,
+// ErrInvalidTransition, ErrUnavailable or ErrValidation.
 type Manager interface {
-	AddOrder(o acmeserverless.Order) (acmeserverless.Order, error)
-	AllOrders() (acmeserverless.Orders, error)
-	UserOrders(userID string) (acmeserverless.Orders, error)
-	UpdateStatus(s acmeserverless.ShipmentData) (acmeserverless.Order, error)
+	AddOrder(ctx context.Context, o acmeserverless.Order, outbox ...OutboxEvent) (acmeserverless.Order, error)
+	AllOrders(ctx context.Context, p Page) (acmeserverless.Orders, string, error)
+	UserOrders(ctx context.Context, userID string, p Page) (acmeserverless.Orders, string, error)
+	GetOrder(ctx context.Context, orderID string) (acmeserverless.Order, error)
+	UpdateStatus(ctx context.Context, s acmeserverless.ShipmentData, m acmeserverless.Metadata, outbox ...OutboxEvent) (acmeserverless.Order, error)
+	History(ctx context.Context, orderID string) (History, error)
+	CancelOrder(ctx context.Context, orderID string, m acmeserverless.Metadata, outbox ...OutboxEvent) (acmeserverless.Order, error)
+	RecordEvent(ctx context.Context, eventID string, ttl time.Duration) (bool, error)
+	CompleteEvent(ctx context.Context, eventID string, ttl time.Duration) error
+	ForgetEvent(ctx context.Context, eventID string) error
+	OutboxEvents(ctx context.Context, limit int64) ([]OutboxEvent, error)
+	RemoveOutboxEvent(ctx context.Context, eventID string) error
+	AddDeadLetter(ctx context.Context, d DeadLetter) error
+	DeadLetters(ctx context.Context, limit int64) ([]DeadLetter, error)
+	RemoveDeadLetter(ctx context.Context, eventID string) error
+	RotateKeys(ctx context.Context, p Page) (int, string, error)
 }
@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/card"
+)
+
+// maskedManager is a Manager that only stores the token and the last four digits of
+// the card of an order. Orders that were stored before cards were masked are masked
+// when they are read, so a full card number never leaves the datastore. The card of
+// the PaymentRequested events in the outbox is masked as well, so the card number and
+// the CVV are only stored encrypted, in the SealedCard of the event.
+type maskedManager struct {
+	Manager
+}
+
+// MaskCards returns a Manager that masks the cards of the orders it stores and returns,
+// using card.Mask. Open wraps every datastore with it.
+func MaskCards(m Manager) Manager {
+	if _, ok := m.(maskedManager); ok {
+		return m
+	}
+	return maskedManager{Manager: m}
+}
+
+func (m maskedManager) AddOrder(ctx context.Context, o acmeserverless.Order, outbox ...OutboxEvent) (acmeserverless.Order, error) {
+	outbox, err := maskOutbox(outbox)
+	if err != nil {
+		return card.MaskOrder(o), err
+	}
+
+	o, err = m.Manager.AddOrder(ctx, card.MaskOrder(o), outbox...)
+	return card.MaskOrder(o), err
+}
+
+func (m maskedManager) AllOrders(ctx context.Context, p Page) (acmeserverless.Orders, string, error) {
+	orders, next, err := m.Manager.AllOrders(ctx, p)
+	return card.MaskOrders(orders), next, err
+}
+
+func (m maskedManager) UserOrders(ctx context.Context, userID string, p Page) (acmeserverless.Orders, string, error) {
+	orders, next, err := m.Manager.UserOrders(ctx, userID, p)
+	return card.MaskOrders(orders), next, err
+}
+
+func (m maskedManager) GetOrder(ctx context.Context, orderID string) (acmeserverless.Order, error) {
+	o, err := m.Manager.GetOrder(ctx, orderID)
+	return card.MaskOrder(o), err
+}
+
+func (m maskedManager) UpdateStatus(ctx context.Context, s acmeserverless.ShipmentData, md acmeserverless.Metadata, outbox ...OutboxEvent) (acmeserverless.Order, error) {
+	outbox, err := maskOutbox(outbox)
+	if err != nil {
+		return acmeserverless.Order{}, err
+	}
+
+	o, err := m.Manager.UpdateStatus(ctx, s, md, outbox...)
+	return card.MaskOrder(o), err
+}
+
+func (m maskedManager) CancelOrder(ctx context.Context, orderID string, md acmeserverless.Metadata, outbox ...OutboxEvent) (acmeserverless.Order, error) {
+	outbox, err := maskOutbox(outbox)
+	if err != nil {
+		return acmeserverless.Order{}, err
+	}
+
+	o, err := m.Manager.CancelOrder(ctx, orderID, md, outbox...)
+	return card.MaskOrder(o), err
+}
+
+// maskOutbox returns the events with the card of the PaymentRequested events masked.
+// The encrypted card is kept. The other events don't contain a card and are returned
+// as they are.
+func maskOutbox(events []OutboxEvent) ([]OutboxEvent, error) {
+	masked := make([]OutboxEvent, len(events))
+
+	for i, e := range events {
+		masked[i] = e
+		if e.Type != acmeserverless.PaymentRequestedEventName {
+			continue
+		}
+
+		var evt PaymentRequestedPayload
+		if err := json.Unmarshal([]byte(e.Payload), &evt); err != nil {
+			return nil, fmt.Errorf("%w: error unmarshalling %s event %s: %s", ErrValidation, e.Type, e.ID, err.Error())
+		}
+		evt.Data.Card = card.Mask(evt.Data.Card)
+
+		payload, err := json.Marshal(evt)
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling %s event %s: %s", e.Type, e.ID, err.Error())
+		}
+		masked[i].Payload = string(payload)
+	}
+
+	return masked, nil
+}
@@ -0,0 +1,31 @@
+package datastore
+
+import (
+	"errors"
+)
+
+// UpdateAttempts is the number of times an update is tried before the
+// conflict is returned to the caller.
+const UpdateAttempts = 3
+
+// ErrConflict is returned when an order was changed by someone else between
+// reading and writing it. Every stored order has a version, which is
+// increased on every write. A write only succeeds when the version of the
+// stored order is still the version that was read.
+var ErrConflict = errors.New("order was changed concurrently")
+
+// RetryOnConflict calls fn until it returns an error other than ErrConflict,
+// or until it has been called UpdateAttempts times. Because fn reads the order
+// again on every call, each attempt works with the latest version.
+func RetryOnConflict(fn func() error) error {
+	var err error
+
+	for i := 0; i < UpdateAttempts; i++ {
+		err = fn()
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+
+	return err
+}
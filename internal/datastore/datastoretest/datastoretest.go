@@ -0,0 +1,1193 @@
+// Package datastoretest contains a conformance suite for implementations of the
+// datastore.Manager interface. Every datastore should behave the same way, so the
+// handlers of the Order service don't need to know which one is used. The suite
+// can be run against the in-memory datastore, as well as against local stand-ins
+// like DynamoDB Local or a MongoDB compatible server.
+//
+// To run the suite against a datastore, call Run from a test in that package
+//
+//	func TestConformance(t *testing.T) {
+//	    datastoretest.Run(t, func(t *testing.T) datastore.Manager {
+//	        return memory.New()
+//	    })
+//	}
+package datastoretest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/pii"
+)
+
+// concurrentWriters is the number of goroutines used to test concurrent access
+// to the datastore.
+const concurrentWriters = 20
+
+// metadata is the metadata of the event that triggers the status updates in the
+// conformance tests.
+var metadata = acmeserverless.Metadata{
+	Domain: acmeserverless.OrderDomain,
+	Source: "Conformance",
+	Type:   "StatusUpdated",
+	Status: acmeserverless.DefaultSuccessStatus,
+}
+
+// Factory returns the datastore.Manager the conformance tests run against. It is
+// called once for every test. The suite doesn't assume the datastore is empty, so
+// a Factory can return a Manager that is connected to a shared database.
+type Factory func(t *testing.T) datastore.Manager
+
+// Run runs all conformance tests against the Manager returned by newManager.
+func Run(t *testing.T, newManager Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, m datastore.Manager)
+	}{
+		{"AddOrder", testAddOrder},
+		{"AllOrders", testAllOrders},
+		{"UserOrders", testUserOrders},
+		{"AllOrdersPages", testAllOrdersPages},
+		{"UserOrdersPages", testUserOrdersPages},
+		{"InvalidToken", testInvalidToken},
+		{"GetOrder", testGetOrder},
+		{"GetOrderNotFound", testGetOrderNotFound},
+		{"GetOrderHistoryKey", testGetOrderHistoryKey},
+		{"UpdateStatus", testUpdateStatus},
+		{"UpdateStatusNotFound", testUpdateStatusNotFound},
+		{"UpdateStatusOverwrite", testUpdateStatusOverwrite},
+		{"UpdateStatusOutbox", testUpdateStatusOutbox},
+		{"InvalidTransition", testInvalidTransition},
+		{"TerminalStatus", testTerminalStatus},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"ConcurrentStatusUpdates", testConcurrentStatusUpdates},
+		{"History", testHistory},
+		{"HistoryNotFound", testHistoryNotFound},
+		{"CancelOrder", testCancelOrder},
+		{"CancelOrderShipped", testCancelOrderShipped},
+		{"CancelOrderNotFound", testCancelOrderNotFound},
+		{"RecordEvent", testRecordEvent},
+		{"RecordEventExpired", testRecordEventExpired},
+		{"ConcurrentRecordEvent", testConcurrentRecordEvent},
+		{"Once", testOnce},
+		{"AddOrderKeepsOrderID", testAddOrderKeepsOrderID},
+		{"Outbox", testOutbox},
+		{"DeadLetters", testDeadLetters},
+		{"CancelledContext", testCancelledContext},
+		{"RotateKeys", testRotateKeys},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newManager(t))
+		})
+	}
+}
+
+// NewOrder returns an order, like the ones sent by the front-end, for the user
+// with the given userID.
+func NewOrder(userID string) acmeserverless.Order {
+	return acmeserverless.Order{
+		UserID:    userID,
+		Firstname: ptrString("John"),
+		Lastname:  ptrString("Blaze"),
+		Address: &acmeserverless.Address{
+			Street:  ptrString("20 Riding Lane Av"),
+			City:    ptrString("San Francisco"),
+			Zip:     ptrString("10201"),
+			State:   ptrString("CA"),
+			Country: ptrString("USA"),
+		},
+		Email:    ptrString("jblaze@marvel.com"),
+		Delivery: "UPS/FEDEX",
+		Cart: []acmeserverless.CartItem{
+			{
+				ID:          ptrString("1234"),
+				Description: "redpants",
+				Quantity:    1,
+				Price:       4,
+			},
+			{
+				ID:          ptrString("5678"),
+				Description: "bluepants",
+				Quantity:    1,
+				Price:       4,
+			},
+		},
+		Total: "8",
+	}
+}
+
+// newUserID returns a unique userID, so tests don't see each others orders
+// when the datastore is shared.
+func newUserID() string {
+	return uuid.Must(uuid.NewV4()).String()
+}
+
+func testAddOrder(t *testing.T, m datastore.Manager) {
+	in := NewOrder(newUserID())
+
+	ord, err := m.AddOrder(context.Background(), in)
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	if _, err := uuid.FromString(ord.OrderID); err != nil {
+		t.Errorf("AddOrder should assign a UUID as OrderID, got %q", ord.OrderID)
+	}
+
+	if ord.Status == nil || *ord.Status != "Pending Payment" {
+		t.Errorf("AddOrder should set the status to %q, got %v", "Pending Payment", statusOf(ord))
+	}
+
+	if ord.UserID != in.UserID || ord.Total != in.Total || len(ord.Cart) != len(in.Cart) {
+		t.Errorf("AddOrder should keep the data of the order, got %+v", ord)
+	}
+
+	other, err := m.AddOrder(context.Background(), in)
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	if other.OrderID == ord.OrderID {
+		t.Errorf("AddOrder should assign a new OrderID to every order, got %q twice", ord.OrderID)
+	}
+}
+
+func testAllOrders(t *testing.T, m datastore.Manager) {
+	userID := newUserID()
+	added := make(map[string]bool)
+
+	for i := 0; i < 3; i++ {
+		ord, err := m.AddOrder(context.Background(), NewOrder(userID))
+		if err != nil {
+			t.Fatalf("AddOrder returned an error: %s", err.Error())
+		}
+		added[ord.OrderID] = true
+	}
+
+	orders, _, err := m.AllOrders(context.Background(), datastore.Page{})
+	if err != nil {
+		t.Fatalf("AllOrders returned an error: %s", err.Error())
+	}
+
+	for _, ord := range orders {
+		if !added[ord.OrderID] {
+			continue
+		}
+		delete(added, ord.OrderID)
+
+		if ord.UserID != userID || ord.Delivery != "UPS/FEDEX" || len(ord.Cart) != 2 {
+			t.Errorf("AllOrders should return the complete order, got %+v", ord)
+		}
+	}
+
+	if len(added) > 0 {
+		t.Errorf("AllOrders didn't return %d of the added orders", len(added))
+	}
+}
+
+func testUserOrders(t *testing.T, m datastore.Manager) {
+	userID := newUserID()
+	added := make(map[string]bool)
+
+	for i := 0; i < 3; i++ {
+		ord, err := m.AddOrder(context.Background(), NewOrder(userID))
+		if err != nil {
+			t.Fatalf("AddOrder returned an error: %s", err.Error())
+		}
+		added[ord.OrderID] = true
+	}
+
+	if _, err := m.AddOrder(context.Background(), NewOrder(newUserID())); err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	orders, _, err := m.UserOrders(context.Background(), userID, datastore.Page{})
+	if err != nil {
+		t.Fatalf("UserOrders returned an error: %s", err.Error())
+	}
+
+	if len(orders) != len(added) {
+		t.Errorf("UserOrders should return %d orders, got %d", len(added), len(orders))
+	}
+
+	for _, ord := range orders {
+		if !added[ord.OrderID] || ord.UserID != userID {
+			t.Errorf("UserOrders returned an order of another user: %+v", ord)
+		}
+	}
+
+	orders, _, err = m.UserOrders(context.Background(), newUserID(), datastore.Page{})
+	if err != nil {
+		t.Fatalf("UserOrders returned an error for a user without orders: %s", err.Error())
+	}
+
+	if len(orders) != 0 {
+		t.Errorf("UserOrders should return no orders for a new user, got %d", len(orders))
+	}
+}
+
+func testAllOrdersPages(t *testing.T, m datastore.Manager) {
+	userID := newUserID()
+	added := make(map[string]bool)
+
+	for i := 0; i < 5; i++ {
+		ord, err := m.AddOrder(context.Background(), NewOrder(userID))
+		if err != nil {
+			t.Fatalf("AddOrder returned an error: %s", err.Error())
+		}
+		added[ord.OrderID] = true
+	}
+
+	orders := readPages(t, func(p datastore.Page) (acmeserverless.Orders, string, error) {
+		return m.AllOrders(context.Background(), p)
+	}, 2)
+
+	for _, ord := range orders {
+		delete(added, ord.OrderID)
+	}
+
+	if len(added) > 0 {
+		t.Errorf("the pages of AllOrders didn't contain %d of the added orders", len(added))
+	}
+}
+
+func testUserOrdersPages(t *testing.T, m datastore.Manager) {
+	userID := newUserID()
+	added := make(map[string]bool)
+
+	for i := 0; i < 5; i++ {
+		ord, err := m.AddOrder(context.Background(), NewOrder(userID))
+		if err != nil {
+			t.Fatalf("AddOrder returned an error: %s", err.Error())
+		}
+		added[ord.OrderID] = true
+
+		// Orders of other users shouldn't show up on the pages
+		if _, err := m.AddOrder(context.Background(), NewOrder(newUserID())); err != nil {
+			t.Fatalf("AddOrder returned an error: %s", err.Error())
+		}
+	}
+
+	orders := readPages(t, func(p datastore.Page) (acmeserverless.Orders, string, error) {
+		return m.UserOrders(context.Background(), userID, p)
+	}, 2)
+
+	if len(orders) != len(added) {
+		t.Errorf("the pages of UserOrders should contain %d orders, got %d", len(added), len(orders))
+	}
+
+	for _, ord := range orders {
+		if !added[ord.OrderID] {
+			t.Errorf("UserOrders returned an order of another user: %+v", ord)
+		}
+	}
+}
+
+// readPages reads all pages of the given size and returns the orders on them. It
+// verifies that no page is larger than the size, and that the orders are sorted
+// by OrderID across pages.
+func readPages(t *testing.T, list func(p datastore.Page) (acmeserverless.Orders, string, error), size int64) acmeserverless.Orders {
+	var all acmeserverless.Orders
+	p := datastore.Page{Size: size}
+
+	for {
+		orders, token, err := list(p)
+		if err != nil {
+			t.Fatalf("listing orders returned an error: %s", err.Error())
+		}
+
+		if int64(len(orders)) > size {
+			t.Fatalf("a page should contain at most %d orders, got %d", size, len(orders))
+		}
+
+		for _, ord := range orders {
+			if len(all) > 0 && ord.OrderID <= all[len(all)-1].OrderID {
+				t.Fatalf("orders should be sorted by OrderID without duplicates, got %q after %q", ord.OrderID, all[len(all)-1].OrderID)
+			}
+			all = append(all, ord)
+		}
+
+		if len(token) == 0 {
+			return all
+		}
+
+		p.Token = token
+	}
+}
+
+func testInvalidToken(t *testing.T, m datastore.Manager) {
+	if _, _, err := m.AllOrders(context.Background(), datastore.Page{Size: 2, Token: "not a valid token"}); !errors.Is(err, datastore.ErrInvalidPage) {
+		t.Errorf("AllOrders should return datastore.ErrInvalidPage for an invalid token, got %v", err)
+	}
+
+	if _, _, err := m.UserOrders(context.Background(), newUserID(), datastore.Page{Size: 2, Token: "not a valid token"}); !errors.Is(err, datastore.ErrInvalidPage) {
+		t.Errorf("UserOrders should return datastore.ErrInvalidPage for an invalid token, got %v", err)
+	}
+}
+
+func testGetOrder(t *testing.T, m datastore.Manager) {
+	userID := newUserID()
+
+	added, err := m.AddOrder(context.Background(), NewOrder(userID))
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	if _, err := m.AddOrder(context.Background(), NewOrder(userID)); err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	ord, err := m.GetOrder(context.Background(), added.OrderID)
+	if err != nil {
+		t.Fatalf("GetOrder returned an error: %s", err.Error())
+	}
+
+	if ord.OrderID != added.OrderID || ord.UserID != userID || statusOf(ord) != "Pending Payment" || len(ord.Cart) != 2 {
+		t.Errorf("GetOrder should return the complete order, got %+v", ord)
+	}
+}
+
+func testGetOrderNotFound(t *testing.T, m datastore.Manager) {
+	_, err := m.GetOrder(context.Background(), uuid.Must(uuid.NewV4()).String())
+	if !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("GetOrder should return datastore.ErrNotFound for an unknown order, got %v", err)
+	}
+}
+
+func testGetOrderHistoryKey(t *testing.T, m datastore.Manager) {
+	ord, err := m.AddOrder(context.Background(), NewOrder(newUserID()))
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	if _, err := m.UpdateStatus(context.Background(), acmeserverless.ShipmentData{OrderNumber: ord.OrderID, Status: datastore.StatusPaid}, metadata); err != nil {
+		t.Fatalf("UpdateStatus returned an error: %s", err.Error())
+	}
+
+	// Datastores that store the history next to the order shouldn't return it as an order
+	for _, id := range []string{ord.OrderID + "#HISTORY#00000000000000000001", ord.OrderID + "#HISTORY#00000000000000000002"} {
+		if _, err := m.GetOrder(context.Background(), id); !errors.Is(err, datastore.ErrNotFound) {
+			t.Errorf("GetOrder should return datastore.ErrNotFound for %s, got %v", id, err)
+		}
+	}
+}
+
+func testUpdateStatus(t *testing.T, m datastore.Manager) {
+	userID := newUserID()
+
+	ord, err := m.AddOrder(context.Background(), NewOrder(userID))
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	updated, err := m.UpdateStatus(context.Background(), acmeserverless.ShipmentData{
+		OrderNumber: ord.OrderID,
+		Status:      datastore.StatusPaid,
+	}, metadata)
+	if err != nil {
+		t.Fatalf("UpdateStatus returned an error: %s", err.Error())
+	}
+
+	if updated.OrderID != ord.OrderID || statusOf(updated) != datastore.StatusPaid {
+		t.Errorf("UpdateStatus should return the updated order, got %+v", updated)
+	}
+
+	if updated.UserID != userID || len(updated.Cart) != len(ord.Cart) {
+		t.Errorf("UpdateStatus should keep the data of the order, got %+v", updated)
+	}
+
+	stored, err := m.GetOrder(context.Background(), ord.OrderID)
+	if err != nil {
+		t.Fatalf("GetOrder returned an error: %s", err.Error())
+	}
+
+	if statusOf(stored) != datastore.StatusPaid {
+		t.Errorf("GetOrder should return the updated order, got %+v", stored)
+	}
+}
+
+func testUpdateStatusNotFound(t *testing.T, m datastore.Manager) {
+	_, err := m.UpdateStatus(context.Background(), acmeserverless.ShipmentData{
+		OrderNumber: uuid.Must(uuid.NewV4()).String(),
+		Status:      datastore.StatusPaid,
+	}, metadata)
+	if !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("UpdateStatus should return datastore.ErrNotFound for an unknown order, got %v", err)
+	}
+}
+
+func testUpdateStatusOverwrite(t *testing.T, m datastore.Manager) {
+	userID := newUserID()
+
+	ord, err := m.AddOrder(context.Background(), NewOrder(userID))
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	statuses := []string{
+		datastore.StatusPaid,
+		datastore.StatusShipmentRequested,
+		datastore.StatusShipped,
+		datastore.StatusDelivered,
+	}
+
+	for _, status := range statuses {
+		if _, err := m.UpdateStatus(context.Background(), acmeserverless.ShipmentData{OrderNumber: ord.OrderID, Status: status}, metadata); err != nil {
+			t.Fatalf("UpdateStatus returned an error: %s", err.Error())
+		}
+	}
+
+	orders, _, err := m.UserOrders(context.Background(), userID, datastore.Page{})
+	if err != nil {
+		t.Fatalf("UserOrders returned an error: %s", err.Error())
+	}
+
+	if len(orders) != 1 || statusOf(orders[0]) != datastore.StatusDelivered {
+		t.Errorf("the last status update should be stored, got %+v", orders)
+	}
+}
+
+func testUpdateStatusOutbox(t *testing.T, m datastore.Manager) {
+	ord, err := m.AddOrder(context.Background(), NewOrder(newUserID()))
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	if _, err := m.UpdateStatus(context.Background(), acmeserverless.ShipmentData{OrderNumber: ord.OrderID, Status: datastore.StatusPaid}, metadata); err != nil {
+		t.Fatalf("UpdateStatus returned an error: %s", err.Error())
+	}
+
+	evt := datastore.NewOutboxEvent("ShipmentRequested", []byte(`{"_id":"`+ord.OrderID+`"}`))
+
+	updated, err := m.UpdateStatus(context.Background(), acmeserverless.ShipmentData{OrderNumber: ord.OrderID, Status: datastore.StatusShipmentRequested}, metadata, evt)
+	if err != nil {
+		t.Fatalf("UpdateStatus returned an error: %s", err.Error())
+	}
+
+	if statusOf(updated) != datastore.StatusShipmentRequested {
+		t.Errorf("expected status %q, got %q", datastore.StatusShipmentRequested, statusOf(updated))
+	}
+
+	events, err := m.OutboxEvents(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("OutboxEvents returned an error: %s", err.Error())
+	}
+
+	found := false
+	for _, e := range events {
+		if e.ID == evt.ID && e.Type == evt.Type {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("UpdateStatus should add the event to the outbox")
+	}
+
+	if err := m.RemoveOutboxEvent(context.Background(), evt.ID); err != nil {
+		t.Fatalf("RemoveOutboxEvent returned an error: %s", err.Error())
+	}
+}
+
+func testInvalidTransition(t *testing.T, m datastore.Manager) {
+	ord, err := m.AddOrder(context.Background(), NewOrder(newUserID()))
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	_, err = m.UpdateStatus(context.Background(), acmeserverless.ShipmentData{OrderNumber: ord.OrderID, Status: datastore.StatusDelivered}, metadata)
+	if !errors.Is(err, datastore.ErrInvalidTransition) {
+		t.Fatalf("UpdateStatus should return datastore.ErrInvalidTransition for an unpaid order, got %v", err)
+	}
+
+	var terr *datastore.TransitionError
+	if !errors.As(err, &terr) || terr.From != datastore.StatusPendingPayment || terr.To != datastore.StatusDelivered {
+		t.Errorf("UpdateStatus should return a *datastore.TransitionError, got %v", err)
+	}
+
+	stored, err := m.GetOrder(context.Background(), ord.OrderID)
+	if err != nil {
+		t.Fatalf("GetOrder returned an error: %s", err.Error())
+	}
+
+	if statusOf(stored) != datastore.StatusPendingPayment {
+		t.Errorf("a rejected status update shouldn't be stored, got %+v", stored)
+	}
+}
+
+func testTerminalStatus(t *testing.T, m datastore.Manager) {
+	ord, err := m.AddOrder(context.Background(), NewOrder(newUserID()))
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	statuses := []string{
+		datastore.StatusPaid,
+		datastore.StatusShipmentRequested,
+		datastore.StatusShipped,
+		datastore.StatusDelivered,
+	}
+
+	for _, status := range statuses {
+		if _, err := m.UpdateStatus(context.Background(), acmeserverless.ShipmentData{OrderNumber: ord.OrderID, Status: status}, metadata); err != nil {
+			t.Fatalf("UpdateStatus returned an error: %s", err.Error())
+		}
+	}
+
+	// A late payment response must not overwrite a delivered order
+	_, err = m.UpdateStatus(context.Background(), acmeserverless.ShipmentData{OrderNumber: ord.OrderID, Status: datastore.StatusPaymentFailed}, metadata)
+	if !errors.Is(err, datastore.ErrInvalidTransition) {
+		t.Errorf("UpdateStatus should return datastore.ErrInvalidTransition for a delivered order, got %v", err)
+	}
+
+	stored, err := m.GetOrder(context.Background(), ord.OrderID)
+	if err != nil {
+		t.Fatalf("GetOrder returned an error: %s", err.Error())
+	}
+
+	if statusOf(stored) != datastore.StatusDelivered {
+		t.Errorf("a rejected status update shouldn't be stored, got %+v", stored)
+	}
+}
+
+func testConcurrentWriters(t *testing.T, m datastore.Manager) {
+	userID := newUserID()
+
+	var wg sync.WaitGroup
+	ids := make(chan string, concurrentWriters)
+
+	for i := 0; i < concurrentWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ord, err := m.AddOrder(context.Background(), NewOrder(userID))
+			if err != nil {
+				t.Errorf("AddOrder returned an error: %s", err.Error())
+				return
+			}
+
+			if _, err := m.UpdateStatus(context.Background(), acmeserverless.ShipmentData{OrderNumber: ord.OrderID, Status: datastore.StatusPaid}, metadata); err != nil {
+				t.Errorf("UpdateStatus returned an error: %s", err.Error())
+				return
+			}
+
+			ids <- ord.OrderID
+		}()
+	}
+
+	wg.Wait()
+	close(ids)
+
+	written := make(map[string]bool)
+	for id := range ids {
+		written[id] = true
+	}
+
+	orders, _, err := m.UserOrders(context.Background(), userID, datastore.Page{})
+	if err != nil {
+		t.Fatalf("UserOrders returned an error: %s", err.Error())
+	}
+
+	if len(orders) != len(written) {
+		t.Errorf("UserOrders should return %d orders, got %d", len(written), len(orders))
+	}
+
+	for _, ord := range orders {
+		if !written[ord.OrderID] || statusOf(ord) != datastore.StatusPaid {
+			t.Errorf("concurrent writes weren't stored correctly, got %+v", ord)
+		}
+	}
+}
+
+func testConcurrentStatusUpdates(t *testing.T, m datastore.Manager) {
+	ord, err := m.AddOrder(context.Background(), NewOrder(newUserID()))
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	// Half of the writers try to mark the order as paid, the other half as
+	// failed. Only one of them can win, the others must not overwrite it.
+	var wg sync.WaitGroup
+	results := make(chan string, concurrentWriters)
+
+	for i := 0; i < concurrentWriters; i++ {
+		status := datastore.StatusPaid
+		if i%2 == 1 {
+			status = datastore.StatusPaymentFailed
+		}
+
+		wg.Add(1)
+		go func(status string) {
+			defer wg.Done()
+
+			_, err := m.UpdateStatus(context.Background(), acmeserverless.ShipmentData{OrderNumber: ord.OrderID, Status: status}, metadata)
+			switch {
+			case err == nil:
+				results <- status
+			case errors.Is(err, datastore.ErrInvalidTransition), errors.Is(err, datastore.ErrConflict):
+			default:
+				t.Errorf("UpdateStatus returned an error: %s", err.Error())
+			}
+		}(status)
+	}
+
+	wg.Wait()
+	close(results)
+
+	var won []string
+	for status := range results {
+		won = append(won, status)
+	}
+
+	if len(won) != 1 {
+		t.Fatalf("exactly one status update should succeed, got %v", won)
+	}
+
+	stored, err := m.GetOrder(context.Background(), ord.OrderID)
+	if err != nil {
+		t.Fatalf("GetOrder returned an error: %s", err.Error())
+	}
+
+	if statusOf(stored) != won[0] {
+		t.Errorf("the successful status update should be stored, got %+v", stored)
+	}
+}
+
+func testHistory(t *testing.T, m datastore.Manager) {
+	ord, err := m.AddOrder(context.Background(), NewOrder(newUserID()))
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	history, err := m.History(context.Background(), ord.OrderID)
+	if err != nil {
+		t.Fatalf("History returned an error: %s", err.Error())
+	}
+
+	if len(history) != 0 {
+		t.Errorf("a new order shouldn't have any history, got %+v", history)
+	}
+
+	statuses := []string{
+		datastore.StatusPaid,
+		datastore.StatusShipmentRequested,
+		datastore.StatusShipped,
+	}
+
+	for _, status := range statuses {
+		if _, err := m.UpdateStatus(context.Background(), acmeserverless.ShipmentData{OrderNumber: ord.OrderID, Status: status}, metadata); err != nil {
+			t.Fatalf("UpdateStatus returned an error: %s", err.Error())
+		}
+	}
+
+	// A rejected status update isn't part of the history
+	if _, err := m.UpdateStatus(context.Background(), acmeserverless.ShipmentData{OrderNumber: ord.OrderID, Status: datastore.StatusPaid}, metadata); err == nil {
+		t.Fatalf("UpdateStatus should reject moving a shipped order back to paid")
+	}
+
+	history, err = m.History(context.Background(), ord.OrderID)
+	if err != nil {
+		t.Fatalf("History returned an error: %s", err.Error())
+	}
+
+	if len(history) != len(statuses) {
+		t.Fatalf("History should return %d entries, got %+v", len(statuses), history)
+	}
+
+	from := datastore.StatusPendingPayment
+	for idx, entry := range history {
+		if entry.OldStatus != from || entry.NewStatus != statuses[idx] {
+			t.Errorf("entry %d should move from %q to %q, got %+v", idx, from, statuses[idx], entry)
+		}
+
+		if entry.Source != metadata.Source || entry.EventType != metadata.Type {
+			t.Errorf("entry %d should contain the metadata of the event, got %+v", idx, entry)
+		}
+
+		if entry.Timestamp.IsZero() || (idx > 0 && entry.Timestamp.Before(history[idx-1].Timestamp)) {
+			t.Errorf("entry %d should have a timestamp after the previous entry, got %+v", idx, entry)
+		}
+
+		from = entry.NewStatus
+	}
+}
+
+func testHistoryNotFound(t *testing.T, m datastore.Manager) {
+	_, err := m.History(context.Background(), uuid.Must(uuid.NewV4()).String())
+	if !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("History should return datastore.ErrNotFound for an unknown order, got %v", err)
+	}
+}
+
+func testCancelOrder(t *testing.T, m datastore.Manager) {
+	ord, err := m.AddOrder(context.Background(), NewOrder(newUserID()))
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	evt := datastore.NewOutboxEvent("OrderCancelled", []byte(`{"orderID":"`+ord.OrderID+`"}`))
+
+	cancelled, err := m.CancelOrder(context.Background(), ord.OrderID, metadata, evt)
+	if err != nil {
+		t.Fatalf("CancelOrder returned an error: %s", err.Error())
+	}
+
+	if cancelled.OrderID != ord.OrderID || statusOf(cancelled) != datastore.StatusCancelled {
+		t.Errorf("CancelOrder should return the cancelled order, got %+v", cancelled)
+	}
+
+	events, err := m.OutboxEvents(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("OutboxEvents returned an error: %s", err.Error())
+	}
+
+	found := false
+	for _, e := range events {
+		if e.ID == evt.ID && e.Type == evt.Type {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("CancelOrder should add the event to the outbox")
+	}
+
+	if err := m.RemoveOutboxEvent(context.Background(), evt.ID); err != nil {
+		t.Fatalf("RemoveOutboxEvent returned an error: %s", err.Error())
+	}
+
+	history, err := m.History(context.Background(), ord.OrderID)
+	if err != nil {
+		t.Fatalf("History returned an error: %s", err.Error())
+	}
+
+	if len(history) != 1 || history[0].NewStatus != datastore.StatusCancelled {
+		t.Errorf("the cancellation should be part of the history, got %+v", history)
+	}
+}
+
+func testCancelOrderShipped(t *testing.T, m datastore.Manager) {
+	ord, err := m.AddOrder(context.Background(), NewOrder(newUserID()))
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	statuses := []string{
+		datastore.StatusPaid,
+		datastore.StatusShipmentRequested,
+		datastore.StatusShipped,
+	}
+
+	for _, status := range statuses {
+		if _, err := m.UpdateStatus(context.Background(), acmeserverless.ShipmentData{OrderNumber: ord.OrderID, Status: status}, metadata); err != nil {
+			t.Fatalf("UpdateStatus returned an error: %s", err.Error())
+		}
+	}
+
+	evt := datastore.NewOutboxEvent("OrderCancelled", []byte(`{"orderID":"`+ord.OrderID+`"}`))
+
+	_, err = m.CancelOrder(context.Background(), ord.OrderID, metadata, evt)
+	if !errors.Is(err, datastore.ErrInvalidTransition) {
+		t.Errorf("CancelOrder should return datastore.ErrInvalidTransition for a shipped order, got %v", err)
+	}
+
+	stored, err := m.GetOrder(context.Background(), ord.OrderID)
+	if err != nil {
+		t.Fatalf("GetOrder returned an error: %s", err.Error())
+	}
+
+	if statusOf(stored) != datastore.StatusShipped {
+		t.Errorf("a shipped order shouldn't be cancelled, got %+v", stored)
+	}
+}
+
+func testCancelOrderNotFound(t *testing.T, m datastore.Manager) {
+	_, err := m.CancelOrder(context.Background(), uuid.Must(uuid.NewV4()).String(), metadata)
+	if !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("CancelOrder should return datastore.ErrNotFound for an unknown order, got %v", err)
+	}
+}
+
+func testRecordEvent(t *testing.T, m datastore.Manager) {
+	eventID := datastore.EventID("Conformance", uuid.Must(uuid.NewV4()).String())
+
+	first, err := m.RecordEvent(context.Background(), eventID, time.Hour)
+	if err != nil {
+		t.Fatalf("RecordEvent returned an error: %s", err.Error())
+	}
+
+	if !first {
+		t.Errorf("RecordEvent should return true for a new event")
+	}
+
+	first, err = m.RecordEvent(context.Background(), eventID, time.Hour)
+	if !errors.Is(err, datastore.ErrInProgress) {
+		t.Errorf("RecordEvent should return datastore.ErrInProgress for an event that is in progress, got %v", err)
+	}
+
+	if first {
+		t.Errorf("RecordEvent should return false for an event that is in progress")
+	}
+
+	if err := m.CompleteEvent(context.Background(), eventID, time.Hour); err != nil {
+		t.Fatalf("CompleteEvent returned an error: %s", err.Error())
+	}
+
+	first, err = m.RecordEvent(context.Background(), eventID, time.Hour)
+	if err != nil {
+		t.Fatalf("RecordEvent returned an error: %s", err.Error())
+	}
+
+	if first {
+		t.Errorf("RecordEvent should return false for an event that was completed")
+	}
+
+	if err := m.ForgetEvent(context.Background(), eventID); err != nil {
+		t.Fatalf("ForgetEvent returned an error: %s", err.Error())
+	}
+
+	first, err = m.RecordEvent(context.Background(), eventID, time.Hour)
+	if err != nil {
+		t.Fatalf("RecordEvent returned an error: %s", err.Error())
+	}
+
+	if !first {
+		t.Errorf("RecordEvent should return true for an event that was forgotten")
+	}
+}
+
+func testRecordEventExpired(t *testing.T, m datastore.Manager) {
+	eventID := datastore.EventID("Conformance", uuid.Must(uuid.NewV4()).String())
+
+	if _, err := m.RecordEvent(context.Background(), eventID, time.Second); err != nil {
+		t.Fatalf("RecordEvent returned an error: %s", err.Error())
+	}
+
+	// Some datastores store the expiry in seconds
+	time.Sleep(1500 * time.Millisecond)
+
+	first, err := m.RecordEvent(context.Background(), eventID, time.Hour)
+	if err != nil {
+		t.Fatalf("RecordEvent returned an error: %s", err.Error())
+	}
+
+	if !first {
+		t.Errorf("RecordEvent should return true for an event that has expired")
+	}
+
+	// A completed event expires as well
+	if err := m.CompleteEvent(context.Background(), eventID, time.Second); err != nil {
+		t.Fatalf("CompleteEvent returned an error: %s", err.Error())
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	first, err = m.RecordEvent(context.Background(), eventID, time.Hour)
+	if err != nil {
+		t.Fatalf("RecordEvent returned an error: %s", err.Error())
+	}
+
+	if !first {
+		t.Errorf("RecordEvent should return true for a completed event that has expired")
+	}
+}
+
+func testConcurrentRecordEvent(t *testing.T, m datastore.Manager) {
+	eventID := datastore.EventID("Conformance", uuid.Must(uuid.NewV4()).String())
+
+	var wg sync.WaitGroup
+	results := make(chan bool, concurrentWriters)
+
+	for i := 0; i < concurrentWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			first, err := m.RecordEvent(context.Background(), eventID, time.Hour)
+			if err != nil && !errors.Is(err, datastore.ErrInProgress) {
+				t.Errorf("RecordEvent returned an error: %s", err.Error())
+				return
+			}
+
+			results <- first
+		}()
+	}
+
+	wg.Wait()
+	close(results)
+
+	count := 0
+	for first := range results {
+		if first {
+			count++
+		}
+	}
+
+	if count != 1 {
+		t.Errorf("exactly one delivery of the event should be processed, got %d", count)
+	}
+}
+
+func testOnce(t *testing.T, m datastore.Manager) {
+	eventID := datastore.EventID("Conformance", uuid.Must(uuid.NewV4()).String())
+	calls := 0
+
+	// A failed delivery is processed again
+	failure := errors.New("failed")
+	err := datastore.Once(context.Background(), m, eventID, func() error {
+		calls++
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("Once should return the error of the function, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err := datastore.Once(context.Background(), m, eventID, func() error {
+			calls++
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Once returned an error: %s", err.Error())
+		}
+	}
+
+	if calls != 2 {
+		t.Errorf("the function should be called for the failed and the first successful delivery, got %d calls", calls)
+	}
+
+	// A delivery while the event is in progress is delivered again later
+	eventID = datastore.EventID("Conformance", uuid.Must(uuid.NewV4()).String())
+	err = datastore.Once(context.Background(), m, eventID, func() error {
+		err := datastore.Once(context.Background(), m, eventID, func() error {
+			t.Errorf("the function shouldn't be called while the event is in progress")
+			return nil
+		})
+		if !errors.Is(err, datastore.ErrInProgress) {
+			t.Errorf("Once should return datastore.ErrInProgress while the event is in progress, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Once returned an error: %s", err.Error())
+	}
+}
+
+func testAddOrderKeepsOrderID(t *testing.T, m datastore.Manager) {
+	o := NewOrder(newUserID())
+	o.OrderID = uuid.Must(uuid.NewV4()).String()
+
+	ord, err := m.AddOrder(context.Background(), o)
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	if ord.OrderID != o.OrderID {
+		t.Errorf("AddOrder should keep the OrderID set by the caller, got %s", ord.OrderID)
+	}
+
+	if _, err := m.GetOrder(context.Background(), o.OrderID); err != nil {
+		t.Errorf("GetOrder returned an error: %s", err.Error())
+	}
+}
+
+func testOutbox(t *testing.T, m datastore.Manager) {
+	// The suite doesn't assume the datastore is empty, so only the events
+	// added by this test are checked
+	o := NewOrder(newUserID())
+	o.OrderID = uuid.Must(uuid.NewV4()).String()
+
+	first := datastore.NewOutboxEvent("PaymentRequested", []byte(`{"orderID":"`+o.OrderID+`"}`))
+	second := datastore.NewOutboxEvent("ShipmentRequested", []byte(`{"_id":"`+o.OrderID+`"}`))
+
+	if _, err := m.AddOrder(context.Background(), o, first, second); err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	events, err := m.OutboxEvents(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("OutboxEvents returned an error: %s", err.Error())
+	}
+
+	var found []datastore.OutboxEvent
+	for _, e := range events {
+		if e.ID == first.ID || e.ID == second.ID {
+			found = append(found, e)
+		}
+	}
+
+	if len(found) != 2 || found[0] != first || found[1] != second {
+		t.Fatalf("OutboxEvents should return the events in the order they were created, got %+v", found)
+	}
+
+	if err := m.RemoveOutboxEvent(context.Background(), first.ID); err != nil {
+		t.Fatalf("RemoveOutboxEvent returned an error: %s", err.Error())
+	}
+
+	events, err = m.OutboxEvents(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("OutboxEvents returned an error: %s", err.Error())
+	}
+
+	for _, e := range events {
+		if e.ID == first.ID {
+			t.Errorf("RemoveOutboxEvent should remove the event from the outbox")
+		}
+	}
+
+	if err := m.RemoveOutboxEvent(context.Background(), second.ID); err != nil {
+		t.Fatalf("RemoveOutboxEvent returned an error: %s", err.Error())
+	}
+}
+
+func testDeadLetters(t *testing.T, m datastore.Manager) {
+	// The suite doesn't assume the datastore is empty, so only the dead
+	// letters added by this test are checked
+	first := datastore.DeadLetter{
+		Event:    datastore.NewOutboxEvent("PaymentRequested", []byte(`{"orderID":"`+uuid.Must(uuid.NewV4()).String()+`"}`)),
+		Error:    "error sending PaymentRequested after 3 attempts",
+		FailedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	second := datastore.DeadLetter{
+		Event:    datastore.NewOutboxEvent("ShipmentRequested", []byte(`{"_id":"`+uuid.Must(uuid.NewV4()).String()+`"}`)),
+		Error:    "circuit breaker is open",
+		FailedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+
+	for _, d := range []datastore.DeadLetter{first, second} {
+		if err := m.AddDeadLetter(context.Background(), d); err != nil {
+			t.Fatalf("AddDeadLetter returned an error: %s", err.Error())
+		}
+	}
+
+	letters, err := m.DeadLetters(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("DeadLetters returned an error: %s", err.Error())
+	}
+
+	var found []datastore.DeadLetter
+	for _, d := range letters {
+		if d.Event.ID == first.Event.ID || d.Event.ID == second.Event.ID {
+			found = append(found, d)
+		}
+	}
+
+	if len(found) != 2 || found[0].Event != first.Event || found[1].Event != second.Event {
+		t.Fatalf("DeadLetters should return the dead letters in the order they were created, got %+v", found)
+	}
+	if found[0].Error != first.Error || !found[0].FailedAt.Equal(first.FailedAt) {
+		t.Errorf("DeadLetters should return the error and the moment of the failure, got %+v", found[0])
+	}
+
+	if err := m.RemoveDeadLetter(context.Background(), first.Event.ID); err != nil {
+		t.Fatalf("RemoveDeadLetter returned an error: %s", err.Error())
+	}
+
+	letters, err = m.DeadLetters(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("DeadLetters returned an error: %s", err.Error())
+	}
+
+	for _, d := range letters {
+		if d.Event.ID == first.Event.ID {
+			t.Errorf("RemoveDeadLetter should remove the dead letter")
+		}
+	}
+
+	if err := m.RemoveDeadLetter(context.Background(), second.Event.ID); err != nil {
+		t.Fatalf("RemoveDeadLetter returned an error: %s", err.Error())
+	}
+}
+
+func testCancelledContext(t *testing.T, m datastore.Manager) {
+	o, err := m.AddOrder(context.Background(), NewOrder(newUserID()))
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	// A cancelled context should stop the call before the datastore is changed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := m.AddOrder(ctx, NewOrder(newUserID())); err == nil {
+		t.Errorf("AddOrder should return an error when the context is cancelled")
+	}
+
+	if _, err := m.GetOrder(ctx, o.OrderID); err == nil {
+		t.Errorf("GetOrder should return an error when the context is cancelled")
+	}
+
+	if _, err := m.UpdateStatus(ctx, acmeserverless.ShipmentData{OrderNumber: o.OrderID, Status: datastore.StatusPaid}, acmeserverless.Metadata{}); err == nil {
+		t.Errorf("UpdateStatus should return an error when the context is cancelled")
+	}
+
+	ord, err := m.GetOrder(context.Background(), o.OrderID)
+	if err != nil {
+		t.Fatalf("GetOrder returned an error: %s", err.Error())
+	}
+
+	if statusOf(ord) != datastore.StatusPendingPayment {
+		t.Errorf("UpdateStatus with a cancelled context shouldn't change the order, got status %s", statusOf(ord))
+	}
+}
+
+func testRotateKeys(t *testing.T, m datastore.Manager) {
+	o, err := m.AddOrder(context.Background(), NewOrder(newUserID()))
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	rotate := func() int {
+		total := 0
+		p := datastore.Page{Size: 10}
+		for {
+			n, next, err := m.RotateKeys(context.Background(), p)
+			if errors.Is(err, pii.ErrNoKeys) {
+				t.Skip("RotateKeys needs encryption keys")
+			}
+			if err != nil {
+				t.Fatalf("RotateKeys returned an error: %s", err.Error())
+			}
+			total += n
+			if len(next) == 0 {
+				return total
+			}
+			p.Token = next
+		}
+	}
+
+	rotate()
+
+	// Orders are encrypted with the current key now, so there is nothing left to rotate
+	if n := rotate(); n != 0 {
+		t.Errorf("RotateKeys should skip orders that use the current key, rotated %d", n)
+	}
+
+	ord, err := m.GetOrder(context.Background(), o.OrderID)
+	if err != nil {
+		t.Fatalf("GetOrder returned an error: %s", err.Error())
+	}
+
+	if *ord.Firstname != *o.Firstname || *ord.Email != *o.Email || *ord.Address.Street != *o.Address.Street {
+		t.Errorf("RotateKeys shouldn't change the order, got %+v", ord)
+	}
+}
+
+func statusOf(o acmeserverless.Order) string {
+	if o.Status == nil {
+		return ""
+	}
+	return *o.Status
+}
+
+func ptrString(p string) *string {
+	return &p
+}
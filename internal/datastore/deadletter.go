@@ -0,0 +1,15 @@
+package datastore
+
+import "time"
+
+// DeadLetter is an event that couldn't be sent, kept so it can be replayed later.
+type DeadLetter struct {
+	// Event is the event, in the same format as the events in the outbox
+	Event OutboxEvent `json:"event"`
+
+	// Error is the reason the event couldn't be sent
+	Error string `json:"error"`
+
+	// FailedAt is the moment the event was given up
+	FailedAt time.Time `json:"failedAt"`
+}
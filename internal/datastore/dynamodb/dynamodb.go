@@ -3,16 +3,25 @@
 package dynamodb
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/gofrs/uuid"
 	acmeserverless "github.com/retgits/acme-serverless"
 	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/pii"
 )
 
 // The pointer to DynamoDB provides the API operation methods for making requests to Amazon DynamoDB.
@@ -20,14 +29,27 @@ import (
 // container stays warm.
 var dbs *dynamodb.DynamoDB
 
-// manager is an empty struct that implements the methods of the
-// Manager interface.
-type manager struct{}
+// manager implements the methods of the Manager interface. The personal data
+// of orders is encrypted with pii before it is stored, and the encrypted data
+// key is stored in the DataKey attribute of the order.
+type manager struct {
+	pii *pii.Encrypter
+}
+
+// connectOnce makes sure the connection is only created once.
+var connectOnce sync.Once
 
-// init creates the connection to dynamoDB. If the environment variable
+// init registers the datastore as dynamodb. The connection is created when
+// the datastore is first used, so binaries that select another datastore
+// never connect to DynamoDB.
+func init() {
+	datastore.Register("dynamodb", Open)
+}
+
+// connect creates the connection to dynamoDB. If the environment variable
 // DYNAMO_URL is set, the connection is made to that URL instead of
 // relying on the AWS SDK to provide the URL
-func init() {
+func connect() {
 	awsSession := session.Must(session.NewSession(&aws.Config{
 		Region: aws.String(os.Getenv("REGION")),
 	}))
@@ -39,19 +61,46 @@ func init() {
 	dbs = dynamodb.New(awsSession)
 }
 
-// New creates a new datastore manager using Amazon DynamoDB as backend
+// Open creates a new datastore manager using Amazon DynamoDB as backend. The personal
+// data of orders is encrypted with the keys set in the environment variables, see
+// pii.FromEnv.
+func Open() (datastore.Manager, error) {
+	enc, err := pii.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	connectOnce.Do(connect)
+
+	return manager{pii: enc}, nil
+}
+
+// New creates a new datastore manager using Amazon DynamoDB as backend. It stops the
+// process when the encryption keys are configured incorrectly.
 func New() datastore.Manager {
-	return manager{}
+	m, err := Open()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	return m
 }
 
-// AddOrder stores a new order in Amazon DynamoDB
-func (m manager) AddOrder(o acmeserverless.Order) (acmeserverless.Order, error) {
-	// Generate and assign a new orderID
-	o.OrderID = uuid.Must(uuid.NewV4()).String()
-	o.Status = aws.String("Pending Payment")
+// AddOrder stores a new order, and the events that need to be sent for it, in Amazon
+// DynamoDB. The order and the events are written in a single transaction.
+func (m manager) AddOrder(ctx context.Context, o acmeserverless.Order, outbox ...datastore.OutboxEvent) (acmeserverless.Order, error) {
+	// Generate and assign a new orderID, unless the caller already did
+	if len(o.OrderID) == 0 {
+		o.OrderID = uuid.Must(uuid.NewV4()).String()
+	}
+	o.Status = aws.String(datastore.StatusPendingPayment)
+
+	// Encrypt the personal data and marshal the newly updated product struct
+	stored, dataKey, err := m.pii.Encrypt(ctx, o, "")
+	if err != nil {
+		return o, fmt.Errorf("error encrypting order: %w", err)
+	}
 
-	// Marshal the newly updated product struct
-	payload, err := o.Marshal()
+	payload, err := stored.Marshal()
 	if err != nil {
 		return o, fmt.Errorf("error marshalling order: %s", err.Error())
 	}
@@ -73,24 +122,69 @@ func (m manager) AddOrder(o acmeserverless.Order) (acmeserverless.Order, error)
 	em[":payload"] = &dynamodb.AttributeValue{
 		S: aws.String(string(payload)),
 	}
+	em[":version"] = &dynamodb.AttributeValue{
+		N: aws.String("1"),
+	}
 
-	uii := &dynamodb.UpdateItemInput{
-		TableName:                 aws.String(os.Getenv("TABLE")),
-		Key:                       km,
-		ExpressionAttributeValues: em,
-		UpdateExpression:          aws.String("SET Payload = :payload, KeyID = :keyid"),
+	update := "SET Payload = :payload, KeyID = :keyid, #version = :version"
+	if len(dataKey) > 0 {
+		em[":datakey"] = &dynamodb.AttributeValue{
+			S: aws.String(dataKey),
+		}
+		update += ", DataKey = :datakey"
 	}
 
-	_, err = dbs.UpdateItem(uii)
+	items := []*dynamodb.TransactWriteItem{
+		{
+			Update: &dynamodb.Update{
+				TableName:                 aws.String(os.Getenv("TABLE")),
+				Key:                       km,
+				ExpressionAttributeNames:  map[string]*string{"#version": aws.String("Version")},
+				ExpressionAttributeValues: em,
+				UpdateExpression:          aws.String(update),
+			},
+		},
+	}
+
+	// Add the events to the outbox, in the same transaction
+	for _, e := range outbox {
+		items = append(items, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName: aws.String(os.Getenv("TABLE")),
+				Item:      outboxItem(e),
+			},
+		})
+	}
+
+	_, err = dbs.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
 	if err != nil {
-		return o, fmt.Errorf("error updating dynamodb: %s", err.Error())
+		return o, dbError("error updating dynamodb", err)
 	}
 
 	return o, nil
 }
 
-// AllOrders retrieves all orders from DynamoDB
-func (m manager) AllOrders() (acmeserverless.Orders, error) {
+// outboxItem returns the map of DynamoDB Attribute Values of an event in the outbox.
+// The events are stored with PK = OUTBOX, and the ID of the event as the sort key.
+func outboxItem(e datastore.OutboxEvent) map[string]*dynamodb.AttributeValue {
+	im := make(map[string]*dynamodb.AttributeValue)
+	im["PK"] = &dynamodb.AttributeValue{
+		S: aws.String("OUTBOX"),
+	}
+	im["SK"] = &dynamodb.AttributeValue{
+		S: aws.String(e.ID),
+	}
+	im["EventType"] = &dynamodb.AttributeValue{
+		S: aws.String(e.Type),
+	}
+	im["Event"] = &dynamodb.AttributeValue{
+		S: aws.String(e.Payload),
+	}
+	return im
+}
+
+// AllOrders retrieves a page of orders from DynamoDB
+func (m manager) AllOrders(ctx context.Context, p datastore.Page) (acmeserverless.Orders, string, error) {
 	// Create a map of DynamoDB Attribute Values containing the table keys
 	// for the access pattern PK = ORDER
 	km := make(map[string]*dynamodb.AttributeValue)
@@ -98,35 +192,20 @@ func (m manager) AllOrders() (acmeserverless.Orders, error) {
 		S: aws.String("ORDER"),
 	}
 
-	// Create the QueryInput
+	// Create the QueryInput. The history of the orders is stored in the
+	// same partition, but those items don't have a Payload.
 	qi := &dynamodb.QueryInput{
 		TableName:                 aws.String(os.Getenv("TABLE")),
 		KeyConditionExpression:    aws.String("PK = :type"),
+		FilterExpression:          aws.String("attribute_exists(Payload)"),
 		ExpressionAttributeValues: km,
 	}
 
-	qo, err := dbs.Query(qi)
-	if err != nil {
-		return nil, err
-	}
-
-	orders := make(acmeserverless.Orders, len(qo.Items))
-
-	for idx, ord := range qo.Items {
-		str := ord["OrderString"].S
-		o, err := acmeserverless.UnmarshalOrder(*str)
-		if err != nil {
-			log.Println(fmt.Sprintf("error unmarshalling order data: %s", err.Error()))
-			continue
-		}
-		orders[idx] = o
-	}
-
-	return orders, nil
+	return m.queryOrders(ctx, qi, p)
 }
 
-// UserOrders retrieves orders for a single user from DynamoDB based on the userID
-func (m manager) UserOrders(userID string) (acmeserverless.Orders, error) {
+// UserOrders retrieves a page of orders for a single user from DynamoDB based on the userID
+func (m manager) UserOrders(ctx context.Context, userID string, p datastore.Page) (acmeserverless.Orders, string, error) {
 	// Create a map of DynamoDB Attribute Values containing the table keys
 	// for the access pattern PK = USER KeyID = ID
 	km := make(map[string]*dynamodb.AttributeValue)
@@ -141,33 +220,93 @@ func (m manager) UserOrders(userID string) (acmeserverless.Orders, error) {
 	qi := &dynamodb.QueryInput{
 		TableName:                 aws.String(os.Getenv("TABLE")),
 		KeyConditionExpression:    aws.String("PK = :type"),
-		FilterExpression:          aws.String("KeyID = :username"),
+		FilterExpression:          aws.String("KeyID = :userid"),
 		ExpressionAttributeValues: km,
 	}
 
-	// Execute the DynamoDB query
-	qo, err := dbs.Query(qi)
+	return m.queryOrders(ctx, qi, p)
+}
+
+// queryOrders executes the DynamoDB query until the page is full, or until
+// there are no more items to evaluate. A single query returns at most 1 MB
+// of data, so DynamoDB is queried again, starting at the LastEvaluatedKey,
+// for as long as more orders are needed. The queries have a filter expression,
+// and DynamoDB applies Limit before the filter, so no Limit is set and the page
+// ends at the order that fills it. The continuation token for the next page is
+// returned together with the orders.
+func (m manager) queryOrders(ctx context.Context, qi *dynamodb.QueryInput, p datastore.Page) (acmeserverless.Orders, string, error) {
+	after, err := p.After()
 	if err != nil {
-		return acmeserverless.Orders{}, err
+		return nil, "", err
 	}
 
-	orders := make(acmeserverless.Orders, len(qo.Items))
+	if len(after) > 0 {
+		qi.ExclusiveStartKey = make(map[string]*dynamodb.AttributeValue)
+		qi.ExclusiveStartKey["PK"] = &dynamodb.AttributeValue{
+			S: aws.String("ORDER"),
+		}
+		qi.ExclusiveStartKey["SK"] = &dynamodb.AttributeValue{
+			S: aws.String(after),
+		}
+	}
+
+	orders := make(acmeserverless.Orders, 0)
 
-	for idx, ord := range qo.Items {
-		str := ord["Payload"].S
-		o, err := acmeserverless.UnmarshalOrder(*str)
+	for {
+		// Execute the DynamoDB query
+		qo, err := dbs.QueryWithContext(ctx, qi)
 		if err != nil {
-			log.Println(fmt.Sprintf("error unmarshalling order data: %s", err.Error()))
-			continue
+			return nil, "", dbError("error querying dynamodb", err)
+		}
+
+		for i, ord := range qo.Items {
+			str := ord["Payload"].S
+			o, err := acmeserverless.UnmarshalOrder(*str)
+			if err != nil {
+				log.Println(fmt.Sprintf("error unmarshalling order data: %s", err.Error()))
+				continue
+			}
+			o, err = m.pii.Decrypt(ctx, o, stringValue(ord["DataKey"]))
+			if err != nil {
+				// An order that can't be decrypted, like an order with a data key of a
+				// master key that was removed, doesn't fail the whole page. When the
+				// keys are unavailable, or the request is cancelled, no order can be
+				// decrypted, so the page fails
+				if errors.Is(err, datastore.ErrUnavailable) || ctx.Err() != nil {
+					return nil, "", err
+				}
+				log.Println(fmt.Sprintf("error decrypting order data: %s", err.Error()))
+				continue
+			}
+			orders = append(orders, o)
+
+			// The next page starts after the last order on this page
+			if p.Size > 0 && int64(len(orders)) >= p.Size {
+				if i == len(qo.Items)-1 && qo.LastEvaluatedKey == nil {
+					return orders, "", nil
+				}
+				return orders, datastore.NewToken(*ord["SK"].S), nil
+			}
+		}
+
+		if qo.LastEvaluatedKey == nil {
+			return orders, "", nil
 		}
-		orders[idx] = o
+
+		qi.ExclusiveStartKey = qo.LastEvaluatedKey
 	}
+}
 
-	return orders, nil
+// GetOrder retrieves a single order from DynamoDB based on the orderID
+func (m manager) GetOrder(ctx context.Context, orderID string) (acmeserverless.Order, error) {
+	ord, _, _, err := m.getOrder(ctx, orderID)
+	return ord, err
 }
 
-// UpdateStatus sets thew new OrderStatus for a specific order
-func (m manager) UpdateStatus(s acmeserverless.ShipmentData) (acmeserverless.Order, error) {
+// getOrder retrieves a single order, together with the version and the data key
+// of the stored item, from DynamoDB. Orders stored before versions were introduced
+// have version 0, and orders that aren't encrypted don't have a data key.
+func (m manager) getOrder(ctx context.Context, orderID string) (acmeserverless.Order, int64, string, error) {
 	// Create a map of DynamoDB Attribute Values containing the table keys
 	// for the access pattern PK = ORDER SK = ID
 	km := make(map[string]*dynamodb.AttributeValue)
@@ -175,7 +314,7 @@ func (m manager) UpdateStatus(s acmeserverless.ShipmentData) (acmeserverless.Ord
 		S: aws.String("ORDER"),
 	}
 	km[":id"] = &dynamodb.AttributeValue{
-		S: aws.String(s.OrderNumber),
+		S: aws.String(orderID),
 	}
 
 	// Create the QueryInput
@@ -185,43 +324,742 @@ func (m manager) UpdateStatus(s acmeserverless.ShipmentData) (acmeserverless.Ord
 		ExpressionAttributeValues: km,
 	}
 
-	qo, err := dbs.Query(qi)
+	qo, err := dbs.QueryWithContext(ctx, qi)
 	if err != nil {
-		return acmeserverless.Order{}, err
+		return acmeserverless.Order{}, 0, "", dbError("error querying dynamodb", err)
+	}
+
+	// Return an error if no order was found. History items share the partition key of
+	// the orders, so an ID like ID#HISTORY#... can match an item that isn't an order.
+	if len(qo.Items) == 0 || len(stringValue(qo.Items[0]["Payload"])) == 0 {
+		return acmeserverless.Order{}, 0, "", fmt.Errorf("%w: %s", datastore.ErrNotFound, orderID)
+	}
+
+	var version int64
+	if v, ok := qo.Items[0]["Version"]; ok && v.N != nil {
+		version, err = strconv.ParseInt(*v.N, 10, 64)
+		if err != nil {
+			return acmeserverless.Order{}, 0, "", fmt.Errorf("error parsing version: %s", err.Error())
+		}
 	}
 
 	// Create an order struct from the data
-	str := *qo.Items[0]["Payload"].S
-	ord, err := acmeserverless.UnmarshalOrder(str)
+	ord, err := acmeserverless.UnmarshalOrder(stringValue(qo.Items[0]["Payload"]))
+	if err != nil {
+		return ord, version, "", err
+	}
+
+	dataKey := stringValue(qo.Items[0]["DataKey"])
+	ord, err = m.pii.Decrypt(ctx, ord, dataKey)
+	return ord, version, dataKey, err
+}
+
+// UpdateStatus sets thew new OrderStatus for a specific order and adds the change
+// to the history of the order, and the events to the outbox, in a single transaction.
+// When the order is changed concurrently, the update is tried again with the latest
+// version of the order.
+func (m manager) UpdateStatus(ctx context.Context, s acmeserverless.ShipmentData, meta acmeserverless.Metadata, outbox ...datastore.OutboxEvent) (acmeserverless.Order, error) {
+	var ord acmeserverless.Order
+
+	err := datastore.RetryOnConflict(func() error {
+		var err error
+		ord, err = m.updateStatus(ctx, s, meta, outbox...)
+		return err
+	})
+
+	return ord, err
+}
+
+// updateStatus reads the order, and writes the new status only if the version of
+// the order hasn't changed in the meantime. The order, the new history item and the
+// events for the outbox are written in a single transaction.
+func (m manager) updateStatus(ctx context.Context, s acmeserverless.ShipmentData, meta acmeserverless.Metadata, outbox ...datastore.OutboxEvent) (acmeserverless.Order, error) {
+	ord, version, dataKey, err := m.getOrder(ctx, s.OrderNumber)
 	if err != nil {
 		return acmeserverless.Order{}, err
 	}
 
+	// Make sure the order is allowed to move to the new status
+	from := ""
+	if ord.Status != nil {
+		from = *ord.Status
+	}
+	if err := datastore.ValidateTransition(ord.OrderID, from, s.Status); err != nil {
+		return acmeserverless.Order{}, err
+	}
+
 	ord.Status = &s.Status
 
-	// Marshal the newly updated product struct
-	payload, err := ord.Marshal()
+	// Encrypt the personal data and marshal the newly updated product struct
+	stored, dataKey, err := m.pii.Encrypt(ctx, ord, dataKey)
+	if err != nil {
+		return ord, fmt.Errorf("error encrypting order: %w", err)
+	}
+
+	payload, err := stored.Marshal()
 	if err != nil {
 		return ord, fmt.Errorf("error marshalling order: %s", err.Error())
 	}
 
+	// Create a map of DynamoDB Attribute Values containing the table keys
+	key := make(map[string]*dynamodb.AttributeValue)
+	key["PK"] = &dynamodb.AttributeValue{
+		S: aws.String("ORDER"),
+	}
+	key["SK"] = &dynamodb.AttributeValue{
+		S: aws.String(ord.OrderID),
+	}
+
 	em := make(map[string]*dynamodb.AttributeValue)
 	em[":payload"] = &dynamodb.AttributeValue{
 		S: aws.String(string(payload)),
 	}
+	em[":next"] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(version+1, 10)),
+	}
+
+	update := "SET Payload = :payload, #version = :next"
+	if len(dataKey) > 0 {
+		em[":datakey"] = &dynamodb.AttributeValue{
+			S: aws.String(dataKey),
+		}
+		update += ", DataKey = :datakey"
+	}
+
+	// Only write the order when nobody else changed it since it was read
+	condition := "attribute_not_exists(#version)"
+	if version > 0 {
+		condition = "#version = :version"
+		em[":version"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(version, 10)),
+		}
+	}
+
+	entry, err := json.Marshal(datastore.NewHistoryEntry(from, s.Status, meta))
+	if err != nil {
+		return ord, fmt.Errorf("error marshalling history entry: %s", err.Error())
+	}
+
+	// Create a map of DynamoDB Attribute Values containing the history item. The
+	// version is part of the sort key, so the history is sorted oldest first.
+	hm := make(map[string]*dynamodb.AttributeValue)
+	hm["PK"] = &dynamodb.AttributeValue{
+		S: aws.String("ORDER"),
+	}
+	hm["SK"] = &dynamodb.AttributeValue{
+		S: aws.String(historyKey(ord.OrderID, version+1)),
+	}
+	hm["History"] = &dynamodb.AttributeValue{
+		S: aws.String(string(entry)),
+	}
+
+	twi := &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				Update: &dynamodb.Update{
+					TableName:                 aws.String(os.Getenv("TABLE")),
+					Key:                       key,
+					ConditionExpression:       aws.String(condition),
+					ExpressionAttributeNames:  map[string]*string{"#version": aws.String("Version")},
+					ExpressionAttributeValues: em,
+					UpdateExpression:          aws.String(update),
+				},
+			},
+			{
+				Put: &dynamodb.Put{
+					TableName:           aws.String(os.Getenv("TABLE")),
+					Item:                hm,
+					ConditionExpression: aws.String("attribute_not_exists(SK)"),
+				},
+			},
+		},
+	}
+
+	// Add the events to the outbox, in the same transaction
+	for _, e := range outbox {
+		twi.TransactItems = append(twi.TransactItems, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName: aws.String(os.Getenv("TABLE")),
+				Item:      outboxItem(e),
+			},
+		})
+	}
+
+	_, err = dbs.TransactWriteItemsWithContext(ctx, twi)
+	if err != nil {
+		return acmeserverless.Order{}, transactionError(ord.OrderID, err)
+	}
+
+	return ord, nil
+}
+
+// CancelOrder cancels an order in DynamoDB. Only orders that haven't been shipped
+// can be cancelled. The cancellation is added to the history of the order, and the
+// events are added to the outbox, in the same transaction.
+func (m manager) CancelOrder(ctx context.Context, orderID string, meta acmeserverless.Metadata, outbox ...datastore.OutboxEvent) (acmeserverless.Order, error) {
+	var ord acmeserverless.Order
+
+	err := datastore.RetryOnConflict(func() error {
+		var err error
+		ord, err = m.updateStatus(ctx, acmeserverless.ShipmentData{OrderNumber: orderID, Status: datastore.StatusCancelled}, meta, outbox...)
+		return err
+	})
+
+	return ord, err
+}
+
+// History retrieves the status changes of a single order from DynamoDB based on the orderID
+func (m manager) History(ctx context.Context, orderID string) (datastore.History, error) {
+	// Make sure the order exists, an order without any status changes has an empty history
+	if _, err := m.GetOrder(ctx, orderID); err != nil {
+		return nil, err
+	}
+
+	// Create a map of DynamoDB Attribute Values containing the table keys
+	// for the access pattern PK = ORDER SK begins with ID#HISTORY#
+	km := make(map[string]*dynamodb.AttributeValue)
+	km[":type"] = &dynamodb.AttributeValue{
+		S: aws.String("ORDER"),
+	}
+	km[":prefix"] = &dynamodb.AttributeValue{
+		S: aws.String(historyKey(orderID, -1)),
+	}
+
+	// Create the QueryInput
+	qi := &dynamodb.QueryInput{
+		TableName:                 aws.String(os.Getenv("TABLE")),
+		KeyConditionExpression:    aws.String("PK = :type AND begins_with(SK, :prefix)"),
+		ExpressionAttributeValues: km,
+	}
+
+	history := make(datastore.History, 0)
+
+	for {
+		qo, err := dbs.QueryWithContext(ctx, qi)
+		if err != nil {
+			return nil, dbError("error querying dynamodb", err)
+		}
+
+		for _, item := range qo.Items {
+			entry, err := datastore.UnmarshalHistoryEntry(*item["History"].S)
+			if err != nil {
+				log.Println(fmt.Sprintf("error unmarshalling history data: %s", err.Error()))
+				continue
+			}
+			history = append(history, entry)
+		}
+
+		if qo.LastEvaluatedKey == nil {
+			return history, nil
+		}
+
+		qi.ExclusiveStartKey = qo.LastEvaluatedKey
+	}
+}
+
+// RecordEvent records that the event is in progress by storing an item with
+// PK = EVENT and InProgress = true in DynamoDB. The ExpiresAt attribute contains the
+// moment, in seconds since the epoch, the record expires. It can be used as the TTL
+// attribute of the table, so DynamoDB removes expired records. Until then, expired
+// records are overwritten. It returns false when the event was already completed, and
+// ErrInProgress when it is still in progress. Records without InProgress were stored
+// for completed events.
+func (m manager) RecordEvent(ctx context.Context, eventID string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+
+	// Create a map of DynamoDB Attribute Values containing the event record
+	im := make(map[string]*dynamodb.AttributeValue)
+	im["PK"] = &dynamodb.AttributeValue{
+		S: aws.String("EVENT"),
+	}
+	im["SK"] = &dynamodb.AttributeValue{
+		S: aws.String(eventID),
+	}
+	im["ExpiresAt"] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(now.Add(ttl).Unix(), 10)),
+	}
+	im["InProgress"] = &dynamodb.AttributeValue{
+		BOOL: aws.Bool(true),
+	}
+
+	em := make(map[string]*dynamodb.AttributeValue)
+	em[":now"] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName:                 aws.String(os.Getenv("TABLE")),
+		Item:                      im,
+		ConditionExpression:       aws.String("attribute_not_exists(SK) OR ExpiresAt <= :now"),
+		ExpressionAttributeValues: em,
+	}
+
+	_, err := dbs.PutItemWithContext(ctx, input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return false, m.eventInProgress(ctx, eventID)
+	}
+	if err != nil {
+		return false, dbError("error updating dynamodb", err)
+	}
+
+	return true, nil
+}
+
+// eventInProgress returns ErrInProgress when the record of the event in DynamoDB
+// is in progress, and nil when the event was completed.
+func (m manager) eventInProgress(ctx context.Context, eventID string) error {
+	km := make(map[string]*dynamodb.AttributeValue)
+	km["PK"] = &dynamodb.AttributeValue{
+		S: aws.String("EVENT"),
+	}
+	km["SK"] = &dynamodb.AttributeValue{
+		S: aws.String(eventID),
+	}
+
+	gio, err := dbs.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(os.Getenv("TABLE")),
+		Key:            km,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return dbError("error reading dynamodb", err)
+	}
+
+	// The record was removed after the write failed, so the event is tried again
+	if gio.Item == nil {
+		return fmt.Errorf("%w: %s", datastore.ErrInProgress, eventID)
+	}
+
+	if v, ok := gio.Item["InProgress"]; ok && v.BOOL != nil && *v.BOOL {
+		return fmt.Errorf("%w: %s", datastore.ErrInProgress, eventID)
+	}
+
+	return nil
+}
+
+// CompleteEvent records that the event was processed, by removing InProgress from
+// the record of the event in DynamoDB and setting the moment it expires
+func (m manager) CompleteEvent(ctx context.Context, eventID string, ttl time.Duration) error {
+	km := make(map[string]*dynamodb.AttributeValue)
+	km["PK"] = &dynamodb.AttributeValue{
+		S: aws.String("EVENT"),
+	}
+	km["SK"] = &dynamodb.AttributeValue{
+		S: aws.String(eventID),
+	}
+
+	em := make(map[string]*dynamodb.AttributeValue)
+	em[":expires"] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)),
+	}
 
 	uii := &dynamodb.UpdateItemInput{
 		TableName:                 aws.String(os.Getenv("TABLE")),
 		Key:                       km,
+		UpdateExpression:          aws.String("SET ExpiresAt = :expires REMOVE InProgress"),
 		ExpressionAttributeValues: em,
-		UpdateExpression:          aws.String("SET Payload = :payload"),
-		ReturnValues:              aws.String("ALL_NEW"),
 	}
 
-	uio, err := dbs.UpdateItem(uii)
+	_, err := dbs.UpdateItemWithContext(ctx, uii)
 	if err != nil {
-		return acmeserverless.Order{}, fmt.Errorf("error updating dynamodb: %s", err.Error())
+		return dbError("error updating dynamodb", err)
 	}
 
-	return acmeserverless.UnmarshalOrder(*uio.Attributes["OrderString"].S)
+	return nil
+}
+
+// ForgetEvent removes the record of the event from DynamoDB
+func (m manager) ForgetEvent(ctx context.Context, eventID string) error {
+	// Create a map of DynamoDB Attribute Values containing the table keys
+	km := make(map[string]*dynamodb.AttributeValue)
+	km["PK"] = &dynamodb.AttributeValue{
+		S: aws.String("EVENT"),
+	}
+	km["SK"] = &dynamodb.AttributeValue{
+		S: aws.String(eventID),
+	}
+
+	dii := &dynamodb.DeleteItemInput{
+		TableName: aws.String(os.Getenv("TABLE")),
+		Key:       km,
+	}
+
+	_, err := dbs.DeleteItemWithContext(ctx, dii)
+	if err != nil {
+		return dbError("error updating dynamodb", err)
+	}
+
+	return nil
+}
+
+// OutboxEvents returns at most limit events that haven't been sent yet from DynamoDB, oldest first
+func (m manager) OutboxEvents(ctx context.Context, limit int64) ([]datastore.OutboxEvent, error) {
+	// Create a map of DynamoDB Attribute Values containing the table keys
+	// for the access pattern PK = OUTBOX
+	km := make(map[string]*dynamodb.AttributeValue)
+	km[":type"] = &dynamodb.AttributeValue{
+		S: aws.String("OUTBOX"),
+	}
+
+	// Create the QueryInput
+	qi := &dynamodb.QueryInput{
+		TableName:                 aws.String(os.Getenv("TABLE")),
+		KeyConditionExpression:    aws.String("PK = :type"),
+		ExpressionAttributeValues: km,
+	}
+
+	events := make([]datastore.OutboxEvent, 0)
+
+	for {
+		if limit > 0 {
+			qi.Limit = aws.Int64(limit - int64(len(events)))
+		}
+
+		qo, err := dbs.QueryWithContext(ctx, qi)
+		if err != nil {
+			return nil, dbError("error querying dynamodb", err)
+		}
+
+		for _, item := range qo.Items {
+			events = append(events, datastore.OutboxEvent{
+				ID:      *item["SK"].S,
+				Type:    *item["EventType"].S,
+				Payload: *item["Event"].S,
+			})
+		}
+
+		if qo.LastEvaluatedKey == nil || (limit > 0 && int64(len(events)) >= limit) {
+			return events, nil
+		}
+
+		qi.ExclusiveStartKey = qo.LastEvaluatedKey
+	}
+}
+
+// RemoveOutboxEvent removes an event that has been sent from the outbox in DynamoDB
+func (m manager) RemoveOutboxEvent(ctx context.Context, eventID string) error {
+	// Create a map of DynamoDB Attribute Values containing the table keys
+	km := make(map[string]*dynamodb.AttributeValue)
+	km["PK"] = &dynamodb.AttributeValue{
+		S: aws.String("OUTBOX"),
+	}
+	km["SK"] = &dynamodb.AttributeValue{
+		S: aws.String(eventID),
+	}
+
+	dii := &dynamodb.DeleteItemInput{
+		TableName: aws.String(os.Getenv("TABLE")),
+		Key:       km,
+	}
+
+	_, err := dbs.DeleteItemWithContext(ctx, dii)
+	if err != nil {
+		return dbError("error updating dynamodb", err)
+	}
+
+	return nil
+}
+
+// AddDeadLetter stores an event that couldn't be sent in DynamoDB. The dead letters are
+// stored with PK = DEADLETTER, and the ID of the event as the sort key.
+func (m manager) AddDeadLetter(ctx context.Context, d datastore.DeadLetter) error {
+	im := outboxItem(d.Event)
+	im["PK"] = &dynamodb.AttributeValue{
+		S: aws.String("DEADLETTER"),
+	}
+	im["Error"] = &dynamodb.AttributeValue{
+		S: aws.String(d.Error),
+	}
+	im["FailedAt"] = &dynamodb.AttributeValue{
+		S: aws.String(d.FailedAt.UTC().Format(time.RFC3339Nano)),
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(os.Getenv("TABLE")),
+		Item:      im,
+	}
+
+	_, err := dbs.PutItemWithContext(ctx, input)
+	if err != nil {
+		return dbError("error updating dynamodb", err)
+	}
+
+	return nil
+}
+
+// DeadLetters returns at most limit events that couldn't be sent from DynamoDB, oldest first
+func (m manager) DeadLetters(ctx context.Context, limit int64) ([]datastore.DeadLetter, error) {
+	// Create a map of DynamoDB Attribute Values containing the table keys
+	// for the access pattern PK = DEADLETTER
+	km := make(map[string]*dynamodb.AttributeValue)
+	km[":type"] = &dynamodb.AttributeValue{
+		S: aws.String("DEADLETTER"),
+	}
+
+	// Create the QueryInput
+	qi := &dynamodb.QueryInput{
+		TableName:                 aws.String(os.Getenv("TABLE")),
+		KeyConditionExpression:    aws.String("PK = :type"),
+		ExpressionAttributeValues: km,
+	}
+
+	letters := make([]datastore.DeadLetter, 0)
+
+	for {
+		if limit > 0 {
+			qi.Limit = aws.Int64(limit - int64(len(letters)))
+		}
+
+		qo, err := dbs.QueryWithContext(ctx, qi)
+		if err != nil {
+			return nil, dbError("error querying dynamodb", err)
+		}
+
+		for _, item := range qo.Items {
+			failedAt, _ := time.Parse(time.RFC3339Nano, stringValue(item["FailedAt"]))
+			letters = append(letters, datastore.DeadLetter{
+				Event: datastore.OutboxEvent{
+					ID:      stringValue(item["SK"]),
+					Type:    stringValue(item["EventType"]),
+					Payload: stringValue(item["Event"]),
+				},
+				Error:    stringValue(item["Error"]),
+				FailedAt: failedAt,
+			})
+		}
+
+		if qo.LastEvaluatedKey == nil || (limit > 0 && int64(len(letters)) >= limit) {
+			return letters, nil
+		}
+
+		qi.ExclusiveStartKey = qo.LastEvaluatedKey
+	}
+}
+
+// RemoveDeadLetter removes an event that has been replayed from DynamoDB
+func (m manager) RemoveDeadLetter(ctx context.Context, eventID string) error {
+	// Create a map of DynamoDB Attribute Values containing the table keys
+	km := make(map[string]*dynamodb.AttributeValue)
+	km["PK"] = &dynamodb.AttributeValue{
+		S: aws.String("DEADLETTER"),
+	}
+	km["SK"] = &dynamodb.AttributeValue{
+		S: aws.String(eventID),
+	}
+
+	dii := &dynamodb.DeleteItemInput{
+		TableName: aws.String(os.Getenv("TABLE")),
+		Key:       km,
+	}
+
+	_, err := dbs.DeleteItemWithContext(ctx, dii)
+	if err != nil {
+		return dbError("error updating dynamodb", err)
+	}
+
+	return nil
+}
+
+// RotateKeys encrypts a page of orders in DynamoDB again, with a new data key, when they
+// aren't encrypted with the current master key. Orders that are changed at the same time
+// are skipped, because the write that changed them encrypted them with the current key.
+func (m manager) RotateKeys(ctx context.Context, p datastore.Page) (int, string, error) {
+	if m.pii == nil {
+		return 0, "", fmt.Errorf("error rotating keys: %w", pii.ErrNoKeys)
+	}
+
+	after, err := p.After()
+	if err != nil {
+		return 0, "", err
+	}
+
+	// Create a map of DynamoDB Attribute Values containing the table keys
+	// for the access pattern PK = ORDER
+	km := make(map[string]*dynamodb.AttributeValue)
+	km[":type"] = &dynamodb.AttributeValue{
+		S: aws.String("ORDER"),
+	}
+
+	qi := &dynamodb.QueryInput{
+		TableName:                 aws.String(os.Getenv("TABLE")),
+		KeyConditionExpression:    aws.String("PK = :type"),
+		FilterExpression:          aws.String("attribute_exists(Payload)"),
+		ExpressionAttributeValues: km,
+	}
+	if p.Size > 0 {
+		qi.Limit = aws.Int64(p.Size)
+	}
+	if len(after) > 0 {
+		qi.ExclusiveStartKey = make(map[string]*dynamodb.AttributeValue)
+		qi.ExclusiveStartKey["PK"] = &dynamodb.AttributeValue{
+			S: aws.String("ORDER"),
+		}
+		qi.ExclusiveStartKey["SK"] = &dynamodb.AttributeValue{
+			S: aws.String(after),
+		}
+	}
+
+	qo, err := dbs.QueryWithContext(ctx, qi)
+	if err != nil {
+		return 0, "", dbError("error querying dynamodb", err)
+	}
+
+	rotated := 0
+
+	for _, item := range qo.Items {
+		if m.pii.Current(stringValue(item["DataKey"])) {
+			continue
+		}
+
+		ok, err := m.rotateKey(ctx, item)
+		if err != nil {
+			return rotated, "", err
+		}
+		if ok {
+			rotated++
+		}
+	}
+
+	token := ""
+	if qo.LastEvaluatedKey != nil {
+		token = datastore.NewToken(*qo.LastEvaluatedKey["SK"].S)
+	}
+
+	return rotated, token, nil
+}
+
+// rotateKey encrypts a single order again with a new data key, and writes it only if
+// the version of the order hasn't changed. It returns false when the order was changed
+// in the meantime.
+func (m manager) rotateKey(ctx context.Context, item map[string]*dynamodb.AttributeValue) (bool, error) {
+	ord, err := acmeserverless.UnmarshalOrder(*item["Payload"].S)
+	if err != nil {
+		return false, fmt.Errorf("error unmarshalling order data: %s", err.Error())
+	}
+
+	ord, err = m.pii.Decrypt(ctx, ord, stringValue(item["DataKey"]))
+	if err != nil {
+		return false, err
+	}
+
+	stored, dataKey, err := m.pii.Encrypt(ctx, ord, "")
+	if err != nil {
+		return false, fmt.Errorf("error encrypting order: %w", err)
+	}
+
+	payload, err := stored.Marshal()
+	if err != nil {
+		return false, fmt.Errorf("error marshalling order: %s", err.Error())
+	}
+
+	var version int64
+	if v, ok := item["Version"]; ok && v.N != nil {
+		version, err = strconv.ParseInt(*v.N, 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("error parsing version: %s", err.Error())
+		}
+	}
+
+	em := make(map[string]*dynamodb.AttributeValue)
+	em[":payload"] = &dynamodb.AttributeValue{
+		S: aws.String(string(payload)),
+	}
+	em[":datakey"] = &dynamodb.AttributeValue{
+		S: aws.String(dataKey),
+	}
+	em[":next"] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(version+1, 10)),
+	}
+
+	// Only write the order when nobody else changed it since it was read
+	condition := "attribute_not_exists(#version)"
+	if version > 0 {
+		condition = "#version = :version"
+		em[":version"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(version, 10)),
+		}
+	}
+
+	uii := &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv("TABLE")),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": item["PK"],
+			"SK": item["SK"],
+		},
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  map[string]*string{"#version": aws.String("Version")},
+		ExpressionAttributeValues: em,
+		UpdateExpression:          aws.String("SET Payload = :payload, DataKey = :datakey, #version = :next"),
+	}
+
+	_, err = dbs.UpdateItemWithContext(ctx, uii)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return false, nil
+	}
+	if err != nil {
+		return false, dbError("error updating dynamodb", err)
+	}
+
+	return true, nil
+}
+
+// historyKey returns the sort key of the history item that is written together with
+// the given version of the order. A negative version returns the prefix shared by all
+// history items of the order.
+func historyKey(orderID string, version int64) string {
+	if version < 0 {
+		return fmt.Sprintf("%s#HISTORY#", orderID)
+	}
+	return fmt.Sprintf("%s#HISTORY#%020d", orderID, version)
+}
+
+// dbError returns the error of a call to DynamoDB, prefixed with msg. Errors that can
+// go away when the call is tried again later, like throttled requests and server
+// errors, wrap datastore.ErrUnavailable.
+func dbError(msg string, err error) error {
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return fmt.Errorf("%s: %w: %s", msg, datastore.ErrUnavailable, err.Error())
+	}
+
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() >= 500 {
+		return fmt.Errorf("%s: %w: %s", msg, datastore.ErrUnavailable, err.Error())
+	}
+
+	return fmt.Errorf("%s: %s", msg, err.Error())
+}
+
+// transactionError returns the error of a transaction that updates the order. Only a
+// failed condition means the order was changed by someone else, which is returned as
+// ErrConflict so the update is tried again with the latest version. Transactions that
+// were cancelled because of throttling, the capacity of the table or another transaction
+// on the same items return ErrUnavailable, and other errors are handled by dbError.
+func transactionError(orderID string, err error) error {
+	var terr *dynamodb.TransactionCanceledException
+	if !errors.As(err, &terr) {
+		return dbError("error updating dynamodb", err)
+	}
+
+	for _, r := range terr.CancellationReasons {
+		if aws.StringValue(r.Code) == "ConditionalCheckFailed" {
+			return fmt.Errorf("%w: %s", datastore.ErrConflict, orderID)
+		}
+	}
+
+	for _, r := range terr.CancellationReasons {
+		switch aws.StringValue(r.Code) {
+		case "ThrottlingError", "ProvisionedThroughputExceeded", "TransactionConflict":
+			return fmt.Errorf("error updating dynamodb: %w: %s", datastore.ErrUnavailable, err.Error())
+		}
+	}
+
+	return dbError("error updating dynamodb", err)
+}
+
+// stringValue returns the string of the attribute, or an empty string when the
+// item doesn't have the attribute.
+func stringValue(av *dynamodb.AttributeValue) string {
+	if av == nil || av.S == nil {
+		return ""
+	}
+	return *av.S
 }
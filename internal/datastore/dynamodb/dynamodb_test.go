@@ -0,0 +1,102 @@
+package dynamodb
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/datastore/datastoretest"
+)
+
+// TestConformance runs the conformance suite against DynamoDB Local, or another
+// DynamoDB compatible server, at DYNAMO_URL. The table set in TABLE is created when
+// it doesn't exist yet.
+func TestConformance(t *testing.T) {
+	if len(os.Getenv("DYNAMO_URL")) == 0 {
+		t.Skip("DYNAMO_URL isn't set")
+	}
+
+	if len(os.Getenv("REGION")) == 0 {
+		os.Setenv("REGION", "us-east-1")
+	}
+	if len(os.Getenv("TABLE")) == 0 {
+		os.Setenv("TABLE", "order-conformance")
+	}
+
+	m, err := Open()
+	if err != nil {
+		t.Fatalf("Open returned an error: %s", err.Error())
+	}
+
+	createTable(t)
+
+	datastoretest.Run(t, func(t *testing.T) datastore.Manager {
+		return m
+	})
+}
+
+// createTable creates the table set in TABLE, with the keys the datastore uses.
+func createTable(t *testing.T) {
+	_, err := dbs.CreateTable(&dynamodb.CreateTableInput{
+		TableName: aws.String(os.Getenv("TABLE")),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("PK"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("SK"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("PK"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			{AttributeName: aws.String("SK"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeResourceInUseException {
+		return
+	}
+	if err != nil {
+		t.Fatalf("error creating table: %s", err.Error())
+	}
+}
+
+// TestTransactionError checks that only a failed condition of a cancelled transaction
+// is reported as a conflict.
+func TestTransactionError(t *testing.T) {
+	cancelled := func(codes ...string) error {
+		reasons := make([]*dynamodb.CancellationReason, 0, len(codes))
+		for _, code := range codes {
+			reasons = append(reasons, &dynamodb.CancellationReason{Code: aws.String(code)})
+		}
+		return &dynamodb.TransactionCanceledException{CancellationReasons: reasons}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "condition failed", err: cancelled("ConditionalCheckFailed", "None"), want: datastore.ErrConflict},
+		{name: "condition failed on history", err: cancelled("None", "ConditionalCheckFailed"), want: datastore.ErrConflict},
+		{name: "transaction conflict", err: cancelled("TransactionConflict", "None"), want: datastore.ErrUnavailable},
+		{name: "throttled", err: cancelled("None", "ThrottlingError"), want: datastore.ErrUnavailable},
+		{name: "capacity", err: cancelled("ProvisionedThroughputExceeded"), want: datastore.ErrUnavailable},
+		{name: "validation", err: cancelled("ValidationError", "None")},
+		{name: "other error", err: awserr.New(dynamodb.ErrCodeResourceNotFoundException, "table not found", nil)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := transactionError("1", tt.err)
+			if err == nil {
+				t.Fatal("transactionError() = nil, want an error")
+			}
+			for _, target := range []error{datastore.ErrConflict, datastore.ErrUnavailable} {
+				if got, want := errors.Is(err, target), target == tt.want; got != want {
+					t.Errorf("errors.Is(%v, %v) = %v, want %v", err, target, got, want)
+				}
+			}
+		})
+	}
+}
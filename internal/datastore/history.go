@@ -0,0 +1,59 @@
+package datastore
+
+import (
+	"encoding/json"
+	"time"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+)
+
+// HistoryEntry is a single change of the status of an order.
+type HistoryEntry struct {
+	// Timestamp is the moment the status changed
+	Timestamp time.Time `json:"timestamp"`
+
+	// OldStatus is the status of the order before the change
+	OldStatus string `json:"oldStatus"`
+
+	// NewStatus is the status of the order after the change
+	NewStatus string `json:"newStatus"`
+
+	// EventType is the type of the event that triggered the change (like CreditCardValidated)
+	EventType string `json:"eventType"`
+
+	// Source is the function the event that triggered the change came from (like ValidateCreditCard)
+	Source string `json:"source"`
+}
+
+// History is the list of status changes of an order, oldest first.
+type History []HistoryEntry
+
+// NewHistoryEntry creates the HistoryEntry for a change from oldStatus to newStatus
+// that was triggered by the event with the given metadata.
+func NewHistoryEntry(oldStatus string, newStatus string, m acmeserverless.Metadata) HistoryEntry {
+	return HistoryEntry{
+		Timestamp: time.Now().UTC(),
+		OldStatus: oldStatus,
+		NewStatus: newStatus,
+		EventType: m.Type,
+		Source:    m.Source,
+	}
+}
+
+// UnmarshalHistoryEntry parses the JSON-encoded data and stores the result
+// in a HistoryEntry.
+func UnmarshalHistoryEntry(data string) (HistoryEntry, error) {
+	var r HistoryEntry
+	err := json.Unmarshal([]byte(data), &r)
+	return r, err
+}
+
+// Marshal returns the JSON encoding of HistoryEntry.
+func (r *HistoryEntry) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// Marshal returns the JSON encoding of History.
+func (r *History) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
@@ -0,0 +1,96 @@
+package datastore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// DefaultEventTTL is how long a processed event is remembered when the
+// environment variable EVENT_TTL isn't set. It matches the default
+// retention period of an Amazon SQS queue.
+const DefaultEventTTL = 4 * 24 * time.Hour
+
+// DefaultEventLease is how long an event stays in progress when the
+// environment variable EVENT_LEASE isn't set. When the process that handles
+// the event crashes, the event can be processed again after the lease.
+const DefaultEventLease = time.Minute
+
+// ErrInProgress is returned by RecordEvent when the event is being processed
+// by someone else. It wraps ErrConflict, so the event is delivered again and
+// skipped once the other delivery is completed.
+var ErrInProgress = fmt.Errorf("%w: event is being processed", ErrConflict)
+
+// EventTTL returns how long a processed event is remembered. The value
+// is read from the environment variable EVENT_TTL (like 96h), and falls
+// back to DefaultEventTTL.
+func EventTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("EVENT_TTL"))
+	if err != nil || ttl <= 0 {
+		return DefaultEventTTL
+	}
+	return ttl
+}
+
+// EventLease returns how long an event stays in progress. The value is read
+// from the environment variable EVENT_LEASE (like 5m), and falls back to
+// DefaultEventLease. It should be longer than handling an event takes.
+func EventLease() time.Duration {
+	lease, err := time.ParseDuration(os.Getenv("EVENT_LEASE"))
+	if err != nil || lease <= 0 {
+		return DefaultEventLease
+	}
+	return lease
+}
+
+// EventID returns the identifier under which an event is recorded. The
+// consumer is part of the identifier, so different functions that receive
+// the same event each process it once.
+func EventID(consumer string, messageID string) string {
+	return fmt.Sprintf("%s#%s", consumer, messageID)
+}
+
+// HashEventID returns the identifier of an event that doesn't have a message
+// ID of its own, based on the payload of the event.
+func HashEventID(consumer string, payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return EventID(consumer, hex.EncodeToString(sum[:]))
+}
+
+// Once calls fn only if the event with the given eventID wasn't processed
+// before. The event is recorded as in progress while fn runs, and completed
+// when fn returns nil. When fn returns an error, the event is forgotten again
+// so it is processed when it is delivered again. When the process crashes
+// while fn runs, the event is processed again after EventLease. Duplicate
+// deliveries of a completed event return nil, and deliveries of an event that
+// is in progress return ErrInProgress.
+func Once(ctx context.Context, m Manager, eventID string, fn func() error) error {
+	first, err := m.RecordEvent(ctx, eventID, EventLease())
+	if err != nil {
+		return fmt.Errorf("error recording event %s: %w", eventID, err)
+	}
+
+	if !first {
+		return nil
+	}
+
+	if err := fn(); err != nil {
+		// The event needs to be forgotten, even when ctx was cancelled
+		if ferr := m.ForgetEvent(context.Background(), eventID); ferr != nil {
+			return fmt.Errorf("%w (error forgetting event %s: %s)", err, eventID, ferr.Error())
+		}
+		return err
+	}
+
+	// The event was processed, so a failure only means a duplicate delivery
+	// after the lease is processed again
+	if err := m.CompleteEvent(context.Background(), eventID, EventTTL()); err != nil {
+		log.Println(fmt.Sprintf("error completing event %s: %s", eventID, err.Error()))
+	}
+
+	return nil
+}
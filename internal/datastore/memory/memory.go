@@ -0,0 +1,455 @@
+// Package memory keeps all data in the memory of the running process. It doesn't need
+// any external service, which makes it useful for local development and tests. All data
+// is lost when the process stops. Like the other datastores, every method returns the
+// error of the context when it was cancelled.
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+)
+
+// item is a single order as it is kept in memory. Just like the other datastores,
+// the order is stored as a JSON payload so callers never share pointers with the
+// stored data.
+type item struct {
+	// KeyID is the ID of the user who placed the order
+	KeyID string
+
+	// Payload is the JSON representation of the order
+	Payload string
+
+	// Version is increased every time the order is written
+	Version int64
+
+	// History contains the status changes of the order
+	History datastore.History
+}
+
+// record is the record of an event that is in progress, or was processed.
+type record struct {
+	// InProgress is true until the event is completed
+	InProgress bool
+
+	// ExpiresAt is the moment the record expires
+	ExpiresAt time.Time
+}
+
+// manager keeps the orders in a map, keyed by OrderID, and implements the
+// methods of the Manager interface. The mutex makes it safe to use the
+// manager from multiple goroutines.
+type manager struct {
+	mu     sync.RWMutex
+	orders map[string]item
+
+	// events contains the records of the events that are in progress or processed
+	events map[string]record
+
+	// outbox contains the events that haven't been sent yet, keyed by ID
+	outbox map[string]datastore.OutboxEvent
+
+	// deadLetters contains the events that couldn't be sent, keyed by ID
+	deadLetters map[string]datastore.DeadLetter
+}
+
+// shared is the datastore that is returned when the memory datastore is
+// selected by name, so every part of the process sees the same orders.
+var (
+	sharedOnce sync.Once
+	shared     datastore.Manager
+)
+
+// init registers the datastore as memory.
+func init() {
+	datastore.Register("memory", func() (datastore.Manager, error) {
+		sharedOnce.Do(func() {
+			shared = New()
+		})
+		return shared, nil
+	})
+}
+
+// New creates a new datastore manager that keeps its data in memory. Every call to
+// New returns a new, empty, datastore.
+func New() datastore.Manager {
+	return &manager{
+		orders:      make(map[string]item),
+		events:      make(map[string]record),
+		outbox:      make(map[string]datastore.OutboxEvent),
+		deadLetters: make(map[string]datastore.DeadLetter),
+	}
+}
+
+// AddOrder stores a new order, and the events that need to be sent for it, in memory
+func (m *manager) AddOrder(ctx context.Context, o acmeserverless.Order, outbox ...datastore.OutboxEvent) (acmeserverless.Order, error) {
+	if err := ctx.Err(); err != nil {
+		return acmeserverless.Order{}, err
+	}
+
+	// Generate and assign a new orderID, unless the caller already did
+	if len(o.OrderID) == 0 {
+		o.OrderID = uuid.Must(uuid.NewV4()).String()
+	}
+	o.Status = ptrString(datastore.StatusPendingPayment)
+
+	// Marshal the newly updated order struct
+	payload, err := o.Marshal()
+	if err != nil {
+		return o, fmt.Errorf("error marshalling order: %s", err.Error())
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.orders[o.OrderID] = item{
+		KeyID:   o.UserID,
+		Payload: string(payload),
+		Version: 1,
+	}
+
+	for _, e := range outbox {
+		m.outbox[e.ID] = e
+	}
+
+	return o, nil
+}
+
+// AllOrders retrieves a page of orders from memory
+func (m *manager) AllOrders(ctx context.Context, p datastore.Page) (acmeserverless.Orders, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	return m.find(func(i item) bool { return true }, p)
+}
+
+// UserOrders retrieves a page of orders for a single user from memory based on the userID
+func (m *manager) UserOrders(ctx context.Context, userID string, p datastore.Page) (acmeserverless.Orders, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	return m.find(func(i item) bool { return i.KeyID == userID }, p)
+}
+
+// GetOrder retrieves a single order from memory based on the orderID
+func (m *manager) GetOrder(ctx context.Context, orderID string) (acmeserverless.Order, error) {
+	if err := ctx.Err(); err != nil {
+		return acmeserverless.Order{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.get(orderID)
+}
+
+// UpdateStatus sets the new OrderStatus for a specific order and adds the change
+// to the history of the order, and the events to the outbox
+func (m *manager) UpdateStatus(ctx context.Context, s acmeserverless.ShipmentData, meta acmeserverless.Metadata, outbox ...datastore.OutboxEvent) (acmeserverless.Order, error) {
+	return m.updateStatus(ctx, s, meta, outbox...)
+}
+
+// updateStatus sets the new OrderStatus for a specific order, and adds the events that
+// need to be sent for the change to the outbox. It takes the lock itself, so the order
+// and the outbox change together.
+func (m *manager) updateStatus(ctx context.Context, s acmeserverless.ShipmentData, meta acmeserverless.Metadata, outbox ...datastore.OutboxEvent) (acmeserverless.Order, error) {
+	if err := ctx.Err(); err != nil {
+		return acmeserverless.Order{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ord, err := m.get(s.OrderNumber)
+	if err != nil {
+		return acmeserverless.Order{}, err
+	}
+
+	// Make sure the order is allowed to move to the new status
+	from := ""
+	if ord.Status != nil {
+		from = *ord.Status
+	}
+	if err := datastore.ValidateTransition(ord.OrderID, from, s.Status); err != nil {
+		return acmeserverless.Order{}, err
+	}
+
+	ord.Status = &s.Status
+
+	// Marshal the newly updated order struct
+	payload, err := ord.Marshal()
+	if err != nil {
+		return ord, fmt.Errorf("error marshalling order: %s", err.Error())
+	}
+
+	// The lock is held between reading and writing the order, so the
+	// version can't change in the meantime
+	i := m.orders[ord.OrderID]
+	i.Payload = string(payload)
+	i.Version++
+	i.History = append(i.History, datastore.NewHistoryEntry(from, s.Status, meta))
+	m.orders[ord.OrderID] = i
+
+	for _, e := range outbox {
+		m.outbox[e.ID] = e
+	}
+
+	return ord, nil
+}
+
+// CancelOrder cancels an order in memory. Only orders that haven't been shipped
+// can be cancelled. The cancellation is added to the history of the order, and
+// the events are added to the outbox, together with the cancellation.
+func (m *manager) CancelOrder(ctx context.Context, orderID string, meta acmeserverless.Metadata, outbox ...datastore.OutboxEvent) (acmeserverless.Order, error) {
+	return m.updateStatus(ctx, acmeserverless.ShipmentData{OrderNumber: orderID, Status: datastore.StatusCancelled}, meta, outbox...)
+}
+
+// History retrieves the status changes of a single order from memory
+func (m *manager) History(ctx context.Context, orderID string) (datastore.History, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i, ok := m.orders[orderID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", datastore.ErrNotFound, orderID)
+	}
+
+	// Return a copy, so callers never share the stored history
+	h := make(datastore.History, len(i.History))
+	copy(h, i.History)
+
+	return h, nil
+}
+
+// RecordEvent records that the event is in progress. It returns false when the event
+// was already completed, and ErrInProgress when it is still in progress, unless the
+// record has expired.
+func (m *manager) RecordEvent(ctx context.Context, eventID string, ttl time.Duration) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	if r, ok := m.events[eventID]; ok && r.ExpiresAt.After(now) {
+		if r.InProgress {
+			return false, fmt.Errorf("%w: %s", datastore.ErrInProgress, eventID)
+		}
+		return false, nil
+	}
+
+	m.events[eventID] = record{
+		InProgress: true,
+		ExpiresAt:  now.Add(ttl),
+	}
+
+	return true, nil
+}
+
+// CompleteEvent records that the event was processed
+func (m *manager) CompleteEvent(ctx context.Context, eventID string, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.events[eventID] = record{
+		ExpiresAt: time.Now().Add(ttl),
+	}
+
+	return nil
+}
+
+// ForgetEvent removes the record of the event
+func (m *manager) ForgetEvent(ctx context.Context, eventID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.events, eventID)
+
+	return nil
+}
+
+// OutboxEvents returns at most limit events that haven't been sent yet, oldest first
+func (m *manager) OutboxEvents(ctx context.Context, limit int64) ([]datastore.OutboxEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ids := make([]string, 0, len(m.outbox))
+	for id := range m.outbox {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	if limit > 0 && int64(len(ids)) > limit {
+		ids = ids[:limit]
+	}
+
+	events := make([]datastore.OutboxEvent, len(ids))
+	for idx, id := range ids {
+		events[idx] = m.outbox[id]
+	}
+
+	return events, nil
+}
+
+// RemoveOutboxEvent removes an event that has been sent from the outbox
+func (m *manager) RemoveOutboxEvent(ctx context.Context, eventID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.outbox, eventID)
+
+	return nil
+}
+
+// AddDeadLetter stores an event that couldn't be sent
+func (m *manager) AddDeadLetter(ctx context.Context, d datastore.DeadLetter) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deadLetters[d.Event.ID] = d
+
+	return nil
+}
+
+// DeadLetters returns at most limit events that couldn't be sent, oldest first
+func (m *manager) DeadLetters(ctx context.Context, limit int64) ([]datastore.DeadLetter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ids := make([]string, 0, len(m.deadLetters))
+	for id := range m.deadLetters {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	if limit > 0 && int64(len(ids)) > limit {
+		ids = ids[:limit]
+	}
+
+	letters := make([]datastore.DeadLetter, len(ids))
+	for idx, id := range ids {
+		letters[idx] = m.deadLetters[id]
+	}
+
+	return letters, nil
+}
+
+// RemoveDeadLetter removes an event that has been replayed
+func (m *manager) RemoveDeadLetter(ctx context.Context, eventID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.deadLetters, eventID)
+
+	return nil
+}
+
+// RotateKeys does nothing, because the orders kept in memory aren't encrypted
+func (m *manager) RotateKeys(ctx context.Context, p datastore.Page) (int, string, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, "", err
+	}
+
+	if _, err := p.After(); err != nil {
+		return 0, "", err
+	}
+
+	return 0, "", nil
+}
+
+// get returns the order with the given orderID. The caller must hold
+// the lock of the manager.
+func (m *manager) get(orderID string) (acmeserverless.Order, error) {
+	i, ok := m.orders[orderID]
+	if !ok {
+		return acmeserverless.Order{}, fmt.Errorf("%w: %s", datastore.ErrNotFound, orderID)
+	}
+
+	// Create an order struct from the data
+	return acmeserverless.UnmarshalOrder(i.Payload)
+}
+
+// find returns a page of orders that match the filter. The orders are sorted
+// by OrderID, the same order in which Amazon DynamoDB returns them.
+func (m *manager) find(filter func(i item) bool, p datastore.Page) (acmeserverless.Orders, string, error) {
+	after, err := p.After()
+	if err != nil {
+		return nil, "", err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ids := make([]string, 0, len(m.orders))
+	for id, i := range m.orders {
+		if id > after && filter(i) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	token := ""
+	if p.Size > 0 && int64(len(ids)) > p.Size {
+		ids = ids[:p.Size]
+		token = datastore.NewToken(ids[len(ids)-1])
+	}
+
+	orders := make(acmeserverless.Orders, len(ids))
+
+	for idx, id := range ids {
+		o, err := acmeserverless.UnmarshalOrder(m.orders[id].Payload)
+		if err != nil {
+			return nil, "", fmt.Errorf("error unmarshalling order data: %s", err.Error())
+		}
+		orders[idx] = o
+	}
+
+	return orders, token, nil
+}
+
+func ptrString(p string) *string {
+	return &p
+}
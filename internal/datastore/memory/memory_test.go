@@ -0,0 +1,14 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/datastore/datastoretest"
+)
+
+func TestConformance(t *testing.T) {
+	datastoretest.Run(t, func(t *testing.T) datastore.Manager {
+		return New()
+	})
+}
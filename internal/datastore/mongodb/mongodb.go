@@ -4,15 +4,19 @@ package mongodb
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gofrs/uuid"
 	acmeserverless "github.com/retgits/acme-serverless"
 	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/pii"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -23,145 +27,806 @@ import (
 // container stays warm.
 var dbs *mongo.Collection
 
-// manager is an empty struct that implements the methods of the
-// Manager interface.
-type manager struct{}
+// manager implements the methods of the Manager interface. The personal data
+// of orders is encrypted with pii before it is stored, and the encrypted data
+// key is stored in the DataKey field of the order.
+type manager struct {
+	pii *pii.Encrypter
+}
+
+// connectOnce makes sure the connection is only created once, and connectErr
+// is the error of that attempt.
+var (
+	connectOnce sync.Once
+	connectErr  error
+)
 
-// init creates the connection to MongoDB.
+// init registers the datastore as mongodb. The connection is created when
+// the datastore is first used, so binaries that select another datastore
+// never connect to MongoDB.
 func init() {
-	username := os.Getenv("MONGO_USERNAME")
-	password := os.Getenv("MONGO_PASSWORD")
-	hostname := os.Getenv("MONGO_HOSTNAME")
-	port := os.Getenv("MONGO_PORT")
+	datastore.Register("mongodb", Open)
+}
 
-	connString := fmt.Sprintf("mongodb+srv://%s:%s@%s:%s", username, password, hostname, port)
-	if strings.HasSuffix(connString, ":") {
-		connString = connString[:len(connString)-1]
+// connect creates the connection to MongoDB. If the environment variable
+// MONGO_URL is set, the connection is made to that URL instead of building
+// a connection string from the separate MONGO_ variables. That makes it
+// possible to connect to a local MongoDB server. The indexes the datastore needs
+// are created when they don't exist yet.
+func connect() error {
+	connString := os.Getenv("MONGO_URL")
+	if len(connString) == 0 {
+		username := os.Getenv("MONGO_USERNAME")
+		password := os.Getenv("MONGO_PASSWORD")
+		hostname := os.Getenv("MONGO_HOSTNAME")
+		port := os.Getenv("MONGO_PORT")
+
+		connString = fmt.Sprintf("mongodb+srv://%s:%s@%s:%s", username, password, hostname, port)
+		if strings.HasSuffix(connString, ":") {
+			connString = connString[:len(connString)-1]
+		}
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
 	client, err := mongo.Connect(ctx, options.Client().ApplyURI(connString))
 	if err != nil {
-		log.Fatalf("error connecting to MongoDB: %s", err.Error())
+		return fmt.Errorf("error connecting to MongoDB: %s", err.Error())
 	}
 	dbs = client.Database("acmeserverless").Collection("order")
+
+	return createIndexes(ctx)
+}
+
+// createIndexes creates a unique index on PK and SK, so an event can only be recorded
+// once by RecordEvent, and a TTL index on ExpiresAt, so MongoDB removes the records of
+// events that have expired. Creating an index that already exists does nothing.
+func createIndexes(ctx context.Context) error {
+	_, err := dbs.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{"PK", 1}, {"SK", 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{"ExpiresAt", 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating MongoDB indexes: %s", err.Error())
+	}
+
+	return nil
 }
 
-// New creates a new datastore manager using Amazon DynamoDB as backend
+// Open creates a new datastore manager using MongoDB as backend, and connects
+// to MongoDB when that didn't happen yet. The personal data of orders is encrypted
+// with the keys set in the environment variables, see pii.FromEnv.
+func Open() (datastore.Manager, error) {
+	enc, err := pii.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	connectOnce.Do(func() {
+		connectErr = connect()
+	})
+	if connectErr != nil {
+		return nil, connectErr
+	}
+
+	return manager{pii: enc}, nil
+}
+
+// New creates a new datastore manager using MongoDB as backend. It stops the
+// process when it can't connect to MongoDB, or when the encryption keys are
+// configured incorrectly.
 func New() datastore.Manager {
-	return manager{}
+	m, err := Open()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	return m
 }
 
 func ptrString(p string) *string {
 	return &p
 }
 
-// AddOrder stores a new order in Amazon DynamoDB
-func (m manager) AddOrder(o acmeserverless.Order) (acmeserverless.Order, error) {
-	// Generate and assign a new orderID
-	o.OrderID = uuid.Must(uuid.NewV4()).String()
-	o.Status = ptrString("Pending Payment")
+// AddOrder stores a new order, and the events that need to be sent for it, in MongoDB.
+// When there are events, the order and the events are written in a multi-document
+// transaction. Transactions need a MongoDB replica set or sharded cluster.
+func (m manager) AddOrder(ctx context.Context, o acmeserverless.Order, outbox ...datastore.OutboxEvent) (acmeserverless.Order, error) {
+	// Generate and assign a new orderID, unless the caller already did
+	if len(o.OrderID) == 0 {
+		o.OrderID = uuid.Must(uuid.NewV4()).String()
+	}
+	o.Status = ptrString(datastore.StatusPendingPayment)
 
-	// Marshal the newly updated product struct
-	payload, err := o.Marshal()
+	// Encrypt the personal data and marshal the newly updated product struct
+	stored, dataKey, err := m.pii.Encrypt(ctx, o, "")
+	if err != nil {
+		return o, fmt.Errorf("error encrypting order: %w", err)
+	}
+
+	payload, err := stored.Marshal()
 	if err != nil {
 		return o, fmt.Errorf("error marshalling order: %s", err.Error())
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	_, err = dbs.InsertOne(ctx, bson.D{{"SK", o.OrderID}, {"KeyID", o.UserID}, {"PK", "ORDER"}, {"Payload", string(payload)}})
+	doc := bson.D{{"SK", o.OrderID}, {"KeyID", o.UserID}, {"PK", "ORDER"}, {"Payload", string(payload)}, {"Version", int64(1)}}
+	if len(dataKey) > 0 {
+		doc = append(doc, bson.E{"DataKey", dataKey})
+	}
 
-	return o, nil
-}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
 
-// AllOrders retrieves all orders from DynamoDB
-func (m manager) AllOrders() (acmeserverless.Orders, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	cursor, err := dbs.Find(ctx, bson.D{})
-	if err != nil {
-		log.Fatal(err)
+	if len(outbox) == 0 {
+		_, err = dbs.InsertOne(ctx, doc)
+		if err != nil {
+			return o, dbError("error inserting order", err)
+		}
+		return o, nil
 	}
 
-	var results []bson.M
-
-	if err = cursor.All(ctx, &results); err != nil {
-		log.Fatal(err)
+	session, err := dbs.Database().Client().StartSession()
+	if err != nil {
+		return o, dbError("error starting session", err)
 	}
+	defer session.EndSession(ctx)
 
-	orders := make(acmeserverless.Orders, len(results))
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		if _, err := dbs.InsertOne(sessCtx, doc); err != nil {
+			return nil, err
+		}
 
-	for idx, ord := range results {
-		o, err := acmeserverless.UnmarshalOrder(ord["Payload"].(string))
-		if err != nil {
-			log.Println(fmt.Sprintf("error unmarshalling order data: %s", err.Error()))
-			continue
+		// Add the events to the outbox, in the same transaction
+		for _, e := range outbox {
+			if _, err := dbs.InsertOne(sessCtx, outboxDocument(e)); err != nil {
+				return nil, err
+			}
 		}
-		orders[idx] = o
+
+		return nil, nil
+	})
+	if err != nil {
+		return o, dbError("error inserting order", err)
 	}
 
-	return orders, nil
+	return o, nil
+}
+
+// AllOrders retrieves a page of orders from MongoDB
+func (m manager) AllOrders(ctx context.Context, p datastore.Page) (acmeserverless.Orders, string, error) {
+	return m.findOrders(ctx, bson.D{{"PK", "ORDER"}}, p)
 }
 
-// UserOrders retrieves orders for a single user from DynamoDB based on the userID
-func (m manager) UserOrders(userID string) (acmeserverless.Orders, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	cursor, err := dbs.Find(ctx, bson.D{{"KeyID", userID}})
+// UserOrders retrieves a page of orders for a single user from MongoDB based on the userID
+func (m manager) UserOrders(ctx context.Context, userID string, p datastore.Page) (acmeserverless.Orders, string, error) {
+	return m.findOrders(ctx, bson.D{{"PK", "ORDER"}, {"KeyID", userID}}, p)
+}
+
+// findOrders retrieves the orders matching the filter, sorted by OrderID. Instead
+// of loading the whole collection, only the orders after the continuation token
+// are read. One order more than the size of the page is requested, to know whether
+// a next page exists.
+func (m manager) findOrders(ctx context.Context, filter bson.D, p datastore.Page) (acmeserverless.Orders, string, error) {
+	after, err := p.After()
 	if err != nil {
-		log.Fatal(err)
+		return nil, "", err
+	}
+
+	if len(after) > 0 {
+		filter = append(filter, bson.E{"SK", bson.D{{"$gt", after}}})
+	}
+
+	opts := options.Find().SetSort(bson.D{{"SK", 1}})
+	if p.Size > 0 {
+		opts.SetLimit(p.Size + 1)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	cursor, err := dbs.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, "", dbError("error querying orders", err)
 	}
 
 	var results []bson.M
 
 	if err = cursor.All(ctx, &results); err != nil {
-		log.Fatal(err)
+		return nil, "", dbError("error reading orders", err)
+	}
+
+	token := ""
+	if p.Size > 0 && int64(len(results)) > p.Size {
+		results = results[:p.Size]
+		token = datastore.NewToken(results[len(results)-1]["SK"].(string))
 	}
 
-	orders := make(acmeserverless.Orders, len(results))
+	orders := make(acmeserverless.Orders, 0, len(results))
 
-	for idx, ord := range results {
+	for _, ord := range results {
 		o, err := acmeserverless.UnmarshalOrder(ord["Payload"].(string))
 		if err != nil {
 			log.Println(fmt.Sprintf("error unmarshalling order data: %s", err.Error()))
 			continue
 		}
-		orders[idx] = o
+		dataKey, _ := ord["DataKey"].(string)
+		o, err = m.pii.Decrypt(ctx, o, dataKey)
+		if err != nil {
+			// An order that can't be decrypted, like an order with a data key of a
+			// master key that was removed, doesn't fail the whole page. When the
+			// keys are unavailable, or the request is cancelled, no order can be
+			// decrypted, so the page fails
+			if errors.Is(err, datastore.ErrUnavailable) || ctx.Err() != nil {
+				return nil, "", err
+			}
+			log.Println(fmt.Sprintf("error decrypting order data: %s", err.Error()))
+			continue
+		}
+		orders = append(orders, o)
 	}
 
-	return orders, nil
+	return orders, token, nil
 }
 
-// UpdateStatus sets thew new OrderStatus for a specific order
-func (m manager) UpdateStatus(s acmeserverless.ShipmentData) (acmeserverless.Order, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+// GetOrder retrieves a single order from MongoDB based on the orderID
+func (m manager) GetOrder(ctx context.Context, orderID string) (acmeserverless.Order, error) {
+	ord, _, _, err := m.getOrder(ctx, orderID)
+	return ord, err
+}
+
+// getOrder retrieves a single order, together with the version and the data key
+// of the stored document, from MongoDB. Orders stored before versions were introduced
+// have version 0, and orders that aren't encrypted don't have a data key.
+func (m manager) getOrder(ctx context.Context, orderID string) (acmeserverless.Order, int64, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
 
-	res := dbs.FindOne(ctx, bson.D{{"SK", s.OrderNumber}})
+	res := dbs.FindOne(ctx, bson.D{{"PK", "ORDER"}, {"SK", orderID}})
 
 	raw, err := res.DecodeBytes()
+	if err == mongo.ErrNoDocuments {
+		return acmeserverless.Order{}, 0, "", fmt.Errorf("%w: %s", datastore.ErrNotFound, orderID)
+	}
 	if err != nil {
-		return acmeserverless.Order{}, fmt.Errorf("unable to decode bytes: %s", err.Error())
+		return acmeserverless.Order{}, 0, "", dbError("unable to decode bytes", err)
 	}
 
 	payload := raw.Lookup("Payload").StringValue()
 
 	// Return an error if no order was found
 	if len(payload) < 5 {
-		return acmeserverless.Order{}, fmt.Errorf("no order found with id %s", s.OrderNumber)
+		return acmeserverless.Order{}, 0, "", fmt.Errorf("%w: %s", datastore.ErrNotFound, orderID)
 	}
 
+	version, _ := raw.Lookup("Version").Int64OK()
+	dataKey, _ := raw.Lookup("DataKey").StringValueOK()
+
 	// Create an order struct from the data
 	ord, err := acmeserverless.UnmarshalOrder(payload)
 	if err != nil {
+		return ord, version, "", err
+	}
+
+	ord, err = m.pii.Decrypt(ctx, ord, dataKey)
+	return ord, version, dataKey, err
+}
+
+// UpdateStatus sets thew new OrderStatus for a specific order and adds the change
+// to the history of the order, and the events to the outbox, in a single transaction.
+// When the order is changed concurrently, the update is tried again with the latest
+// version of the order.
+func (m manager) UpdateStatus(ctx context.Context, s acmeserverless.ShipmentData, meta acmeserverless.Metadata, outbox ...datastore.OutboxEvent) (acmeserverless.Order, error) {
+	var ord acmeserverless.Order
+
+	err := datastore.RetryOnConflict(func() error {
+		var err error
+		ord, err = m.updateStatus(ctx, s, meta, outbox...)
+		return err
+	})
+
+	return ord, err
+}
+
+// updateStatus reads the order, and writes the new status only if the version of
+// the order hasn't changed in the meantime. The change is added to the History
+// array of the same document, so both are written at once. The events for the
+// outbox are written in the same transaction as the order.
+func (m manager) updateStatus(ctx context.Context, s acmeserverless.ShipmentData, meta acmeserverless.Metadata, outbox ...datastore.OutboxEvent) (acmeserverless.Order, error) {
+	ord, version, dataKey, err := m.getOrder(ctx, s.OrderNumber)
+	if err != nil {
+		return acmeserverless.Order{}, err
+	}
+
+	// Make sure the order is allowed to move to the new status
+	from := ""
+	if ord.Status != nil {
+		from = *ord.Status
+	}
+	if err := datastore.ValidateTransition(ord.OrderID, from, s.Status); err != nil {
 		return acmeserverless.Order{}, err
 	}
 
 	ord.Status = &s.Status
 
-	// Marshal the newly updated product struct
-	newOrder, err := ord.Marshal()
+	// Encrypt the personal data and marshal the newly updated product struct
+	stored, dataKey, err := m.pii.Encrypt(ctx, ord, dataKey)
+	if err != nil {
+		return ord, fmt.Errorf("error encrypting order: %w", err)
+	}
+
+	newOrder, err := stored.Marshal()
 	if err != nil {
 		return ord, fmt.Errorf("error marshalling order: %s", err.Error())
 	}
 
-	_, err = dbs.UpdateOne(ctx, bson.D{{"SK", ord.OrderID}}, bson.D{{"$set", bson.D{{"Payload", string(newOrder)}}}})
+	entry, err := json.Marshal(datastore.NewHistoryEntry(from, s.Status, meta))
+	if err != nil {
+		return ord, fmt.Errorf("error marshalling history entry: %s", err.Error())
+	}
+
+	// Only write the order when nobody else changed it since it was read
+	filter := bson.D{{"PK", "ORDER"}, {"SK", ord.OrderID}, {"Version", version}}
+	if version == 0 {
+		filter = bson.D{{"PK", "ORDER"}, {"SK", ord.OrderID}, {"Version", bson.D{{"$exists", false}}}}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	set := bson.D{{"Payload", string(newOrder)}, {"Version", version + 1}}
+	if len(dataKey) > 0 {
+		set = append(set, bson.E{"DataKey", dataKey})
+	}
+
+	update := bson.D{
+		{"$set", set},
+		{"$push", bson.D{{"History", string(entry)}}},
+	}
+
+	if len(outbox) == 0 {
+		res, err := dbs.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return acmeserverless.Order{}, dbError("error updating order", err)
+		}
+
+		if res.MatchedCount == 0 {
+			return acmeserverless.Order{}, fmt.Errorf("%w: %s", datastore.ErrConflict, ord.OrderID)
+		}
+
+		return ord, nil
+	}
+
+	session, err := dbs.Database().Client().StartSession()
+	if err != nil {
+		return acmeserverless.Order{}, dbError("error starting session", err)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		res, err := dbs.UpdateOne(sessCtx, filter, update)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.MatchedCount == 0 {
+			return nil, fmt.Errorf("%w: %s", datastore.ErrConflict, ord.OrderID)
+		}
+
+		// Add the events to the outbox, in the same transaction
+		for _, e := range outbox {
+			if _, err := dbs.InsertOne(sessCtx, outboxDocument(e)); err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, nil
+	})
+	if errors.Is(err, datastore.ErrConflict) {
+		return acmeserverless.Order{}, err
+	}
+	if err != nil {
+		return acmeserverless.Order{}, dbError("error updating order", err)
+	}
+
+	return ord, nil
+}
+
+// CancelOrder cancels an order in MongoDB. Only orders that haven't been shipped
+// can be cancelled. The cancellation is added to the history of the order, and the
+// events are added to the outbox, in the same transaction.
+func (m manager) CancelOrder(ctx context.Context, orderID string, meta acmeserverless.Metadata, outbox ...datastore.OutboxEvent) (acmeserverless.Order, error) {
+	var ord acmeserverless.Order
+
+	err := datastore.RetryOnConflict(func() error {
+		var err error
+		ord, err = m.updateStatus(ctx, acmeserverless.ShipmentData{OrderNumber: orderID, Status: datastore.StatusCancelled}, meta, outbox...)
+		return err
+	})
 
 	return ord, err
 }
+
+// outboxDocument returns the document of an event in the outbox. The events are
+// stored with PK = OUTBOX, and the ID of the event as the sort key.
+func outboxDocument(e datastore.OutboxEvent) bson.D {
+	return bson.D{{"SK", e.ID}, {"PK", "OUTBOX"}, {"EventType", e.Type}, {"Event", e.Payload}}
+}
+
+// History retrieves the status changes of a single order from MongoDB based on the orderID
+func (m manager) History(ctx context.Context, orderID string) (datastore.History, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	res := dbs.FindOne(ctx, bson.D{{"PK", "ORDER"}, {"SK", orderID}})
+
+	raw, err := res.DecodeBytes()
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("%w: %s", datastore.ErrNotFound, orderID)
+	}
+	if err != nil {
+		return nil, dbError("unable to decode bytes", err)
+	}
+
+	history := make(datastore.History, 0)
+
+	// An order without any status changes doesn't have a History array
+	val, err := raw.LookupErr("History")
+	if err != nil {
+		return history, nil
+	}
+
+	var entries []string
+	if err := val.Unmarshal(&entries); err != nil {
+		return nil, fmt.Errorf("error unmarshalling history data: %s", err.Error())
+	}
+
+	for _, e := range entries {
+		entry, err := datastore.UnmarshalHistoryEntry(e)
+		if err != nil {
+			log.Println(fmt.Sprintf("error unmarshalling history data: %s", err.Error()))
+			continue
+		}
+		history = append(history, entry)
+	}
+
+	return history, nil
+}
+
+// RecordEvent records that the event is in progress by storing a document with
+// PK = EVENT and InProgress = true in MongoDB. The ExpiresAt field contains the moment
+// the record expires. A TTL index on that field lets MongoDB remove expired records.
+// Until then, expired records are overwritten. It returns false when the event was
+// already completed, and ErrInProgress when it is still in progress. Records without
+// InProgress were stored for completed events.
+func (m manager) RecordEvent(ctx context.Context, eventID string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	expires := now.Add(ttl)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// Insert the record, unless a record for the event exists
+	res, err := dbs.UpdateOne(ctx,
+		bson.D{{"PK", "EVENT"}, {"SK", eventID}},
+		bson.D{{"$setOnInsert", bson.D{{"ExpiresAt", expires}, {"InProgress", true}}}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return false, dbError("error recording event", err)
+	}
+
+	if res.UpsertedCount == 1 {
+		return true, nil
+	}
+
+	// Take over the record if it has expired
+	res, err = dbs.UpdateOne(ctx,
+		bson.D{{"PK", "EVENT"}, {"SK", eventID}, {"ExpiresAt", bson.D{{"$lte", now}}}},
+		bson.D{{"$set", bson.D{{"ExpiresAt", expires}, {"InProgress", true}}}},
+	)
+	if err != nil {
+		return false, dbError("error recording event", err)
+	}
+
+	if res.MatchedCount == 1 {
+		return true, nil
+	}
+
+	var rec struct {
+		InProgress bool `bson:"InProgress"`
+	}
+
+	err = dbs.FindOne(ctx, bson.D{{"PK", "EVENT"}, {"SK", eventID}}).Decode(&rec)
+	if err == mongo.ErrNoDocuments {
+		// The record was removed in the meantime, so the event is tried again
+		return false, fmt.Errorf("%w: %s", datastore.ErrInProgress, eventID)
+	}
+	if err != nil {
+		return false, dbError("error reading event", err)
+	}
+
+	if rec.InProgress {
+		return false, fmt.Errorf("%w: %s", datastore.ErrInProgress, eventID)
+	}
+
+	return false, nil
+}
+
+// CompleteEvent records that the event was processed, by removing InProgress from
+// the record of the event in MongoDB and setting the moment it expires
+func (m manager) CompleteEvent(ctx context.Context, eventID string, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, err := dbs.UpdateOne(ctx,
+		bson.D{{"PK", "EVENT"}, {"SK", eventID}},
+		bson.D{{"$set", bson.D{{"ExpiresAt", time.Now().Add(ttl)}}}, {"$unset", bson.D{{"InProgress", ""}}}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return dbError("error completing event", err)
+	}
+
+	return nil
+}
+
+// ForgetEvent removes the record of the event from MongoDB
+func (m manager) ForgetEvent(ctx context.Context, eventID string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, err := dbs.DeleteOne(ctx, bson.D{{"PK", "EVENT"}, {"SK", eventID}})
+	if err != nil {
+		return dbError("error forgetting event", err)
+	}
+
+	return nil
+}
+
+// OutboxEvents returns at most limit events that haven't been sent yet from MongoDB, oldest first
+func (m manager) OutboxEvents(ctx context.Context, limit int64) ([]datastore.OutboxEvent, error) {
+	opts := options.Find().SetSort(bson.D{{"SK", 1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	cursor, err := dbs.Find(ctx, bson.D{{"PK", "OUTBOX"}}, opts)
+	if err != nil {
+		return nil, dbError("error querying outbox", err)
+	}
+
+	var results []bson.M
+
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, dbError("error reading outbox", err)
+	}
+
+	events := make([]datastore.OutboxEvent, 0, len(results))
+
+	for _, e := range results {
+		events = append(events, datastore.OutboxEvent{
+			ID:      e["SK"].(string),
+			Type:    e["EventType"].(string),
+			Payload: e["Event"].(string),
+		})
+	}
+
+	return events, nil
+}
+
+// RemoveOutboxEvent removes an event that has been sent from the outbox in MongoDB
+func (m manager) RemoveOutboxEvent(ctx context.Context, eventID string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, err := dbs.DeleteOne(ctx, bson.D{{"PK", "OUTBOX"}, {"SK", eventID}})
+	if err != nil {
+		return dbError("error removing outbox event", err)
+	}
+
+	return nil
+}
+
+// AddDeadLetter stores an event that couldn't be sent in MongoDB. The dead letters are
+// stored with PK = DEADLETTER, and the ID of the event as the sort key.
+func (m manager) AddDeadLetter(ctx context.Context, d datastore.DeadLetter) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, err := dbs.InsertOne(ctx, bson.D{{"SK", d.Event.ID}, {"PK", "DEADLETTER"}, {"EventType", d.Event.Type}, {"Event", d.Event.Payload}, {"Error", d.Error}, {"FailedAt", d.FailedAt.UTC()}})
+	if err != nil {
+		return dbError("error inserting dead letter", err)
+	}
+
+	return nil
+}
+
+// DeadLetters returns at most limit events that couldn't be sent from MongoDB, oldest first
+func (m manager) DeadLetters(ctx context.Context, limit int64) ([]datastore.DeadLetter, error) {
+	opts := options.Find().SetSort(bson.D{{"SK", 1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	cursor, err := dbs.Find(ctx, bson.D{{"PK", "DEADLETTER"}}, opts)
+	if err != nil {
+		return nil, dbError("error querying dead letters", err)
+	}
+
+	var results []struct {
+		SK        string    `bson:"SK"`
+		EventType string    `bson:"EventType"`
+		Event     string    `bson:"Event"`
+		Error     string    `bson:"Error"`
+		FailedAt  time.Time `bson:"FailedAt"`
+	}
+
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, dbError("error reading dead letters", err)
+	}
+
+	letters := make([]datastore.DeadLetter, 0, len(results))
+
+	for _, d := range results {
+		letters = append(letters, datastore.DeadLetter{
+			Event: datastore.OutboxEvent{
+				ID:      d.SK,
+				Type:    d.EventType,
+				Payload: d.Event,
+			},
+			Error:    d.Error,
+			FailedAt: d.FailedAt,
+		})
+	}
+
+	return letters, nil
+}
+
+// RemoveDeadLetter removes an event that has been replayed from MongoDB
+func (m manager) RemoveDeadLetter(ctx context.Context, eventID string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, err := dbs.DeleteOne(ctx, bson.D{{"PK", "DEADLETTER"}, {"SK", eventID}})
+	if err != nil {
+		return dbError("error removing dead letter", err)
+	}
+
+	return nil
+}
+
+// RotateKeys encrypts a page of orders in MongoDB again, with a new data key, when they
+// aren't encrypted with the current master key. Orders that are changed at the same time
+// are skipped, because the write that changed them encrypted them with the current key.
+func (m manager) RotateKeys(ctx context.Context, p datastore.Page) (int, string, error) {
+	if m.pii == nil {
+		return 0, "", fmt.Errorf("error rotating keys: %w", pii.ErrNoKeys)
+	}
+
+	after, err := p.After()
+	if err != nil {
+		return 0, "", err
+	}
+
+	filter := bson.D{{"PK", "ORDER"}}
+	if len(after) > 0 {
+		filter = append(filter, bson.E{"SK", bson.D{{"$gt", after}}})
+	}
+
+	opts := options.Find().SetSort(bson.D{{"SK", 1}})
+	if p.Size > 0 {
+		opts.SetLimit(p.Size + 1)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	cursor, err := dbs.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, "", dbError("error querying orders", err)
+	}
+
+	var results []bson.M
+
+	if err = cursor.All(ctx, &results); err != nil {
+		return 0, "", dbError("error reading orders", err)
+	}
+
+	token := ""
+	if p.Size > 0 && int64(len(results)) > p.Size {
+		results = results[:p.Size]
+		token = datastore.NewToken(results[len(results)-1]["SK"].(string))
+	}
+
+	rotated := 0
+
+	for _, doc := range results {
+		dataKey, _ := doc["DataKey"].(string)
+		if m.pii.Current(dataKey) {
+			continue
+		}
+
+		ok, err := m.rotateKey(ctx, doc)
+		if err != nil {
+			return rotated, "", err
+		}
+		if ok {
+			rotated++
+		}
+	}
+
+	return rotated, token, nil
+}
+
+// rotateKey encrypts a single order again with a new data key, and writes it only if
+// the version of the order hasn't changed. It returns false when the order was changed
+// in the meantime.
+func (m manager) rotateKey(ctx context.Context, doc bson.M) (bool, error) {
+	payload, _ := doc["Payload"].(string)
+	dataKey, _ := doc["DataKey"].(string)
+	orderID, _ := doc["SK"].(string)
+
+	ord, err := acmeserverless.UnmarshalOrder(payload)
+	if err != nil {
+		return false, fmt.Errorf("error unmarshalling order data: %s", err.Error())
+	}
+
+	ord, err = m.pii.Decrypt(ctx, ord, dataKey)
+	if err != nil {
+		return false, err
+	}
+
+	stored, dataKey, err := m.pii.Encrypt(ctx, ord, "")
+	if err != nil {
+		return false, fmt.Errorf("error encrypting order: %w", err)
+	}
+
+	newOrder, err := stored.Marshal()
+	if err != nil {
+		return false, fmt.Errorf("error marshalling order: %s", err.Error())
+	}
+
+	// Only write the order when nobody else changed it since it was read
+	version, _ := doc["Version"].(int64)
+	filter := bson.D{{"PK", "ORDER"}, {"SK", orderID}, {"Version", version}}
+	if version == 0 {
+		filter = bson.D{{"PK", "ORDER"}, {"SK", orderID}, {"Version", bson.D{{"$exists", false}}}}
+	}
+
+	res, err := dbs.UpdateOne(ctx, filter, bson.D{
+		{"$set", bson.D{{"Payload", string(newOrder)}, {"DataKey", dataKey}, {"Version", version + 1}}},
+	})
+	if err != nil {
+		return false, dbError("error updating order", err)
+	}
+
+	return res.MatchedCount == 1, nil
+}
+
+// dbError returns the error of a call to MongoDB, prefixed with msg. Errors that can
+// go away when the call is tried again later, like network errors and calls that
+// timed out, wrap datastore.ErrUnavailable.
+func dbError(msg string, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%s: %w: %s", msg, datastore.ErrUnavailable, err.Error())
+	}
+
+	var cerr mongo.CommandError
+	if errors.As(err, &cerr) && (cerr.HasErrorLabel("NetworkError") || cerr.HasErrorLabel("TransientTransactionError")) {
+		return fmt.Errorf("%s: %w: %s", msg, datastore.ErrUnavailable, err.Error())
+	}
+
+	return fmt.Errorf("%s: %s", msg, err.Error())
+}
@@ -0,0 +1,27 @@
+package mongodb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/datastore/datastoretest"
+)
+
+// TestConformance runs the conformance suite against the MongoDB compatible server
+// at MONGO_URL. Transactions need a replica set, like a single node started with
+// mongod --replSet rs0.
+func TestConformance(t *testing.T) {
+	if len(os.Getenv("MONGO_URL")) == 0 {
+		t.Skip("MONGO_URL isn't set")
+	}
+
+	m, err := Open()
+	if err != nil {
+		t.Fatalf("Open returned an error: %s", err.Error())
+	}
+
+	datastoretest.Run(t, func(t *testing.T) datastore.Manager {
+		return m
+	})
+}
@@ -0,0 +1,48 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gofrs/uuid"
+	acmeserverless "github.com/retgits/acme-serverless"
+)
+
+// outboxTimeFormat is a fixed width timestamp, so the IDs of outbox events
+// sort in the order they were created.
+const outboxTimeFormat = "20060102T150405.000000000Z"
+
+// OutboxEvent is an event that is stored together with an order, in the same
+// transaction, and still needs to be sent to other services. It stays in the
+// outbox until it has been sent.
+type OutboxEvent struct {
+	// ID is the unique identifier of the event. IDs sort in the order the
+	// events were created.
+	ID string
+
+	// Type is the type of the event (like PaymentRequested)
+	Type string
+
+	// Payload is the JSON representation of the event
+	Payload string
+}
+
+// NewOutboxEvent creates a new OutboxEvent with the given type and payload.
+func NewOutboxEvent(eventType string, payload []byte) OutboxEvent {
+	return OutboxEvent{
+		ID:      fmt.Sprintf("%s-%s", time.Now().UTC().Format(outboxTimeFormat), uuid.Must(uuid.NewV4()).String()),
+		Type:    eventType,
+		Payload: string(payload),
+	}
+}
+
+// PaymentRequestedPayload is the payload of a PaymentRequested event in the outbox. The
+// card of the event is masked, like the card of the order, and the full card is stored
+// next to it, encrypted, so the event can be sent by every function or service that has
+// the keys to decrypt it.
+type PaymentRequestedPayload struct {
+	acmeserverless.PaymentRequestedEvent
+
+	// SealedCard is the full card, encrypted with pii.Encrypter.Seal
+	SealedCard string `json:"sealedCard,omitempty"`
+}
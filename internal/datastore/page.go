@@ -0,0 +1,65 @@
+package datastore
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+)
+
+// ErrInvalidPage is returned when the page size or continuation token
+// sent by a client can't be used. It wraps ErrValidation.
+var ErrInvalidPage = fmt.Errorf("%w: invalid page", ErrValidation)
+
+// Page describes which part of a list of orders should be returned.
+type Page struct {
+	// Size is the maximum number of orders to return. When Size is 0,
+	// all orders are returned.
+	Size int64
+
+	// Token is the opaque continuation token returned with the previous
+	// page. When Token is empty, the first page is returned.
+	Token string
+}
+
+// ParsePage creates a Page from the size and token query parameters of
+// a request. Both parameters are optional.
+func ParsePage(size string, token string) (Page, error) {
+	p := Page{
+		Token: token,
+	}
+
+	if len(size) > 0 {
+		s, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || s < 0 {
+			return p, fmt.Errorf("%w: size must be a positive number, got %q", ErrInvalidPage, size)
+		}
+		p.Size = s
+	}
+
+	if _, err := p.After(); err != nil {
+		return p, err
+	}
+
+	return p, nil
+}
+
+// After returns the OrderID after which the page starts. It returns an
+// empty string for the first page.
+func (p Page) After() (string, error) {
+	if len(p.Token) == 0 {
+		return "", nil
+	}
+
+	id, err := base64.RawURLEncoding.DecodeString(p.Token)
+	if err != nil || len(id) == 0 {
+		return "", fmt.Errorf("%w: unknown continuation token %q", ErrInvalidPage, p.Token)
+	}
+
+	return string(id), nil
+}
+
+// NewToken returns the continuation token for the page that starts
+// after the order with the given orderID.
+func NewToken(orderID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(orderID))
+}
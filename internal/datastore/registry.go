@@ -0,0 +1,87 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/retgits/acme-serverless-order/internal/card"
+)
+
+// Factory creates a Manager. It is only called when the datastore is selected,
+// so datastores that aren't used never connect to their database.
+type Factory func() (Manager, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a datastore available by the given name. Datastores call it
+// from their init function, so a binary can use every datastore it imports.
+// Register panics when it is called twice with the same name, or when factory
+// is nil.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if factory == nil {
+		panic("datastore: Register factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("datastore: Register called twice for " + name)
+	}
+	factories[name] = factory
+}
+
+// Backends returns the sorted names of the registered datastores.
+func Backends() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Open creates the datastore that was registered with the given name. The datastore
+// is wrapped with MaskCards, so it never stores or returns a full card number. The
+// tokens of cards need the same key everywhere, so an error is returned when the
+// environment variable CARD_TOKEN_KEY isn't set.
+func Open(name string) (Manager, error) {
+	if err := card.CheckKey(); err != nil {
+		return nil, fmt.Errorf("error opening datastore %s: %s", name, err.Error())
+	}
+
+	factoriesMu.RLock()
+	factory, ok := factories[name]
+	factoriesMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("error opening datastore: unknown datastore %q (registered: %s)", name, strings.Join(Backends(), ", "))
+	}
+
+	m, err := factory()
+	if err != nil {
+		return nil, fmt.Errorf("error opening datastore %s: %w", name, err)
+	}
+
+	return MaskCards(m), nil
+}
+
+// FromEnv creates the datastore set in the environment variable ORDER_DATASTORE
+// (like dynamodb, mongodb or memory), or the fallback when it isn't set.
+func FromEnv(fallback string) (Manager, error) {
+	name := os.Getenv("ORDER_DATASTORE")
+	if len(name) == 0 {
+		name = fallback
+	}
+
+	return Open(name)
+}
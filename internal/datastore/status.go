@@ -0,0 +1,149 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+)
+
+// The statuses an order goes through during its lifecycle. A new order
+// starts as Pending Payment. After the payment service validated the
+// creditcard, the order is either Paid or Payment Failed. A paid order
+// moves through Shipment Requested, Shipped, and Delivered. Any order
+// that hasn't been shipped yet can be Cancelled.
+const (
+	StatusPendingPayment    = "Pending Payment"
+	StatusPaid              = "Paid"
+	StatusPaymentFailed     = "Payment Failed"
+	StatusShipmentRequested = "Shipment Requested"
+	StatusShipped           = "Shipped"
+	StatusDelivered         = "Delivered"
+	StatusCancelled         = "Cancelled"
+)
+
+// transitions contains, for every status, the statuses an order can move to.
+var transitions = map[string][]string{
+	StatusPendingPayment:    {StatusPaid, StatusPaymentFailed, StatusCancelled},
+	StatusPaymentFailed:     {StatusCancelled},
+	StatusPaid:              {StatusShipmentRequested, StatusCancelled},
+	StatusShipmentRequested: {StatusShipped, StatusCancelled},
+	StatusShipped:           {StatusDelivered},
+	StatusDelivered:         {},
+	StatusCancelled:         {},
+}
+
+// legacyPaymentSuccess is the message the payment service sends when the
+// creditcard is valid, which was stored as the status of paid orders before
+// the lifecycle existed.
+const legacyPaymentSuccess = "transaction successful"
+
+// ErrInvalidTransition is returned when the status of an order can't
+// change to the requested status.
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// TransitionError describes a status change that isn't allowed by the
+// lifecycle of an order. It wraps ErrInvalidTransition.
+type TransitionError struct {
+	// OrderID is the unique identifier of the order
+	OrderID string
+
+	// From is the current status of the order
+	From string
+
+	// To is the requested status of the order
+	To string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("%s: order %s can't move from %q to %q", ErrInvalidTransition.Error(), e.OrderID, e.From, e.To)
+}
+
+// Unwrap returns ErrInvalidTransition, so callers can use errors.Is.
+func (e *TransitionError) Unwrap() error {
+	return ErrInvalidTransition
+}
+
+// ValidateTransition returns a *TransitionError when the order can't move
+// from its current status to the requested status. Orders stored before the
+// lifecycle existed can have a status that isn't part of it, like "pending
+// payment" or "shipped - pending delivery". Those statuses are mapped to the
+// lifecycle first, using NormalizeStatus. Only an order without a status can
+// move to any status, an order with a status that can't be mapped can't move
+// at all.
+func ValidateTransition(orderID string, from string, to string) error {
+	if _, ok := transitions[to]; !ok {
+		return &TransitionError{OrderID: orderID, From: from, To: to}
+	}
+
+	if from == "" {
+		return nil
+	}
+
+	current, ok := NormalizeStatus(from)
+	if !ok {
+		return &TransitionError{OrderID: orderID, From: from, To: to}
+	}
+
+	for _, status := range transitions[current] {
+		if status == to {
+			return nil
+		}
+	}
+
+	return &TransitionError{OrderID: orderID, From: from, To: to}
+}
+
+// NormalizeStatus maps a stored status to a status of the lifecycle. Orders
+// stored before the lifecycle existed have the message of the last event as
+// their status: "pending payment" for new orders, the message of the payment
+// service, like "transaction successful", or the status of the shipment
+// service. It returns false when the status can't be mapped.
+func NormalizeStatus(status string) (string, bool) {
+	if _, ok := transitions[status]; ok {
+		return status, true
+	}
+
+	s := strings.ToLower(strings.TrimSpace(status))
+
+	for known := range transitions {
+		if strings.ToLower(known) == s {
+			return known, true
+		}
+	}
+
+	if s == legacyPaymentSuccess {
+		return PaymentStatus(acmeserverless.CreditCardValidationDetails{Success: true}), true
+	}
+
+	if shipment, err := ShipmentStatus(s); err == nil {
+		return shipment, true
+	}
+
+	return "", false
+}
+
+// PaymentStatus returns the status of an order after the payment service
+// validated the creditcard.
+func PaymentStatus(d acmeserverless.CreditCardValidationDetails) string {
+	if d.Success {
+		return StatusPaid
+	}
+	return StatusPaymentFailed
+}
+
+// ShipmentStatus maps the status sent by the shipment service, like
+// "shipped - pending delivery" or "delivered", to the status of an order.
+func ShipmentStatus(status string) (string, error) {
+	s := strings.ToLower(strings.TrimSpace(status))
+
+	switch {
+	case strings.HasPrefix(s, "shipped"):
+		return StatusShipped, nil
+	case strings.HasPrefix(s, "delivered"):
+		return StatusDelivered, nil
+	}
+
+	return "", fmt.Errorf("%w: unknown shipment status %q", ErrInvalidTransition, status)
+}
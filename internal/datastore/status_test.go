@@ -0,0 +1,63 @@
+package datastore
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateTransition(t *testing.T) {
+	tests := []struct {
+		from    string
+		to      string
+		wantErr bool
+	}{
+		{"", StatusPaid, false},
+		{StatusPendingPayment, StatusPaid, false},
+		{StatusPaid, StatusShipmentRequested, false},
+		{StatusShipped, StatusPaid, true},
+		{StatusDelivered, StatusCancelled, true},
+		{StatusPaid, "refunded", true},
+		{"pending payment", StatusPaid, false},
+		{"transaction successful", StatusShipmentRequested, false},
+		{"transaction successful", StatusDelivered, true},
+		{"shipped - pending delivery", StatusDelivered, false},
+		{"shipped - pending delivery", StatusCancelled, true},
+		{"delivered", StatusShipped, true},
+		{"lost in transit", StatusPaid, true},
+		{"lost in transit", StatusCancelled, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from+" to "+tt.to, func(t *testing.T) {
+			err := ValidateTransition("1", tt.from, tt.to)
+			if tt.wantErr != errors.Is(err, ErrInvalidTransition) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil && !tt.wantErr {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestNormalizeStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		want   string
+		ok     bool
+	}{
+		{StatusPaid, StatusPaid, true},
+		{"pending payment", StatusPendingPayment, true},
+		{"transaction successful", StatusPaid, true},
+		{"shipped - pending delivery", StatusShipped, true},
+		{"delivered", StatusDelivered, true},
+		{"lost in transit", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := NormalizeStatus(tt.status)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("NormalizeStatus(%q) = %q, %v, expected %q, %v", tt.status, got, ok, tt.want, tt.ok)
+		}
+	}
+}
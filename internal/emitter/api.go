@@ -5,13 +5,30 @@
 package emitter
 
 import (
+	"context"
+	"errors"
+
 	acmeserverless "github.com/retgits/acme-serverless"
 )
 
+// ErrUnavailable is returned when the event can't be sent right now, like when
+// the broker can't be reached or throttles the request. Trying again later can
+// succeed.
+var ErrUnavailable = errors.New("event broker unavailable")
+
+// ErrValidation is returned when the event was rejected because of its content.
+// Trying again won't succeed.
+var ErrValidation = errors.New("event rejected")
+
 // EventEmitter is the interface that describes the methods the
 // eventing service needs to implement to be able to work with
-// the ACME Serverless Fitness Shop.
+// the ACME Serverless Fitness Shop. The context of the request
+// is passed as first argument, so a request or a function that
+// times out stops the event from being sent.
+// Errors wrap ErrUnavailable or ErrValidation when the cause is
+// known, so callers can decide whether to try again.
 type EventEmitter interface {
-	SendPaymentRequestedEvent(e acmeserverless.PaymentRequestedEvent) error
-	SendShipmentRequestedEvent(e acmeserverless.ShipmentRequested) error
+	SendPaymentRequestedEvent(ctx context.Context, e acmeserverless.PaymentRequestedEvent) error
+	SendShipmentRequestedEvent(ctx context.Context, e acmeserverless.ShipmentRequested) error
+	SendOrderCancelledEvent(ctx context.Context, e OrderCancelled) error
 }
@@ -4,44 +4,75 @@
 package eventbridge
 
 import (
+	"context"
+	"fmt"
 	"os"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/eventbridge"
 	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/cloudevents"
 	"github.com/retgits/acme-serverless-order/internal/emitter"
 )
 
-// responder is an empty struct that implements the methods of the
-// EventEmitter interface
-type responder struct{}
+// responder implements the methods of the EventEmitter interface. The mode
+// determines whether events are wrapped in a CloudEvent.
+type responder struct {
+	mode cloudevents.Mode
+}
+
+// init registers the emitter as eventbridge.
+func init() {
+	emitter.Register("eventbridge", func() (emitter.EventEmitter, error) {
+		return New(), nil
+	})
+}
 
 // New creates a new instance of the EventEmitter with EventBridge
-// as the messaging layer.
+// as the messaging layer. When the environment variable CLOUDEVENTS_MODE
+// is set, events are sent as CloudEvents in structured mode.
 func New() emitter.EventEmitter {
-	return responder{}
+	return responder{
+		mode: cloudevents.ModeFromEnv(),
+	}
+}
+
+func (r responder) SendPaymentRequestedEvent(ctx context.Context, e acmeserverless.PaymentRequestedEvent) error {
+	payload, err := cloudevents.Encode(r.mode, &e, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), e.Metadata, e.Data.OrderID, e.Data)
+	if err != nil {
+		return err
+	}
+
+	return send(ctx, string(payload), e.Metadata.Source)
 }
 
-func (r responder) SendPaymentRequestedEvent(e acmeserverless.PaymentRequestedEvent) error {
-	payload, err := e.Marshal()
+func (r responder) SendShipmentRequestedEvent(ctx context.Context, e acmeserverless.ShipmentRequested) error {
+	payload, err := cloudevents.Encode(r.mode, &e, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), e.Metadata, e.Data.OrderID, e.Data)
 	if err != nil {
 		return err
 	}
 
-	return send(string(payload), e.Metadata.Source)
+	return send(ctx, string(payload), e.Metadata.Source)
 }
 
-func (r responder) SendShipmentRequestedEvent(e acmeserverless.ShipmentRequested) error {
-	payload, err := e.Marshal()
+func (r responder) SendOrderCancelledEvent(ctx context.Context, e emitter.OrderCancelled) error {
+	payload, err := cloudevents.Encode(r.mode, &e, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), e.Metadata, e.Data.OrderID, e.Data)
 	if err != nil {
 		return err
 	}
 
-	return send(string(payload), e.Metadata.Source)
+	return send(ctx, string(payload), e.Metadata.Source)
 }
 
-func send(payload string, source string) error {
+// send sends the event to an EventBridge bus. The bus is determined by the
+// environment variable EVENTBUS. The AWS region this code looks in to find
+// the bus is determined by the environment variable REGION. The method
+// returns an error if anything goes wrong, including when the bus rejected
+// the event.
+func send(ctx context.Context, payload string, source string) error {
 	awsSession := session.Must(session.NewSession(&aws.Config{
 		Region: aws.String(os.Getenv("REGION")),
 	}))
@@ -60,10 +91,43 @@ func send(payload string, source string) error {
 		Entries: entries,
 	}
 
-	_, err := svc.PutEvents(event)
+	out, err := svc.PutEventsWithContext(ctx, event)
 	if err != nil {
-		return err
+		return sendError(err)
+	}
+
+	// PutEvents doesn't return an error when entries were rejected,
+	// those are reported in the output instead. Entries that were
+	// throttled or hit an internal failure can be sent again.
+	if aws.Int64Value(out.FailedEntryCount) > 0 {
+		for _, entry := range out.Entries {
+			if entry.ErrorCode == nil {
+				continue
+			}
+
+			cause := emitter.ErrValidation
+			if code := aws.StringValue(entry.ErrorCode); code == "ThrottlingException" || code == "InternalFailure" {
+				cause = emitter.ErrUnavailable
+			}
+			return fmt.Errorf("error sending event to %s: %w: %s: %s", os.Getenv("EVENTBUS"), cause, aws.StringValue(entry.ErrorCode), aws.StringValue(entry.ErrorMessage))
+		}
+		return fmt.Errorf("error sending event to %s: %w: %d entries failed", os.Getenv("EVENTBUS"), emitter.ErrUnavailable, aws.Int64Value(out.FailedEntryCount))
 	}
 
 	return nil
 }
+
+// sendError returns the error of a call to EventBridge. Errors that can go away when the
+// call is tried again later, like throttled requests and server errors, wrap
+// emitter.ErrUnavailable.
+func sendError(err error) error {
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return fmt.Errorf("%w: %s", emitter.ErrUnavailable, err.Error())
+	}
+
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() >= 500 {
+		return fmt.Errorf("%w: %s", emitter.ErrUnavailable, err.Error())
+	}
+
+	return err
+}
@@ -0,0 +1,50 @@
+package emitter
+
+import (
+	"encoding/json"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+)
+
+// OrderCancelledEventName is the name of the event that is sent when
+// a customer cancels an order.
+const OrderCancelledEventName = "OrderCancelled"
+
+// OrderCancelled is sent to the Payment service when a customer cancels
+// an order, so the payment can be refunded.
+type OrderCancelled struct {
+	// Metadata for the event
+	Metadata acmeserverless.Metadata `json:"metadata"`
+
+	// Data contains the details of the cancelled order
+	Data OrderCancelledDetails `json:"data"`
+}
+
+// OrderCancelledDetails contains the details of the cancelled order the
+// Payment service needs to refund the payment.
+type OrderCancelledDetails struct {
+	// OrderID is the unique identifier of the order
+	OrderID string `json:"orderID"`
+
+	// UserID is the unique identifier of the user who placed the order
+	UserID string `json:"userid"`
+
+	// Total is the amount that was paid for the order
+	Total string `json:"total"`
+
+	// Status is the status of the order before it was cancelled
+	Status string `json:"status"`
+}
+
+// UnmarshalOrderCancelled parses the JSON-encoded data and stores the result
+// in an OrderCancelled event.
+func UnmarshalOrderCancelled(data []byte) (OrderCancelled, error) {
+	var r OrderCancelled
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+// Marshal returns the JSON encoding of OrderCancelled.
+func (r *OrderCancelled) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
@@ -0,0 +1,225 @@
+// Package fanout sends every event to multiple backends, like both Amazon SQS and Amazon
+// EventBridge during a migration from one to the other. The Policy decides which backends
+// need to receive an event before sending it is successful.
+package fanout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/getsentry/sentry-go"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+)
+
+// Policy decides when sending an event to multiple backends is successful.
+type Policy string
+
+const (
+	// PolicyAll sends the event to all backends, and fails when any of the backends fails
+	PolicyAll Policy = "all"
+
+	// PolicyBestEffort sends the event to all backends, and only fails when all of the
+	// backends fail
+	PolicyBestEffort Policy = "best-effort"
+
+	// PolicyPrimary sends the event to the first backend, the primary, and to all other
+	// backends, the shadows. It only fails when the primary fails. Failures of the shadows
+	// are reported to Sentry.
+	PolicyPrimary Policy = "primary"
+)
+
+// Backend is an emitter that events are sent to.
+type Backend struct {
+	// Name identifies the backend in errors (like sqs)
+	Name string
+
+	// Emitter sends the events to the backend
+	Emitter emitter.EventEmitter
+}
+
+// Error is returned when sending an event failed. It contains the error of every
+// backend that failed.
+type Error struct {
+	Errors map[string]error
+}
+
+func (e *Error) Error() string {
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %s", name, e.Errors[name].Error())
+	}
+
+	return fmt.Sprintf("error sending event to %d backend(s): %s", len(names), strings.Join(msgs, "; "))
+}
+
+// Is returns true when target is the kind of the error, so callers can use
+// errors.Is to decide whether to try again. The error is emitter.ErrValidation
+// when every backend that failed rejected the event, because sending it again
+// can't succeed, and emitter.ErrUnavailable otherwise. Which backends failed
+// depends on the policy: with PolicyPrimary it is only the primary.
+func (e *Error) Is(target error) bool {
+	return target == e.kind()
+}
+
+// kind returns emitter.ErrValidation or emitter.ErrUnavailable, see Is.
+func (e *Error) kind() error {
+	if len(e.Errors) == 0 {
+		return emitter.ErrUnavailable
+	}
+
+	for _, err := range e.Errors {
+		if !errors.Is(err, emitter.ErrValidation) {
+			return emitter.ErrUnavailable
+		}
+	}
+	return emitter.ErrValidation
+}
+
+// responder implements the methods of the EventEmitter interface.
+type responder struct {
+	policy   Policy
+	backends []Backend
+}
+
+// New creates a new instance of the EventEmitter that sends every event to all
+// backends. With PolicyPrimary, the first backend is the primary.
+func New(policy Policy, backends ...Backend) emitter.EventEmitter {
+	return responder{
+		policy:   policy,
+		backends: backends,
+	}
+}
+
+// FromEnv creates the EventEmitter from the environment variables EMITTER_BACKENDS and
+// EMITTER_POLICY. EMITTER_BACKENDS is a comma separated list of the names of registered
+// emitters (like sqs,eventbridge), and EMITTER_POLICY is one of all, best-effort or primary
+// (the default is all). When EMITTER_BACKENDS isn't set, the single emitter selected by
+// emitter.FromEnv is returned, which is fallback unless ORDER_EMITTER is set.
+func FromEnv(fallback string) (emitter.EventEmitter, error) {
+	names := os.Getenv("EMITTER_BACKENDS")
+	if len(names) == 0 {
+		return emitter.FromEnv(fallback)
+	}
+
+	policy := Policy(os.Getenv("EMITTER_POLICY"))
+	switch policy {
+	case "":
+		policy = PolicyAll
+	case PolicyAll, PolicyBestEffort, PolicyPrimary:
+	default:
+		return nil, fmt.Errorf("error creating emitter: unknown policy %q", policy)
+	}
+
+	var backends []Backend
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		em, err := emitter.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, Backend{
+			Name:    name,
+			Emitter: em,
+		})
+	}
+
+	return New(policy, backends...), nil
+}
+
+func (r responder) SendPaymentRequestedEvent(ctx context.Context, e acmeserverless.PaymentRequestedEvent) error {
+	return r.send(func(em emitter.EventEmitter) error {
+		return em.SendPaymentRequestedEvent(ctx, e)
+	})
+}
+
+func (r responder) SendShipmentRequestedEvent(ctx context.Context, e acmeserverless.ShipmentRequested) error {
+	return r.send(func(em emitter.EventEmitter) error {
+		return em.SendShipmentRequestedEvent(ctx, e)
+	})
+}
+
+func (r responder) SendOrderCancelledEvent(ctx context.Context, e emitter.OrderCancelled) error {
+	return r.send(func(em emitter.EventEmitter) error {
+		return em.SendOrderCancelledEvent(ctx, e)
+	})
+}
+
+// send sends the event to the backends, following the policy.
+func (r responder) send(fn func(em emitter.EventEmitter) error) error {
+	if len(r.backends) == 0 {
+		return fmt.Errorf("error sending event: no backends configured")
+	}
+
+	if r.policy == PolicyPrimary {
+		primary := r.backends[0]
+
+		var wg sync.WaitGroup
+		for _, shadow := range r.backends[1:] {
+			wg.Add(1)
+			go func(b Backend) {
+				defer wg.Done()
+				if err := fn(b.Emitter); err != nil {
+					sentry.CaptureException(fmt.Errorf("error sending event to shadow %s: %s", b.Name, err.Error()))
+				}
+			}(shadow)
+		}
+
+		err := fn(primary.Emitter)
+		wg.Wait()
+
+		if err != nil {
+			return &Error{Errors: map[string]error{primary.Name: err}}
+		}
+		return nil
+	}
+
+	errs := sendAll(r.backends, fn)
+	if len(errs) == 0 {
+		return nil
+	}
+
+	if r.policy == PolicyBestEffort && len(errs) < len(r.backends) {
+		for name, err := range errs {
+			sentry.CaptureException(fmt.Errorf("error sending event to %s: %s", name, err.Error()))
+		}
+		return nil
+	}
+
+	return &Error{Errors: errs}
+}
+
+// sendAll sends the event to all backends at the same time, and returns the errors
+// of the backends that failed.
+func sendAll(backends []Backend, fn func(em emitter.EventEmitter) error) map[string]error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(map[string]error)
+
+	for _, b := range backends {
+		wg.Add(1)
+		go func(b Backend) {
+			defer wg.Done()
+			if err := fn(b.Emitter); err != nil {
+				mu.Lock()
+				errs[b.Name] = err
+				mu.Unlock()
+			}
+		}(b)
+	}
+
+	wg.Wait()
+
+	return errs
+}
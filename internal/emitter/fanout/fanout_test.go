@@ -0,0 +1,118 @@
+package fanout_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+	"github.com/retgits/acme-serverless-order/internal/emitter/fanout"
+	"github.com/retgits/acme-serverless-order/internal/emitter/mock"
+)
+
+func TestSend(t *testing.T) {
+	rejected := fmt.Errorf("bad request: %w", emitter.ErrValidation)
+
+	tests := []struct {
+		name    string
+		policy  fanout.Policy
+		fail    map[string]error
+		wantErr []string
+		is      error
+		isNot   error
+	}{
+		{name: "all sent", policy: fanout.PolicyAll},
+		{name: "all with one failure", policy: fanout.PolicyAll, fail: map[string]error{"eventbridge": nil}, wantErr: []string{"eventbridge"}, is: emitter.ErrUnavailable},
+		{name: "all with every failure", policy: fanout.PolicyAll, fail: map[string]error{"sqs": nil, "eventbridge": rejected}, wantErr: []string{"eventbridge", "sqs"}, is: emitter.ErrUnavailable, isNot: emitter.ErrValidation},
+		{name: "all rejected", policy: fanout.PolicyAll, fail: map[string]error{"sqs": rejected, "eventbridge": rejected}, wantErr: []string{"eventbridge", "sqs"}, is: emitter.ErrValidation, isNot: emitter.ErrUnavailable},
+		{name: "all with one rejection", policy: fanout.PolicyAll, fail: map[string]error{"eventbridge": rejected}, wantErr: []string{"eventbridge"}, is: emitter.ErrValidation, isNot: emitter.ErrUnavailable},
+		{name: "best-effort sent", policy: fanout.PolicyBestEffort},
+		{name: "best-effort with one failure", policy: fanout.PolicyBestEffort, fail: map[string]error{"sqs": nil}},
+		{name: "best-effort with every failure", policy: fanout.PolicyBestEffort, fail: map[string]error{"sqs": nil, "eventbridge": nil}, wantErr: []string{"eventbridge", "sqs"}, is: emitter.ErrUnavailable},
+		{name: "best-effort with a rejection", policy: fanout.PolicyBestEffort, fail: map[string]error{"sqs": rejected, "eventbridge": nil}, wantErr: []string{"eventbridge", "sqs"}, is: emitter.ErrUnavailable, isNot: emitter.ErrValidation},
+		{name: "primary sent", policy: fanout.PolicyPrimary},
+		{name: "primary fails", policy: fanout.PolicyPrimary, fail: map[string]error{"sqs": rejected}, wantErr: []string{"sqs"}, is: emitter.ErrValidation, isNot: emitter.ErrUnavailable},
+		{name: "primary fails and shadow rejects", policy: fanout.PolicyPrimary, fail: map[string]error{"sqs": nil, "eventbridge": rejected}, wantErr: []string{"sqs"}, is: emitter.ErrUnavailable, isNot: emitter.ErrValidation},
+		{name: "shadow fails", policy: fanout.PolicyPrimary, fail: map[string]error{"eventbridge": nil}},
+		{name: "primary and shadow fail", policy: fanout.PolicyPrimary, fail: map[string]error{"sqs": nil, "eventbridge": nil}, wantErr: []string{"sqs"}, is: emitter.ErrUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// sqs is the first backend, which is the primary with PolicyPrimary
+			recorders := map[string]*mock.Recorder{
+				"sqs":         mock.NewRecorder(),
+				"eventbridge": mock.NewRecorder(),
+			}
+			for name, err := range tt.fail {
+				recorders[name].Fail(err)
+			}
+
+			em := fanout.New(tt.policy,
+				fanout.Backend{Name: "sqs", Emitter: recorders["sqs"]},
+				fanout.Backend{Name: "eventbridge", Emitter: recorders["eventbridge"]},
+			)
+
+			err := em.SendShipmentRequestedEvent(context.Background(), acmeserverless.ShipmentRequested{
+				Data: acmeserverless.ShipmentRequest{OrderID: "1", Delivery: "UPS/FEDEX"},
+			})
+
+			// Every policy sends the event to every backend
+			for name, rec := range recorders {
+				if n := len(rec.Events()) + len(rec.Failed()); n != 1 {
+					t.Errorf("expected 1 event sent to %s, got %d", name, n)
+				}
+			}
+
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("expected no error, got %s", err.Error())
+				}
+				return
+			}
+
+			var ferr *fanout.Error
+			if !errors.As(err, &ferr) {
+				t.Fatalf("expected a *fanout.Error, got %v", err)
+			}
+
+			var names []string
+			for name := range ferr.Errors {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if fmt.Sprint(names) != fmt.Sprint(tt.wantErr) {
+				t.Errorf("expected errors of %v, got %v", tt.wantErr, names)
+			}
+			if !errors.Is(err, tt.is) {
+				t.Errorf("expected errors.Is(err, %v) to be true for %v", tt.is, err)
+			}
+			if tt.isNot != nil && errors.Is(err, tt.isNot) {
+				t.Errorf("expected errors.Is(err, %v) to be false for %v", tt.isNot, err)
+			}
+		})
+	}
+}
+
+func TestSendWithoutBackends(t *testing.T) {
+	em := fanout.New(fanout.PolicyAll)
+
+	if err := em.SendShipmentRequestedEvent(context.Background(), acmeserverless.ShipmentRequested{}); err == nil {
+		t.Fatal("expected an error when no backends are configured")
+	}
+}
+
+func TestFromEnvUnknownPolicy(t *testing.T) {
+	os.Setenv("EMITTER_BACKENDS", "mock")
+	os.Setenv("EMITTER_POLICY", "any")
+	defer os.Unsetenv("EMITTER_BACKENDS")
+	defer os.Unsetenv("EMITTER_POLICY")
+
+	if _, err := fanout.FromEnv("mock"); err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+}
@@ -0,0 +1,346 @@
+// Package http sends events as JSON to HTTP endpoints (webhooks) of the other services
+// in the ACME Serverless Fitness Shop. Every type of event can be sent to a different
+// endpoint, and failed requests are tried again with an increasing delay.
+package http
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/cloudevents"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+)
+
+const (
+	// DefaultTimeout is the time a single request can take when the environment
+	// variable HTTP_TIMEOUT isn't set.
+	DefaultTimeout = 5 * time.Second
+
+	// DefaultRetries is the number of times a failed request is tried again when
+	// the environment variable HTTP_RETRIES isn't set.
+	DefaultRetries = 3
+
+	// DefaultBackoff is the delay before the first retry when the environment
+	// variable HTTP_BACKOFF isn't set. The delay doubles after every retry.
+	DefaultBackoff = 200 * time.Millisecond
+)
+
+// Endpoint is the HTTP endpoint an event is sent to.
+type Endpoint struct {
+	// URL is the URL the event is POSTed to
+	URL string
+
+	// Host overrides the Host header of the request, which is needed when the
+	// service is reached through a gateway that routes on the host name
+	Host string
+
+	// Headers are added to every request to the endpoint
+	Headers map[string]string
+}
+
+// Config is the configuration of the HTTP emitter.
+type Config struct {
+	// Endpoints are the endpoints per type of event (like PaymentRequestedEvent)
+	Endpoints map[string]Endpoint
+
+	// Timeout is the time a single request can take
+	Timeout time.Duration
+
+	// Retries is the number of times a failed request is tried again
+	Retries int
+
+	// Backoff is the delay before the first retry, which doubles after every retry
+	Backoff time.Duration
+
+	// Mode determines whether events are sent as CloudEvents, in structured or
+	// binary mode
+	Mode cloudevents.Mode
+}
+
+// StatusError is returned when an endpoint responds with a status code
+// other than 2xx.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s responded with status %d: %s", e.URL, e.StatusCode, e.Body)
+}
+
+// Temporary returns true when the request can succeed when it is tried again,
+// which is the case for 5xx status codes and 429 Too Many Requests.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Unwrap returns emitter.ErrUnavailable for temporary status codes and
+// emitter.ErrValidation for the others, so callers can use errors.Is.
+func (e *StatusError) Unwrap() error {
+	if e.Temporary() {
+		return emitter.ErrUnavailable
+	}
+	return emitter.ErrValidation
+}
+
+// responder implements the methods of the EventEmitter interface.
+type responder struct {
+	cfg    Config
+	client *http.Client
+}
+
+// init registers the emitter as http.
+func init() {
+	emitter.Register("http", func() (emitter.EventEmitter, error) {
+		return New(), nil
+	})
+}
+
+// New creates a new instance of the EventEmitter with HTTP as the messaging
+// layer, configured using ConfigFromEnv.
+func New() emitter.EventEmitter {
+	return NewWithConfig(ConfigFromEnv())
+}
+
+// NewWithConfig creates a new instance of the EventEmitter with HTTP as the
+// messaging layer, using the given configuration.
+func NewWithConfig(cfg Config) emitter.EventEmitter {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.Retries < 0 {
+		cfg.Retries = 0
+	}
+
+	return responder{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: cfg.Timeout,
+		},
+	}
+}
+
+// ConfigFromEnv reads the configuration from the environment variables:
+//
+// * PAYMENT_URL and PAYMENT_HOST: the endpoint for PaymentRequested events
+// * CANCEL_URL and CANCEL_HOST: the endpoint for OrderCancelled events (defaults to the PAYMENT_ variables)
+// * SHIPMENT_URL and SHIPMENT_HOST: the endpoint for ShipmentRequested events
+// * HTTP_HEADERS: headers added to every request, as a comma separated list of key=value pairs
+// * HTTP_TIMEOUT: the time a single request can take (like 5s)
+// * HTTP_RETRIES: the number of times a failed request is tried again
+// * HTTP_BACKOFF: the delay before the first retry (like 200ms)
+// * CLOUDEVENTS_MODE: send events as CloudEvents in structured or binary mode
+func ConfigFromEnv() Config {
+	headers := parseHeaders(os.Getenv("HTTP_HEADERS"))
+
+	payment := Endpoint{
+		URL:     os.Getenv("PAYMENT_URL"),
+		Host:    os.Getenv("PAYMENT_HOST"),
+		Headers: headers,
+	}
+
+	cancel := payment
+	if url := os.Getenv("CANCEL_URL"); len(url) > 0 {
+		cancel = Endpoint{
+			URL:     url,
+			Host:    os.Getenv("CANCEL_HOST"),
+			Headers: headers,
+		}
+	}
+
+	cfg := Config{
+		Endpoints: map[string]Endpoint{
+			acmeserverless.PaymentRequestedEventName: payment,
+			emitter.OrderCancelledEventName:          cancel,
+			acmeserverless.ShipmentRequestedEventName: {
+				URL:     os.Getenv("SHIPMENT_URL"),
+				Host:    os.Getenv("SHIPMENT_HOST"),
+				Headers: headers,
+			},
+		},
+		Timeout: DefaultTimeout,
+		Retries: DefaultRetries,
+		Backoff: DefaultBackoff,
+		Mode:    cloudevents.ModeFromEnv(),
+	}
+
+	if timeout, err := time.ParseDuration(os.Getenv("HTTP_TIMEOUT")); err == nil && timeout > 0 {
+		cfg.Timeout = timeout
+	}
+	if retries, err := strconv.Atoi(os.Getenv("HTTP_RETRIES")); err == nil && retries >= 0 {
+		cfg.Retries = retries
+	}
+	if backoff, err := time.ParseDuration(os.Getenv("HTTP_BACKOFF")); err == nil && backoff >= 0 {
+		cfg.Backoff = backoff
+	}
+
+	return cfg
+}
+
+// parseHeaders parses a comma separated list of key=value pairs.
+func parseHeaders(s string) map[string]string {
+	headers := make(map[string]string)
+
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+			continue
+		}
+		headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	return headers
+}
+
+func (r responder) SendPaymentRequestedEvent(ctx context.Context, e acmeserverless.PaymentRequestedEvent) error {
+	msg, err := r.message(&e, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), e.Metadata, e.Data.OrderID, e.Data)
+	if err != nil {
+		return err
+	}
+
+	return r.send(ctx, acmeserverless.PaymentRequestedEventName, msg)
+}
+
+func (r responder) SendShipmentRequestedEvent(ctx context.Context, e acmeserverless.ShipmentRequested) error {
+	msg, err := r.message(&e, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), e.Metadata, e.Data.OrderID, e.Data)
+	if err != nil {
+		return err
+	}
+
+	return r.send(ctx, acmeserverless.ShipmentRequestedEventName, msg)
+}
+
+func (r responder) SendOrderCancelledEvent(ctx context.Context, e emitter.OrderCancelled) error {
+	msg, err := r.message(&e, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), e.Metadata, e.Data.OrderID, e.Data)
+	if err != nil {
+		return err
+	}
+
+	return r.send(ctx, emitter.OrderCancelledEventName, msg)
+}
+
+// message is the body and the headers of a request.
+type message struct {
+	body    []byte
+	headers map[string]string
+}
+
+// message creates the request for an event with the given ID, metadata, subject and data.
+// In binary mode, the data of the event is the body and the CloudEvent attributes are
+// sent as headers.
+func (r responder) message(event cloudevents.Marshaler, id string, m acmeserverless.Metadata, subject string, data interface{}) (message, error) {
+	switch r.cfg.Mode {
+	case cloudevents.ModeNone:
+		body, err := event.Marshal()
+		return message{
+			body:    body,
+			headers: map[string]string{"Content-Type": "application/json"},
+		}, err
+	case cloudevents.ModeBinary:
+		ce, err := cloudevents.New(id, m, subject, data)
+		if err != nil {
+			return message{}, err
+		}
+		headers := ce.Headers()
+		headers["Content-Type"] = ce.DataContentType
+		return message{
+			body:    ce.Data,
+			headers: headers,
+		}, nil
+	default:
+		ce, err := cloudevents.New(id, m, subject, data)
+		if err != nil {
+			return message{}, err
+		}
+		body, err := ce.Marshal()
+		return message{
+			body:    body,
+			headers: map[string]string{"Content-Type": cloudevents.ContentType},
+		}, err
+	}
+}
+
+// send POSTs the event to the endpoint of its type. Requests that fail because
+// of a network error or a temporary status code are tried again, up to the
+// configured number of retries. The method returns the last error if the
+// event couldn't be sent, or the error of ctx when it was cancelled. An event
+// without an endpoint can never be sent, so that error wraps emitter.ErrValidation.
+func (r responder) send(ctx context.Context, eventType string, msg message) error {
+	endpoint, ok := r.cfg.Endpoints[eventType]
+	if !ok || len(endpoint.URL) == 0 {
+		return fmt.Errorf("error sending %s: %w: no endpoint configured", eventType, emitter.ErrValidation)
+	}
+
+	backoff := r.cfg.Backoff
+
+	var err error
+	for attempt := 0; attempt <= r.cfg.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("error sending %s: %w", eventType, ctx.Err())
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		err = r.post(ctx, endpoint, msg)
+		if err == nil {
+			return nil
+		}
+
+		if serr, ok := err.(*StatusError); ok && !serr.Temporary() {
+			break
+		}
+	}
+
+	return fmt.Errorf("error sending %s: %w", eventType, err)
+}
+
+// post sends a single request to the endpoint.
+func (r responder) post(ctx context.Context, endpoint Endpoint, msg message) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(msg.body))
+	if err != nil {
+		return err
+	}
+
+	for key, value := range endpoint.Headers {
+		req.Header.Set(key, value)
+	}
+	for key, value := range msg.headers {
+		req.Header.Set(key, value)
+	}
+	if len(endpoint.Host) > 0 {
+		req.Host = endpoint.Host
+	}
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s", emitter.ErrUnavailable, err.Error())
+	}
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &StatusError{
+			URL:        endpoint.URL,
+			StatusCode: res.StatusCode,
+			Body:       string(body),
+		}
+	}
+
+	return nil
+}
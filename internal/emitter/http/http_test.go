@@ -0,0 +1,321 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/cloudevents"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+)
+
+// request is a request received by a server.
+type request struct {
+	header http.Header
+	host   string
+	body   []byte
+	at     time.Time
+}
+
+// server is an endpoint that responds with the given status codes, one per request,
+// and with 200 OK when it runs out. It records every request.
+type server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	delay    time.Duration
+	requests []request
+}
+
+func newServer(t *testing.T, statuses ...int) *server {
+	s := &server{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		s.mu.Lock()
+		s.requests = append(s.requests, request{header: r.Header, host: r.Host, body: body, at: time.Now()})
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		delay := s.delay
+		s.mu.Unlock()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(delay):
+		}
+
+		w.WriteHeader(status)
+		w.Write([]byte(http.StatusText(status)))
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *server) received() []request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]request(nil), s.requests...)
+}
+
+func (s *server) emitter(cfg Config) emitter.EventEmitter {
+	cfg.Endpoints = map[string]Endpoint{
+		acmeserverless.ShipmentRequestedEventName: {URL: s.URL},
+	}
+	return NewWithConfig(cfg)
+}
+
+func shipmentRequested() acmeserverless.ShipmentRequested {
+	return acmeserverless.ShipmentRequested{
+		Metadata: acmeserverless.Metadata{
+			Domain: acmeserverless.OrderDomain,
+			Source: "ShipOrder",
+			Type:   acmeserverless.ShipmentRequestedEventName,
+			Status: acmeserverless.DefaultSuccessStatus,
+		},
+		Data: acmeserverless.ShipmentRequest{OrderID: "1", Delivery: "UPS/FEDEX"},
+	}
+}
+
+func TestSendRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		retries  int
+		wantErr  error
+		status   int
+		attempts int
+	}{
+		{name: "ok", statuses: []int{http.StatusOK}, retries: 3, attempts: 1},
+		{name: "accepted", statuses: []int{http.StatusAccepted}, retries: 3, attempts: 1},
+		{name: "recovers", statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK}, retries: 3, attempts: 3},
+		{name: "too many requests", statuses: []int{http.StatusTooManyRequests, http.StatusOK}, retries: 3, attempts: 2},
+		{
+			name:     "keeps failing",
+			statuses: []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError},
+			retries:  2,
+			wantErr:  emitter.ErrUnavailable,
+			status:   http.StatusInternalServerError,
+			attempts: 3,
+		},
+		{
+			name:     "no retries",
+			statuses: []int{http.StatusServiceUnavailable},
+			wantErr:  emitter.ErrUnavailable,
+			status:   http.StatusServiceUnavailable,
+			attempts: 1,
+		},
+		{
+			name:     "rejected",
+			statuses: []int{http.StatusBadRequest},
+			retries:  3,
+			wantErr:  emitter.ErrValidation,
+			status:   http.StatusBadRequest,
+			attempts: 1,
+		},
+		{
+			name:     "rejected after a retry",
+			statuses: []int{http.StatusServiceUnavailable, http.StatusUnprocessableEntity},
+			retries:  3,
+			wantErr:  emitter.ErrValidation,
+			status:   http.StatusUnprocessableEntity,
+			attempts: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t, tt.statuses...)
+			em := s.emitter(Config{Retries: tt.retries, Backoff: time.Millisecond})
+
+			err := em.SendShipmentRequestedEvent(context.Background(), shipmentRequested())
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("SendShipmentRequestedEvent returned an error: %s", err.Error())
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				var serr *StatusError
+				if !errors.As(err, &serr) || serr.StatusCode != tt.status || serr.URL != s.URL || serr.Body != http.StatusText(tt.status) {
+					t.Errorf("expected a StatusError with status %d, got %v", tt.status, err)
+				}
+			}
+			if n := len(s.received()); n != tt.attempts {
+				t.Errorf("expected %d attempts, got %d", tt.attempts, n)
+			}
+		})
+	}
+}
+
+func TestSendBackoff(t *testing.T) {
+	s := newServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	backoff := 20 * time.Millisecond
+	em := s.emitter(Config{Retries: 3, Backoff: backoff})
+
+	if err := em.SendShipmentRequestedEvent(context.Background(), shipmentRequested()); err != nil {
+		t.Fatalf("SendShipmentRequestedEvent returned an error: %s", err.Error())
+	}
+
+	requests := s.received()
+	if len(requests) != 4 {
+		t.Fatalf("expected 4 attempts, got %d", len(requests))
+	}
+
+	// The delay doubles after every retry
+	for i := 1; i < len(requests); i++ {
+		if delay := requests[i].at.Sub(requests[i-1].at); delay < backoff {
+			t.Errorf("expected attempt %d to wait at least %s, waited %s", i+1, backoff, delay)
+		}
+		backoff *= 2
+	}
+}
+
+func TestSendCancelledDuringBackoff(t *testing.T) {
+	s := newServer(t, http.StatusServiceUnavailable)
+	em := s.emitter(Config{Retries: 3, Backoff: time.Minute})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := em.SendShipmentRequestedEvent(ctx, shipmentRequested())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+	if n := len(s.received()); n != 1 {
+		t.Errorf("expected 1 attempt, got %d", n)
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	s := newServer(t)
+	s.delay = time.Second
+	em := s.emitter(Config{Timeout: 20 * time.Millisecond, Retries: 1, Backoff: time.Millisecond})
+
+	start := time.Now()
+	err := em.SendShipmentRequestedEvent(context.Background(), shipmentRequested())
+	if !errors.Is(err, emitter.ErrUnavailable) {
+		t.Fatalf("expected error %v, got %v", emitter.ErrUnavailable, err)
+	}
+	if elapsed := time.Since(start); elapsed >= s.delay {
+		t.Errorf("expected the requests to time out, took %s", elapsed)
+	}
+	if n := len(s.received()); n != 2 {
+		t.Errorf("expected 2 attempts, got %d", n)
+	}
+}
+
+func TestSendWithoutEndpoint(t *testing.T) {
+	em := NewWithConfig(Config{})
+
+	err := em.SendShipmentRequestedEvent(context.Background(), shipmentRequested())
+	if !errors.Is(err, emitter.ErrValidation) {
+		t.Fatalf("expected emitter.ErrValidation when no endpoint is configured, got %v", err)
+	}
+}
+
+func TestSendHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        cloudevents.Mode
+		contentType string
+		ceHeaders   map[string]string
+	}{
+		{name: "event", mode: cloudevents.ModeNone, contentType: "application/json"},
+		{name: "structured", mode: cloudevents.ModeStructured, contentType: cloudevents.ContentType},
+		{
+			name:        "binary",
+			mode:        cloudevents.ModeBinary,
+			contentType: "application/json",
+			ceHeaders: map[string]string{
+				"ce-specversion": cloudevents.SpecVersion,
+				"ce-id":          "evt-1",
+				"ce-source":      "ShipOrder",
+				"ce-type":        acmeserverless.ShipmentRequestedEventName,
+				"ce-subject":     "1",
+				"ce-domain":      acmeserverless.OrderDomain,
+				"ce-status":      acmeserverless.DefaultSuccessStatus,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t)
+			em := NewWithConfig(Config{
+				Endpoints: map[string]Endpoint{
+					acmeserverless.ShipmentRequestedEventName: {
+						URL:  s.URL,
+						Host: "shipment.example.com",
+						Headers: map[string]string{
+							"Authorization": "Bearer secret",
+							// The content type of the event wins over the headers of the endpoint
+							"Content-Type": "text/plain",
+						},
+					},
+				},
+				Mode: tt.mode,
+			})
+
+			ctx := cloudevents.WithID(context.Background(), "evt-1")
+			if err := em.SendShipmentRequestedEvent(ctx, shipmentRequested()); err != nil {
+				t.Fatalf("SendShipmentRequestedEvent returned an error: %s", err.Error())
+			}
+
+			requests := s.received()
+			if len(requests) != 1 {
+				t.Fatalf("expected 1 request, got %d", len(requests))
+			}
+			req := requests[0]
+
+			if req.host != "shipment.example.com" {
+				t.Errorf("expected Host %q, got %q", "shipment.example.com", req.host)
+			}
+			if got := req.header.Get("Authorization"); got != "Bearer secret" {
+				t.Errorf("expected Authorization %q, got %q", "Bearer secret", got)
+			}
+			if got := req.header.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("expected Content-Type %q, got %q", tt.contentType, got)
+			}
+			for key, want := range tt.ceHeaders {
+				if got := req.header.Get(key); got != want {
+					t.Errorf("expected %s %q, got %q", key, want, got)
+				}
+			}
+			if tt.ceHeaders == nil && len(req.header.Get("ce-specversion")) > 0 {
+				t.Errorf("expected no CloudEvents headers, got ce-specversion %q", req.header.Get("ce-specversion"))
+			}
+
+			var body map[string]json.RawMessage
+			if err := json.Unmarshal(req.body, &body); err != nil {
+				t.Fatalf("the body isn't JSON: %s", err.Error())
+			}
+			switch tt.mode {
+			case cloudevents.ModeNone:
+				if _, ok := body["metadata"]; !ok {
+					t.Errorf("expected the event as body, got %s", req.body)
+				}
+			case cloudevents.ModeStructured:
+				if id := string(body["id"]); id != `"evt-1"` {
+					t.Errorf("expected a CloudEvent with id evt-1 as body, got %s", req.body)
+				}
+			case cloudevents.ModeBinary:
+				if string(body["delivery"]) != `"UPS/FEDEX"` {
+					t.Errorf("expected the data of the event as body, got %s", req.body)
+				}
+			}
+		})
+	}
+}
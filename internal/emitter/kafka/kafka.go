@@ -0,0 +1,220 @@
+// Package kafka uses Apache Kafka, a distributed event streaming platform, to send events.
+// Every message is keyed by the ID of the order, so all events of an order end up in the
+// same partition and are consumed in the order they were sent.
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/cloudevents"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// DefaultBrokers are the brokers used when the environment variable KAFKA_BROKERS
+	// isn't set.
+	DefaultBrokers = "localhost:9092"
+
+	// DefaultPaymentTopic is the topic PaymentRequested events are sent to when the
+	// environment variable KAFKA_PAYMENT_TOPIC isn't set.
+	DefaultPaymentTopic = "payment-request"
+
+	// DefaultShipmentTopic is the topic ShipmentRequested events are sent to when the
+	// environment variable KAFKA_SHIPMENT_TOPIC isn't set.
+	DefaultShipmentTopic = "shipment-request"
+)
+
+// Writer writes messages to a single Kafka topic. A *kafka.Writer implements
+// Writer, and tests can use an in-process stand-in.
+type Writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Writers are the writers for each type of event.
+type Writers struct {
+	// Payment writes PaymentRequested events
+	Payment Writer
+
+	// Shipment writes ShipmentRequested events
+	Shipment Writer
+
+	// Cancel writes OrderCancelled events
+	Cancel Writer
+}
+
+// Brokers returns the brokers set in the environment variable KAFKA_BROKERS,
+// as a comma separated list of host:port pairs.
+func Brokers() []string {
+	brokers := os.Getenv("KAFKA_BROKERS")
+	if len(brokers) == 0 {
+		brokers = DefaultBrokers
+	}
+
+	return strings.Split(brokers, ",")
+}
+
+// NewWriter creates a writer for the topic. Messages with the same key are written to
+// the same partition, and a write only succeeds when all in-sync replicas stored it.
+func NewWriter(brokers []string, topic string) *kafka.Writer {
+	return kafka.NewWriter(kafka.WriterConfig{
+		Brokers:      brokers,
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: -1,
+	})
+}
+
+// responder implements the methods of the EventEmitter interface.
+type responder struct {
+	writers Writers
+	mode    cloudevents.Mode
+}
+
+// writersOnce makes sure the writers are only created once.
+var (
+	writersOnce sync.Once
+	writers     Writers
+)
+
+// init registers the emitter as kafka.
+func init() {
+	emitter.Register("kafka", func() (emitter.EventEmitter, error) {
+		return New(), nil
+	})
+}
+
+// New creates a new instance of the EventEmitter with Kafka as the messaging layer. The
+// topics are read from the environment variables KAFKA_PAYMENT_TOPIC, KAFKA_SHIPMENT_TOPIC
+// and KAFKA_CANCEL_TOPIC. OrderCancelled events are sent to the payment topic, unless
+// KAFKA_CANCEL_TOPIC is set. The writers are only created the first time, after that
+// every emitter uses the same writers and their connections to the brokers.
+func New() emitter.EventEmitter {
+	writersOnce.Do(func() {
+		writers = newWriters()
+	})
+
+	return NewWithWriters(writers)
+}
+
+// newWriters creates the writers for the topics set in the environment variables.
+func newWriters() Writers {
+	brokers := Brokers()
+
+	paymentTopic := getEnv("KAFKA_PAYMENT_TOPIC", DefaultPaymentTopic)
+	payment := NewWriter(brokers, paymentTopic)
+
+	cancel := payment
+	if topic := getEnv("KAFKA_CANCEL_TOPIC", paymentTopic); topic != paymentTopic {
+		cancel = NewWriter(brokers, topic)
+	}
+
+	return Writers{
+		Payment:  payment,
+		Shipment: NewWriter(brokers, getEnv("KAFKA_SHIPMENT_TOPIC", DefaultShipmentTopic)),
+		Cancel:   cancel,
+	}
+}
+
+// NewWithWriters creates a new instance of the EventEmitter that sends the
+// events using the given writers.
+func NewWithWriters(w Writers) emitter.EventEmitter {
+	return responder{
+		writers: w,
+		mode:    cloudevents.ModeFromEnv(),
+	}
+}
+
+func (r responder) SendPaymentRequestedEvent(ctx context.Context, e acmeserverless.PaymentRequestedEvent) error {
+	msg, err := r.message(&e, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), e.Metadata, e.Data.OrderID, e.Data)
+	if err != nil {
+		return err
+	}
+
+	return send(ctx, r.writers.Payment, msg)
+}
+
+func (r responder) SendShipmentRequestedEvent(ctx context.Context, e acmeserverless.ShipmentRequested) error {
+	msg, err := r.message(&e, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), e.Metadata, e.Data.OrderID, e.Data)
+	if err != nil {
+		return err
+	}
+
+	return send(ctx, r.writers.Shipment, msg)
+}
+
+func (r responder) SendOrderCancelledEvent(ctx context.Context, e emitter.OrderCancelled) error {
+	msg, err := r.message(&e, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), e.Metadata, e.Data.OrderID, e.Data)
+	if err != nil {
+		return err
+	}
+
+	return send(ctx, r.writers.Cancel, msg)
+}
+
+// message creates the Kafka message for an event with the given ID, metadata, order ID and
+// data. In binary mode, the data of the event is the value and the CloudEvent attributes
+// are sent as headers.
+func (r responder) message(event cloudevents.Marshaler, id string, m acmeserverless.Metadata, orderID string, data interface{}) (kafka.Message, error) {
+	msg := kafka.Message{
+		Key: []byte(orderID),
+	}
+
+	if r.mode != cloudevents.ModeBinary {
+		value, err := cloudevents.Encode(r.mode, event, id, m, orderID, data)
+		msg.Value = value
+		return msg, err
+	}
+
+	ce, err := cloudevents.New(id, m, orderID, data)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+
+	msg.Value = ce.Data
+	for key, value := range ce.Headers() {
+		// The Kafka binding of CloudEvents uses ce_ instead of ce- as prefix
+		msg.Headers = append(msg.Headers, kafka.Header{
+			Key:   "ce_" + strings.TrimPrefix(key, "ce-"),
+			Value: []byte(value),
+		})
+	}
+	msg.Headers = append(msg.Headers, kafka.Header{
+		Key:   "content-type",
+		Value: []byte(ce.DataContentType),
+	})
+
+	return msg, nil
+}
+
+// send writes the message using w. The method returns an error if anything
+// goes wrong. Errors other than the cancellation of ctx wrap
+// emitter.ErrUnavailable.
+func send(ctx context.Context, w Writer, msg kafka.Message) error {
+	if w == nil {
+		return fmt.Errorf("error sending event for order %s: no writer configured", string(msg.Key))
+	}
+
+	if err := w.WriteMessages(ctx, msg); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("error sending event for order %s: %w", string(msg.Key), ctx.Err())
+		}
+		return fmt.Errorf("error sending event for order %s: %w: %s", string(msg.Key), emitter.ErrUnavailable, err.Error())
+	}
+
+	return nil
+}
+
+// getEnv returns the value of the environment variable key, or fallback when
+// it isn't set.
+func getEnv(key string, fallback string) string {
+	if value := os.Getenv(key); len(value) > 0 {
+		return value
+	}
+	return fallback
+}
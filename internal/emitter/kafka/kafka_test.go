@@ -0,0 +1,152 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+	"github.com/segmentio/kafka-go"
+)
+
+// writer is a stand-in for a *kafka.Writer that keeps the messages written to its topic.
+type writer struct {
+	msgs []kafka.Message
+	err  error
+}
+
+func (w *writer) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.msgs = append(w.msgs, msgs...)
+	return nil
+}
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		name  string
+		topic string
+		send  func(em emitter.EventEmitter) error
+	}{
+		{
+			name:  "PaymentRequested",
+			topic: "payment",
+			send: func(em emitter.EventEmitter) error {
+				return em.SendPaymentRequestedEvent(context.Background(), acmeserverless.PaymentRequestedEvent{
+					Data: acmeserverless.PaymentRequestDetails{OrderID: "1", Total: "8.00"},
+				})
+			},
+		},
+		{
+			name:  "ShipmentRequested",
+			topic: "shipment",
+			send: func(em emitter.EventEmitter) error {
+				return em.SendShipmentRequestedEvent(context.Background(), acmeserverless.ShipmentRequested{
+					Data: acmeserverless.ShipmentRequest{OrderID: "1", Delivery: "UPS/FEDEX"},
+				})
+			},
+		},
+		{
+			name:  "OrderCancelled",
+			topic: "cancel",
+			send: func(em emitter.EventEmitter) error {
+				return em.SendOrderCancelledEvent(context.Background(), emitter.OrderCancelled{
+					Data: emitter.OrderCancelledDetails{OrderID: "1", Total: "8.00"},
+				})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topics := map[string]*writer{
+				"payment":  {},
+				"shipment": {},
+				"cancel":   {},
+			}
+			em := NewWithWriters(Writers{
+				Payment:  topics["payment"],
+				Shipment: topics["shipment"],
+				Cancel:   topics["cancel"],
+			})
+
+			if err := tt.send(em); err != nil {
+				t.Fatalf("sending the event returned an error: %s", err.Error())
+			}
+
+			for topic, w := range topics {
+				want := 0
+				if topic == tt.topic {
+					want = 1
+				}
+				if len(w.msgs) != want {
+					t.Fatalf("expected %d message(s) in topic %s, got %d", want, topic, len(w.msgs))
+				}
+			}
+
+			// The order ID is the key, so all events of an order go to the same partition
+			if key := string(topics[tt.topic].msgs[0].Key); key != "1" {
+				t.Errorf("expected the order ID as key, got %q", key)
+			}
+		})
+	}
+}
+
+func TestSendUnavailable(t *testing.T) {
+	em := NewWithWriters(Writers{
+		Shipment: &writer{err: errors.New("leader not available")},
+	})
+
+	err := em.SendShipmentRequestedEvent(context.Background(), acmeserverless.ShipmentRequested{
+		Data: acmeserverless.ShipmentRequest{OrderID: "1"},
+	})
+	if !errors.Is(err, emitter.ErrUnavailable) {
+		t.Errorf("expected emitter.ErrUnavailable, got %v", err)
+	}
+}
+
+func TestNewWriters(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		topics [3]string
+	}{
+		{name: "defaults", topics: [3]string{DefaultPaymentTopic, DefaultShipmentTopic, DefaultPaymentTopic}},
+		{
+			name:   "configured",
+			env:    map[string]string{"KAFKA_PAYMENT_TOPIC": "payments", "KAFKA_SHIPMENT_TOPIC": "shipments", "KAFKA_CANCEL_TOPIC": "cancellations"},
+			topics: [3]string{"payments", "shipments", "cancellations"},
+		},
+		{
+			name:   "cancel to the payment topic",
+			env:    map[string]string{"KAFKA_PAYMENT_TOPIC": "payments"},
+			topics: [3]string{"payments", DefaultShipmentTopic, "payments"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				os.Setenv(key, value)
+				defer os.Unsetenv(key)
+			}
+
+			w := newWriters()
+			for _, kw := range []Writer{w.Payment, w.Shipment, w.Cancel} {
+				defer kw.(*kafka.Writer).Close()
+			}
+
+			got := [3]string{
+				w.Payment.(*kafka.Writer).Stats().Topic,
+				w.Shipment.(*kafka.Writer).Stats().Topic,
+				w.Cancel.(*kafka.Writer).Stats().Topic,
+			}
+			if got != tt.topics {
+				t.Errorf("expected the topics %v, got %v", tt.topics, got)
+			}
+		})
+	}
+}
@@ -1,13 +1,19 @@
-// Package mock uses the log file to log all incoming events.
+// Package mock uses the log file to log all incoming events, with
+// the card of PaymentRequested events masked.
 // This is useful for testing, but doesn't send any events to other
 // services. That means if you use this in a non-testing scenario
 // the event flow will stop here.
+//
+// A Recorder keeps the events instead, so tests can check which events
+// were sent, and can fail sends to simulate a broker outage.
 package mock
 
 import (
+	"context"
 	"log"
 
 	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/card"
 	"github.com/retgits/acme-serverless-order/internal/emitter"
 )
 
@@ -15,13 +21,35 @@ import (
 // EventEmitter interface.
 type responder struct{}
 
+// init registers the emitter as mock.
+func init() {
+	emitter.Register("mock", func() (emitter.EventEmitter, error) {
+		return New(), nil
+	})
+}
+
 // New creates a new instance of the EventEmitter with mock
 // as the messaging layer.
 func New() emitter.EventEmitter {
 	return responder{}
 }
 
-func (r responder) SendPaymentRequestedEvent(e acmeserverless.PaymentRequestedEvent) error {
+func (r responder) SendPaymentRequestedEvent(ctx context.Context, e acmeserverless.PaymentRequestedEvent) error {
+	// The full card doesn't belong in the log, e is a copy so the
+	// event of the caller keeps the full card
+	e.Data.Card = card.Mask(e.Data.Card)
+
+	payload, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Payload: %s", payload)
+
+	return nil
+}
+
+func (r responder) SendShipmentRequestedEvent(ctx context.Context, e acmeserverless.ShipmentRequested) error {
 	payload, err := e.Marshal()
 	if err != nil {
 		return err
@@ -32,7 +60,7 @@ func (r responder) SendPaymentRequestedEvent(e acmeserverless.PaymentRequestedEv
 	return nil
 }
 
-func (r responder) SendShipmentRequestedEvent(e acmeserverless.ShipmentRequested) error {
+func (r responder) SendOrderCancelledEvent(ctx context.Context, e emitter.OrderCancelled) error {
 	payload, err := e.Marshal()
 	if err != nil {
 		return err
@@ -0,0 +1,241 @@
+package mock
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+)
+
+// ErrUnavailable is the error returned by a Recorder that simulates a broker
+// outage, unless another error is given. It wraps emitter.ErrUnavailable.
+var ErrUnavailable = fmt.Errorf("mock: %w", emitter.ErrUnavailable)
+
+// Event is an event that was sent to a Recorder.
+type Event struct {
+	// Type is the type of the event (like PaymentRequested)
+	Type string
+
+	// OrderID is the ID of the order the event is about
+	OrderID string
+
+	// Event is the event itself, an acmeserverless.PaymentRequestedEvent,
+	// acmeserverless.ShipmentRequested or emitter.OrderCancelled
+	Event interface{}
+}
+
+// Recorder is an EventEmitter that records every event it receives, in the order
+// they were sent, so tests can check which events were emitted. It can simulate
+// a broker outage by failing sends. A Recorder is safe for concurrent use.
+type Recorder struct {
+	mu       sync.Mutex
+	events   []Event
+	failed   []Event
+	failAll  error
+	failNext []error
+	failType map[string]error
+}
+
+var _ emitter.EventEmitter = (*Recorder)(nil)
+
+// NewRecorder creates a new Recorder without any events.
+func NewRecorder() *Recorder {
+	return &Recorder{
+		failType: make(map[string]error),
+	}
+}
+
+func (r *Recorder) SendPaymentRequestedEvent(ctx context.Context, e acmeserverless.PaymentRequestedEvent) error {
+	return r.record(Event{
+		Type:    acmeserverless.PaymentRequestedEventName,
+		OrderID: e.Data.OrderID,
+		Event:   e,
+	})
+}
+
+func (r *Recorder) SendShipmentRequestedEvent(ctx context.Context, e acmeserverless.ShipmentRequested) error {
+	return r.record(Event{
+		Type:    acmeserverless.ShipmentRequestedEventName,
+		OrderID: e.Data.OrderID,
+		Event:   e,
+	})
+}
+
+func (r *Recorder) SendOrderCancelledEvent(ctx context.Context, e emitter.OrderCancelled) error {
+	return r.record(Event{
+		Type:    emitter.OrderCancelledEventName,
+		OrderID: e.Data.OrderID,
+		Event:   e,
+	})
+}
+
+// record stores the event, unless a failure was injected for it.
+func (r *Recorder) record(evt Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err error
+	switch {
+	case len(r.failNext) > 0:
+		err = r.failNext[0]
+		r.failNext = r.failNext[1:]
+	case r.failType[evt.Type] != nil:
+		err = r.failType[evt.Type]
+	case r.failAll != nil:
+		err = r.failAll
+	}
+
+	if err != nil {
+		r.failed = append(r.failed, evt)
+		return err
+	}
+
+	r.events = append(r.events, evt)
+	return nil
+}
+
+// Fail makes every send fail with err until Recover is called. When err is nil,
+// ErrUnavailable is used.
+func (r *Recorder) Fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failAll = orUnavailable(err)
+}
+
+// FailNext makes the next n sends fail with err. When err is nil, ErrUnavailable
+// is used.
+func (r *Recorder) FailNext(n int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		r.failNext = append(r.failNext, orUnavailable(err))
+	}
+}
+
+// FailType makes every send of an event of the given type fail with err until
+// Recover is called. When err is nil, ErrUnavailable is used.
+func (r *Recorder) FailType(eventType string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failType[eventType] = orUnavailable(err)
+}
+
+// Recover removes all injected failures.
+func (r *Recorder) Recover() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failAll = nil
+	r.failNext = nil
+	r.failType = make(map[string]error)
+}
+
+// Reset removes all recorded events and injected failures.
+func (r *Recorder) Reset() {
+	r.Recover()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = nil
+	r.failed = nil
+}
+
+// Events returns all events that were sent successfully, in the order they were sent.
+func (r *Recorder) Events() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	events := make([]Event, len(r.events))
+	copy(events, r.events)
+	return events
+}
+
+// Failed returns all events that failed because of an injected failure, in the order
+// they were sent.
+func (r *Recorder) Failed() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	events := make([]Event, len(r.failed))
+	copy(events, r.failed)
+	return events
+}
+
+// EventsForOrder returns the events about the order, in the order they were sent.
+func (r *Recorder) EventsForOrder(orderID string) []Event {
+	return r.filter(func(evt Event) bool {
+		return evt.OrderID == orderID
+	})
+}
+
+// EventsOfType returns the events of the given type, in the order they were sent.
+func (r *Recorder) EventsOfType(eventType string) []Event {
+	return r.filter(func(evt Event) bool {
+		return evt.Type == eventType
+	})
+}
+
+// Last returns the last event of the given type, and false when there are no
+// events of that type.
+func (r *Recorder) Last(eventType string) (Event, bool) {
+	events := r.EventsOfType(eventType)
+	if len(events) == 0 {
+		return Event{}, false
+	}
+	return events[len(events)-1], true
+}
+
+// PaymentRequested returns the PaymentRequested events, in the order they were sent.
+func (r *Recorder) PaymentRequested() []acmeserverless.PaymentRequestedEvent {
+	var events []acmeserverless.PaymentRequestedEvent
+	for _, evt := range r.EventsOfType(acmeserverless.PaymentRequestedEventName) {
+		events = append(events, evt.Event.(acmeserverless.PaymentRequestedEvent))
+	}
+	return events
+}
+
+// ShipmentRequested returns the ShipmentRequested events, in the order they were sent.
+func (r *Recorder) ShipmentRequested() []acmeserverless.ShipmentRequested {
+	var events []acmeserverless.ShipmentRequested
+	for _, evt := range r.EventsOfType(acmeserverless.ShipmentRequestedEventName) {
+		events = append(events, evt.Event.(acmeserverless.ShipmentRequested))
+	}
+	return events
+}
+
+// OrderCancelled returns the OrderCancelled events, in the order they were sent.
+func (r *Recorder) OrderCancelled() []emitter.OrderCancelled {
+	var events []emitter.OrderCancelled
+	for _, evt := range r.EventsOfType(emitter.OrderCancelledEventName) {
+		events = append(events, evt.Event.(emitter.OrderCancelled))
+	}
+	return events
+}
+
+// filter returns the events for which keep returns true.
+func (r *Recorder) filter(keep func(evt Event) bool) []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var events []Event
+	for _, evt := range r.events {
+		if keep(evt) {
+			events = append(events, evt)
+		}
+	}
+	return events
+}
+
+// orUnavailable returns err, or ErrUnavailable when err is nil.
+func orUnavailable(err error) error {
+	if err == nil {
+		return ErrUnavailable
+	}
+	return err
+}
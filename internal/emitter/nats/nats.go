@@ -0,0 +1,224 @@
+// Package nats uses NATS, a simple, secure and high performance open source messaging system,
+// to send events. When JetStream is enabled, events are stored in a stream and the server
+// acknowledges every event, so events aren't lost when no consumer is listening.
+package nats
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/cloudevents"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+)
+
+const (
+	// DefaultPaymentSubject is the subject PaymentRequested events are sent to when
+	// the environment variable NATS_PAYMENT_SUBJECT isn't set.
+	DefaultPaymentSubject = "payment-request"
+
+	// DefaultShipmentSubject is the subject ShipmentRequested events are sent to when
+	// the environment variable NATS_SHIPMENT_SUBJECT isn't set.
+	DefaultShipmentSubject = "shipment-request"
+)
+
+// Subjects are the subjects the events are sent to.
+type Subjects struct {
+	// Payment is the subject for PaymentRequested events
+	Payment string
+
+	// Shipment is the subject for ShipmentRequested events
+	Shipment string
+
+	// Cancel is the subject for OrderCancelled events
+	Cancel string
+}
+
+// SubjectsFromEnv returns the subjects set in the environment variables NATS_PAYMENT_SUBJECT,
+// NATS_SHIPMENT_SUBJECT and NATS_CANCEL_SUBJECT. OrderCancelled events are sent to the
+// payment subject, unless NATS_CANCEL_SUBJECT is set.
+func SubjectsFromEnv() Subjects {
+	s := Subjects{
+		Payment:  getEnv("NATS_PAYMENT_SUBJECT", DefaultPaymentSubject),
+		Shipment: getEnv("NATS_SHIPMENT_SUBJECT", DefaultShipmentSubject),
+	}
+	s.Cancel = getEnv("NATS_CANCEL_SUBJECT", s.Payment)
+
+	return s
+}
+
+// JetStreamFromEnv returns true when the environment variable NATS_JETSTREAM is set to true.
+func JetStreamFromEnv() bool {
+	return strings.EqualFold(os.Getenv("NATS_JETSTREAM"), "true")
+}
+
+// Connect connects to the NATS server at the URL in the environment variable NATS_URL,
+// or to the default URL when it isn't set.
+func Connect() (*nats.Conn, error) {
+	return nats.Connect(getEnv("NATS_URL", nats.DefaultURL), nats.Name("acmeserverless-order"))
+}
+
+// responder implements the methods of the EventEmitter interface.
+type responder struct {
+	publish  func(ctx context.Context, subject string, data []byte) error
+	subjects Subjects
+	mode     cloudevents.Mode
+}
+
+// connOnce makes sure the connection is only created once, and conn and connErr
+// are the connection and the error of that attempt. openOnce does the same for
+// the emitter that uses the connection.
+var (
+	connOnce sync.Once
+	conn     *nats.Conn
+	connErr  error
+
+	openOnce sync.Once
+	shared   emitter.EventEmitter
+	openErr  error
+)
+
+// init registers the emitter as nats.
+func init() {
+	emitter.Register("nats", Open)
+}
+
+// Open creates a new instance of the EventEmitter with NATS as the messaging
+// layer, configured using the environment variables. The connection is only
+// created the first time, after that every call returns the same emitter, so
+// the process has a single connection to NATS.
+func Open() (emitter.EventEmitter, error) {
+	openOnce.Do(func() {
+		shared, openErr = open()
+	})
+
+	return shared, openErr
+}
+
+// open creates the emitter with the shared connection.
+func open() (emitter.EventEmitter, error) {
+	nc, err := Conn()
+	if err != nil {
+		return nil, err
+	}
+
+	em, err := NewWithConn(nc, JetStreamFromEnv(), SubjectsFromEnv())
+	if err != nil {
+		return nil, fmt.Errorf("error creating NATS emitter: %s", err.Error())
+	}
+
+	return em, nil
+}
+
+// Conn returns the connection that Open uses, so a process that also subscribes
+// to NATS has a single connection. The connection is created with Connect the
+// first time, after that every call returns the same connection.
+func Conn() (*nats.Conn, error) {
+	connOnce.Do(func() {
+		conn, connErr = Connect()
+		if connErr != nil {
+			connErr = fmt.Errorf("error connecting to NATS: %s", connErr.Error())
+		}
+	})
+
+	return conn, connErr
+}
+
+// New creates a new instance of the EventEmitter with NATS as the messaging
+// layer, configured using the environment variables. It stops the process when
+// it can't connect to NATS.
+func New() emitter.EventEmitter {
+	em, err := Open()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	return em
+}
+
+// NewWithConn creates a new instance of the EventEmitter that uses an existing
+// connection to a NATS server. When jetStream is true, the events are published
+// to JetStream and the method returns when the server stored the event.
+func NewWithConn(nc *nats.Conn, jetStream bool, subjects Subjects) (emitter.EventEmitter, error) {
+	r := responder{
+		publish: func(ctx context.Context, subject string, data []byte) error {
+			// Core NATS doesn't wait for the server, so the context is only
+			// checked before the event is published
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return nc.Publish(subject, data)
+		},
+		subjects: subjects,
+		mode:     cloudevents.ModeFromEnv(),
+	}
+
+	if jetStream {
+		js, err := nc.JetStream()
+		if err != nil {
+			return nil, fmt.Errorf("error creating JetStream context: %s", err.Error())
+		}
+
+		r.publish = func(ctx context.Context, subject string, data []byte) error {
+			_, err := js.Publish(subject, data, nats.Context(ctx))
+			return err
+		}
+	}
+
+	return r, nil
+}
+
+func (r responder) SendPaymentRequestedEvent(ctx context.Context, e acmeserverless.PaymentRequestedEvent) error {
+	payload, err := cloudevents.Encode(r.mode, &e, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), e.Metadata, e.Data.OrderID, e.Data)
+	if err != nil {
+		return err
+	}
+
+	return r.send(ctx, r.subjects.Payment, payload)
+}
+
+func (r responder) SendShipmentRequestedEvent(ctx context.Context, e acmeserverless.ShipmentRequested) error {
+	payload, err := cloudevents.Encode(r.mode, &e, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), e.Metadata, e.Data.OrderID, e.Data)
+	if err != nil {
+		return err
+	}
+
+	return r.send(ctx, r.subjects.Shipment, payload)
+}
+
+func (r responder) SendOrderCancelledEvent(ctx context.Context, e emitter.OrderCancelled) error {
+	payload, err := cloudevents.Encode(r.mode, &e, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), e.Metadata, e.Data.OrderID, e.Data)
+	if err != nil {
+		return err
+	}
+
+	return r.send(ctx, r.subjects.Cancel, payload)
+}
+
+// send publishes the event to the subject. The method returns an error if
+// anything goes wrong. Errors other than the cancellation of ctx wrap
+// emitter.ErrUnavailable.
+func (r responder) send(ctx context.Context, subject string, payload []byte) error {
+	if err := r.publish(ctx, subject, payload); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("error publishing to %s: %w", subject, ctx.Err())
+		}
+		return fmt.Errorf("error publishing to %s: %w: %s", subject, emitter.ErrUnavailable, err.Error())
+	}
+
+	return nil
+}
+
+// getEnv returns the value of the environment variable key, or fallback when
+// it isn't set.
+func getEnv(key string, fallback string) string {
+	if value := os.Getenv(key); len(value) > 0 {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,64 @@
+package nats
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	acmeserverless "github.com/retgits/acme-serverless"
+)
+
+func TestOpenSharesConnection(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+
+	os.Setenv("NATS_URL", s.ClientURL())
+	defer os.Unsetenv("NATS_URL")
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("Connect returned an error: %s", err.Error())
+	}
+	defer nc.Close()
+
+	sub, err := nc.SubscribeSync(DefaultShipmentSubject)
+	if err != nil {
+		t.Fatalf("SubscribeSync returned an error: %s", err.Error())
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Flush returned an error: %s", err.Error())
+	}
+
+	for i := 0; i < 3; i++ {
+		em, err := Open()
+		if err != nil {
+			t.Fatalf("Open returned an error: %s", err.Error())
+		}
+
+		evt := acmeserverless.ShipmentRequested{
+			Data: acmeserverless.ShipmentRequest{OrderID: "1", Delivery: "UPS/FEDEX"},
+		}
+		if err := em.SendShipmentRequestedEvent(context.Background(), evt); err != nil {
+			t.Fatalf("SendShipmentRequestedEvent returned an error: %s", err.Error())
+		}
+
+		if _, err := sub.NextMsg(time.Second); err != nil {
+			t.Fatalf("NextMsg returned an error: %s", err.Error())
+		}
+	}
+
+	// Conn returns the connection of the emitter
+	if _, err := Conn(); err != nil {
+		t.Fatalf("Conn returned an error: %s", err.Error())
+	}
+
+	// The connection of the test and the one of the emitter
+	if n := s.NumClients(); n != 2 {
+		t.Errorf("expected the emitters to share 1 connection, got %d connections", n-1)
+	}
+}
@@ -0,0 +1,78 @@
+package emitter
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Factory creates an EventEmitter. It is only called when the emitter is
+// selected, so emitters that aren't used never connect to their broker.
+type Factory func() (EventEmitter, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes an emitter available by the given name. Emitters call it
+// from their init function, so a binary can use every emitter it imports.
+// Register panics when it is called twice with the same name, or when factory
+// is nil.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if factory == nil {
+		panic("emitter: Register factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("emitter: Register called twice for " + name)
+	}
+	factories[name] = factory
+}
+
+// Backends returns the sorted names of the registered emitters.
+func Backends() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Open creates the emitter that was registered with the given name.
+func Open(name string) (EventEmitter, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[name]
+	factoriesMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("error opening emitter: unknown emitter %q (registered: %s)", name, strings.Join(Backends(), ", "))
+	}
+
+	em, err := factory()
+	if err != nil {
+		return nil, fmt.Errorf("error opening emitter %s: %w", name, err)
+	}
+
+	return em, nil
+}
+
+// FromEnv creates the emitter set in the environment variable ORDER_EMITTER
+// (like sqs, eventbridge, http or mock), or the fallback when it isn't set.
+func FromEnv(fallback string) (EventEmitter, error) {
+	name := os.Getenv("ORDER_EMITTER")
+	if len(name) == 0 {
+		name = fallback
+	}
+
+	return Open(name)
+}
@@ -0,0 +1,93 @@
+package resilient
+
+import (
+	"sync"
+	"time"
+)
+
+// breakers holds the circuit breakers by name, so the state of a circuit breaker
+// is kept while the process (like a warm Lambda container) is running.
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*breaker)
+)
+
+// breakerFor returns the circuit breaker with the given name, and creates it when
+// it doesn't exist yet.
+func breakerFor(name string, threshold int, timeout time.Duration) *breaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	b, ok := breakers[name]
+	if !ok {
+		b = &breaker{
+			threshold: threshold,
+			timeout:   timeout,
+		}
+		breakers[name] = b
+	}
+
+	return b
+}
+
+// breaker is a circuit breaker. It is closed while events can be sent, and opens
+// after threshold events in a row failed. While it is open, no events are sent.
+// After the timeout, a single event is let through: when it succeeds the breaker
+// closes, when it fails the breaker opens again.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	timeout   time.Duration
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+// allow returns true when an event can be sent.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return true
+	}
+
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+
+	// Half-open: let a single event through to see if the backend recovered
+	b.trial = true
+	return true
+}
+
+// success records an event that was sent.
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.trial = false
+}
+
+// failure records an event that couldn't be sent.
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.timeout)
+	}
+}
+
+// abort records an event that was given up because its context was cancelled.
+// It doesn't count as a failure, but lets another event through when the
+// breaker is half-open.
+func (b *breaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+}
@@ -0,0 +1,280 @@
+package resilient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+	"github.com/retgits/acme-serverless-order/internal/outbox"
+)
+
+// DeadLetter is an event that couldn't be sent. It is the same type as the dead
+// letters of a datastore, so it can be stored by DatastoreSink.
+type DeadLetter = datastore.DeadLetter
+
+// Sink stores the events that couldn't be sent, so they can be replayed later.
+type Sink interface {
+	Store(ctx context.Context, letter DeadLetter) error
+}
+
+// SinkFromEnv creates the dead-letter Sink from the environment variables. When
+// DEADLETTER_DATASTORE is set to the name of a datastore (like dynamodb), the events
+// are stored in that datastore. When DEADLETTER_QUEUE is set to the ARN of an SQS
+// queue, the events are sent to that queue. When DEADLETTER_FILE is set, the events
+// are appended to that file. When none of them is set, nil is returned.
+func SinkFromEnv() Sink {
+	if name := os.Getenv("DEADLETTER_DATASTORE"); len(name) > 0 {
+		return DatastoreSink{Name: name}
+	}
+
+	if arn := os.Getenv("DEADLETTER_QUEUE"); len(arn) > 0 {
+		return QueueSink{ARN: arn}
+	}
+
+	if path := os.Getenv("DEADLETTER_FILE"); len(path) > 0 {
+		return NewFileSink(path)
+	}
+
+	return nil
+}
+
+// FileSink appends dead letters to a file, one JSON document per line.
+type FileSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileSink creates a new FileSink that appends to the file at path.
+func NewFileSink(path string) *FileSink {
+	return &FileSink{
+		path: path,
+	}
+}
+
+// Store appends the dead letter to the file.
+func (s *FileSink) Store(ctx context.Context, letter DeadLetter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("error marshalling dead letter: %s", err.Error())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening dead-letter file: %s", err.Error())
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing dead-letter file: %s", err.Error())
+	}
+
+	return nil
+}
+
+// ReadFile reads the dead letters that a FileSink stored in the file at path.
+func ReadFile(path string) ([]DeadLetter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening dead-letter file: %s", err.Error())
+	}
+	defer f.Close()
+
+	var letters []DeadLetter
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(line), &letter); err != nil {
+			return nil, fmt.Errorf("error unmarshalling dead letter: %s", err.Error())
+		}
+		letters = append(letters, letter)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading dead-letter file: %s", err.Error())
+	}
+
+	return letters, nil
+}
+
+// QueueSink sends dead letters to an SQS queue. The AWS region this code looks
+// in to find the queue is determined by the environment variable REGION.
+type QueueSink struct {
+	// ARN is the ARN of the queue
+	ARN string
+}
+
+// Store sends the dead letter to the queue.
+func (s QueueSink) Store(ctx context.Context, letter DeadLetter) error {
+	body, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("error marshalling dead letter: %s", err.Error())
+	}
+
+	urlParts := strings.Split(s.ARN, ":")
+	if len(urlParts) < 6 {
+		return fmt.Errorf("error sending dead letter: invalid queue ARN %s", s.ARN)
+	}
+	queue := fmt.Sprintf("https://sqs.%s.amazonaws.com/%s/%s", urlParts[3], urlParts[4], urlParts[5])
+
+	awsSession := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("REGION")),
+	}))
+
+	svc := sqs.New(awsSession)
+
+	_, err = svc.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(queue),
+		MessageBody: aws.String(string(body)),
+	})
+	if err != nil {
+		return fmt.Errorf("error sending dead letter: %s", err.Error())
+	}
+
+	return nil
+}
+
+// DatastoreSink stores dead letters in a datastore. Use the DeadLetters method of the
+// datastore to read them, and RemoveDeadLetter after they have been replayed.
+type DatastoreSink struct {
+	// Name is the name of the datastore (like dynamodb or mongodb)
+	Name string
+}
+
+// Store adds the dead letter to the datastore.
+func (s DatastoreSink) Store(ctx context.Context, letter DeadLetter) error {
+	db, err := datastore.Open(s.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := db.AddDeadLetter(ctx, letter); err != nil {
+		return fmt.Errorf("error storing dead letter: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Replay sends the dead letters again using the emitter, and returns the dead
+// letters that still couldn't be sent. The emitter may be wrapped by New, events
+// that fail again are retried but not stored a second time.
+func Replay(ctx context.Context, e emitter.EventEmitter, letters []DeadLetter) ([]DeadLetter, error) {
+	var failed []DeadLetter
+	var errs []string
+
+	for _, letter := range letters {
+		if err := outbox.Send(ctx, e, letter.Event); err != nil {
+			letter.Error = err.Error()
+			letter.FailedAt = time.Now().UTC()
+			failed = append(failed, letter)
+			errs = append(errs, fmt.Sprintf("%s: %s", letter.Event.ID, err.Error()))
+		}
+	}
+
+	if len(errs) > 0 {
+		return failed, fmt.Errorf("error replaying %d dead letter(s): %s", len(errs), strings.Join(errs, "; "))
+	}
+
+	return nil, nil
+}
+
+// ReplayDatastore sends the dead letters in the datastore again using the emitter,
+// and removes the ones that were sent. The dead letters that still can't be sent
+// stay in the datastore. It returns the number of dead letters that were sent.
+func ReplayDatastore(ctx context.Context, m datastore.Manager, e emitter.EventEmitter) (int, error) {
+	sent := 0
+	failed := make(map[string]bool)
+	var errs []string
+
+	for {
+		letters, err := m.DeadLetters(ctx, outbox.DefaultBatchSize+int64(len(failed)))
+		if err != nil {
+			return sent, fmt.Errorf("error reading dead letters: %s", err.Error())
+		}
+
+		pending := 0
+		for _, letter := range letters {
+			if failed[letter.Event.ID] {
+				continue
+			}
+			pending++
+
+			if err := outbox.Send(ctx, e, letter.Event); err != nil {
+				// The dead letter stays in the datastore, so it is skipped for the rest of this run
+				failed[letter.Event.ID] = true
+				errs = append(errs, fmt.Sprintf("%s: %s", letter.Event.ID, err.Error()))
+				continue
+			}
+
+			if err := m.RemoveDeadLetter(ctx, letter.Event.ID); err != nil {
+				failed[letter.Event.ID] = true
+				errs = append(errs, fmt.Sprintf("%s: error removing dead letter: %s", letter.Event.ID, err.Error()))
+				continue
+			}
+			sent++
+		}
+
+		if pending == 0 {
+			break
+		}
+	}
+
+	if len(errs) > 0 {
+		return sent, fmt.Errorf("error replaying %d dead letter(s): %s", len(errs), strings.Join(errs, "; "))
+	}
+
+	return sent, nil
+}
+
+// ReplayFile sends the dead letters that a FileSink stored in the file at path again
+// using the emitter, and writes the dead letters that still can't be sent back to
+// the file. No FileSink should append to the file while it is replayed. It returns
+// the number of dead letters that were sent.
+func ReplayFile(ctx context.Context, path string, e emitter.EventEmitter) (int, error) {
+	letters, err := ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	failed, rerr := Replay(ctx, e, letters)
+
+	var b []byte
+	for _, letter := range failed {
+		line, err := json.Marshal(letter)
+		if err != nil {
+			return 0, fmt.Errorf("error marshalling dead letter: %s", err.Error())
+		}
+		b = append(b, append(line, '\n')...)
+	}
+
+	// Write to a temporary file first, so the dead letters aren't lost when writing fails
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return 0, fmt.Errorf("error writing dead-letter file: %s", err.Error())
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, fmt.Errorf("error writing dead-letter file: %s", err.Error())
+	}
+
+	return len(letters) - len(failed), rerr
+}
@@ -0,0 +1,260 @@
+// Package resilient wraps an EventEmitter to make sending events more reliable. Failed
+// events are tried again with an exponential backoff and jitter, and a circuit breaker
+// stops sending events to a backend that keeps failing. Events that can't be sent are
+// stored in a dead-letter Sink, so they can be replayed later.
+package resilient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/cloudevents"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+	"github.com/retgits/acme-serverless-order/internal/outbox"
+)
+
+const (
+	// DefaultAttempts is the number of times an event is sent when the environment
+	// variable EMITTER_ATTEMPTS isn't set.
+	DefaultAttempts = 3
+
+	// DefaultBackoff is the base delay between two attempts when the environment
+	// variable EMITTER_BACKOFF isn't set.
+	DefaultBackoff = 100 * time.Millisecond
+
+	// DefaultMaxBackoff is the longest delay between two attempts when the environment
+	// variable EMITTER_MAX_BACKOFF isn't set.
+	DefaultMaxBackoff = 2 * time.Second
+
+	// DefaultFailureThreshold is the number of events in a row that can't be sent
+	// before the circuit breaker opens, when the environment variable
+	// EMITTER_BREAKER_THRESHOLD isn't set.
+	DefaultFailureThreshold = 5
+
+	// DefaultOpenTimeout is how long the circuit breaker stays open before an event
+	// is tried again, when the environment variable EMITTER_BREAKER_TIMEOUT isn't set.
+	DefaultOpenTimeout = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned when an event isn't sent because the circuit breaker
+// is open. It wraps emitter.ErrUnavailable.
+var ErrCircuitOpen = fmt.Errorf("%w: circuit breaker is open", emitter.ErrUnavailable)
+
+// Config is the configuration of the resilient emitter.
+type Config struct {
+	// Name identifies the circuit breaker. Emitters with the same name share their
+	// circuit breaker, so the state is kept when an emitter is created for every
+	// invocation of a function.
+	Name string
+
+	// Attempts is the number of times an event is sent before it is given up
+	Attempts int
+
+	// Backoff is the base delay between two attempts, which doubles after every attempt
+	Backoff time.Duration
+
+	// MaxBackoff is the longest delay between two attempts
+	MaxBackoff time.Duration
+
+	// FailureThreshold is the number of events in a row that can't be sent before
+	// the circuit breaker opens
+	FailureThreshold int
+
+	// OpenTimeout is how long the circuit breaker stays open
+	OpenTimeout time.Duration
+
+	// DeadLetter stores the events that can't be sent (optional)
+	DeadLetter Sink
+}
+
+// ConfigFromEnv reads the configuration from the environment variables EMITTER_ATTEMPTS,
+// EMITTER_BACKOFF, EMITTER_MAX_BACKOFF, EMITTER_BREAKER_THRESHOLD and EMITTER_BREAKER_TIMEOUT.
+// The dead-letter Sink is created by SinkFromEnv.
+func ConfigFromEnv() Config {
+	cfg := Config{
+		Name:             "default",
+		Attempts:         DefaultAttempts,
+		Backoff:          DefaultBackoff,
+		MaxBackoff:       DefaultMaxBackoff,
+		FailureThreshold: DefaultFailureThreshold,
+		OpenTimeout:      DefaultOpenTimeout,
+		DeadLetter:       SinkFromEnv(),
+	}
+
+	if attempts, err := strconv.Atoi(os.Getenv("EMITTER_ATTEMPTS")); err == nil && attempts > 0 {
+		cfg.Attempts = attempts
+	}
+	if backoff, err := time.ParseDuration(os.Getenv("EMITTER_BACKOFF")); err == nil && backoff > 0 {
+		cfg.Backoff = backoff
+	}
+	if backoff, err := time.ParseDuration(os.Getenv("EMITTER_MAX_BACKOFF")); err == nil && backoff > 0 {
+		cfg.MaxBackoff = backoff
+	}
+	if threshold, err := strconv.Atoi(os.Getenv("EMITTER_BREAKER_THRESHOLD")); err == nil && threshold > 0 {
+		cfg.FailureThreshold = threshold
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("EMITTER_BREAKER_TIMEOUT")); err == nil && timeout > 0 {
+		cfg.OpenTimeout = timeout
+	}
+
+	return cfg
+}
+
+// responder implements the methods of the EventEmitter interface.
+type responder struct {
+	next    emitter.EventEmitter
+	cfg     Config
+	breaker *breaker
+}
+
+// New creates a new instance of the EventEmitter that sends the events using next.
+//
+// When an event can't be sent after all attempts, or when the circuit breaker is open,
+// the event is stored in the dead-letter Sink, so it can be replayed from there. Events
+// that are sent from the outbox (see outbox.Owned) aren't stored, because they stay in
+// the outbox and are sent again by the relay. The error is returned either way, and
+// wraps emitter.ErrUnavailable, so the caller doesn't act as if the event was sent: the
+// event stays in the outbox and the order keeps its status. Events that were rejected
+// keep the emitter.ErrValidation of the backend.
+func New(next emitter.EventEmitter, cfg Config) emitter.EventEmitter {
+	if cfg.Attempts <= 0 {
+		cfg.Attempts = 1
+	}
+
+	return responder{
+		next:    next,
+		cfg:     cfg,
+		breaker: breakerFor(cfg.Name, cfg.FailureThreshold, cfg.OpenTimeout),
+	}
+}
+
+func (r responder) SendPaymentRequestedEvent(ctx context.Context, e acmeserverless.PaymentRequestedEvent) error {
+	// Dead letters are stored like the event in the outbox, with the card encrypted,
+	// so they can be replayed with the full card
+	payload := func() ([]byte, error) {
+		evt, err := outbox.PaymentRequested(ctx, e)
+		return []byte(evt.Payload), err
+	}
+
+	return r.send(ctx, acmeserverless.PaymentRequestedEventName, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), payload, func() error {
+		return r.next.SendPaymentRequestedEvent(ctx, e)
+	})
+}
+
+func (r responder) SendShipmentRequestedEvent(ctx context.Context, e acmeserverless.ShipmentRequested) error {
+	return r.send(ctx, acmeserverless.ShipmentRequestedEventName, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), e.Marshal, func() error {
+		return r.next.SendShipmentRequestedEvent(ctx, e)
+	})
+}
+
+func (r responder) SendOrderCancelledEvent(ctx context.Context, e emitter.OrderCancelled) error {
+	return r.send(ctx, emitter.OrderCancelledEventName, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), e.Marshal, func() error {
+		return r.next.SendOrderCancelledEvent(ctx, e)
+	})
+}
+
+// send calls fn until it succeeds or until all attempts are used. Events that
+// were rejected with emitter.ErrValidation aren't tried again. When ctx is
+// cancelled, the error of ctx is returned, and the event isn't stored in the
+// dead-letter Sink because the caller will try again. The id is the ID of the
+// CloudEvent, which is used as the ID of the dead letter, and payload returns
+// the payload of the dead letter.
+func (r responder) send(ctx context.Context, eventType string, id string, payload func() ([]byte, error), fn func() error) error {
+	if !r.breaker.allow() {
+		return r.deadLetter(ctx, eventType, id, payload, ErrCircuitOpen)
+	}
+
+	var err error
+	for attempt := 0; attempt < r.cfg.Attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				r.breaker.abort()
+				return fmt.Errorf("error sending %s: %w", eventType, ctx.Err())
+			case <-time.After(r.backoff(attempt)):
+			}
+		}
+
+		err = fn()
+		if err == nil {
+			r.breaker.success()
+			return nil
+		}
+
+		// An event that was rejected will be rejected again, but the
+		// broker did respond, so it doesn't count as a failure
+		if errors.Is(err, emitter.ErrValidation) {
+			r.breaker.success()
+			return r.deadLetter(ctx, eventType, id, payload, fmt.Errorf("error sending %s: %w", eventType, err))
+		}
+	}
+
+	if ctx.Err() != nil {
+		r.breaker.abort()
+		return fmt.Errorf("error sending %s: %w", eventType, ctx.Err())
+	}
+
+	r.breaker.failure()
+
+	if !errors.Is(err, emitter.ErrUnavailable) {
+		err = fmt.Errorf("%w: %s", emitter.ErrUnavailable, err.Error())
+	}
+
+	return r.deadLetter(ctx, eventType, id, payload, fmt.Errorf("error sending %s after %d attempts: %w", eventType, r.cfg.Attempts, err))
+}
+
+// backoff returns the delay before the given attempt, using full jitter: a random
+// duration between zero and the exponential backoff.
+func (r responder) backoff(attempt int) time.Duration {
+	max := r.cfg.Backoff << uint(attempt-1)
+	if max <= 0 || max > r.cfg.MaxBackoff {
+		max = r.cfg.MaxBackoff
+	}
+	if max <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// deadLetter stores the event in the dead-letter Sink, with the given ID and the payload
+// in the same format as the outbox, so Replay can send it again, and returns
+// cause, with the ID of the dead letter when the event was stored. Events that are
+// sent from the outbox aren't stored, so they aren't sent twice when the dead letter
+// is replayed and the relay sends the event in the outbox.
+func (r responder) deadLetter(ctx context.Context, eventType string, id string, payload func() ([]byte, error), cause error) error {
+	if r.cfg.DeadLetter == nil || outbox.Owned(ctx) {
+		return cause
+	}
+
+	b, err := payload()
+	if err != nil {
+		return fmt.Errorf("%w (error marshalling dead letter: %s)", cause, err.Error())
+	}
+
+	letter := DeadLetter{
+		Event: datastore.OutboxEvent{
+			ID:      id,
+			Type:    eventType,
+			Payload: string(b),
+		},
+		Error:    cause.Error(),
+		FailedAt: time.Now().UTC(),
+	}
+
+	if err := r.cfg.DeadLetter.Store(ctx, letter); err != nil {
+		return fmt.Errorf("%w (error storing dead letter: %s)", cause, err.Error())
+	}
+
+	sentry.CaptureException(fmt.Errorf("event %s stored as dead letter: %s", letter.Event.ID, cause.Error()))
+
+	return fmt.Errorf("%w (stored as dead letter %s)", cause, letter.Event.ID)
+}
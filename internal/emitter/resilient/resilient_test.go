@@ -0,0 +1,282 @@
+package resilient_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/cloudevents"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/datastore/memory"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+	"github.com/retgits/acme-serverless-order/internal/emitter/mock"
+	"github.com/retgits/acme-serverless-order/internal/emitter/resilient"
+	"github.com/retgits/acme-serverless-order/internal/outbox"
+	"github.com/retgits/creditcard"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("CARD_TOKEN_KEY", "test")
+	os.Setenv("PII_KEYS", "1="+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	os.Exit(m.Run())
+}
+
+// sink keeps the dead letters in a datastore that isn't shared with other tests.
+type sink struct {
+	db datastore.Manager
+}
+
+func (s sink) Store(ctx context.Context, letter resilient.DeadLetter) error {
+	return s.db.AddDeadLetter(ctx, letter)
+}
+
+func config(name string, db datastore.Manager) resilient.Config {
+	return resilient.Config{
+		Name:             name,
+		Attempts:         2,
+		Backoff:          time.Millisecond,
+		MaxBackoff:       time.Millisecond,
+		FailureThreshold: 1,
+		OpenTimeout:      time.Minute,
+		DeadLetter:       sink{db},
+	}
+}
+
+func shipmentRequested(orderID string) acmeserverless.ShipmentRequested {
+	return acmeserverless.ShipmentRequested{
+		Metadata: acmeserverless.Metadata{
+			Domain: acmeserverless.OrderDomain,
+			Source: "ShipOrder",
+			Type:   acmeserverless.ShipmentRequestedEventName,
+			Status: acmeserverless.DefaultSuccessStatus,
+		},
+		Data: acmeserverless.ShipmentRequest{
+			OrderID:  orderID,
+			Delivery: "UPS/FEDEX",
+		},
+	}
+}
+
+func TestDeadLetterReturnsError(t *testing.T) {
+	db := memory.New()
+	rec := mock.NewRecorder()
+	rec.Fail(errors.New("connection reset"))
+
+	em := resilient.New(rec, config(t.Name(), db))
+
+	err := em.SendShipmentRequestedEvent(context.Background(), shipmentRequested("1"))
+	if !errors.Is(err, emitter.ErrUnavailable) {
+		t.Fatalf("expected an error that wraps emitter.ErrUnavailable, got %v", err)
+	}
+
+	letters, err := db.DeadLetters(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("DeadLetters returned an error: %s", err.Error())
+	}
+	if len(letters) != 1 || letters[0].Event.Type != acmeserverless.ShipmentRequestedEventName {
+		t.Fatalf("expected 1 ShipmentRequested dead letter, got %+v", letters)
+	}
+
+	// The circuit breaker is open now, which is an error as well
+	err = em.SendShipmentRequestedEvent(context.Background(), shipmentRequested("2"))
+	if !errors.Is(err, resilient.ErrCircuitOpen) || !errors.Is(err, emitter.ErrUnavailable) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+
+	letters, err = db.DeadLetters(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("DeadLetters returned an error: %s", err.Error())
+	}
+	if len(letters) != 2 {
+		t.Fatalf("expected 2 dead letters, got %d", len(letters))
+	}
+}
+
+func TestDeadLetterKeepsValidation(t *testing.T) {
+	db := memory.New()
+	rec := mock.NewRecorder()
+	rec.Fail(emitter.ErrValidation)
+
+	em := resilient.New(rec, config(t.Name(), db))
+
+	err := em.SendShipmentRequestedEvent(context.Background(), shipmentRequested("1"))
+	if !errors.Is(err, emitter.ErrValidation) {
+		t.Fatalf("expected an error that wraps emitter.ErrValidation, got %v", err)
+	}
+	if len(rec.Failed()) != 1 {
+		t.Errorf("a rejected event shouldn't be sent again, got %d attempts", len(rec.Failed()))
+	}
+}
+
+func TestDeliverKeepsEventInOutbox(t *testing.T) {
+	db := memory.New()
+	rec := mock.NewRecorder()
+	rec.Fail(nil)
+
+	em := resilient.New(rec, config(t.Name(), db))
+
+	req := shipmentRequested("1")
+	payload, err := req.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal returned an error: %s", err.Error())
+	}
+
+	evt := datastore.NewOutboxEvent(acmeserverless.ShipmentRequestedEventName, payload)
+	if _, err := db.AddOrder(context.Background(), acmeserverless.Order{OrderID: "1"}, evt); err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	if err := outbox.Deliver(context.Background(), db, em, evt); err == nil {
+		t.Fatalf("Deliver should fail when the event can't be sent")
+	}
+
+	events, err := db.OutboxEvents(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("OutboxEvents returned an error: %s", err.Error())
+	}
+	if len(events) != 1 || events[0].ID != evt.ID {
+		t.Fatalf("the event should stay in the outbox, got %+v", events)
+	}
+
+	// The relay sends the event again, so it isn't a dead letter
+	letters, err := db.DeadLetters(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("DeadLetters returned an error: %s", err.Error())
+	}
+	if len(letters) != 0 {
+		t.Fatalf("an event in the outbox shouldn't be stored as dead letter, got %+v", letters)
+	}
+}
+
+func TestDeadLetterEncryptsCard(t *testing.T) {
+	db := memory.New()
+	rec := mock.NewRecorder()
+	rec.Fail(nil)
+
+	em := resilient.New(rec, config(t.Name(), db))
+
+	req := acmeserverless.PaymentRequestedEvent{
+		Metadata: acmeserverless.Metadata{
+			Domain: acmeserverless.OrderDomain,
+			Source: "AddOrder",
+			Type:   acmeserverless.PaymentRequestedEventName,
+			Status: acmeserverless.DefaultSuccessStatus,
+		},
+		Data: acmeserverless.PaymentRequestDetails{
+			OrderID: "1",
+			Card: creditcard.Card{
+				Type:        "Visa",
+				Number:      "4111111111111111",
+				ExpiryMonth: 12,
+				ExpiryYear:  2030,
+				CVV:         "123",
+			},
+			Total: "8.00",
+		},
+	}
+
+	ctx := cloudevents.WithID(context.Background(), "evt-1")
+	if err := em.SendPaymentRequestedEvent(ctx, req); err == nil {
+		t.Fatalf("SendPaymentRequestedEvent should fail when the event can't be sent")
+	}
+
+	letters, err := db.DeadLetters(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("DeadLetters returned an error: %s", err.Error())
+	}
+	if len(letters) != 1 || letters[0].Event.ID != "evt-1" {
+		t.Fatalf("expected 1 dead letter with the ID of the CloudEvent, got %+v", letters)
+	}
+	if strings.Contains(letters[0].Event.Payload, "4111111111111111") || strings.Contains(letters[0].Event.Payload, `"123"`) {
+		t.Errorf("the dead letter should only have the encrypted card, got %s", letters[0].Event.Payload)
+	}
+
+	// The dead letter is replayed with the full card and removed
+	rec.Recover()
+	sent, err := resilient.ReplayDatastore(context.Background(), db, rec)
+	if err != nil || sent != 1 {
+		t.Fatalf("ReplayDatastore should send 1 dead letter, got %d (%v)", sent, err)
+	}
+	if got := rec.PaymentRequested(); len(got) != 1 || got[0].Data.Card != req.Data.Card {
+		t.Errorf("the dead letter should be replayed with the full card, got %+v", got)
+	}
+	if letters, _ := db.DeadLetters(context.Background(), 0); len(letters) != 0 {
+		t.Errorf("the replayed dead letter should be removed, got %+v", letters)
+	}
+}
+
+func TestReplayFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletters")
+	if err != nil {
+		t.Fatalf("TempDir returned an error: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "deadletters")
+	sink := resilient.NewFileSink(path)
+
+	letter := resilient.DeadLetter{
+		Event:    datastore.NewOutboxEvent(acmeserverless.ShipmentRequestedEventName, []byte(`{"request":"ship"}`)),
+		Error:    "error sending ShipmentRequested",
+		FailedAt: time.Now().UTC(),
+	}
+	if err := sink.Store(context.Background(), letter); err != nil {
+		t.Fatalf("Store returned an error: %s", err.Error())
+	}
+
+	rec := mock.NewRecorder()
+	rec.Fail(nil)
+
+	// The dead letter stays in the file while it can't be sent
+	if sent, err := resilient.ReplayFile(context.Background(), path, rec); err == nil || sent != 0 {
+		t.Fatalf("ReplayFile should fail when the event can't be sent, got %d (%v)", sent, err)
+	}
+	letters, err := resilient.ReadFile(path)
+	if err != nil || len(letters) != 1 || letters[0].Event.ID != letter.Event.ID {
+		t.Fatalf("the dead letter should stay in the file, got %+v (%v)", letters, err)
+	}
+
+	rec.Recover()
+	if sent, err := resilient.ReplayFile(context.Background(), path, rec); err != nil || sent != 1 {
+		t.Fatalf("ReplayFile should send 1 dead letter, got %d (%v)", sent, err)
+	}
+	if letters, _ := resilient.ReadFile(path); len(letters) != 0 {
+		t.Errorf("the replayed dead letter should be removed from the file, got %+v", letters)
+	}
+}
+
+func TestDatastoreSink(t *testing.T) {
+	letter := resilient.DeadLetter{
+		Event:    datastore.NewOutboxEvent(acmeserverless.ShipmentRequestedEventName, []byte(`{}`)),
+		Error:    "error sending ShipmentRequested",
+		FailedAt: time.Now().UTC(),
+	}
+
+	if err := (resilient.DatastoreSink{Name: "memory"}).Store(context.Background(), letter); err != nil {
+		t.Fatalf("Store returned an error: %s", err.Error())
+	}
+
+	db, err := datastore.Open("memory")
+	if err != nil {
+		t.Fatalf("Open returned an error: %s", err.Error())
+	}
+
+	letters, err := db.DeadLetters(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("DeadLetters returned an error: %s", err.Error())
+	}
+	for _, d := range letters {
+		if d.Event.ID == letter.Event.ID {
+			return
+		}
+	}
+	t.Fatalf("the dead letter should be stored in the datastore, got %+v", letters)
+}
@@ -4,50 +4,75 @@
 package sqs
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/cloudevents"
 	"github.com/retgits/acme-serverless-order/internal/emitter"
 )
 
-// responder is an empty struct that implements the methods of the
-// EventEmitter interface.
-type responder struct{}
+// responder implements the methods of the EventEmitter interface. The mode
+// determines whether events are wrapped in a CloudEvent.
+type responder struct {
+	mode cloudevents.Mode
+}
+
+// init registers the emitter as sqs.
+func init() {
+	emitter.Register("sqs", func() (emitter.EventEmitter, error) {
+		return New(), nil
+	})
+}
 
 // New creates a new instance of the EventEmitter with SQS
-// as the messaging layer.
+// as the messaging layer. When the environment variable CLOUDEVENTS_MODE
+// is set, events are sent as CloudEvents in structured mode.
 func New() emitter.EventEmitter {
-	return responder{}
+	return responder{
+		mode: cloudevents.ModeFromEnv(),
+	}
 }
 
-func (r responder) SendPaymentRequestedEvent(e acmeserverless.PaymentRequestedEvent) error {
-	payload, err := e.Marshal()
+func (r responder) SendPaymentRequestedEvent(ctx context.Context, e acmeserverless.PaymentRequestedEvent) error {
+	payload, err := cloudevents.Encode(r.mode, &e, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), e.Metadata, e.Data.OrderID, e.Data)
 	if err != nil {
 		return err
 	}
 
-	return send(string(payload))
+	return send(ctx, string(payload))
 }
 
-func (r responder) SendShipmentRequestedEvent(e acmeserverless.ShipmentRequested) error {
-	payload, err := e.Marshal()
+func (r responder) SendShipmentRequestedEvent(ctx context.Context, e acmeserverless.ShipmentRequested) error {
+	payload, err := cloudevents.Encode(r.mode, &e, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), e.Metadata, e.Data.OrderID, e.Data)
 	if err != nil {
 		return err
 	}
 
-	return send(string(payload))
+	return send(ctx, string(payload))
+}
+
+func (r responder) SendOrderCancelledEvent(ctx context.Context, e emitter.OrderCancelled) error {
+	payload, err := cloudevents.Encode(r.mode, &e, cloudevents.ID(ctx, e.Metadata, e.Data.OrderID), e.Metadata, e.Data.OrderID, e.Data)
+	if err != nil {
+		return err
+	}
+
+	return send(ctx, string(payload))
 }
 
 // send sends the event to an SQS queue. The SQS queue is determined
 // by the environment variable RESPONSEQUEUE. The AWS region this code
 // looks in to find the queue is determined by the environment
 // variable REGION. The method returns an error if anything goes wrong.
-func send(payload string) error {
+func send(ctx context.Context, payload string) error {
 	awsSession := session.Must(session.NewSession(&aws.Config{
 		Region: aws.String(os.Getenv("REGION")),
 	}))
@@ -62,10 +87,25 @@ func send(payload string) error {
 		MessageBody: aws.String(payload),
 	}
 
-	_, err := svc.SendMessage(sendMessageInput)
+	_, err := svc.SendMessageWithContext(ctx, sendMessageInput)
 	if err != nil {
-		return err
+		return sendError(err)
 	}
 
 	return nil
 }
+
+// sendError returns the error of a call to SQS. Errors that can go away when the
+// call is tried again later, like throttled requests and server errors, wrap
+// emitter.ErrUnavailable.
+func sendError(err error) error {
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return fmt.Errorf("%w: %s", emitter.ErrUnavailable, err.Error())
+	}
+
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() >= 500 {
+		return fmt.Errorf("%w: %s", emitter.ErrUnavailable, err.Error())
+	}
+
+	return err
+}
@@ -0,0 +1,241 @@
+// Package kafkaworker consumes the responses of the Payment and Shipment services from
+// Apache Kafka and updates the orders, like the lambda-order-sqs-ship and
+// lambda-order-sqs-update functions do for Amazon SQS.
+//
+// The offset of a message is committed after the message was handled. A message that
+// fails is tried again, with an increasing delay, before the next message of the same
+// partition is handled, so the events of an order are applied in the order they were
+// sent. Messages that can never succeed, like messages that can't be unmarshalled or
+// events that don't fit the lifecycle of the order, are reported to Sentry and committed.
+// Whether a message can succeed is decided by service.Retry.
+//
+// The Worker reads messages through the Reader interface, so it can be tested against an
+// in-process stand-in for Kafka.
+package kafkaworker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/retgits/acme-serverless-order/internal/cloudevents"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/service"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// DefaultGroupID is the consumer group of the worker when the environment variable
+	// KAFKA_GROUP_ID isn't set.
+	DefaultGroupID = "order"
+
+	// DefaultPaymentTopic is the topic the responses of the Payment service are read
+	// from when the environment variable KAFKA_PAYMENT_RESPONSE_TOPIC isn't set.
+	DefaultPaymentTopic = "payment-response"
+
+	// DefaultShipmentTopic is the topic the responses of the Shipment service are read
+	// from when the environment variable KAFKA_SHIPMENT_RESPONSE_TOPIC isn't set.
+	DefaultShipmentTopic = "shipment-response"
+
+	// MaxBackoff is the longest delay between two attempts to handle a message.
+	MaxBackoff = 30 * time.Second
+)
+
+// Reader reads messages from a Kafka topic as a member of a consumer group. A *kafka.Reader
+// implements Reader, and tests can use an in-process stand-in.
+type Reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// NewReader creates a reader for the topic that is a member of the consumer group
+// set in the environment variable KAFKA_GROUP_ID. Offsets are committed when
+// CommitMessages is called.
+func NewReader(brokers []string, topic string) *kafka.Reader {
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers: brokers,
+		GroupID: getEnv("KAFKA_GROUP_ID", DefaultGroupID),
+		Topic:   topic,
+	})
+}
+
+// PaymentTopic returns the topic set in the environment variable KAFKA_PAYMENT_RESPONSE_TOPIC.
+func PaymentTopic() string {
+	return getEnv("KAFKA_PAYMENT_RESPONSE_TOPIC", DefaultPaymentTopic)
+}
+
+// ShipmentTopic returns the topic set in the environment variable KAFKA_SHIPMENT_RESPONSE_TOPIC.
+func ShipmentTopic() string {
+	return getEnv("KAFKA_SHIPMENT_RESPONSE_TOPIC", DefaultShipmentTopic)
+}
+
+// Worker reads the responses of the Payment and Shipment services.
+type Worker struct {
+	db       datastore.Manager
+	svc      *service.Service
+	payment  Reader
+	shipment Reader
+
+	// Backoff is the delay before a failed message is tried again, which
+	// doubles after every attempt up to MaxBackoff
+	Backoff time.Duration
+}
+
+// New creates a new Worker that handles the messages from the payment and shipment
+// readers with svc. The datastore db keeps track of the messages that were processed.
+func New(db datastore.Manager, svc *service.Service, payment Reader, shipment Reader) *Worker {
+	return &Worker{
+		db:       db,
+		svc:      svc,
+		payment:  payment,
+		shipment: shipment,
+		Backoff:  time.Second,
+	}
+}
+
+// Run reads and handles messages until ctx is cancelled, and closes the readers
+// before it returns. It returns the first error of a reader, other than the
+// cancellation of ctx.
+func (w *Worker) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	loops := []struct {
+		reader   Reader
+		consumer string
+		handle   func(ctx context.Context, msg kafka.Message) error
+	}{
+		{w.payment, "ShipOrder", w.shipOrder},
+		{w.shipment, "UpdateOrder", w.updateOrder},
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(loops))
+
+	for _, l := range loops {
+		wg.Add(1)
+		go func(r Reader, consumer string, handle func(ctx context.Context, msg kafka.Message) error) {
+			defer wg.Done()
+			if err := w.consume(ctx, r, consumer, handle); err != nil {
+				errs <- err
+				cancel()
+			}
+		}(l.reader, l.consumer, l.handle)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	var err error
+	for _, r := range []Reader{w.payment, w.shipment} {
+		if cerr := r.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	if rerr, ok := <-errs; ok {
+		return rerr
+	}
+	return err
+}
+
+// consume reads messages from r until ctx is cancelled.
+func (w *Worker) consume(ctx context.Context, r Reader, consumer string, handle func(ctx context.Context, msg kafka.Message) error) error {
+	for {
+		msg, err := r.FetchMessage(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error fetching message: %s", err.Error())
+		}
+
+		// Kafka delivers messages at least once, for example after a rebalance
+		// of the consumer group, so messages that were already processed are skipped
+		eventID := datastore.EventID(consumer, fmt.Sprintf("%s-%d-%d", msg.Topic, msg.Partition, msg.Offset))
+
+		backoff := w.Backoff
+		for {
+			err = datastore.Once(ctx, w.db, eventID, func() error {
+				return handle(ctx, msg)
+			})
+			if err == nil {
+				break
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2
+			if backoff > MaxBackoff {
+				backoff = MaxBackoff
+			}
+		}
+
+		if err := r.CommitMessages(ctx, msg); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("error committing message: %s", err.Error())
+		}
+	}
+}
+
+// shipOrder updates the order with the result of the payment and, when the payment
+// was successful, requests the shipment of the order.
+func (w *Worker) shipOrder(ctx context.Context, msg kafka.Message) error {
+	payload, err := unwrap(msg)
+	if err != nil {
+		return service.Report(service.Malformed(err))
+	}
+
+	return service.Report(w.svc.HandlePaymentPayload(ctx, payload))
+}
+
+// updateOrder updates the order with the status of the shipment.
+func (w *Worker) updateOrder(ctx context.Context, msg kafka.Message) error {
+	payload, err := unwrap(msg)
+	if err != nil {
+		return service.Report(service.Malformed(err))
+	}
+
+	return service.Report(w.svc.HandleShipmentPayload(ctx, payload))
+}
+
+// unwrap returns the value of the message in the format of the ACME Serverless Fitness
+// Shop. Events can also arrive as a CloudEvent in binary mode, with the attributes in the
+// headers of the message, which the Service can't see. Structured mode and unwrapped
+// events are returned as they are.
+func unwrap(msg kafka.Message) ([]byte, error) {
+	header := func(key string) string {
+		// The Kafka binding of CloudEvents uses ce_ instead of ce- as prefix
+		key = strings.Replace(key, "ce-", "ce_", 1)
+		for _, h := range msg.Headers {
+			if h.Key == key {
+				return string(h.Value)
+			}
+		}
+		return ""
+	}
+
+	if len(header("ce-specversion")) == 0 {
+		return msg.Value, nil
+	}
+	return cloudevents.UnwrapHTTP(header, msg.Value)
+}
+
+// getEnv returns the value of the environment variable key, or fallback when
+// it isn't set.
+func getEnv(key string, fallback string) string {
+	if value := os.Getenv(key); len(value) > 0 {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,334 @@
+package kafkaworker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/datastore/memory"
+	"github.com/retgits/acme-serverless-order/internal/emitter/mock"
+	"github.com/retgits/acme-serverless-order/internal/service"
+	"github.com/segmentio/kafka-go"
+)
+
+// reader is an in-process stand-in for a partition of a Kafka topic. It returns
+// its messages in order, and blocks when there are no messages left.
+type reader struct {
+	mu        sync.Mutex
+	topic     string
+	messages  []kafka.Message
+	committed []int64
+	fetchErr  error
+	closed    bool
+}
+
+func newReader(topic string, values ...[]byte) *reader {
+	r := &reader{topic: topic}
+	for _, v := range values {
+		r.add(v)
+	}
+	return r
+}
+
+// add appends a message with the next offset to the topic.
+func (r *reader) add(value []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.messages = append(r.messages, kafka.Message{
+		Topic:  r.topic,
+		Offset: int64(len(r.messages)),
+		Value:  value,
+	})
+}
+
+// redeliver appends a copy of the message at offset, like Kafka does after a
+// rebalance of the consumer group.
+func (r *reader) redeliver(offset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.messages = append(r.messages, r.messages[offset])
+}
+
+func (r *reader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	for {
+		r.mu.Lock()
+		if r.fetchErr != nil {
+			r.mu.Unlock()
+			return kafka.Message{}, r.fetchErr
+		}
+		if len(r.messages) > 0 {
+			msg := r.messages[0]
+			r.messages = r.messages[1:]
+			r.mu.Unlock()
+			return msg, nil
+		}
+		r.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (r *reader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, msg := range msgs {
+		r.committed = append(r.committed, msg.Offset)
+	}
+	return nil
+}
+
+func (r *reader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	return nil
+}
+
+func (r *reader) commits() []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]int64(nil), r.committed...)
+}
+
+func creditCardValidated(t *testing.T, orderID string) []byte {
+	evt := acmeserverless.CreditCardValidatedEvent{
+		Metadata: acmeserverless.Metadata{
+			Domain: acmeserverless.PaymentDomain,
+			Source: "ValidateCreditCard",
+			Type:   acmeserverless.CreditCardValidatedEventName,
+			Status: acmeserverless.DefaultSuccessStatus,
+		},
+		Data: acmeserverless.CreditCardValidationDetails{
+			Success:       true,
+			Status:        200,
+			Message:       "transaction successful",
+			Amount:        "10.00",
+			OrderID:       orderID,
+			TransactionID: "1",
+		},
+	}
+
+	payload, err := evt.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal returned an error: %s", err.Error())
+	}
+	return payload
+}
+
+// run starts the worker and returns a function that stops it and returns the
+// error of Run.
+func run(w *Worker) func() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- w.Run(ctx)
+	}()
+
+	return func() error {
+		cancel()
+		return <-done
+	}
+}
+
+// waitForCommits waits until the reader committed the expected offsets.
+func waitForCommits(t *testing.T, r *reader, n int) []int64 {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		commits := r.commits()
+		if len(commits) >= n {
+			return commits
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d commits on %s, got %v", n, r.topic, commits)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// flaky is a datastore that is unavailable for the next status updates, set with failNext.
+type flaky struct {
+	datastore.Manager
+
+	mu     sync.Mutex
+	fail   int
+	failed int
+}
+
+// failNext makes the next n status updates fail with datastore.ErrUnavailable.
+func (f *flaky) failNext(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.fail = n
+}
+
+func (f *flaky) UpdateStatus(ctx context.Context, s acmeserverless.ShipmentData, m acmeserverless.Metadata, outbox ...datastore.OutboxEvent) (acmeserverless.Order, error) {
+	f.mu.Lock()
+	if f.fail > 0 {
+		f.fail--
+		f.failed++
+		f.mu.Unlock()
+		return acmeserverless.Order{}, datastore.ErrUnavailable
+	}
+	f.mu.Unlock()
+
+	return f.Manager.UpdateStatus(ctx, s, m, outbox...)
+}
+
+// failures returns the number of status updates that failed.
+func (f *flaky) failures() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.failed
+}
+
+func newWorker(payment *reader, shipment *reader) (*Worker, *flaky, *mock.Recorder) {
+	db := &flaky{Manager: memory.New()}
+	rec := mock.NewRecorder()
+
+	w := New(db, service.New(db, rec), payment, shipment)
+	w.Backoff = time.Millisecond
+
+	return w, db, rec
+}
+
+func addOrder(t *testing.T, db datastore.Manager) acmeserverless.Order {
+	ord, err := db.AddOrder(context.Background(), acmeserverless.Order{Delivery: "UPS/FEDEX"})
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+	return ord
+}
+
+func statusOf(t *testing.T, db datastore.Manager, orderID string) string {
+	ord, err := db.GetOrder(context.Background(), orderID)
+	if err != nil {
+		t.Fatalf("GetOrder returned an error: %s", err.Error())
+	}
+	if ord.Status == nil {
+		return ""
+	}
+	return *ord.Status
+}
+
+func TestWorker(t *testing.T) {
+	tests := []struct {
+		name      string
+		failNext  int
+		redeliver bool
+		malformed bool
+	}{
+		{name: "success"},
+		{name: "failed update is tried again before commit", failNext: 2},
+		{name: "redelivered message is skipped", redeliver: true},
+		{name: "malformed message is committed", malformed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payment := newReader("payment-response")
+			shipment := newReader("shipment-response")
+			w, db, rec := newWorker(payment, shipment)
+
+			ord := addOrder(t, db)
+			db.failNext(tt.failNext)
+
+			if tt.malformed {
+				payment.add([]byte("{"))
+			}
+			payment.add(creditCardValidated(t, ord.OrderID))
+			if tt.redeliver {
+				payment.redeliver(0)
+			}
+
+			n := len(payment.messages)
+			stop := run(w)
+
+			commits := waitForCommits(t, payment, n)
+			if err := stop(); err != nil {
+				t.Fatalf("Run returned an error: %s", err.Error())
+			}
+
+			for i, offset := range commits {
+				if i > 0 && offset < commits[i-1] && !tt.redeliver {
+					t.Errorf("offsets should be committed in order, got %v", commits)
+				}
+			}
+
+			if n := db.failures(); n != tt.failNext {
+				t.Errorf("expected %d failed updates, got %d", tt.failNext, n)
+			}
+			if n := len(rec.ShipmentRequested()); n != 1 {
+				t.Errorf("expected 1 ShipmentRequested event, got %d", n)
+			}
+			if status := statusOf(t, db, ord.OrderID); status != datastore.StatusShipmentRequested {
+				t.Errorf("expected status %q, got %q", datastore.StatusShipmentRequested, status)
+			}
+			if !payment.closed || !shipment.closed {
+				t.Errorf("Run should close the readers")
+			}
+		})
+	}
+}
+
+func TestWorkerKeepsOrderOfPartition(t *testing.T) {
+	payment := newReader("payment-response")
+	shipment := newReader("shipment-response")
+	w, db, rec := newWorker(payment, shipment)
+
+	first := addOrder(t, db)
+	second := addOrder(t, db)
+
+	// The first order can't be updated the first time, which shouldn't let the
+	// second order overtake it
+	db.failNext(1)
+
+	payment.add(creditCardValidated(t, first.OrderID))
+	payment.add(creditCardValidated(t, second.OrderID))
+
+	stop := run(w)
+
+	commits := waitForCommits(t, payment, 2)
+	if err := stop(); err != nil {
+		t.Fatalf("Run returned an error: %s", err.Error())
+	}
+
+	if commits[0] != 0 || commits[1] != 1 {
+		t.Errorf("offsets should be committed in order, got %v", commits)
+	}
+
+	events := rec.ShipmentRequested()
+	if len(events) != 2 || events[0].Data.OrderID != first.OrderID || events[1].Data.OrderID != second.OrderID {
+		t.Errorf("the shipments should be requested in the order of the partition, got %+v", events)
+	}
+}
+
+func TestWorkerReturnsFetchError(t *testing.T) {
+	payment := newReader("payment-response")
+	shipment := newReader("shipment-response")
+	w, _, _ := newWorker(payment, shipment)
+
+	payment.fetchErr = errors.New("broker not available")
+
+	if err := w.Run(context.Background()); err == nil {
+		t.Fatalf("Run should return the error of a reader")
+	}
+	if !payment.closed || !shipment.closed {
+		t.Errorf("Run should close the readers")
+	}
+}
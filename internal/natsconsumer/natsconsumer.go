@@ -0,0 +1,200 @@
+// Package natsconsumer receives the responses of the Payment and Shipment services from
+// NATS and updates the orders, like the lambda-order-sqs-ship and lambda-order-sqs-update
+// functions do for Amazon SQS.
+//
+// The Consumer only needs a connection to a NATS server, so it can be tested against an
+// embedded nats-server.
+package natsconsumer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/service"
+)
+
+const (
+	// DefaultPaymentSubject is the subject the responses of the Payment service are
+	// received on when the environment variable NATS_PAYMENT_RESPONSE_SUBJECT isn't set.
+	DefaultPaymentSubject = "payment-response"
+
+	// DefaultShipmentSubject is the subject the responses of the Shipment service are
+	// received on when the environment variable NATS_SHIPMENT_RESPONSE_SUBJECT isn't set.
+	DefaultShipmentSubject = "shipment-response"
+
+	// DefaultQueue is the queue group of the consumer when the environment variable
+	// NATS_QUEUE isn't set. Every event is handled by one member of the queue group.
+	DefaultQueue = "order"
+
+	// HandlerTimeout is how long handling a single event may take. It matches the
+	// default AckWait of JetStream, after which the event is delivered again.
+	HandlerTimeout = 30 * time.Second
+)
+
+// Config is the configuration of the Consumer.
+type Config struct {
+	// PaymentSubject is the subject for CreditCardValidated events
+	PaymentSubject string
+
+	// ShipmentSubject is the subject for SentShipment and DeliveredShipment events
+	ShipmentSubject string
+
+	// Queue is the queue group of the consumer, which is also used as the
+	// name of the durable JetStream consumers
+	Queue string
+
+	// JetStream receives the events from JetStream. Events are acknowledged when
+	// they are handled, and events that failed are delivered again.
+	JetStream bool
+}
+
+// ConfigFromEnv reads the configuration from the environment variables
+// NATS_PAYMENT_RESPONSE_SUBJECT, NATS_SHIPMENT_RESPONSE_SUBJECT, NATS_QUEUE
+// and NATS_JETSTREAM.
+func ConfigFromEnv() Config {
+	return Config{
+		PaymentSubject:  getEnv("NATS_PAYMENT_RESPONSE_SUBJECT", DefaultPaymentSubject),
+		ShipmentSubject: getEnv("NATS_SHIPMENT_RESPONSE_SUBJECT", DefaultShipmentSubject),
+		Queue:           getEnv("NATS_QUEUE", DefaultQueue),
+		JetStream:       strings.EqualFold(os.Getenv("NATS_JETSTREAM"), "true"),
+	}
+}
+
+// Consumer subscribes to the responses of the Payment and Shipment services.
+type Consumer struct {
+	nc   *nats.Conn
+	db   datastore.Manager
+	svc  *service.Service
+	cfg  Config
+	subs []*nats.Subscription
+}
+
+// New creates a new Consumer that receives events using nc, and handles them
+// with svc. The datastore db keeps track of the events that were processed.
+func New(nc *nats.Conn, db datastore.Manager, svc *service.Service, cfg Config) *Consumer {
+	return &Consumer{
+		nc:  nc,
+		db:  db,
+		svc: svc,
+		cfg: cfg,
+	}
+}
+
+// Start subscribes to the subjects. Events are handled in the background until
+// Close is called.
+func (c *Consumer) Start() error {
+	handlers := []struct {
+		subject  string
+		consumer string
+		handle   func(ctx context.Context, payload []byte) error
+	}{
+		{c.cfg.PaymentSubject, "ShipOrder", c.shipOrder},
+		{c.cfg.ShipmentSubject, "UpdateOrder", c.updateOrder},
+	}
+
+	var js nats.JetStreamContext
+	if c.cfg.JetStream {
+		var err error
+		js, err = c.nc.JetStream()
+		if err != nil {
+			return fmt.Errorf("error creating JetStream context: %s", err.Error())
+		}
+	}
+
+	for _, h := range handlers {
+		cb := c.callback(h.consumer, h.handle)
+
+		var sub *nats.Subscription
+		var err error
+		if js != nil {
+			sub, err = js.QueueSubscribe(h.subject, c.cfg.Queue, cb, nats.Durable(fmt.Sprintf("%s-%s", c.cfg.Queue, h.consumer)), nats.ManualAck())
+		} else {
+			sub, err = c.nc.QueueSubscribe(h.subject, c.cfg.Queue, cb)
+		}
+		if err != nil {
+			c.Close()
+			return fmt.Errorf("error subscribing to %s: %s", h.subject, err.Error())
+		}
+
+		c.subs = append(c.subs, sub)
+	}
+
+	return nil
+}
+
+// Close stops receiving events. Events that are being handled are finished first.
+func (c *Consumer) Close() error {
+	var err error
+	for _, sub := range c.subs {
+		if serr := sub.Drain(); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	c.subs = nil
+
+	return err
+}
+
+// callback returns the handler for the messages of a subject. NATS delivers JetStream
+// messages at least once, so messages that were already processed are skipped. When
+// handling a JetStream message fails, the message is delivered again.
+func (c *Consumer) callback(consumer string, handle func(ctx context.Context, payload []byte) error) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		ctx, cancel := context.WithTimeout(context.Background(), HandlerTimeout)
+		defer cancel()
+
+		err := datastore.Once(ctx, c.db, datastore.EventID(consumer, messageID(msg)), func() error {
+			return handle(ctx, msg.Data)
+		})
+
+		if !c.cfg.JetStream {
+			return
+		}
+
+		if err != nil {
+			msg.Nak()
+			return
+		}
+		msg.Ack()
+	}
+}
+
+// messageID returns the identifier of a message. JetStream messages are identified by
+// their position in the stream, other messages by the Nats-Msg-Id header or a hash of
+// the payload.
+func messageID(msg *nats.Msg) string {
+	if meta, err := msg.Metadata(); err == nil {
+		return fmt.Sprintf("%s-%d", meta.Stream, meta.Sequence.Stream)
+	}
+
+	if id := msg.Header.Get(nats.MsgIdHdr); len(id) > 0 {
+		return id
+	}
+
+	return datastore.HashEventID(msg.Subject, msg.Data)
+}
+
+// shipOrder updates the order with the result of the payment and, when the payment
+// was successful, requests the shipment of the order.
+func (c *Consumer) shipOrder(ctx context.Context, payload []byte) error {
+	return service.Report(c.svc.HandlePaymentPayload(ctx, payload))
+}
+
+// updateOrder updates the order with the status of the shipment.
+func (c *Consumer) updateOrder(ctx context.Context, payload []byte) error {
+	return service.Report(c.svc.HandleShipmentPayload(ctx, payload))
+}
+
+// getEnv returns the value of the environment variable key, or fallback when
+// it isn't set.
+func getEnv(key string, fallback string) string {
+	if value := os.Getenv(key); len(value) > 0 {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,232 @@
+package natsconsumer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/datastore/memory"
+	"github.com/retgits/acme-serverless-order/internal/emitter/mock"
+	"github.com/retgits/acme-serverless-order/internal/service"
+)
+
+// startServer runs an embedded nats-server on a random port and connects to it.
+func startServer(t *testing.T, jetStream bool) *nats.Conn {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+
+	if jetStream {
+		dir, err := ioutil.TempDir("", "natsconsumer")
+		if err != nil {
+			t.Fatalf("TempDir returned an error: %s", err.Error())
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+
+		opts.JetStream = true
+		opts.StoreDir = dir
+	}
+
+	s := natsserver.RunServer(&opts)
+	t.Cleanup(s.Shutdown)
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("Connect returned an error: %s", err.Error())
+	}
+	t.Cleanup(nc.Close)
+
+	return nc
+}
+
+// flaky is a datastore that is unavailable for the next status updates, set with failNext.
+type flaky struct {
+	datastore.Manager
+
+	mu     sync.Mutex
+	fail   int
+	failed int
+}
+
+// failNext makes the next n status updates fail with datastore.ErrUnavailable.
+func (f *flaky) failNext(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.fail = n
+}
+
+func (f *flaky) UpdateStatus(ctx context.Context, s acmeserverless.ShipmentData, m acmeserverless.Metadata, outbox ...datastore.OutboxEvent) (acmeserverless.Order, error) {
+	f.mu.Lock()
+	if f.fail > 0 {
+		f.fail--
+		f.failed++
+		f.mu.Unlock()
+		return acmeserverless.Order{}, datastore.ErrUnavailable
+	}
+	f.mu.Unlock()
+
+	return f.Manager.UpdateStatus(ctx, s, m, outbox...)
+}
+
+// failures returns the number of status updates that failed.
+func (f *flaky) failures() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.failed
+}
+
+// startConsumer adds an order to a new datastore and starts a Consumer that
+// sends its events to a Recorder.
+func startConsumer(t *testing.T, nc *nats.Conn, jetStream bool) (*flaky, *mock.Recorder, acmeserverless.Order) {
+	db := &flaky{Manager: memory.New()}
+	rec := mock.NewRecorder()
+
+	ord, err := db.AddOrder(context.Background(), acmeserverless.Order{Delivery: "UPS/FEDEX"})
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	cfg := Config{
+		PaymentSubject:  DefaultPaymentSubject,
+		ShipmentSubject: DefaultShipmentSubject,
+		Queue:           DefaultQueue,
+		JetStream:       jetStream,
+	}
+
+	c := New(nc, db, service.New(db, rec), cfg)
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start returned an error: %s", err.Error())
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return db, rec, ord
+}
+
+func creditCardValidated(t *testing.T, orderID string) []byte {
+	evt := acmeserverless.CreditCardValidatedEvent{
+		Metadata: acmeserverless.Metadata{
+			Domain: acmeserverless.PaymentDomain,
+			Source: "ValidateCreditCard",
+			Type:   acmeserverless.CreditCardValidatedEventName,
+			Status: acmeserverless.DefaultSuccessStatus,
+		},
+		Data: acmeserverless.CreditCardValidationDetails{
+			Success:       true,
+			Status:        200,
+			Message:       "transaction successful",
+			Amount:        "10.00",
+			OrderID:       orderID,
+			TransactionID: "1",
+		},
+	}
+
+	payload, err := evt.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal returned an error: %s", err.Error())
+	}
+	return payload
+}
+
+// waitForStatus waits until the order has the expected status.
+func waitForStatus(t *testing.T, db datastore.Manager, orderID string, status string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ord, err := db.GetOrder(context.Background(), orderID)
+		if err != nil {
+			t.Fatalf("GetOrder returned an error: %s", err.Error())
+		}
+		if ord.Status != nil && *ord.Status == status {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected status %q, got %v", status, ord.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShipOrder(t *testing.T) {
+	nc := startServer(t, false)
+	db, rec, ord := startConsumer(t, nc, false)
+
+	payload := creditCardValidated(t, ord.OrderID)
+
+	// NATS can deliver the same event twice, which is only handled once
+	for i := 0; i < 2; i++ {
+		msg := nats.NewMsg(DefaultPaymentSubject)
+		msg.Header.Set(nats.MsgIdHdr, "payment-1")
+		msg.Data = payload
+		if err := nc.PublishMsg(msg); err != nil {
+			t.Fatalf("PublishMsg returned an error: %s", err.Error())
+		}
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Flush returned an error: %s", err.Error())
+	}
+
+	waitForStatus(t, db, ord.OrderID, datastore.StatusShipmentRequested)
+
+	// Give the duplicate time to arrive
+	time.Sleep(100 * time.Millisecond)
+
+	if n := len(rec.ShipmentRequested()); n != 1 {
+		t.Fatalf("expected 1 ShipmentRequested event, got %d", n)
+	}
+}
+
+func TestUpdateOrderDropsMalformedEvents(t *testing.T) {
+	nc := startServer(t, false)
+	db, _, ord := startConsumer(t, nc, false)
+
+	if err := nc.Publish(DefaultShipmentSubject, []byte("{")); err != nil {
+		t.Fatalf("Publish returned an error: %s", err.Error())
+	}
+	if err := nc.Publish(DefaultPaymentSubject, creditCardValidated(t, ord.OrderID)); err != nil {
+		t.Fatalf("Publish returned an error: %s", err.Error())
+	}
+
+	// The consumer keeps handling events after a malformed one
+	waitForStatus(t, db, ord.OrderID, datastore.StatusShipmentRequested)
+}
+
+func TestJetStreamRedeliversFailedEvents(t *testing.T) {
+	nc := startServer(t, true)
+
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("JetStream returned an error: %s", err.Error())
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "PAYMENT", Subjects: []string{DefaultPaymentSubject}}); err != nil {
+		t.Fatalf("AddStream returned an error: %s", err.Error())
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "SHIPMENT", Subjects: []string{DefaultShipmentSubject}}); err != nil {
+		t.Fatalf("AddStream returned an error: %s", err.Error())
+	}
+
+	db, rec, ord := startConsumer(t, nc, true)
+
+	// The first attempt to update the order fails, so the event is delivered
+	// again
+	db.failNext(1)
+
+	if _, err := js.Publish(DefaultPaymentSubject, creditCardValidated(t, ord.OrderID)); err != nil {
+		t.Fatalf("Publish returned an error: %s", err.Error())
+	}
+
+	waitForStatus(t, db, ord.OrderID, datastore.StatusShipmentRequested)
+
+	if n := db.failures(); n != 1 {
+		t.Errorf("expected 1 failed update, got %d", n)
+	}
+	if n := len(rec.ShipmentRequested()); n != 1 {
+		t.Errorf("expected 1 ShipmentRequested event, got %d", n)
+	}
+}
@@ -0,0 +1,305 @@
+// Package outbox sends the events that were stored together with an order to other
+// services. Because the events are written in the same transaction as the order, an
+// order can't be stored without its events. The events stay in the outbox until they
+// have been sent, so an event that couldn't be sent is tried again by Relay. Events
+// can be sent more than once, so the services that receive them need to handle
+// duplicates.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/card"
+	"github.com/retgits/acme-serverless-order/internal/cloudevents"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+	"github.com/retgits/acme-serverless-order/internal/pii"
+	"github.com/retgits/creditcard"
+)
+
+// DefaultBatchSize is the number of events Relay reads from the outbox at once.
+const DefaultBatchSize = 25
+
+// DefaultInterval is the time between two runs of Poll when the environment
+// variable OUTBOX_INTERVAL isn't set.
+const DefaultInterval = time.Minute
+
+// Deliver sends a single event using the emitter and removes it from the outbox
+// after it has been sent.
+func Deliver(ctx context.Context, m datastore.Manager, e emitter.EventEmitter, evt datastore.OutboxEvent) error {
+	if err := Send(ctx, e, evt); err != nil {
+		return fmt.Errorf("error sending %s event %s: %w", evt.Type, evt.ID, err)
+	}
+
+	if err := m.RemoveOutboxEvent(ctx, evt.ID); err != nil {
+		return fmt.Errorf("error removing %s event %s from the outbox: %s", evt.Type, evt.ID, err.Error())
+	}
+
+	return nil
+}
+
+// PaymentRequested returns the outbox event for a PaymentRequested event. The event is
+// stored with the card masked by card.Mask, and with the full card encrypted next to it
+// by the pii.Encrypter of pii.FromEnv, so Send can send it from every function or service
+// with the same keys. Without keys the event can't be stored, and pii.ErrNoKeys is
+// returned.
+func PaymentRequested(ctx context.Context, e acmeserverless.PaymentRequestedEvent) (datastore.OutboxEvent, error) {
+	enc, err := pii.FromEnv()
+	if err != nil {
+		return datastore.OutboxEvent{}, err
+	}
+
+	c, err := json.Marshal(e.Data.Card)
+	if err != nil {
+		return datastore.OutboxEvent{}, fmt.Errorf("error marshalling card: %s", err.Error())
+	}
+
+	sealed, err := enc.Seal(ctx, c, cardData(e.Data.OrderID))
+	if err != nil {
+		return datastore.OutboxEvent{}, fmt.Errorf("error encrypting card of order %s: %w", e.Data.OrderID, err)
+	}
+
+	e.Data.Card = card.Mask(e.Data.Card)
+
+	payload, err := json.Marshal(datastore.PaymentRequestedPayload{
+		PaymentRequestedEvent: e,
+		SealedCard:            sealed,
+	})
+	if err != nil {
+		return datastore.OutboxEvent{}, fmt.Errorf("error marshalling payment request: %s", err.Error())
+	}
+
+	return datastore.NewOutboxEvent(acmeserverless.PaymentRequestedEventName, payload), nil
+}
+
+// cardData is the additional data the card of an order is encrypted with, so it can't
+// be moved to the payment request of another order.
+func cardData(orderID string) string {
+	return orderID + "#card"
+}
+
+// Relay sends the events in the outbox, oldest first, until the outbox is empty
+// or an event can't be sent. It returns the number of events that were sent.
+// Events that can never be sent, because their payload or the card of a PaymentRequested
+// event can't be decoded, their type isn't one the emitter knows or the event was
+// rejected with emitter.ErrValidation, are moved from the outbox to the dead letters and reported in the returned error, so they don't block
+// the events after them.
+func Relay(ctx context.Context, m datastore.Manager, e emitter.EventEmitter) (int, error) {
+	sent := 0
+	skipped := make(map[string]bool)
+	var errs []string
+
+	for {
+		events, err := m.OutboxEvents(ctx, DefaultBatchSize+int64(len(skipped)))
+		if err != nil {
+			return sent, fmt.Errorf("error reading the outbox: %s", err.Error())
+		}
+
+		pending := 0
+		for _, evt := range events {
+			if skipped[evt.ID] {
+				continue
+			}
+			pending++
+
+			err := Deliver(ctx, m, e, evt)
+			if permanent(err) {
+				if derr := deadLetter(ctx, m, evt, err); derr != nil {
+					// The event stays in the outbox, so it is skipped for the rest of this run
+					skipped[evt.ID] = true
+					err = fmt.Errorf("%s: %s", err.Error(), derr.Error())
+				}
+				errs = append(errs, err.Error())
+				continue
+			}
+			if err != nil {
+				errs = append(errs, err.Error())
+				return sent, fmt.Errorf("%s", strings.Join(errs, "; "))
+			}
+			sent++
+		}
+
+		if pending == 0 {
+			break
+		}
+	}
+
+	if len(errs) > 0 {
+		return sent, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	return sent, nil
+}
+
+// permanent returns true when err means the event can't be sent, no matter how
+// often it is tried again.
+func permanent(err error) bool {
+	return errors.As(err, new(unknownTypeError)) ||
+		errors.As(err, new(decodeError)) ||
+		errors.Is(err, emitter.ErrValidation)
+}
+
+// deadLetter stores an event that can't be sent as a dead letter, with the same ID,
+// and removes it from the outbox.
+func deadLetter(ctx context.Context, m datastore.Manager, evt datastore.OutboxEvent, cause error) error {
+	d := datastore.DeadLetter{
+		Event:    evt,
+		Error:    cause.Error(),
+		FailedAt: time.Now().UTC(),
+	}
+
+	if err := m.AddDeadLetter(ctx, d); err != nil {
+		return fmt.Errorf("error storing %s event %s as a dead letter: %s", evt.Type, evt.ID, err.Error())
+	}
+
+	if err := m.RemoveOutboxEvent(ctx, evt.ID); err != nil {
+		return fmt.Errorf("error removing %s event %s from the outbox: %s", evt.Type, evt.ID, err.Error())
+	}
+
+	return nil
+}
+
+// IntervalFromEnv returns the interval set in the environment variable OUTBOX_INTERVAL
+// (like 30s), or DefaultInterval when it isn't set.
+func IntervalFromEnv() time.Duration {
+	if interval, err := time.ParseDuration(os.Getenv("OUTBOX_INTERVAL")); err == nil && interval > 0 {
+		return interval
+	}
+	return DefaultInterval
+}
+
+// Poll runs Relay every interval until ctx is cancelled. It is meant for services
+// that run continuously, where the relay functions of AWS Lambda don't send the
+// events in the outbox. Errors of Relay are reported to Sentry.
+func Poll(ctx context.Context, m datastore.Manager, e emitter.EventEmitter, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		sent, err := Relay(ctx, m, e)
+		if err != nil && ctx.Err() == nil {
+			sentry.CaptureException(fmt.Errorf("error relaying outbox events: %s", err.Error()))
+		}
+		if sent > 0 {
+			sentry.CaptureMessage(fmt.Sprintf("%d outbox events successfully sent", sent))
+		}
+	}
+}
+
+// revealCard returns the full card of the payment request, decrypted from its SealedCard.
+// Errors that can go away, because the keys aren't available right now, are returned as
+// they are, and all others are a decodeError.
+func revealCard(ctx context.Context, req datastore.PaymentRequestedPayload) (creditcard.Card, error) {
+	enc, err := pii.FromEnv()
+	if err != nil {
+		return req.Data.Card, err
+	}
+
+	if len(req.SealedCard) == 0 {
+		return req.Data.Card, decodeError{eventType: acmeserverless.PaymentRequestedEventName, err: errors.New("the event has no encrypted card")}
+	}
+
+	plain, err := enc.Open(ctx, req.SealedCard, cardData(req.Data.OrderID))
+	if errors.Is(err, datastore.ErrUnavailable) || errors.Is(err, pii.ErrNoKeys) {
+		return req.Data.Card, err
+	}
+	if err != nil {
+		return req.Data.Card, decodeError{eventType: acmeserverless.PaymentRequestedEventName, err: err}
+	}
+
+	var c creditcard.Card
+	if err := json.Unmarshal(plain, &c); err != nil {
+		return req.Data.Card, decodeError{eventType: acmeserverless.PaymentRequestedEventName, err: err}
+	}
+
+	return c, nil
+}
+
+// unknownTypeError is returned when the type of an event isn't one the
+// emitter can send.
+type unknownTypeError string
+
+func (e unknownTypeError) Error() string {
+	return fmt.Sprintf("unknown event type %s", string(e))
+}
+
+// decodeError is returned when the payload of an event can't be decoded into
+// an event of its type.
+type decodeError struct {
+	eventType string
+	err       error
+}
+
+func (e decodeError) Error() string {
+	return fmt.Sprintf("error decoding %s event: %s", e.eventType, e.err.Error())
+}
+
+func (e decodeError) Unwrap() error {
+	return e.err
+}
+
+// ownedKey is the key in a context that marks events that are sent from the outbox.
+type ownedKey struct{}
+
+// Owned returns true when ctx is the context of an event that is sent by Send. The
+// event stays in the outbox until it has been sent, so it doesn't need to be kept
+// anywhere else when sending it fails.
+func Owned(ctx context.Context) bool {
+	owned, _ := ctx.Value(ownedKey{}).(bool)
+	return owned
+}
+
+// Send unmarshals the payload of the event and sends it using the method of the
+// emitter that matches the type of the event. It doesn't change the outbox. The ID
+// of the event is used as the ID of the CloudEvent, so every attempt to send the
+// event has the same ID.
+//
+// PaymentRequested events are sent with the full card, which is decrypted from the
+// SealedCard of the event. When the keys aren't available, the error wraps
+// datastore.ErrUnavailable or pii.ErrNoKeys, and the event can be sent later. Events
+// without a card that can be decrypted return a decodeError.
+func Send(ctx context.Context, e emitter.EventEmitter, evt datastore.OutboxEvent) error {
+	ctx = cloudevents.WithID(context.WithValue(ctx, ownedKey{}, true), evt.ID)
+
+	switch evt.Type {
+	case acmeserverless.PaymentRequestedEventName:
+		var req datastore.PaymentRequestedPayload
+		if err := json.Unmarshal([]byte(evt.Payload), &req); err != nil {
+			return decodeError{eventType: evt.Type, err: err}
+		}
+		c, err := revealCard(ctx, req)
+		if err != nil {
+			return fmt.Errorf("error requesting payment for order %s: %w", req.Data.OrderID, err)
+		}
+		req.Data.Card = c
+		return e.SendPaymentRequestedEvent(ctx, req.PaymentRequestedEvent)
+	case acmeserverless.ShipmentRequestedEventName:
+		req, err := acmeserverless.UnmarshalShipmentRequested([]byte(evt.Payload))
+		if err != nil {
+			return decodeError{eventType: evt.Type, err: err}
+		}
+		return e.SendShipmentRequestedEvent(ctx, req)
+	case emitter.OrderCancelledEventName:
+		req, err := emitter.UnmarshalOrderCancelled([]byte(evt.Payload))
+		if err != nil {
+			return decodeError{eventType: evt.Type, err: err}
+		}
+		return e.SendOrderCancelledEvent(ctx, req)
+	}
+
+	return unknownTypeError(evt.Type)
+}
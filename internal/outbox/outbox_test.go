@@ -0,0 +1,235 @@
+package outbox_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/card"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/datastore/memory"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+	"github.com/retgits/acme-serverless-order/internal/emitter/mock"
+	"github.com/retgits/acme-serverless-order/internal/outbox"
+	"github.com/retgits/creditcard"
+)
+
+func shipmentRequested(t *testing.T, orderID string) datastore.OutboxEvent {
+	evt := acmeserverless.ShipmentRequested{
+		Metadata: acmeserverless.Metadata{
+			Domain: acmeserverless.OrderDomain,
+			Source: "ShipOrder",
+			Type:   acmeserverless.ShipmentRequestedEventName,
+			Status: acmeserverless.DefaultSuccessStatus,
+		},
+		Data: acmeserverless.ShipmentRequest{OrderID: orderID, Delivery: "UPS/FEDEX"},
+	}
+
+	payload, err := evt.Marshal()
+	if err != nil {
+		t.Fatalf("error marshalling event: %s", err.Error())
+	}
+	return datastore.NewOutboxEvent(acmeserverless.ShipmentRequestedEventName, payload)
+}
+
+func TestMain(m *testing.M) {
+	os.Setenv("CARD_TOKEN_KEY", "test")
+	os.Setenv("PII_KEYS", "1="+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	os.Exit(m.Run())
+}
+
+const cardNumber = "4111111111111111"
+
+func paymentRequestedEvent(orderID string) acmeserverless.PaymentRequestedEvent {
+	return acmeserverless.PaymentRequestedEvent{
+		Metadata: acmeserverless.Metadata{
+			Domain: acmeserverless.OrderDomain,
+			Source: "AddOrder",
+			Type:   acmeserverless.PaymentRequestedEventName,
+			Status: acmeserverless.DefaultSuccessStatus,
+		},
+		Data: acmeserverless.PaymentRequestDetails{
+			OrderID: orderID,
+			Card:    creditcard.Card{Type: "Visa", Number: cardNumber, ExpiryMonth: 12, ExpiryYear: 2030, CVV: "123"},
+			Total:   "8.00",
+		},
+	}
+}
+
+func paymentRequested(t *testing.T, orderID string) datastore.OutboxEvent {
+	evt, err := outbox.PaymentRequested(context.Background(), paymentRequestedEvent(orderID))
+	if err != nil {
+		t.Fatalf("PaymentRequested returned an error: %s", err.Error())
+	}
+	return evt
+}
+
+// movedCard returns a PaymentRequested event with the encrypted card of another order.
+func movedCard(t *testing.T, orderID string) datastore.OutboxEvent {
+	evt := paymentRequested(t, "other")
+
+	var payload datastore.PaymentRequestedPayload
+	if err := json.Unmarshal([]byte(evt.Payload), &payload); err != nil {
+		t.Fatalf("error unmarshalling event: %s", err.Error())
+	}
+	payload.Data.OrderID = orderID
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("error marshalling event: %s", err.Error())
+	}
+	evt.Payload = string(b)
+	return evt
+}
+
+// maskedOnly returns a PaymentRequested event with only the masked card, like the
+// events that were stored before cards were encrypted.
+func maskedOnly(t *testing.T, orderID string) datastore.OutboxEvent {
+	evt := paymentRequestedEvent(orderID)
+	evt.Data.Card = card.Mask(evt.Data.Card)
+
+	payload, err := evt.Marshal()
+	if err != nil {
+		t.Fatalf("error marshalling event: %s", err.Error())
+	}
+	return datastore.NewOutboxEvent(acmeserverless.PaymentRequestedEventName, payload)
+}
+
+func TestRelay(t *testing.T) {
+	tests := []struct {
+		name        string
+		event       func(t *testing.T, orderID string) datastore.OutboxEvent
+		fail        error
+		sent        int
+		outbox      int
+		deadLetters int
+	}{
+		{
+			name:  "sent",
+			event: shipmentRequested,
+			sent:  2,
+		},
+		{
+			name: "malformed payload",
+			event: func(t *testing.T, orderID string) datastore.OutboxEvent {
+				return datastore.NewOutboxEvent(acmeserverless.ShipmentRequestedEventName, []byte("{"))
+			},
+			sent:        1,
+			deadLetters: 1,
+		},
+		{
+			name: "unknown type",
+			event: func(t *testing.T, orderID string) datastore.OutboxEvent {
+				return datastore.NewOutboxEvent("OrderLost", []byte("{}"))
+			},
+			sent:        1,
+			deadLetters: 1,
+		},
+		{
+			name:  "payment requested",
+			event: paymentRequested,
+			sent:  2,
+		},
+		{
+			name:        "card of another order",
+			event:       movedCard,
+			sent:        1,
+			deadLetters: 1,
+		},
+		{
+			name:        "no encrypted card",
+			event:       maskedOnly,
+			sent:        1,
+			deadLetters: 1,
+		},
+		{
+			name:        "rejected",
+			event:       shipmentRequested,
+			fail:        fmt.Errorf("bad request: %w", emitter.ErrValidation),
+			deadLetters: 2,
+		},
+		{
+			name:   "broker outage",
+			event:  shipmentRequested,
+			fail:   mock.ErrUnavailable,
+			outbox: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			db := memory.New()
+			rec := mock.NewRecorder()
+			if tt.fail != nil {
+				rec.Fail(tt.fail)
+			}
+
+			// The event under test is stored before a valid event, which is
+			// sent unless the emitter fails
+			evt := tt.event(t, "1")
+			if _, err := db.AddOrder(ctx, acmeserverless.Order{OrderID: "1"}, evt); err != nil {
+				t.Fatalf("AddOrder returned an error: %s", err.Error())
+			}
+			if _, err := db.AddOrder(ctx, acmeserverless.Order{OrderID: "2"}, shipmentRequested(t, "2")); err != nil {
+				t.Fatalf("AddOrder returned an error: %s", err.Error())
+			}
+
+			sent, err := outbox.Relay(ctx, db, rec)
+			if sent != tt.sent {
+				t.Errorf("expected %d events to be sent, got %d", tt.sent, sent)
+			}
+			if got, want := err != nil, tt.sent < 2; got != want {
+				t.Errorf("expected an error: %v, got %v", want, err)
+			}
+
+			events, err := db.OutboxEvents(ctx, 10)
+			if err != nil {
+				t.Fatalf("OutboxEvents returned an error: %s", err.Error())
+			}
+			if len(events) != tt.outbox {
+				t.Errorf("expected %d events in the outbox, got %d", tt.outbox, len(events))
+			}
+
+			letters, err := db.DeadLetters(ctx, 10)
+			if err != nil {
+				t.Fatalf("DeadLetters returned an error: %s", err.Error())
+			}
+			if len(letters) != tt.deadLetters {
+				t.Fatalf("expected %d dead letters, got %d", tt.deadLetters, len(letters))
+			}
+			if len(letters) > 0 && (letters[0].Event != evt || len(letters[0].Error) == 0) {
+				t.Errorf("expected a dead letter of event %s with an error, got %+v", evt.ID, letters[0])
+			}
+		})
+	}
+}
+
+func TestPaymentRequested(t *testing.T) {
+	ctx := context.Background()
+	evt := paymentRequested(t, "1")
+
+	if strings.Contains(evt.Payload, cardNumber) || strings.Contains(evt.Payload, `"123"`) {
+		t.Errorf("the outbox event shouldn't contain the card in plaintext, got %s", evt.Payload)
+	}
+
+	// Any process with the same keys, like the relay, sends the event with the full card
+	rec := mock.NewRecorder()
+	if err := outbox.Send(ctx, rec, evt); err != nil {
+		t.Fatalf("Send returned an error: %s", err.Error())
+	}
+
+	events := rec.PaymentRequested()
+	if len(events) != 1 {
+		t.Fatalf("expected 1 PaymentRequested event, got %d", len(events))
+	}
+	if events[0].Data.Card != paymentRequestedEvent("1").Data.Card {
+		t.Errorf("expected the payment request to have the full card, got %+v", events[0].Data.Card)
+	}
+}
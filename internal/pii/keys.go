@@ -0,0 +1,174 @@
+package pii
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DataKeySize is the size, in bytes, of the data keys and of the master keys of
+// StaticKeys.
+const DataKeySize = 32
+
+// KeyProvider generates the data keys that orders are encrypted with, and keeps the
+// master keys that encrypt those data keys.
+type KeyProvider interface {
+	// KeyID returns the ID of the current master key
+	KeyID() string
+
+	// GenerateDataKey returns a new data key, and the envelope with the data key
+	// encrypted with the current master key
+	GenerateDataKey(ctx context.Context) ([]byte, Envelope, error)
+
+	// DecryptDataKey returns the data key in the envelope
+	DecryptDataKey(ctx context.Context, env Envelope) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider with master keys that are kept by the process itself,
+// which is useful for tests and for running the Order service without AWS KMS. The
+// data keys are encrypted locally with AES-256-GCM.
+type StaticKeys struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewStaticKeys creates a new StaticKeys with the master keys, by ID. New data keys
+// are encrypted with the master key with ID current, and the other keys are only used
+// to decrypt the data keys of orders that haven't been rotated yet.
+func NewStaticKeys(current string, keys map[string][]byte) (*StaticKeys, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("error creating static keys: unknown key %q", current)
+	}
+
+	for id, key := range keys {
+		if len(key) != DataKeySize {
+			return nil, fmt.Errorf("error creating static keys: key %q should be %d bytes, got %d", id, DataKeySize, len(key))
+		}
+	}
+
+	return &StaticKeys{
+		current: current,
+		keys:    keys,
+	}, nil
+}
+
+// KeyID returns the ID of the current master key.
+func (s *StaticKeys) KeyID() string {
+	return s.current
+}
+
+// GenerateDataKey returns a new random data key, encrypted with the current master key.
+func (s *StaticKeys) GenerateDataKey(ctx context.Context) ([]byte, Envelope, error) {
+	key := make([]byte, DataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, Envelope{}, fmt.Errorf("error generating data key: %s", err.Error())
+	}
+
+	gcm, err := newGCM(s.keys[s.current])
+	if err != nil {
+		return nil, Envelope{}, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, Envelope{}, fmt.Errorf("error generating nonce: %s", err.Error())
+	}
+
+	return key, Envelope{
+		KeyID: s.current,
+		Key:   gcm.Seal(nonce, nonce, key, []byte(s.current)),
+	}, nil
+}
+
+// DecryptDataKey returns the data key in the envelope, using the master key it was
+// encrypted with.
+func (s *StaticKeys) DecryptDataKey(ctx context.Context, env Envelope) ([]byte, error) {
+	master, ok := s.keys[env.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", env.KeyID)
+	}
+
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(gcm, env.Key, []byte(env.KeyID))
+}
+
+// open decrypts sealed, which starts with the nonce.
+func open(gcm cipher.AEAD, sealed []byte, additionalData []byte) ([]byte, error) {
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid ciphertext")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additionalData)
+}
+
+// fromEnv is the Encrypter returned by FromEnv.
+var (
+	fromEnvOnce sync.Once
+	fromEnv     *Encrypter
+	fromEnvErr  error
+)
+
+// FromEnv creates the Encrypter from the environment variables:
+//
+// * PII_KMS_KEY: the ID or ARN of the AWS KMS key that encrypts the data keys, in the region set in REGION
+// * PII_KEYS: a comma separated list of id=key pairs, where key is a base64 encoded 256-bit key, used when PII_KMS_KEY isn't set
+// * PII_KEY_ID: the ID of the key in PII_KEYS that encrypts new data keys (defaults to the first key)
+//
+// When neither PII_KMS_KEY nor PII_KEYS is set, nil is returned and orders are stored
+// without encrypting them.
+//
+// The Encrypter is created once per process, so every datastore that is opened shares
+// its cache of data keys and its AWS KMS client.
+func FromEnv() (*Encrypter, error) {
+	fromEnvOnce.Do(func() {
+		fromEnv, fromEnvErr = newFromEnv()
+	})
+	return fromEnv, fromEnvErr
+}
+
+// newFromEnv creates a new Encrypter from the environment variables.
+func newFromEnv() (*Encrypter, error) {
+	if keyID := os.Getenv("PII_KMS_KEY"); len(keyID) > 0 {
+		return New(NewKMSKeys(keyID)), nil
+	}
+
+	if len(os.Getenv("PII_KEYS")) == 0 {
+		return nil, nil
+	}
+
+	keys := make(map[string][]byte)
+	current := os.Getenv("PII_KEY_ID")
+
+	for _, pair := range strings.Split(os.Getenv("PII_KEYS"), ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+			return nil, fmt.Errorf("error reading PII_KEYS: expected id=key, got %q", pair)
+		}
+
+		id := strings.TrimSpace(kv[0])
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("error reading PII_KEYS: key %q isn't base64 encoded: %s", id, err.Error())
+		}
+
+		keys[id] = key
+		if len(current) == 0 {
+			current = id
+		}
+	}
+
+	s, err := NewStaticKeys(current, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(s), nil
+}
@@ -0,0 +1,98 @@
+package pii
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+)
+
+// KMSKeys is a KeyProvider that uses AWS KMS to generate and decrypt the data keys,
+// so the master keys never leave AWS KMS. The AWS region this code looks in to find
+// the key is determined by the environment variable REGION. The functions need the
+// kms:GenerateDataKey permission on the current key, and kms:Decrypt on the current
+// key and on the keys it replaced.
+type KMSKeys struct {
+	keyID string
+
+	once sync.Once
+	svc  *kms.KMS
+}
+
+// NewKMSKeys creates a new KMSKeys that encrypts new data keys with the AWS KMS key
+// with the given ID or ARN.
+func NewKMSKeys(keyID string) *KMSKeys {
+	return &KMSKeys{
+		keyID: keyID,
+	}
+}
+
+// client returns the AWS KMS client, which is created when it is first used.
+func (k *KMSKeys) client() *kms.KMS {
+	k.once.Do(func() {
+		awsSession := session.Must(session.NewSession(&aws.Config{
+			Region: aws.String(os.Getenv("REGION")),
+		}))
+		k.svc = kms.New(awsSession)
+	})
+	return k.svc
+}
+
+// KeyID returns the ID of the current AWS KMS key.
+func (k *KMSKeys) KeyID() string {
+	return k.keyID
+}
+
+// GenerateDataKey returns a new data key generated by AWS KMS, encrypted with the
+// current AWS KMS key.
+func (k *KMSKeys) GenerateDataKey(ctx context.Context) ([]byte, Envelope, error) {
+	out, err := k.client().GenerateDataKeyWithContext(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(k.keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, Envelope{}, kmsError("error generating data key", err)
+	}
+
+	return out.Plaintext, Envelope{
+		KeyID: k.keyID,
+		Key:   out.CiphertextBlob,
+	}, nil
+}
+
+// DecryptDataKey returns the data key in the envelope, decrypted by AWS KMS. The
+// encrypted data key tells AWS KMS which key to use, so data keys of earlier keys
+// can be decrypted as well.
+func (k *KMSKeys) DecryptDataKey(ctx context.Context, env Envelope) ([]byte, error) {
+	out, err := k.client().DecryptWithContext(ctx, &kms.DecryptInput{
+		CiphertextBlob: env.Key,
+	})
+	if err != nil {
+		return nil, kmsError("error decrypting data key", err)
+	}
+
+	return out.Plaintext, nil
+}
+
+// kmsError returns the error of a call to AWS KMS, prefixed with msg. Errors that can
+// go away when the call is tried again later, like throttled requests and server
+// errors, wrap datastore.ErrUnavailable, because the order can't be read or written
+// until AWS KMS is available again.
+func kmsError(msg string, err error) error {
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return fmt.Errorf("%s: %w: %s", msg, datastore.ErrUnavailable, err.Error())
+	}
+
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() >= 500 {
+		return fmt.Errorf("%s: %w: %s", msg, datastore.ErrUnavailable, err.Error())
+	}
+
+	return fmt.Errorf("%s: %s", msg, err.Error())
+}
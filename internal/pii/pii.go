@@ -0,0 +1,366 @@
+// Package pii encrypts the personal data of customers before orders are stored in a
+// datastore. The names, the address and the email address of an order are encrypted
+// field by field, using envelope encryption: every order gets its own data key, which
+// encrypts the fields with AES-256-GCM, and the data key is stored with the order,
+// encrypted with a master key of a KeyProvider. The other fields of the order, like
+// the status and the cart, stay readable, so orders can still be queried.
+//
+// When the master key is rotated, orders are encrypted again with a new data key the
+// next time they are written, or when the datastore rotates the keys of all orders.
+package pii
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+)
+
+// fieldPrefix is the prefix of encrypted fields, followed by the base64 encoded
+// nonce and ciphertext.
+const fieldPrefix = "enc:v1:"
+
+// maxCachedKeys is the number of decrypted data keys an Encrypter remembers, so
+// listing orders doesn't call the KeyProvider for every order.
+const maxCachedKeys = 1024
+
+// ErrNoKeys is returned when an order is encrypted, but no keys are configured to
+// decrypt it.
+var ErrNoKeys = errors.New("no encryption keys configured")
+
+// Envelope is the data key of an order, encrypted with a master key.
+type Envelope struct {
+	// KeyID is the ID of the master key the data key is encrypted with
+	KeyID string `json:"keyId"`
+
+	// Key is the encrypted data key
+	Key []byte `json:"key"`
+}
+
+// Encrypter encrypts and decrypts the personal data of orders. Datastores store the
+// envelope Encrypt returns next to the order, and pass it back to Decrypt. A nil
+// Encrypter stores orders as they are, so datastores work without keys. An Encrypter
+// is safe for concurrent use.
+type Encrypter struct {
+	keys KeyProvider
+
+	mu    sync.Mutex
+	cache map[string][]byte
+}
+
+// New creates a new Encrypter that gets its data keys from keys.
+func New(keys KeyProvider) *Encrypter {
+	return &Encrypter{
+		keys:  keys,
+		cache: make(map[string][]byte),
+	}
+}
+
+// Encrypt returns the order with its personal data encrypted, and the envelope that
+// needs to be stored with it. The envelope is the one the order was stored with before,
+// or empty for a new order. When it uses the current master key, its data key is used
+// again. Otherwise a new data key is generated, so orders move to the current master
+// key when they are written. Every field is encrypted, even when it already looks
+// encrypted, so values sent by a customer are never stored as they are.
+func (e *Encrypter) Encrypt(ctx context.Context, o acmeserverless.Order, envelope string) (acmeserverless.Order, string, error) {
+	if e == nil {
+		return o, "", nil
+	}
+
+	var key []byte
+	if e.Current(envelope) {
+		env, err := unmarshalEnvelope(envelope)
+		if err != nil {
+			return o, "", err
+		}
+		key, err = e.dataKey(ctx, env)
+		if err != nil {
+			return o, "", err
+		}
+	} else {
+		k, env, err := e.keys.GenerateDataKey(ctx)
+		if err != nil {
+			return o, "", fmt.Errorf("error generating data key: %w", err)
+		}
+		envelope, err = marshalEnvelope(env)
+		if err != nil {
+			return o, "", err
+		}
+		key = k
+		e.remember(env, key)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return o, "", err
+	}
+
+	for _, f := range fields(&o) {
+		if *f.value == nil {
+			continue
+		}
+
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return o, "", fmt.Errorf("error generating nonce: %s", err.Error())
+		}
+
+		sealed := gcm.Seal(nonce, nonce, []byte(**f.value), additionalData(o.OrderID, f.name))
+		*f.value = ptrString(fieldPrefix + base64.StdEncoding.EncodeToString(sealed))
+	}
+
+	return o, envelope, nil
+}
+
+// Decrypt returns the order with its personal data decrypted, using the data key in the
+// envelope the order was stored with. Fields that aren't encrypted, like the fields of
+// orders that were stored before encryption was enabled, are returned as they are.
+func (e *Encrypter) Decrypt(ctx context.Context, o acmeserverless.Order, envelope string) (acmeserverless.Order, error) {
+	if len(envelope) == 0 {
+		return o, nil
+	}
+	if e == nil {
+		return o, fmt.Errorf("error decrypting order %s: %w", o.OrderID, ErrNoKeys)
+	}
+
+	env, err := unmarshalEnvelope(envelope)
+	if err != nil {
+		return o, err
+	}
+
+	key, err := e.dataKey(ctx, env)
+	if err != nil {
+		return o, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return o, err
+	}
+
+	for _, f := range fields(&o) {
+		if *f.value == nil || !strings.HasPrefix(**f.value, fieldPrefix) {
+			continue
+		}
+
+		sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(**f.value, fieldPrefix))
+		if err != nil {
+			return o, fmt.Errorf("error decrypting %s of order %s: %s", f.name, o.OrderID, err.Error())
+		}
+
+		plain, err := open(gcm, sealed, additionalData(o.OrderID, f.name))
+		if err != nil {
+			return o, fmt.Errorf("error decrypting %s of order %s: %s", f.name, o.OrderID, err.Error())
+		}
+
+		*f.value = ptrString(string(plain))
+	}
+
+	return o, nil
+}
+
+// sealed is a value encrypted by Seal, with the envelope of its data key.
+type sealed struct {
+	Envelope Envelope `json:"envelope"`
+	Data     []byte   `json:"data"`
+}
+
+// Seal encrypts plain with a new data key and returns it, together with the envelope
+// of the data key, as a single string that can be stored anywhere. The additional data
+// binds the value to where it is used, like the ID of an order, and is needed to open
+// it. A nil Encrypter returns ErrNoKeys, so values are never stored unencrypted.
+func (e *Encrypter) Seal(ctx context.Context, plain []byte, additional string) (string, error) {
+	if e == nil {
+		return "", ErrNoKeys
+	}
+
+	key, env, err := e.keys.GenerateDataKey(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error generating data key: %w", err)
+	}
+	e.remember(env, key)
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("error generating nonce: %s", err.Error())
+	}
+
+	b, err := json.Marshal(sealed{
+		Envelope: env,
+		Data:     gcm.Seal(nonce, nonce, plain, []byte(additional)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error marshalling sealed value: %s", err.Error())
+	}
+
+	return fieldPrefix + base64.StdEncoding.EncodeToString(b), nil
+}
+
+// Open returns the value that was encrypted by Seal with the same additional data. A nil
+// Encrypter returns ErrNoKeys.
+func (e *Encrypter) Open(ctx context.Context, value string, additional string) ([]byte, error) {
+	if e == nil {
+		return nil, ErrNoKeys
+	}
+	if !strings.HasPrefix(value, fieldPrefix) {
+		return nil, fmt.Errorf("error opening sealed value: not encrypted")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, fieldPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("error opening sealed value: %s", err.Error())
+	}
+
+	var s sealed
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("error opening sealed value: %s", err.Error())
+	}
+
+	key, err := e.dataKey(ctx, s.Envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := open(gcm, s.Data, []byte(additional))
+	if err != nil {
+		return nil, fmt.Errorf("error opening sealed value: %s", err.Error())
+	}
+
+	return plain, nil
+}
+
+// Current returns true when the envelope contains a data key that is encrypted with
+// the current master key. A nil Encrypter has no master key, so it returns true for
+// orders that aren't encrypted.
+func (e *Encrypter) Current(envelope string) bool {
+	if e == nil {
+		return len(envelope) == 0
+	}
+	if len(envelope) == 0 {
+		return false
+	}
+
+	env, err := unmarshalEnvelope(envelope)
+	if err != nil {
+		return false
+	}
+
+	return env.KeyID == e.keys.KeyID()
+}
+
+// dataKey returns the decrypted data key of the envelope.
+func (e *Encrypter) dataKey(ctx context.Context, env Envelope) ([]byte, error) {
+	e.mu.Lock()
+	key, ok := e.cache[string(env.Key)]
+	e.mu.Unlock()
+
+	if ok {
+		return key, nil
+	}
+
+	key, err := e.keys.DecryptDataKey(ctx, env)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data key: %w", err)
+	}
+
+	e.remember(env, key)
+
+	return key, nil
+}
+
+// remember caches the decrypted data key of the envelope. The cache is cleared
+// when it is full.
+func (e *Encrypter) remember(env Envelope, key []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.cache) >= maxCachedKeys {
+		e.cache = make(map[string][]byte)
+	}
+	e.cache[string(env.Key)] = key
+}
+
+// field is a field of an order that contains personal data.
+type field struct {
+	name  string
+	value **string
+}
+
+// fields returns the fields of the order that are encrypted. The address of the order
+// is copied, so the address of the caller isn't changed.
+func fields(o *acmeserverless.Order) []field {
+	f := []field{
+		{"firstname", &o.Firstname},
+		{"lastname", &o.Lastname},
+		{"email", &o.Email},
+	}
+
+	if o.Address != nil {
+		a := *o.Address
+		o.Address = &a
+		f = append(f,
+			field{"address.street", &a.Street},
+			field{"address.city", &a.City},
+			field{"address.zip", &a.Zip},
+			field{"address.state", &a.State},
+			field{"address.country", &a.Country},
+		)
+	}
+
+	return f
+}
+
+// additionalData binds the ciphertext of a field to the order and the field, so
+// encrypted values can't be moved to another order or field.
+func additionalData(orderID string, name string) []byte {
+	return []byte(orderID + "#" + name)
+}
+
+// newGCM returns AES-GCM with the 256-bit key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %s", err.Error())
+	}
+	return cipher.NewGCM(block)
+}
+
+// marshalEnvelope returns the JSON representation of the envelope.
+func marshalEnvelope(env Envelope) (string, error) {
+	b, err := json.Marshal(env)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling data key: %s", err.Error())
+	}
+	return string(b), nil
+}
+
+// unmarshalEnvelope parses the JSON representation of an envelope.
+func unmarshalEnvelope(envelope string) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal([]byte(envelope), &env); err != nil {
+		return env, fmt.Errorf("error unmarshalling data key: %s", err.Error())
+	}
+	return env, nil
+}
+
+func ptrString(p string) *string {
+	return &p
+}
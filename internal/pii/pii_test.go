@@ -0,0 +1,104 @@
+package pii
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+)
+
+func newEncrypter(t *testing.T) *Encrypter {
+	keys, err := NewStaticKeys("1", map[string][]byte{"1": bytes.Repeat([]byte{1}, DataKeySize)})
+	if err != nil {
+		t.Fatalf("NewStaticKeys returned an error: %s", err.Error())
+	}
+	return New(keys)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	e := newEncrypter(t)
+
+	o := acmeserverless.Order{
+		OrderID:   "1",
+		Firstname: ptrString("Richard"),
+		Email:     ptrString(fieldPrefix + "crafted"),
+		Address: &acmeserverless.Address{
+			Street: ptrString("Main Street 1"),
+		},
+	}
+
+	stored, envelope, err := e.Encrypt(context.Background(), o, "")
+	if err != nil {
+		t.Fatalf("Encrypt returned an error: %s", err.Error())
+	}
+
+	if *o.Address.Street != "Main Street 1" {
+		t.Errorf("Encrypt shouldn't change the address of the caller")
+	}
+
+	for name, value := range map[string]*string{"firstname": stored.Firstname, "email": stored.Email, "address.street": stored.Address.Street} {
+		if !strings.HasPrefix(*value, fieldPrefix) || strings.Contains(*value, "crafted") || strings.Contains(*value, "Richard") {
+			t.Errorf("%s should be encrypted, got %s", name, *value)
+		}
+	}
+
+	plain, err := e.Decrypt(context.Background(), stored, envelope)
+	if err != nil {
+		t.Fatalf("Decrypt returned an error: %s", err.Error())
+	}
+
+	if *plain.Firstname != "Richard" || *plain.Email != fieldPrefix+"crafted" || *plain.Address.Street != "Main Street 1" {
+		t.Errorf("Decrypt should return the original order, got %+v", plain)
+	}
+}
+
+func TestDecryptWithoutEnvelope(t *testing.T) {
+	o := acmeserverless.Order{
+		OrderID:   "1",
+		Firstname: ptrString("Richard"),
+	}
+
+	plain, err := newEncrypter(t).Decrypt(context.Background(), o, "")
+	if err != nil {
+		t.Fatalf("Decrypt returned an error: %s", err.Error())
+	}
+	if *plain.Firstname != "Richard" {
+		t.Errorf("Decrypt should return orders without an envelope as they are, got %s", *plain.Firstname)
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	e := newEncrypter(t)
+	ctx := context.Background()
+
+	value, err := e.Seal(ctx, []byte("4111111111111111"), "1#card")
+	if err != nil {
+		t.Fatalf("Seal returned an error: %s", err.Error())
+	}
+	if !strings.HasPrefix(value, fieldPrefix) || strings.Contains(value, "4111111111111111") {
+		t.Errorf("the value should be encrypted, got %s", value)
+	}
+
+	// Another Encrypter with the same keys, like another process, can open the value
+	plain, err := newEncrypter(t).Open(ctx, value, "1#card")
+	if err != nil {
+		t.Fatalf("Open returned an error: %s", err.Error())
+	}
+	if string(plain) != "4111111111111111" {
+		t.Errorf("Open should return the original value, got %s", plain)
+	}
+
+	if _, err := e.Open(ctx, value, "2#card"); err == nil {
+		t.Error("Open should fail with other additional data")
+	}
+
+	var nilEncrypter *Encrypter
+	if _, err := nilEncrypter.Seal(ctx, []byte("4111111111111111"), "1#card"); err != ErrNoKeys {
+		t.Errorf("Seal without keys should return ErrNoKeys, got %v", err)
+	}
+	if _, err := nilEncrypter.Open(ctx, value, "1#card"); err != ErrNoKeys {
+		t.Errorf("Open without keys should return ErrNoKeys, got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+)
+
+// ErrMalformed is returned by the adapters when a request or event can't be
+// unmarshalled.
+var ErrMalformed = errors.New("malformed payload")
+
+// Malformed returns err, the error of unmarshalling a request or event, wrapped
+// in ErrMalformed.
+func Malformed(err error) error {
+	return fmt.Errorf("%w: %s", ErrMalformed, err.Error())
+}
+
+// StatusCode returns the HTTP status code of the response to a request that failed
+// with err, an error of the Service, a datastore.Manager or an emitter.EventEmitter:
+//
+// * 400 Bad Request for ErrMalformed
+// * 404 Not Found for datastore.ErrNotFound
+// * 409 Conflict for datastore.ErrConflict and datastore.ErrInvalidTransition
+// * 422 Unprocessable Entity for datastore.ErrValidation and emitter.ErrValidation
+// * 503 Service Unavailable for datastore.ErrUnavailable, emitter.ErrUnavailable and requests that timed out
+// * 500 Internal Server Error for all other errors
+func StatusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrMalformed):
+		return http.StatusBadRequest
+	case errors.Is(err, datastore.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, datastore.ErrConflict), errors.Is(err, datastore.ErrInvalidTransition):
+		return http.StatusConflict
+	case errors.Is(err, datastore.ErrValidation), errors.Is(err, emitter.ErrValidation):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, datastore.ErrUnavailable), errors.Is(err, emitter.ErrUnavailable), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Retry returns true when a queue consumer should have an event delivered again after
+// handling it failed with err. Events that failed because the data store or the broker
+// was unavailable, or because the order was changed at the same time, can succeed later.
+// Events that are malformed, that are about an order that doesn't exist, or that don't
+// fit the lifecycle of the order fail every time, so they are dropped. Events that failed
+// with an unexpected error are tried again.
+func Retry(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, datastore.ErrUnavailable), errors.Is(err, emitter.ErrUnavailable), errors.Is(err, datastore.ErrConflict):
+		return true
+	case errors.Is(err, ErrMalformed), errors.Is(err, datastore.ErrNotFound), errors.Is(err, datastore.ErrInvalidTransition),
+		errors.Is(err, datastore.ErrValidation), errors.Is(err, emitter.ErrValidation):
+		return false
+	default:
+		return true
+	}
+}
+
+// Report sends err to Sentry and returns it when the event needs to be delivered again.
+// Events that fail every time they are delivered, like malformed events or events that
+// don't fit the lifecycle of the order, are dropped (see Retry). Queue consumers return
+// the result of Report to the broker.
+func Report(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	sentry.CaptureException(err)
+	if !Retry(err) {
+		return nil
+	}
+	return err
+}
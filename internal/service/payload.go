@@ -0,0 +1,45 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/cloudevents"
+)
+
+// HandlePaymentPayload unmarshals the payload of a CreditCardValidated event and handles
+// it with HandlePaymentResult. The payload can also be a CloudEvent in structured mode.
+// A payload that can't be unmarshalled returns an error that wraps ErrMalformed.
+func (s *Service) HandlePaymentPayload(ctx context.Context, payload []byte) error {
+	// Events can also arrive wrapped in a CloudEvent
+	payload, err := cloudevents.Unwrap(payload)
+	if err != nil {
+		return Malformed(err)
+	}
+
+	req, err := acmeserverless.UnmarshalCreditCardValidatedEvent(payload)
+	if err != nil {
+		return Malformed(fmt.Errorf("error unmarshalling creditcard validated event: %s", err.Error()))
+	}
+
+	return s.HandlePaymentResult(ctx, req)
+}
+
+// HandleShipmentPayload unmarshals the payload of a ShipmentSent event and handles it
+// with HandleShipmentUpdate. The payload can also be a CloudEvent in structured mode.
+// A payload that can't be unmarshalled returns an error that wraps ErrMalformed.
+func (s *Service) HandleShipmentPayload(ctx context.Context, payload []byte) error {
+	// Events can also arrive wrapped in a CloudEvent
+	payload, err := cloudevents.Unwrap(payload)
+	if err != nil {
+		return Malformed(err)
+	}
+
+	req, err := acmeserverless.UnmarshalShipmentSent(payload)
+	if err != nil {
+		return Malformed(fmt.Errorf("error unmarshalling shipment update event: %s", err.Error()))
+	}
+
+	return s.HandleShipmentUpdate(ctx, req)
+}
@@ -0,0 +1,291 @@
+// Package service contains the logic of the Order service in the ACME Serverless Fitness Shop.
+// It doesn't know how requests and events arrive, or where orders are stored and events are
+// sent to. The AWS Lambda functions and the Google Cloud Run service are adapters that
+// unmarshal the incoming request or event, call the Service, and turn the result into a
+// response.
+//
+// Errors wrap the errors of the datastore and emitter packages, like datastore.ErrNotFound
+// or emitter.ErrUnavailable. Adapters use StatusCode to turn an error into the status code
+// of the response, and queue consumers use Retry to decide whether an event that failed
+// is delivered again or dropped.
+//
+// Every method takes the context of the request. It is passed to the datastore and the
+// emitter, so their calls stop when the context is cancelled, like when the Lambda function
+// or the request times out. The Cloud Run service uses fasthttp, which doesn't tell a
+// handler that its client disconnected, so a request there runs until it is done or times
+// out. When the context carries a Sentry hub, breadcrumbs and errors are reported to that
+// hub, so they end up in the trace of the request.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gofrs/uuid"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/card"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/emitter"
+	"github.com/retgits/acme-serverless-order/internal/outbox"
+	"github.com/retgits/acme-serverless-order/internal/validation"
+)
+
+// Service handles the orders, using a datastore.Manager to store them and an
+// emitter.EventEmitter to send events to the other services.
+type Service struct {
+	db datastore.Manager
+	em emitter.EventEmitter
+}
+
+// New creates a new Service that stores orders in db and sends events using em.
+func New(db datastore.Manager, em emitter.EventEmitter) *Service {
+	return &Service{
+		db: db,
+		em: em,
+	}
+}
+
+// PlaceOrder stores a new order and requests the payment for it. The order is validated
+// first, and its total is computed from the cart. An order that isn't valid is rejected
+// with a *validation.Error. The order and the PaymentRequested event are stored in a
+// single transaction. When the event can't be sent right away, it stays in the outbox
+// and is sent by the relay later, so the order is still placed. The returned OrderStatus
+// is the response for the customer.
+//
+// The full card is never stored in plaintext. The order is stored with the card masked
+// by card.Mask, and the PaymentRequested event in the outbox with the full card encrypted
+// (see outbox.PaymentRequested), so the relay can still send it. The breadcrumb of the
+// payment request has the masked card.
+func (s *Service) PlaceOrder(ctx context.Context, o acmeserverless.Order) (acmeserverless.OrderStatus, error) {
+	o, err := validation.Order(o)
+	if err != nil {
+		return acmeserverless.OrderStatus{}, err
+	}
+
+	o.OrderID = uuid.Must(uuid.NewV4()).String()
+
+	prEvent := acmeserverless.PaymentRequestedEvent{
+		Metadata: acmeserverless.Metadata{
+			Domain: acmeserverless.OrderDomain,
+			Source: "AddOrder",
+			Type:   acmeserverless.PaymentRequestedEventName,
+			Status: acmeserverless.DefaultSuccessStatus,
+		},
+		Data: acmeserverless.PaymentRequestDetails{
+			OrderID: o.OrderID,
+			Card:    o.Card,
+			Total:   o.Total,
+		},
+	}
+
+	evt, err := outbox.PaymentRequested(ctx, prEvent)
+	if err != nil {
+		return acmeserverless.OrderStatus{}, fmt.Errorf("error storing payment request: %w", err)
+	}
+
+	// The full card is only needed to request the payment
+	o.Card = card.Mask(o.Card)
+	prEvent.Data.Card = o.Card
+
+	ord, err := s.db.AddOrder(ctx, o, evt)
+	if err != nil {
+		return acmeserverless.OrderStatus{}, fmt.Errorf("error storing order: %w", err)
+	}
+
+	// Send a breadcrumb to Sentry with the payment request, without the full card
+	hub(ctx).AddBreadcrumb(&sentry.Breadcrumb{
+		Category:  acmeserverless.PaymentRequestedEventName,
+		Timestamp: time.Now(),
+		Level:     sentry.LevelInfo,
+		Data:      acmeserverless.ToSentryMap(prEvent.Data),
+	}, nil)
+
+	if err := outbox.Deliver(ctx, s.db, s.em, evt); err != nil {
+		hub(ctx).CaptureException(fmt.Errorf("error requesting payment: %s", err.Error()))
+	}
+
+	status := acmeserverless.OrderStatus{
+		OrderID: ord.OrderID,
+		UserID:  ord.UserID,
+		Payment: acmeserverless.CreditCardValidationDetails{
+			Message: "pending payment",
+			Success: false,
+		},
+	}
+
+	// Send a breadcrumb to Sentry with the status of the order
+	hub(ctx).AddBreadcrumb(&sentry.Breadcrumb{
+		Category:  acmeserverless.PaymentRequestedEventName,
+		Timestamp: time.Now(),
+		Level:     sentry.LevelInfo,
+		Data:      acmeserverless.ToSentryMap(status.Payment),
+	}, nil)
+
+	return status, nil
+}
+
+// HandlePaymentResult updates the order with the result of the payment. When the payment
+// was successful, the shipment of the order is requested. The order moves to Shipment
+// Requested and the ShipmentRequested event is stored in the outbox in a single
+// transaction, before the event is sent, so updates from the Shipment service always
+// find the order in Shipment Requested. When the event can't be sent right away, it
+// stays in the outbox and is sent by the relay later. When the order is already paid,
+// because an earlier attempt failed to request the shipment, the shipment is requested
+// again.
+func (s *Service) HandlePaymentResult(ctx context.Context, e acmeserverless.CreditCardValidatedEvent) error {
+	shipmentStatus := acmeserverless.ShipmentData{
+		OrderNumber: e.Data.OrderID,
+		Status:      datastore.PaymentStatus(e.Data),
+	}
+
+	ord, err := s.db.UpdateStatus(ctx, shipmentStatus, e.Metadata)
+
+	// Orders stored before the lifecycle existed can be paid with another status,
+	// like "transaction successful", so the status is normalized first
+	var terr *datastore.TransitionError
+	if errors.As(err, &terr) && shipmentStatus.Status == datastore.StatusPaid {
+		if from, _ := datastore.NormalizeStatus(terr.From); from == datastore.StatusPaid {
+			ord, err = s.db.GetOrder(ctx, e.Data.OrderID)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error updating payment status for order [%s]: %w", e.Data.OrderID, err)
+	}
+
+	if !e.Data.Success {
+		return nil
+	}
+
+	srEvent := acmeserverless.ShipmentRequested{
+		Metadata: acmeserverless.Metadata{
+			Domain: acmeserverless.OrderDomain,
+			Source: "ShipOrder",
+			Type:   acmeserverless.ShipmentRequestedEventName,
+			Status: acmeserverless.DefaultSuccessStatus,
+		},
+		Data: acmeserverless.ShipmentRequest{
+			OrderID:  e.Data.OrderID,
+			Delivery: ord.Delivery,
+		},
+	}
+
+	payload, err := srEvent.Marshal()
+	if err != nil {
+		return fmt.Errorf("error marshalling ShipmentRequested event for order [%s]: %s", e.Data.OrderID, err.Error())
+	}
+
+	evt := datastore.NewOutboxEvent(acmeserverless.ShipmentRequestedEventName, payload)
+
+	shipmentStatus.Status = datastore.StatusShipmentRequested
+	if _, err := s.db.UpdateStatus(ctx, shipmentStatus, srEvent.Metadata, evt); err != nil {
+		return fmt.Errorf("error updating shipment status for order [%s]: %w", e.Data.OrderID, err)
+	}
+
+	// Send a breadcrumb to Sentry with the shipment request
+	hub(ctx).AddBreadcrumb(&sentry.Breadcrumb{
+		Category:  acmeserverless.ShipmentRequestedEventName,
+		Timestamp: time.Now(),
+		Level:     sentry.LevelInfo,
+		Data:      acmeserverless.ToSentryMap(srEvent.Data),
+	}, nil)
+
+	if err := outbox.Deliver(ctx, s.db, s.em, evt); err != nil {
+		hub(ctx).CaptureException(fmt.Errorf("error requesting shipment: %s", err.Error()))
+		return nil
+	}
+
+	hub(ctx).CaptureMessage(fmt.Sprintf("shipment successfully requested for order [%s]", e.Data.OrderID))
+
+	return nil
+}
+
+// HandleShipmentUpdate updates the order with the status of the shipment.
+func (s *Service) HandleShipmentUpdate(ctx context.Context, e acmeserverless.ShipmentSent) error {
+	// Map the status of the shipment to the status of the order
+	shipmentStatus := e.Data
+
+	status, err := datastore.ShipmentStatus(e.Data.Status)
+	if err != nil {
+		return fmt.Errorf("error updating shipment status for order [%s]: %w", e.Data.OrderNumber, err)
+	}
+	shipmentStatus.Status = status
+
+	if _, err := s.db.UpdateStatus(ctx, shipmentStatus, e.Metadata); err != nil {
+		return fmt.Errorf("error updating shipment status for order [%s]: %w", e.Data.OrderNumber, err)
+	}
+
+	hub(ctx).CaptureMessage(fmt.Sprintf("shipment status successfully updated for order [%s]", e.Data.OrderNumber))
+
+	return nil
+}
+
+// CancelOrder cancels an order that hasn't been shipped yet and sends an OrderCancelled
+// event, so the Payment service can refund the payment. The cancellation and the event
+// are stored in a single transaction. When the event can't be sent right away, it stays
+// in the outbox and is sent by the relay later, so the order is still cancelled.
+func (s *Service) CancelOrder(ctx context.Context, orderID string) (acmeserverless.Order, error) {
+	ord, err := s.db.GetOrder(ctx, orderID)
+	if err != nil {
+		return acmeserverless.Order{}, fmt.Errorf("error retrieving order: %w", err)
+	}
+
+	// The Payment service uses the status before the cancellation
+	// to decide whether the payment needs to be refunded
+	status := ""
+	if ord.Status != nil {
+		status = *ord.Status
+	}
+
+	ocEvent := emitter.OrderCancelled{
+		Metadata: acmeserverless.Metadata{
+			Domain: acmeserverless.OrderDomain,
+			Source: "CancelOrder",
+			Type:   emitter.OrderCancelledEventName,
+			Status: acmeserverless.DefaultSuccessStatus,
+		},
+		Data: emitter.OrderCancelledDetails{
+			OrderID: ord.OrderID,
+			UserID:  ord.UserID,
+			Total:   ord.Total,
+			Status:  status,
+		},
+	}
+
+	payload, err := ocEvent.Marshal()
+	if err != nil {
+		return acmeserverless.Order{}, fmt.Errorf("error marshalling OrderCancelled event: %s", err.Error())
+	}
+
+	evt := datastore.NewOutboxEvent(emitter.OrderCancelledEventName, payload)
+
+	ord, err = s.db.CancelOrder(ctx, orderID, ocEvent.Metadata, evt)
+	if err != nil {
+		return acmeserverless.Order{}, fmt.Errorf("error cancelling order: %w", err)
+	}
+
+	// Send a breadcrumb to Sentry with the cancellation
+	hub(ctx).AddBreadcrumb(&sentry.Breadcrumb{
+		Category:  emitter.OrderCancelledEventName,
+		Timestamp: time.Now(),
+		Level:     sentry.LevelInfo,
+		Data:      acmeserverless.ToSentryMap(ocEvent.Data),
+	}, nil)
+
+	if err := outbox.Deliver(ctx, s.db, s.em, evt); err != nil {
+		hub(ctx).CaptureException(fmt.Errorf("error sending OrderCancelled event: %s", err.Error()))
+	}
+
+	return ord, nil
+}
+
+// hub returns the Sentry hub of the request, or the current hub when ctx
+// doesn't carry one.
+func hub(ctx context.Context) *sentry.Hub {
+	if h := sentry.GetHubFromContext(ctx); h != nil {
+		return h
+	}
+	return sentry.CurrentHub()
+}
@@ -0,0 +1,443 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/datastore/memory"
+	"github.com/retgits/acme-serverless-order/internal/emitter/mock"
+	"github.com/retgits/acme-serverless-order/internal/outbox"
+	"github.com/retgits/acme-serverless-order/internal/service"
+	"github.com/retgits/creditcard"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("CARD_TOKEN_KEY", "test")
+	os.Setenv("PII_KEYS", "1="+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	os.Exit(m.Run())
+}
+
+const cardNumber = "4111111111111111"
+
+func ptrString(s string) *string {
+	return &s
+}
+
+func order() acmeserverless.Order {
+	return acmeserverless.Order{
+		UserID:    "8888",
+		Firstname: ptrString("Richard"),
+		Lastname:  ptrString("Seroter"),
+		Email:     ptrString("richard@example.com"),
+		Delivery:  "UPS/FEDEX",
+		Address: &acmeserverless.Address{
+			Street:  ptrString("Main Street 1"),
+			City:    ptrString("San Francisco"),
+			Zip:     ptrString("94105"),
+			Country: ptrString("USA"),
+		},
+		Card: creditcard.Card{
+			Type:        "Visa",
+			Number:      cardNumber,
+			ExpiryMonth: 12,
+			ExpiryYear:  time.Now().Year() + 1,
+			CVV:         "123",
+		},
+		Cart: []acmeserverless.CartItem{
+			{ID: ptrString("sdfsdfsdf"), Description: "Weights", Price: 4, Quantity: 2},
+		},
+	}
+}
+
+func creditCardValidated(orderID string, success bool) acmeserverless.CreditCardValidatedEvent {
+	return acmeserverless.CreditCardValidatedEvent{
+		Metadata: acmeserverless.Metadata{
+			Domain: acmeserverless.PaymentDomain,
+			Source: "ValidateCreditCard",
+			Type:   acmeserverless.CreditCardValidatedEventName,
+			Status: acmeserverless.DefaultSuccessStatus,
+		},
+		Data: acmeserverless.CreditCardValidationDetails{
+			Success:       success,
+			Message:       "transaction successful",
+			Amount:        "8.00",
+			OrderID:       orderID,
+			TransactionID: "1",
+		},
+	}
+}
+
+func statusOf(t *testing.T, db datastore.Manager, orderID string) string {
+	ord, err := db.GetOrder(context.Background(), orderID)
+	if err != nil {
+		t.Fatalf("GetOrder returned an error: %s", err.Error())
+	}
+	if ord.Status == nil {
+		return ""
+	}
+	return *ord.Status
+}
+
+func TestPlaceOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		order   func() acmeserverless.Order
+		fail    bool
+		wantErr error
+		sent    int
+		outbox  int
+	}{
+		{name: "valid order", order: order, sent: 1},
+		{name: "broker outage", order: order, fail: true, outbox: 1},
+		{
+			name: "invalid order",
+			order: func() acmeserverless.Order {
+				o := order()
+				o.Email = ptrString("richard")
+				return o
+			},
+			wantErr: datastore.ErrValidation,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := memory.New()
+			rec := mock.NewRecorder()
+			if tt.fail {
+				rec.Fail(nil)
+			}
+
+			status, err := service.New(db, rec).PlaceOrder(context.Background(), tt.order())
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("PlaceOrder returned an error: %s", err.Error())
+			}
+
+			events := rec.PaymentRequested()
+			if len(events) != tt.sent {
+				t.Fatalf("expected %d PaymentRequested events, got %d", tt.sent, len(events))
+			}
+
+			for _, e := range events {
+				if e.Data.OrderID != status.OrderID || e.Data.Total != "8.00" {
+					t.Errorf("expected a payment request of 8.00 for order %s, got %+v", status.OrderID, e.Data)
+				}
+				if e.Data.Card.Number != cardNumber {
+					t.Errorf("the payment request should have the full card")
+				}
+			}
+
+			outbox, err := db.OutboxEvents(context.Background(), 0)
+			if err != nil {
+				t.Fatalf("OutboxEvents returned an error: %s", err.Error())
+			}
+			if len(outbox) != tt.outbox {
+				t.Errorf("expected %d events in the outbox, got %d", tt.outbox, len(outbox))
+			}
+			for _, e := range outbox {
+				if strings.Contains(e.Payload, cardNumber) || strings.Contains(e.Payload, `"123"`) {
+					t.Errorf("the outbox should only have the masked card, got %s", e.Payload)
+				}
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			ord, err := db.GetOrder(context.Background(), status.OrderID)
+			if err != nil {
+				t.Fatalf("GetOrder returned an error: %s", err.Error())
+			}
+			if ord.Card.Number == cardNumber || len(ord.Card.CVV) > 0 || !strings.HasSuffix(ord.Card.Number, "1111") {
+				t.Errorf("the order should be stored with a masked card, got %+v", ord.Card)
+			}
+			if ord.Status == nil || *ord.Status != datastore.StatusPendingPayment {
+				t.Errorf("expected status %q, got %v", datastore.StatusPendingPayment, ord.Status)
+			}
+		})
+	}
+}
+
+func TestPlaceOrderRelay(t *testing.T) {
+	db := memory.New()
+	rec := mock.NewRecorder()
+
+	rec.Fail(nil)
+	status, err := service.New(db, rec).PlaceOrder(context.Background(), order())
+	if err != nil {
+		t.Fatalf("PlaceOrder returned an error: %s", err.Error())
+	}
+
+	// The relay sends the event with the full card that was kept in memory
+	rec.Reset()
+	if _, err := outbox.Relay(context.Background(), db, rec); err != nil {
+		t.Fatalf("Relay returned an error: %s", err.Error())
+	}
+
+	events := rec.PaymentRequested()
+	if len(events) != 1 {
+		t.Fatalf("expected 1 PaymentRequested event, got %d", len(events))
+	}
+	if events[0].Data.OrderID != status.OrderID || events[0].Data.Card.Number != cardNumber || events[0].Data.Card.CVV != "123" {
+		t.Errorf("the payment request should have the full card, got %+v", events[0].Data)
+	}
+}
+
+func TestHandlePaymentResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		success  bool
+		failNext int
+		unknown  bool
+		wantErr  error
+		retry    bool
+		sent     int
+		outbox   int
+		status   string
+	}{
+		{name: "payment successful", success: true, sent: 1, status: datastore.StatusShipmentRequested},
+		{name: "payment failed", status: datastore.StatusPaymentFailed},
+		{name: "broker outage", success: true, failNext: 1, outbox: 1, status: datastore.StatusShipmentRequested},
+		{name: "unknown order", success: true, unknown: true, wantErr: datastore.ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := memory.New()
+			rec := mock.NewRecorder()
+			svc := service.New(db, rec)
+
+			ord, err := db.AddOrder(context.Background(), acmeserverless.Order{Delivery: "UPS/FEDEX"})
+			if err != nil {
+				t.Fatalf("AddOrder returned an error: %s", err.Error())
+			}
+
+			orderID := ord.OrderID
+			if tt.unknown {
+				orderID = "unknown"
+			}
+
+			rec.FailNext(tt.failNext, nil)
+
+			err = svc.HandlePaymentResult(context.Background(), creditCardValidated(orderID, tt.success))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("HandlePaymentResult returned an error: %s", err.Error())
+			}
+
+			if err != nil && service.Retry(err) != tt.retry {
+				t.Errorf("expected Retry to return %v for %v", tt.retry, err)
+			}
+
+			events := rec.ShipmentRequested()
+			if len(events) != tt.sent {
+				t.Fatalf("expected %d ShipmentRequested events, got %d", tt.sent, len(events))
+			}
+			for _, e := range events {
+				if e.Data.OrderID != ord.OrderID || e.Data.Delivery != ord.Delivery {
+					t.Errorf("expected a shipment request for order %s, got %+v", ord.OrderID, e.Data)
+				}
+			}
+
+			outbox, err := db.OutboxEvents(context.Background(), 0)
+			if err != nil {
+				t.Fatalf("OutboxEvents returned an error: %s", err.Error())
+			}
+			if len(outbox) != tt.outbox {
+				t.Errorf("expected %d events in the outbox, got %d", tt.outbox, len(outbox))
+			}
+
+			if tt.unknown {
+				return
+			}
+
+			if status := statusOf(t, db, ord.OrderID); status != tt.status {
+				t.Errorf("expected status %q, got %q", tt.status, status)
+			}
+		})
+	}
+}
+
+func TestHandlePaymentResultAlreadyPaid(t *testing.T) {
+	db := memory.New()
+	rec := mock.NewRecorder()
+	svc := service.New(db, rec)
+
+	ord, err := db.AddOrder(context.Background(), acmeserverless.Order{Delivery: "UPS/FEDEX"})
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	evt := creditCardValidated(ord.OrderID, true)
+
+	// The order was paid, but the shipment wasn't requested
+	if _, err := db.UpdateStatus(context.Background(), acmeserverless.ShipmentData{OrderNumber: ord.OrderID, Status: datastore.StatusPaid}, evt.Metadata); err != nil {
+		t.Fatalf("UpdateStatus returned an error: %s", err.Error())
+	}
+
+	// The event is delivered again, when the order is already paid
+	if err := svc.HandlePaymentResult(context.Background(), evt); err != nil {
+		t.Fatalf("HandlePaymentResult returned an error: %s", err.Error())
+	}
+
+	if n := len(rec.ShipmentRequested()); n != 1 {
+		t.Errorf("expected 1 ShipmentRequested event, got %d", n)
+	}
+	if status := statusOf(t, db, ord.OrderID); status != datastore.StatusShipmentRequested {
+		t.Errorf("expected status %q, got %q", datastore.StatusShipmentRequested, status)
+	}
+}
+
+// legacyPaid is a datastore with an order that was paid before the lifecycle
+// existed, so its status is the message of the payment service.
+type legacyPaid struct {
+	datastore.Manager
+}
+
+func (m legacyPaid) UpdateStatus(ctx context.Context, s acmeserverless.ShipmentData, meta acmeserverless.Metadata, outbox ...datastore.OutboxEvent) (acmeserverless.Order, error) {
+	if s.Status == datastore.StatusPaid {
+		if _, err := m.Manager.UpdateStatus(ctx, s, meta, outbox...); err != nil {
+			return acmeserverless.Order{}, err
+		}
+		return acmeserverless.Order{}, &datastore.TransitionError{OrderID: s.OrderNumber, From: "transaction successful", To: s.Status}
+	}
+	return m.Manager.UpdateStatus(ctx, s, meta, outbox...)
+}
+
+func TestHandlePaymentResultLegacyPaid(t *testing.T) {
+	db := legacyPaid{memory.New()}
+	rec := mock.NewRecorder()
+	svc := service.New(db, rec)
+
+	ord, err := db.AddOrder(context.Background(), acmeserverless.Order{Delivery: "UPS/FEDEX"})
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	if err := svc.HandlePaymentResult(context.Background(), creditCardValidated(ord.OrderID, true)); err != nil {
+		t.Fatalf("HandlePaymentResult returned an error: %s", err.Error())
+	}
+
+	if n := len(rec.ShipmentRequested()); n != 1 {
+		t.Errorf("expected 1 ShipmentRequested event, got %d", n)
+	}
+}
+
+func TestHandleShipmentUpdateAfterShipmentRequested(t *testing.T) {
+	db := memory.New()
+	svc := service.New(db, mock.NewRecorder())
+
+	ord, err := db.AddOrder(context.Background(), acmeserverless.Order{Delivery: "UPS/FEDEX"})
+	if err != nil {
+		t.Fatalf("AddOrder returned an error: %s", err.Error())
+	}
+
+	if err := svc.HandlePaymentResult(context.Background(), creditCardValidated(ord.OrderID, true)); err != nil {
+		t.Fatalf("HandlePaymentResult returned an error: %s", err.Error())
+	}
+
+	// The Shipment service responds as soon as the shipment was requested
+	sent := acmeserverless.ShipmentSent{
+		Metadata: acmeserverless.Metadata{
+			Domain: acmeserverless.ShipmentDomain,
+			Source: "SendShipment",
+			Type:   acmeserverless.ShipmentSentEventName,
+			Status: acmeserverless.DefaultSuccessStatus,
+		},
+		Data: acmeserverless.ShipmentData{
+			OrderNumber: ord.OrderID,
+			Status:      "shipped - pending delivery",
+		},
+	}
+
+	if err := svc.HandleShipmentUpdate(context.Background(), sent); err != nil {
+		t.Fatalf("HandleShipmentUpdate returned an error: %s", err.Error())
+	}
+	if status := statusOf(t, db, ord.OrderID); status != datastore.StatusShipped {
+		t.Errorf("expected status %q, got %q", datastore.StatusShipped, status)
+	}
+}
+
+func TestHandlePaymentPayload(t *testing.T) {
+	event := `{"metadata":{"domain":"Payment","source":"ValidateCreditCard","type":"CreditCardValidatedEvent","status":"success"},"data":{"success":true,"status":200,"message":"transaction successful","amount":"8.00","transactionID":"1","orderID":"%s"}}`
+	cloudEvent := `{"specversion":"1.0","id":"1","source":"ValidateCreditCard","type":"CreditCardValidatedEvent","domain":"Payment","status":"success","datacontenttype":"application/json","data":{"success":true,"status":200,"message":"transaction successful","amount":"8.00","transactionID":"1","orderID":"%s"}}`
+
+	tests := []struct {
+		name    string
+		payload string
+		wantErr error
+		status  string
+	}{
+		{name: "event", payload: event, status: datastore.StatusShipmentRequested},
+		{name: "cloudevent", payload: cloudEvent, status: datastore.StatusShipmentRequested},
+		{name: "malformed event", payload: `{"data":%q`, wantErr: service.ErrMalformed, status: datastore.StatusPendingPayment},
+		{name: "malformed cloudevent", payload: `{"specversion":"0.3","data":%q}`, wantErr: service.ErrMalformed, status: datastore.StatusPendingPayment},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := memory.New()
+			svc := service.New(db, mock.NewRecorder())
+
+			ord, err := db.AddOrder(context.Background(), acmeserverless.Order{Delivery: "UPS/FEDEX"})
+			if err != nil {
+				t.Fatalf("AddOrder returned an error: %s", err.Error())
+			}
+
+			err = svc.HandlePaymentPayload(context.Background(), []byte(fmt.Sprintf(tt.payload, ord.OrderID)))
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("HandlePaymentPayload returned an error: %s", err.Error())
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if status := statusOf(t, db, ord.OrderID); status != tt.status {
+				t.Errorf("expected status %q, got %q", tt.status, status)
+			}
+		})
+	}
+}
+
+func TestReport(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "no error"},
+		{name: "malformed", err: service.Malformed(errors.New("unexpected end of JSON input"))},
+		{name: "unknown order", err: fmt.Errorf("error getting order: %w", datastore.ErrNotFound)},
+		{name: "invalid transition", err: fmt.Errorf("error updating order: %w", datastore.ErrInvalidTransition)},
+		{name: "database outage", err: fmt.Errorf("error updating order: %w", datastore.ErrUnavailable), want: datastore.ErrUnavailable},
+		{name: "broker outage", err: mock.ErrUnavailable, want: mock.ErrUnavailable},
+		{name: "conflict", err: fmt.Errorf("error updating order: %w", datastore.ErrConflict), want: datastore.ErrConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := service.Report(tt.err)
+			if tt.want == nil && err != nil {
+				t.Errorf("expected the event to be dropped, got %v", err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("expected error %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+// Package sqsbatch processes the records of an Amazon SQS event one by one and
+// reports the records that failed back to AWS Lambda. Only those records are made
+// visible in the queue again, the others are deleted. For AWS Lambda to use the
+// response, the event source mapping needs to have ReportBatchItemFailures in its
+// FunctionResponseTypes.
+//
+// When the event source mapping doesn't have ReportBatchItemFailures, AWS Lambda ignores
+// the response and deletes every record of a batch that didn't return an error. Unless
+// the environment variable SQS_REPORT_BATCH_ITEM_FAILURES is set to true, Process
+// therefore returns an error when a record failed, so the whole batch is delivered again.
+package sqsbatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// ErrBatchItemFailures is returned by Process when records failed and the event source
+// mapping doesn't report the failed records.
+var ErrBatchItemFailures = errors.New("records in the batch failed")
+
+// Response is the response of a Lambda function that processes an SQS event.
+// It has the same JSON representation as events.SQSEventResponse in newer
+// versions of the aws-lambda-go module.
+type Response struct {
+	BatchItemFailures []ItemFailure `json:"batchItemFailures"`
+}
+
+// ItemFailure identifies a single record that failed.
+type ItemFailure struct {
+	// ItemIdentifier is the MessageId of the record
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+// Handler processes a single SQS record. When the handler returns an error,
+// the record is reported as failed and will be delivered again.
+type Handler func(ctx context.Context, record events.SQSMessage) error
+
+// Process calls the handler for every record in the event. A record that fails
+// doesn't stop the other records from being processed. When ctx is done, like when
+// the function is about to time out, the remaining records are reported as failed
+// without calling the handler. An empty event returns an empty response.
+//
+// When records failed and ReportBatchItemFailures returns false, Process returns an
+// error that wraps ErrBatchItemFailures, so AWS Lambda doesn't delete the failed records.
+// The records that succeeded are delivered again as well, so the handler needs to skip
+// records that were already processed.
+func Process(ctx context.Context, event events.SQSEvent, handler Handler) (Response, error) {
+	res := Response{
+		BatchItemFailures: make([]ItemFailure, 0),
+	}
+
+	for _, record := range event.Records {
+		if ctx.Err() != nil {
+			res.BatchItemFailures = append(res.BatchItemFailures, ItemFailure{ItemIdentifier: record.MessageId})
+			continue
+		}
+
+		if err := handler(ctx, record); err != nil {
+			res.BatchItemFailures = append(res.BatchItemFailures, ItemFailure{ItemIdentifier: record.MessageId})
+		}
+	}
+
+	if len(res.BatchItemFailures) > 0 && !ReportBatchItemFailures() {
+		return res, fmt.Errorf("%w: %d of %d records", ErrBatchItemFailures, len(res.BatchItemFailures), len(event.Records))
+	}
+
+	return res, nil
+}
+
+// ReportBatchItemFailures returns true when the environment variable
+// SQS_REPORT_BATCH_ITEM_FAILURES is set to true, which means the event source mapping
+// has ReportBatchItemFailures in its FunctionResponseTypes.
+func ReportBatchItemFailures() bool {
+	return strings.EqualFold(os.Getenv("SQS_REPORT_BATCH_ITEM_FAILURES"), "true")
+}
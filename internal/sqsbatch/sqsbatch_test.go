@@ -0,0 +1,80 @@
+package sqsbatch
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestProcess(t *testing.T) {
+	event := events.SQSEvent{
+		Records: []events.SQSMessage{
+			{MessageId: "1"},
+			{MessageId: "2"},
+			{MessageId: "3"},
+		},
+	}
+
+	handler := func(ctx context.Context, record events.SQSMessage) error {
+		if record.MessageId == "2" {
+			return errors.New("failed")
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name    string
+		report  string
+		handler Handler
+		failed  []string
+		wantErr bool
+	}{
+		{"success", "", func(ctx context.Context, record events.SQSMessage) error { return nil }, nil, false},
+		{"failure", "", handler, []string{"2"}, true},
+		{"failure with report", "true", handler, []string{"2"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("SQS_REPORT_BATCH_ITEM_FAILURES", tt.report)
+			defer os.Unsetenv("SQS_REPORT_BATCH_ITEM_FAILURES")
+
+			res, err := Process(context.Background(), event, tt.handler)
+			if tt.wantErr != errors.Is(err, ErrBatchItemFailures) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if len(res.BatchItemFailures) != len(tt.failed) {
+				t.Fatalf("expected %d failures, got %d", len(tt.failed), len(res.BatchItemFailures))
+			}
+			for i, id := range tt.failed {
+				if res.BatchItemFailures[i].ItemIdentifier != id {
+					t.Errorf("expected failure %s, got %s", id, res.BatchItemFailures[i].ItemIdentifier)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	event := events.SQSEvent{
+		Records: []events.SQSMessage{{MessageId: "1"}},
+	}
+
+	res, err := Process(ctx, event, func(ctx context.Context, record events.SQSMessage) error {
+		t.Fatal("handler called after ctx was cancelled")
+		return nil
+	})
+	if !errors.Is(err, ErrBatchItemFailures) {
+		t.Fatalf("expected ErrBatchItemFailures, got %v", err)
+	}
+	if len(res.BatchItemFailures) != 1 {
+		t.Fatalf("expected 1 failure, got %d", len(res.BatchItemFailures))
+	}
+}
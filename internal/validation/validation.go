@@ -0,0 +1,223 @@
+// Package validation checks the orders that are placed in the ACME Serverless Fitness Shop
+// before they are stored. An order needs the details of the customer, an address to deliver
+// it to, a valid creditcard, and at least one item in the cart. The total of the order is
+// computed from the cart, so customers can't decide what they pay.
+package validation
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/creditcard"
+)
+
+// cardNumberPattern matches the numbers of creditcards, which have 12 to 19 digits.
+var cardNumberPattern = regexp.MustCompile(`^[0-9]{12,19}$`)
+
+// zipPattern matches the zip or postal codes of most countries, like 10201, 1011 AB or SW1A 1AA.
+var zipPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 -]{1,9}$`)
+
+// FieldError describes a field of the order that isn't valid.
+type FieldError struct {
+	// Field is the path of the field in the JSON representation of the order (like address.zip or cart[0].quantity)
+	Field string `json:"field"`
+
+	// Message describes why the field isn't valid
+	Message string `json:"message"`
+}
+
+// Error is returned when an order isn't valid. It contains an error for every field
+// that isn't valid, and wraps datastore.ErrValidation.
+type Error struct {
+	Fields []FieldError
+}
+
+func (e *Error) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = fmt.Sprintf("%s: %s", f.Field, f.Message)
+	}
+
+	return fmt.Sprintf("order is not valid: %s", strings.Join(msgs, "; "))
+}
+
+// Unwrap returns datastore.ErrValidation, so callers can use errors.Is.
+func (e *Error) Unwrap() error {
+	return datastore.ErrValidation
+}
+
+// Marshal returns the JSON encoding of the Error, which is the body of the response
+// to a request with an order that isn't valid.
+func (e *Error) Marshal() ([]byte, error) {
+	return json.Marshal(struct {
+		Message string       `json:"message"`
+		Errors  []FieldError `json:"errors"`
+	}{
+		Message: "order is not valid",
+		Errors:  e.Fields,
+	})
+}
+
+// add adds an error for the field.
+func (e *Error) add(field string, format string, args ...interface{}) {
+	e.Fields = append(e.Fields, FieldError{
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Order validates the order and returns it with the total computed from the cart. When
+// the order has a total that doesn't match the cart, the order isn't valid. The returned
+// error is an *Error that lists every field that isn't valid.
+func Order(o acmeserverless.Order) (acmeserverless.Order, error) {
+	verr := &Error{}
+
+	required(verr, "userid", o.UserID)
+	required(verr, "firstname", stringValue(o.Firstname))
+	required(verr, "lastname", stringValue(o.Lastname))
+	required(verr, "delivery", o.Delivery)
+
+	email(verr, stringValue(o.Email))
+	address(verr, o.Address)
+	card(verr, o.Card)
+
+	total, ok := cart(verr, o.Cart)
+	if ok {
+		if len(strings.TrimSpace(o.Total)) > 0 {
+			t, err := strconv.ParseFloat(strings.TrimSpace(o.Total), 64)
+			switch {
+			case err != nil:
+				verr.add("total", "must be a number")
+			case math.Abs(t-total) >= 0.005:
+				verr.add("total", "%s doesn't match the total of the cart, which is %.2f", o.Total, total)
+			}
+		}
+		o.Total = strconv.FormatFloat(total, 'f', 2, 64)
+	}
+
+	if len(verr.Fields) > 0 {
+		return o, verr
+	}
+
+	return o, nil
+}
+
+// required adds an error when the value is empty.
+func required(verr *Error, field string, value string) bool {
+	if len(strings.TrimSpace(value)) == 0 {
+		verr.add(field, "is required")
+		return false
+	}
+	return true
+}
+
+// email checks that the email address is a single address without a display name.
+func email(verr *Error, value string) {
+	if !required(verr, "email", value) {
+		return
+	}
+
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Address != strings.TrimSpace(value) {
+		verr.add("email", "is not a valid email address")
+		return
+	}
+
+	// Addresses like john@localhost are valid, but can't be used to reach a customer
+	if domain := addr.Address[strings.LastIndex(addr.Address, "@")+1:]; !strings.Contains(domain, ".") {
+		verr.add("email", "is not a valid email address")
+	}
+}
+
+// address checks that the address has a street, city, zip and country.
+func address(verr *Error, a *acmeserverless.Address) {
+	if a == nil {
+		verr.add("address", "is required")
+		return
+	}
+
+	required(verr, "address.street", stringValue(a.Street))
+	required(verr, "address.city", stringValue(a.City))
+	required(verr, "address.country", stringValue(a.Country))
+
+	if zip := strings.TrimSpace(stringValue(a.Zip)); required(verr, "address.zip", zip) && !zipPattern.MatchString(zip) {
+		verr.add("address.zip", "is not a valid zip code")
+	}
+}
+
+// card checks the creditcard using the creditcard module. The number needs to pass the
+// Luhn check and match the type of the card when it is set, and the card can't be expired.
+// Validate sets the type of the card when it is empty, so c is a copy.
+func card(verr *Error, c creditcard.Card) {
+	// The creditcard module expects a number of at least a few digits
+	if !cardNumberPattern.MatchString(c.Number) {
+		verr.add("card.number", "must have 12 to 19 digits")
+		return
+	}
+
+	v := c.Validate()
+
+	if !v.ValidCardNumber {
+		verr.add("card.number", "is not a valid card number")
+	}
+	if !v.ValidExpiryMonth {
+		verr.add("card.expiryMonth", "must be between 1 and 12")
+	}
+	if !v.ValidExpiryYear {
+		verr.add("card.expiryYear", "is not a valid year")
+	}
+	if v.ValidExpiryMonth && v.ValidExpiryYear && v.IsExpired {
+		verr.add("card", "is expired")
+	}
+	if !v.ValidCVV {
+		verr.add("card.cvv", "doesn't match the type of the card")
+	}
+}
+
+// cart checks the items in the cart and returns the total of the cart, rounded to cents.
+// It returns false when the total can't be computed.
+func cart(verr *Error, items []acmeserverless.CartItem) (float64, bool) {
+	if len(items) == 0 {
+		verr.add("cart", "must contain at least one item")
+		return 0, false
+	}
+
+	ok := true
+	total := 0.0
+
+	for i, item := range items {
+		field := fmt.Sprintf("cart[%d]", i)
+
+		if len(stringValue(item.ID)) == 0 && len(stringValue(item.ItemID)) == 0 {
+			verr.add(field+".id", "is required")
+			ok = false
+		}
+		if item.Quantity <= 0 {
+			verr.add(field+".quantity", "must be at least 1")
+			ok = false
+		}
+		if item.Price < 0 || math.IsNaN(item.Price) || math.IsInf(item.Price, 0) {
+			verr.add(field+".price", "can't be negative")
+			ok = false
+		}
+
+		total += item.Price * float64(item.Quantity)
+	}
+
+	return math.Round(total*100) / 100, ok
+}
+
+// stringValue returns the value of the pointer, or an empty string when it is nil.
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,134 @@
+package validation_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-order/internal/datastore"
+	"github.com/retgits/acme-serverless-order/internal/validation"
+	"github.com/retgits/creditcard"
+)
+
+func ptrString(s string) *string {
+	return &s
+}
+
+func order() acmeserverless.Order {
+	return acmeserverless.Order{
+		UserID:    "8888",
+		Firstname: ptrString("Richard"),
+		Lastname:  ptrString("Seroter"),
+		Email:     ptrString("richard@example.com"),
+		Delivery:  "UPS/FEDEX",
+		Address: &acmeserverless.Address{
+			Street:  ptrString("Main Street 1"),
+			City:    ptrString("San Francisco"),
+			Zip:     ptrString("94105"),
+			Country: ptrString("USA"),
+		},
+		Card: creditcard.Card{
+			Type:        "Visa",
+			Number:      "4111111111111111",
+			ExpiryMonth: 12,
+			ExpiryYear:  time.Now().Year() + 1,
+			CVV:         "123",
+		},
+		Cart: []acmeserverless.CartItem{
+			{ID: ptrString("sdfsdfsdf"), Description: "Weights", Price: 4, Quantity: 2},
+			{ItemID: ptrString("dsfsdfsdf"), Description: "Shoes", Price: 0.1, Quantity: 3},
+		},
+	}
+}
+
+func TestOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(o *acmeserverless.Order)
+		fields []string
+		total  string
+	}{
+		{name: "valid", change: func(o *acmeserverless.Order) {}, total: "8.30"},
+		{name: "matching total", change: func(o *acmeserverless.Order) { o.Total = " 8.3 " }, total: "8.30"},
+		{name: "total within a cent", change: func(o *acmeserverless.Order) { o.Total = "8.304" }, total: "8.30"},
+		{name: "wrong total", change: func(o *acmeserverless.Order) { o.Total = "1.00" }, fields: []string{"total"}},
+		{name: "total isn't a number", change: func(o *acmeserverless.Order) { o.Total = "free" }, fields: []string{"total"}},
+		{name: "no user", change: func(o *acmeserverless.Order) { o.UserID = " " }, fields: []string{"userid"}},
+		{name: "no firstname", change: func(o *acmeserverless.Order) { o.Firstname = nil }, fields: []string{"firstname"}},
+		{name: "no lastname", change: func(o *acmeserverless.Order) { o.Lastname = ptrString("") }, fields: []string{"lastname"}},
+		{name: "no delivery", change: func(o *acmeserverless.Order) { o.Delivery = "" }, fields: []string{"delivery"}},
+		{name: "no email", change: func(o *acmeserverless.Order) { o.Email = nil }, fields: []string{"email"}},
+		{name: "email without domain", change: func(o *acmeserverless.Order) { o.Email = ptrString("richard@localhost") }, fields: []string{"email"}},
+		{name: "email with name", change: func(o *acmeserverless.Order) { o.Email = ptrString("Richard <richard@example.com>") }, fields: []string{"email"}},
+		{name: "no address", change: func(o *acmeserverless.Order) { o.Address = nil }, fields: []string{"address"}},
+		{
+			name: "empty address",
+			change: func(o *acmeserverless.Order) {
+				o.Address = &acmeserverless.Address{}
+			},
+			fields: []string{"address.street", "address.city", "address.country", "address.zip"},
+		},
+		{name: "postal code", change: func(o *acmeserverless.Order) { o.Address.Zip = ptrString("SW1A 1AA") }, total: "8.30"},
+		{name: "invalid zip", change: func(o *acmeserverless.Order) { o.Address.Zip = ptrString("94105!") }, fields: []string{"address.zip"}},
+		{name: "short card number", change: func(o *acmeserverless.Order) { o.Card.Number = "4111" }, fields: []string{"card.number"}},
+		{name: "card number with letters", change: func(o *acmeserverless.Order) { o.Card.Number = "4111-1111-1111-1111" }, fields: []string{"card.number"}},
+		{name: "card number fails luhn", change: func(o *acmeserverless.Order) { o.Card.Number = "4111111111111112" }, fields: []string{"card.number"}},
+		{name: "invalid expiry month", change: func(o *acmeserverless.Order) { o.Card.ExpiryMonth = 13 }, fields: []string{"card.expiryMonth"}},
+		{name: "expired card", change: func(o *acmeserverless.Order) { o.Card.ExpiryYear = time.Now().Year() - 1 }, fields: []string{"card"}},
+		{name: "invalid cvv", change: func(o *acmeserverless.Order) { o.Card.CVV = "12" }, fields: []string{"card.cvv"}},
+		{name: "empty cart", change: func(o *acmeserverless.Order) { o.Cart = nil }, fields: []string{"cart"}},
+		{name: "item without id", change: func(o *acmeserverless.Order) { o.Cart[1].ItemID = nil }, fields: []string{"cart[1].id"}},
+		{name: "no quantity", change: func(o *acmeserverless.Order) { o.Cart[0].Quantity = 0 }, fields: []string{"cart[0].quantity"}},
+		{name: "negative quantity", change: func(o *acmeserverless.Order) { o.Cart[1].Quantity = -1 }, fields: []string{"cart[1].quantity"}},
+		{name: "negative price", change: func(o *acmeserverless.Order) { o.Cart[0].Price = -4 }, fields: []string{"cart[0].price"}},
+		{name: "free item", change: func(o *acmeserverless.Order) { o.Cart[0].Price = 0 }, total: "0.30"},
+		{
+			name: "every invalid field is reported",
+			change: func(o *acmeserverless.Order) {
+				o.UserID = ""
+				o.Card.CVV = ""
+				o.Cart[0].Quantity = 0
+				o.Total = "1.00"
+			},
+			// The total isn't checked when it can't be computed from the cart
+			fields: []string{"userid", "card.cvv", "cart[0].quantity"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := order()
+			tt.change(&o)
+
+			got, err := validation.Order(o)
+			if len(tt.fields) == 0 {
+				if err != nil {
+					t.Fatalf("Order returned an error: %s", err.Error())
+				}
+				if got.Total != tt.total {
+					t.Errorf("expected total %s, got %s", tt.total, got.Total)
+				}
+				return
+			}
+
+			if !errors.Is(err, datastore.ErrValidation) {
+				t.Errorf("expected the error to wrap datastore.ErrValidation, got %v", err)
+			}
+
+			var verr *validation.Error
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected a *validation.Error, got %v", err)
+			}
+
+			fields := make([]string, len(verr.Fields))
+			for i, f := range verr.Fields {
+				fields[i] = f.Field
+			}
+			if fmt.Sprint(fields) != fmt.Sprint(tt.fields) {
+				t.Errorf("expected errors for %v, got %v", tt.fields, verr.Fields)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"path"
 
 	"github.com/pulumi/pulumi-aws/sdk/v2/go/aws/apigateway"
+	"github.com/pulumi/pulumi-aws/sdk/v2/go/aws/cloudwatch"
 	"github.com/pulumi/pulumi-aws/sdk/v2/go/aws/dynamodb"
 	"github.com/pulumi/pulumi-aws/sdk/v2/go/aws/iam"
 	"github.com/pulumi/pulumi-aws/sdk/v2/go/aws/lambda"
@@ -41,6 +42,12 @@ type GenericConfig struct {
 	// The DSN used to connect to Sentry
 	SentryDSN string `json:"sentrydsn"`
 
+	// The key used to compute the tokens of creditcards
+	CardTokenKey string `json:"cardtokenkey"`
+
+	// The static keys that encrypt the personal data and the creditcards in the outbox
+	PiiKeys string `json:"piikeys"`
+
 	// The AWS AccountID to use
 	AccountID string `json:"accountid"`
 
@@ -86,7 +93,11 @@ func main() {
 		functions := []string{
 			"lambda-order-all",
 			"lambda-order-users",
+			"lambda-order-get",
+			"lambda-order-history",
 			"lambda-order-sqs-add",
+			"lambda-order-sqs-cancel",
+			"lambda-order-sqs-relay",
 			"lambda-order-sqs-ship",
 			"lambda-order-sqs-update",
 		}
@@ -193,6 +204,8 @@ func main() {
 		variables := make(map[string]pulumi.StringInput)
 		variables["REGION"] = pulumi.String(genericConfig.Region)
 		variables["SENTRY_DSN"] = pulumi.String(genericConfig.SentryDSN)
+		variables["CARD_TOKEN_KEY"] = pulumi.String(genericConfig.CardTokenKey)
+		variables["PII_KEYS"] = pulumi.String(genericConfig.PiiKeys)
 		variables["VERSION"] = tags.Version
 		variables["STAGE"] = pulumi.String(ctx.Stack())
 		variables["TABLE"] = pulumi.String(dynamoTable.Name)
@@ -282,6 +295,120 @@ func main() {
 
 		ctx.Export("lambda-order-users::Arn", orderUsersFunction.Arn)
 
+		// Add OrderGet function
+		roleArgs = &iam.RoleArgs{
+			AssumeRolePolicy: pulumi.String(sampolicies.AssumeRoleLambda()),
+			Description:      pulumi.String("Role for the Order Service (lambda-order-get) of the ACME Serverless Fitness Shop"),
+			Tags:             pulumi.Map(tagMap),
+		}
+
+		role, err = iam.NewRole(ctx, "ACMEServerlessOrderRole-lambda-order-get", roleArgs)
+		if err != nil {
+			return err
+		}
+
+		// Attach the AWSLambdaBasicExecutionRole so the function can create Log groups in CloudWatch
+		_, err = iam.NewRolePolicyAttachment(ctx, "AWSLambdaBasicExecutionRole-lambda-order-get", &iam.RolePolicyAttachmentArgs{
+			PolicyArn: pulumi.String("arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"),
+			Role:      role.Name,
+		})
+		if err != nil {
+			return err
+		}
+
+		// Add the DynamoDB policy
+		_, err = iam.NewRolePolicy(ctx, "ACMEServerlessOrderPolicy-lambda-order-get", &iam.RolePolicyArgs{
+			Name:   pulumi.String("ACMEServerlessOrderPolicy-lambda-order-get"),
+			Role:   role.Name,
+			Policy: pulumi.String(dynamoPolicy),
+		})
+		if err != nil {
+			return err
+		}
+
+		// Create the Get function
+		variables["FUNCTION_NAME"] = pulumi.String(fmt.Sprintf("%s-lambda-order-get", ctx.Stack()))
+		environment = lambda.FunctionEnvironmentArgs{
+			Variables: pulumi.StringMap(variables),
+		}
+
+		functionArgs = &lambda.FunctionArgs{
+			Description: pulumi.String("A Lambda function to get a single order"),
+			Runtime:     pulumi.String("go1.x"),
+			Name:        pulumi.String(fmt.Sprintf("%s-lambda-order-get", ctx.Stack())),
+			MemorySize:  pulumi.Int(256),
+			Timeout:     pulumi.Int(10),
+			Handler:     pulumi.String("lambda-order-get"),
+			Environment: environment,
+			Code:        pulumi.NewFileArchive("../cmd/lambda-order-get/lambda-order-get.zip"),
+			Role:        role.Arn,
+			Tags:        pulumi.Map(tagMap),
+		}
+
+		orderGetFunction, err := lambda.NewFunction(ctx, fmt.Sprintf("%s-lambda-order-get", ctx.Stack()), functionArgs)
+		if err != nil {
+			return err
+		}
+
+		ctx.Export("lambda-order-get::Arn", orderGetFunction.Arn)
+
+		// Add OrderHistory function
+		roleArgs = &iam.RoleArgs{
+			AssumeRolePolicy: pulumi.String(sampolicies.AssumeRoleLambda()),
+			Description:      pulumi.String("Role for the Order Service (lambda-order-history) of the ACME Serverless Fitness Shop"),
+			Tags:             pulumi.Map(tagMap),
+		}
+
+		role, err = iam.NewRole(ctx, "ACMEServerlessOrderRole-lambda-order-history", roleArgs)
+		if err != nil {
+			return err
+		}
+
+		// Attach the AWSLambdaBasicExecutionRole so the function can create Log groups in CloudWatch
+		_, err = iam.NewRolePolicyAttachment(ctx, "AWSLambdaBasicExecutionRole-lambda-order-history", &iam.RolePolicyAttachmentArgs{
+			PolicyArn: pulumi.String("arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"),
+			Role:      role.Name,
+		})
+		if err != nil {
+			return err
+		}
+
+		// Add the DynamoDB policy
+		_, err = iam.NewRolePolicy(ctx, "ACMEServerlessOrderPolicy-lambda-order-history", &iam.RolePolicyArgs{
+			Name:   pulumi.String("ACMEServerlessOrderPolicy-lambda-order-history"),
+			Role:   role.Name,
+			Policy: pulumi.String(dynamoPolicy),
+		})
+		if err != nil {
+			return err
+		}
+
+		// Create the History function
+		variables["FUNCTION_NAME"] = pulumi.String(fmt.Sprintf("%s-lambda-order-history", ctx.Stack()))
+		environment = lambda.FunctionEnvironmentArgs{
+			Variables: pulumi.StringMap(variables),
+		}
+
+		functionArgs = &lambda.FunctionArgs{
+			Description: pulumi.String("A Lambda function to get the status history of a single order"),
+			Runtime:     pulumi.String("go1.x"),
+			Name:        pulumi.String(fmt.Sprintf("%s-lambda-order-history", ctx.Stack())),
+			MemorySize:  pulumi.Int(256),
+			Timeout:     pulumi.Int(10),
+			Handler:     pulumi.String("lambda-order-history"),
+			Environment: environment,
+			Code:        pulumi.NewFileArchive("../cmd/lambda-order-history/lambda-order-history.zip"),
+			Role:        role.Arn,
+			Tags:        pulumi.Map(tagMap),
+		}
+
+		orderHistoryFunction, err := lambda.NewFunction(ctx, fmt.Sprintf("%s-lambda-order-history", ctx.Stack()), functionArgs)
+		if err != nil {
+			return err
+		}
+
+		ctx.Export("lambda-order-history::Arn", orderHistoryFunction.Arn)
+
 		// Add Order SQS Add function
 		// policyString is a policy template, derived from AWS SAM, to allow apps
 		// to connect to and execute command on Amazon DynamoDB and SQS
@@ -350,6 +477,170 @@ func main() {
 
 		ctx.Export("lambda-order-sqs-add::Arn", orderAddFunction.Arn)
 
+		// Add Order SQS Cancel function
+		// policyString is a policy template, derived from AWS SAM, to allow apps
+		// to connect to and execute command on Amazon DynamoDB and SQS
+		iamFactory.ClearPolicies()
+		iamFactory.AddDynamoDBCrudPolicy(dynamoTable.Name)
+		iamFactory.AddSQSSendMessagePolicy(paymentRequestQueue.Name)
+		policies, err = iamFactory.GetPolicyStatement()
+		if err != nil {
+			return err
+		}
+
+		roleArgs = &iam.RoleArgs{
+			AssumeRolePolicy: pulumi.String(sampolicies.AssumeRoleLambda()),
+			Description:      pulumi.String("Role for the Order Service (lambda-order-sqs-cancel) of the ACME Serverless Fitness Shop"),
+			Tags:             pulumi.Map(tagMap),
+		}
+
+		role, err = iam.NewRole(ctx, "ACMEServerlessOrderRole-lambda-order-sqs-cancel", roleArgs)
+		if err != nil {
+			return err
+		}
+
+		// Attach the AWSLambdaBasicExecutionRole so the function can create Log groups in CloudWatch
+		_, err = iam.NewRolePolicyAttachment(ctx, "AWSLambdaBasicExecutionRole-lambda-order-sqs-cancel", &iam.RolePolicyAttachmentArgs{
+			PolicyArn: pulumi.String("arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"),
+			Role:      role.Name,
+		})
+		if err != nil {
+			return err
+		}
+
+		// Add the policy
+		_, err = iam.NewRolePolicy(ctx, "ACMEServerlessOrderPolicy-lambda-order-sqs-cancel", &iam.RolePolicyArgs{
+			Name:   pulumi.String("ACMEServerlessOrderPolicy-lambda-order-sqs-cancel"),
+			Role:   role.Name,
+			Policy: pulumi.String(policies),
+		})
+		if err != nil {
+			return err
+		}
+
+		variables["RESPONSEQUEUE"] = pulumi.String(paymentRequestQueue.Arn)
+		variables["FUNCTION_NAME"] = pulumi.String(fmt.Sprintf("%s-lambda-order-sqs-cancel", ctx.Stack()))
+
+		environment = lambda.FunctionEnvironmentArgs{
+			Variables: pulumi.StringMap(variables),
+		}
+
+		functionArgs = &lambda.FunctionArgs{
+			Description: pulumi.String("A Lambda function to cancel orders"),
+			Runtime:     pulumi.String("go1.x"),
+			Name:        pulumi.String(fmt.Sprintf("%s-lambda-order-sqs-cancel", ctx.Stack())),
+			MemorySize:  pulumi.Int(256),
+			Timeout:     pulumi.Int(10),
+			Handler:     pulumi.String("lambda-order-sqs-cancel"),
+			Environment: environment,
+			Code:        pulumi.NewFileArchive("../cmd/lambda-order-sqs-cancel/lambda-order-sqs-cancel.zip"),
+			Role:        role.Arn,
+			Tags:        pulumi.Map(tagMap),
+		}
+
+		orderCancelFunction, err := lambda.NewFunction(ctx, fmt.Sprintf("%s-lambda-order-sqs-cancel", ctx.Stack()), functionArgs)
+		if err != nil {
+			return err
+		}
+
+		ctx.Export("lambda-order-sqs-cancel::Arn", orderCancelFunction.Arn)
+
+		// Add Order SQS Relay function
+		// policyString is a policy template, derived from AWS SAM, to allow apps
+		// to connect to and execute command on Amazon DynamoDB and SQS
+		iamFactory.ClearPolicies()
+		iamFactory.AddDynamoDBCrudPolicy(dynamoTable.Name)
+		iamFactory.AddSQSSendMessagePolicy(paymentRequestQueue.Name)
+		policies, err = iamFactory.GetPolicyStatement()
+		if err != nil {
+			return err
+		}
+
+		roleArgs = &iam.RoleArgs{
+			AssumeRolePolicy: pulumi.String(sampolicies.AssumeRoleLambda()),
+			Description:      pulumi.String("Role for the Order Service (lambda-order-sqs-relay) of the ACME Serverless Fitness Shop"),
+			Tags:             pulumi.Map(tagMap),
+		}
+
+		role, err = iam.NewRole(ctx, "ACMEServerlessOrderRole-lambda-order-sqs-relay", roleArgs)
+		if err != nil {
+			return err
+		}
+
+		// Attach the AWSLambdaBasicExecutionRole so the function can create Log groups in CloudWatch
+		_, err = iam.NewRolePolicyAttachment(ctx, "AWSLambdaBasicExecutionRole-lambda-order-sqs-relay", &iam.RolePolicyAttachmentArgs{
+			PolicyArn: pulumi.String("arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"),
+			Role:      role.Name,
+		})
+		if err != nil {
+			return err
+		}
+
+		// Add the policy
+		_, err = iam.NewRolePolicy(ctx, "ACMEServerlessOrderPolicy-lambda-order-sqs-relay", &iam.RolePolicyArgs{
+			Name:   pulumi.String("ACMEServerlessOrderPolicy-lambda-order-sqs-relay"),
+			Role:   role.Name,
+			Policy: pulumi.String(policies),
+		})
+		if err != nil {
+			return err
+		}
+
+		variables["RESPONSEQUEUE"] = pulumi.String(paymentRequestQueue.Arn)
+		variables["FUNCTION_NAME"] = pulumi.String(fmt.Sprintf("%s-lambda-order-sqs-relay", ctx.Stack()))
+
+		environment = lambda.FunctionEnvironmentArgs{
+			Variables: pulumi.StringMap(variables),
+		}
+
+		functionArgs = &lambda.FunctionArgs{
+			Description: pulumi.String("A Lambda function to send the events in the outbox"),
+			Runtime:     pulumi.String("go1.x"),
+			Name:        pulumi.String(fmt.Sprintf("%s-lambda-order-sqs-relay", ctx.Stack())),
+			MemorySize:  pulumi.Int(256),
+			Timeout:     pulumi.Int(10),
+			Handler:     pulumi.String("lambda-order-sqs-relay"),
+			Environment: environment,
+			Code:        pulumi.NewFileArchive("../cmd/lambda-order-sqs-relay/lambda-order-sqs-relay.zip"),
+			Role:        role.Arn,
+			Tags:        pulumi.Map(tagMap),
+		}
+
+		orderRelayFunction, err := lambda.NewFunction(ctx, fmt.Sprintf("%s-lambda-order-sqs-relay", ctx.Stack()), functionArgs)
+		if err != nil {
+			return err
+		}
+
+		// Run the relay function every minute
+		relaySchedule, err := cloudwatch.NewEventRule(ctx, fmt.Sprintf("%s-lambda-order-sqs-relay-schedule", ctx.Stack()), &cloudwatch.EventRuleArgs{
+			Description:        pulumi.String("Send the events in the outbox of the Order Service"),
+			ScheduleExpression: pulumi.String("rate(1 minute)"),
+			Tags:               pulumi.Map(tagMap),
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = cloudwatch.NewEventTarget(ctx, fmt.Sprintf("%s-lambda-order-sqs-relay-target", ctx.Stack()), &cloudwatch.EventTargetArgs{
+			Rule: relaySchedule.Name,
+			Arn:  orderRelayFunction.Arn,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = lambda.NewPermission(ctx, "OrderRelaySchedulePermission", &lambda.PermissionArgs{
+			Action:    pulumi.String("lambda:InvokeFunction"),
+			Function:  orderRelayFunction.Name,
+			Principal: pulumi.String("events.amazonaws.com"),
+			SourceArn: relaySchedule.Arn,
+		})
+		if err != nil {
+			return err
+		}
+
+		ctx.Export("lambda-order-sqs-relay::Arn", orderRelayFunction.Arn)
+
 		// Add Order SQS Ship function
 		roleArgs = &iam.RoleArgs{
 			AssumeRolePolicy: pulumi.String(sampolicies.AssumeRoleLambda()),
@@ -410,6 +701,9 @@ func main() {
 			return err
 		}
 
+		// This version of the Pulumi AWS provider can't set FunctionResponseTypes to
+		// ReportBatchItemFailures, so the function returns an error when a record fails
+		// and the batch size is one, so only that record is delivered again
 		_, err = lambda.NewEventSourceMapping(ctx, fmt.Sprintf("%s-lambda-order-sqs-update", ctx.Stack()), &lambda.EventSourceMappingArgs{
 			BatchSize:      pulumi.Int(1),
 			Enabled:        pulumi.Bool(true),
@@ -488,6 +782,9 @@ func main() {
 			return err
 		}
 
+		// This version of the Pulumi AWS provider can't set FunctionResponseTypes to
+		// ReportBatchItemFailures, so the function returns an error when a record fails
+		// and the batch size is one, so only that record is delivered again
 		_, err = lambda.NewEventSourceMapping(ctx, fmt.Sprintf("%s-lambda-order-sqs-ship", ctx.Stack()), &lambda.EventSourceMappingArgs{
 			BatchSize:      pulumi.Int(1),
 			Enabled:        pulumi.Bool(true),
@@ -576,6 +873,54 @@ func main() {
 				fmt.Println(err)
 			}
 
+			resource = gw.MustGetGatewayResource(ctx, id, "/order/id/{orderid}")
+
+			i4, err := apigateway.NewIntegration(ctx, "OrderGetAPIIntegration", &apigateway.IntegrationArgs{
+				HttpMethod:            pulumi.String("GET"),
+				IntegrationHttpMethod: pulumi.String("POST"),
+				ResourceId:            pulumi.String(resource.Id),
+				RestApi:               gateway.ID(),
+				Type:                  pulumi.String("AWS_PROXY"),
+				Uri:                   orderGetFunction.InvokeArn,
+			})
+			if err != nil {
+				fmt.Println(err)
+			}
+
+			_, err = lambda.NewPermission(ctx, "OrderGetAPIPermission", &lambda.PermissionArgs{
+				Action:    pulumi.String("lambda:InvokeFunction"),
+				Function:  orderGetFunction.Name,
+				Principal: pulumi.String("apigateway.amazonaws.com"),
+				SourceArn: pulumi.Sprintf("arn:aws:execute-api:%s:%s:%s/*/GET/order/id/*", genericConfig.Region, genericConfig.AccountID, gateway.ID()),
+			})
+			if err != nil {
+				fmt.Println(err)
+			}
+
+			resource = gw.MustGetGatewayResource(ctx, id, "/order/id/{orderid}/history")
+
+			i5, err := apigateway.NewIntegration(ctx, "OrderHistoryAPIIntegration", &apigateway.IntegrationArgs{
+				HttpMethod:            pulumi.String("GET"),
+				IntegrationHttpMethod: pulumi.String("POST"),
+				ResourceId:            pulumi.String(resource.Id),
+				RestApi:               gateway.ID(),
+				Type:                  pulumi.String("AWS_PROXY"),
+				Uri:                   orderHistoryFunction.InvokeArn,
+			})
+			if err != nil {
+				fmt.Println(err)
+			}
+
+			_, err = lambda.NewPermission(ctx, "OrderHistoryAPIPermission", &lambda.PermissionArgs{
+				Action:    pulumi.String("lambda:InvokeFunction"),
+				Function:  orderHistoryFunction.Name,
+				Principal: pulumi.String("apigateway.amazonaws.com"),
+				SourceArn: pulumi.Sprintf("arn:aws:execute-api:%s:%s:%s/*/GET/order/id/*/history", genericConfig.Region, genericConfig.AccountID, gateway.ID()),
+			})
+			if err != nil {
+				fmt.Println(err)
+			}
+
 			resource = gw.MustGetGatewayResource(ctx, id, "/order/add/{userid}")
 
 			i3, err := apigateway.NewIntegration(ctx, "OrderAddAPIIntegration", &apigateway.IntegrationArgs{
@@ -600,13 +945,37 @@ func main() {
 				fmt.Println(err)
 			}
 
+			resource = gw.MustGetGatewayResource(ctx, id, "/order/cancel/{orderid}")
+
+			i6, err := apigateway.NewIntegration(ctx, "OrderCancelAPIIntegration", &apigateway.IntegrationArgs{
+				HttpMethod:            pulumi.String("POST"),
+				IntegrationHttpMethod: pulumi.String("POST"),
+				ResourceId:            pulumi.String(resource.Id),
+				RestApi:               gateway.ID(),
+				Type:                  pulumi.String("AWS_PROXY"),
+				Uri:                   orderCancelFunction.InvokeArn,
+			})
+			if err != nil {
+				fmt.Println(err)
+			}
+
+			_, err = lambda.NewPermission(ctx, "OrderCancelAPIPermission", &lambda.PermissionArgs{
+				Action:    pulumi.String("lambda:InvokeFunction"),
+				Function:  orderCancelFunction.Name,
+				Principal: pulumi.String("apigateway.amazonaws.com"),
+				SourceArn: pulumi.Sprintf("arn:aws:execute-api:%s:%s:%s/*/POST/order/cancel/*", genericConfig.Region, genericConfig.AccountID, gateway.ID()),
+			})
+			if err != nil {
+				fmt.Println(err)
+			}
+
 			// Create a new deployment in API Gateway
 			_, err = apigateway.NewDeployment(ctx, "prod", &apigateway.DeploymentArgs{
 				Description:      pulumi.String("deployment to the prod stage"),
 				RestApi:          gateway.ID(),
 				StageDescription: pulumi.String("Prod Stage"),
 				StageName:        pulumi.String("Prod"),
-			}, pulumi.DependsOn([]pulumi.Resource{i1, i2, i3}))
+			}, pulumi.DependsOn([]pulumi.Resource{i1, i2, i3, i4, i5, i6}))
 			if err != nil {
 				fmt.Println(err)
 			}